@@ -7,21 +7,54 @@ import (
 	"net/http"
 	"os"
 	"encoding/json"
+	"errors"
+	"strconv"
 	
+	osearch "goclassifieds/lib/os"
 	"goclassifieds/lib/repo"
 	"goclassifieds/lib/search" 
+	"goclassifieds/lib/sign"
 	
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/google/go-github/v46/github"
+	opensearch "github.com/opensearch-project/opensearch-go"
 	"golang.org/x/oauth2"
 )
 
+// Shared across warm invocations. Configured by SEARCH_CACHE (memory, disk, s3 or none).
+var resultCache *search.CountingResultCache
+
+func newResultCache() *search.CountingResultCache {
+	switch os.Getenv("SEARCH_CACHE") {
+	case "none":
+		return nil
+	case "disk":
+		dir := os.Getenv("SEARCH_CACHE_DIR")
+		if dir == "" {
+			dir = os.TempDir() + "/search-cache"
+		}
+		cache, err := search.NewDiskResultCache(dir)
+		if err != nil {
+			log.Printf("Search cache disabled, unable to create %s: %v", dir, err)
+			return nil
+		}
+		return search.NewCountingResultCache(cache)
+	case "s3":
+		sess := session.Must(session.NewSession())
+		return search.NewCountingResultCache(search.NewS3ResultCache(sess, os.Getenv("SEARCH_CACHE_BUCKET"), "search-cache/"))
+	default:
+		size, _ := strconv.Atoi(os.Getenv("SEARCH_CACHE_SIZE"))
+		return search.NewCountingResultCache(search.NewMemoryResultCache(size))
+	}
+}
+
 // ====================================================================
 // === SERVICE LAYER: executeSearchRequest (Engine Instantiation) =====
 // ====================================================================
 
-func executeSearchRequest(ctx context.Context, owner, repoName string, requestBody []byte) (events.APIGatewayProxyResponse, error) {
+func executeSearchRequest(ctx context.Context, owner, repoName string, requestBody []byte, principal *search.Principal) (events.APIGatewayProxyResponse, error) {
 	
 	branch := "dev"
 	
@@ -37,27 +70,6 @@ func executeSearchRequest(ctx context.Context, owner, repoName string, requestBo
 	
 	// ... (Query extraction logic) ...
 
-	var queriesToExecute []search.Query
-	if topLevelQuery.Query != nil {
-		queriesToExecute = []search.Query{*topLevelQuery.Query}
-	} else if topLevelQuery.Union != nil {
-		queriesToExecute = topLevelQuery.Union.Queries
-	} else {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       "Request body must contain 'query' or 'union'.",
-		}, nil
-	}
-    
-    if len(queriesToExecute) == 0 {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       "No queries found to execute.",
-		}, nil
-	}
-
-	firstQuery := queriesToExecute[0]
-
 	// 2. Setup GitHub Client and Token (UNCHANGED)
 	githubAppID := os.Getenv("GITHUB_APP_ID")
 	if githubAppID == "" {
@@ -96,6 +108,60 @@ func executeSearchRequest(ctx context.Context, owner, repoName string, requestBo
 	
 	// ===============================================================
 
+	if topLevelQuery.Branch != "" {
+		branch = topLevelQuery.Branch
+	}
+	repoInput := &search.GetIndexConfigurationInput{
+		Owner:  owner,
+		Stage:  os.Getenv("STAGE"),
+		Repo:   owner + "/" + repoName,
+		Branch: branch,
+	}
+
+	// SQL is compiled into a regular query up front so caching and execution are shared.
+	// The index configs resolve which equality conditions are partition keys.
+	if topLevelQuery.SQL != "" {
+		compiled, err := search.ParseSQL(topLevelQuery.SQL, func(index string) ([]string, error) {
+			indexInput := *repoInput
+			indexInput.Id = index
+			indexObject, err := githubLoader.GetIndexById(&indexInput)
+			if err != nil || indexObject == nil {
+				return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", index)
+			}
+			return search.PartitionFields(indexObject), nil
+		})
+		if err != nil {
+			log.Printf("Error compiling SQL query: %s", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       err.Error(),
+			}, nil
+		}
+		topLevelQuery.Query = compiled
+		topLevelQuery.SQL = ""
+	}
+
+	var queriesToExecute []search.Query
+	if topLevelQuery.Query != nil {
+		queriesToExecute = []search.Query{*topLevelQuery.Query}
+	} else if topLevelQuery.Union != nil {
+		queriesToExecute = topLevelQuery.Union.Queries
+	} else {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Request body must contain 'query', 'union' or 'sql'.",
+		}, nil
+	}
+    
+    if len(queriesToExecute) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "No queries found to execute.",
+		}, nil
+	}
+
+	firstQuery := queriesToExecute[0]
+
 	// 4. Create the single input struct (UNCHANGED)
 	input := &search.UnionQueryInput{
 		Ctx:                   ctx,
@@ -111,6 +177,54 @@ func executeSearchRequest(ctx context.Context, owner, repoName string, requestBo
 		ScoreModifiersRequest: firstQuery.ScoreModifiers,
 		PostFilter:            firstQuery.PostFilter,
 		FacetingAggs:          firstQuery.FacetingAggs,
+		Collapse:              firstQuery.Collapse,
+		FacetsOnly:            firstQuery.FacetsOnly,
+		SuggestCorrections:    firstQuery.SuggestCorrections,
+		AutoCorrect:           firstQuery.AutoCorrect,
+		Principal:             principal,
+	}
+
+	// Indexes declaring "backend": "opensearch" are searched through lib/os instead of the engine.
+	openSearchIndexes, securityFilters, err := resolveOpenSearchIndexes(githubLoader, repoInput, queriesToExecute, principal)
+	if err != nil {
+		log.Printf("Error routing search: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+	}
+	if openSearchIndexes != nil {
+		if topLevelQuery.Ref != "" {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "ref is not supported by the opensearch backend"}, nil
+		}
+		// Documents are not loaded through the engine so the security predicates go into the queries.
+		for i, query := range input.QueriesToExecute {
+			input.QueriesToExecute[i] = search.SecureQuery(query, securityFilters[query.Index])
+		}
+		return executeOpenSearchRequest(ctx, input, openSearchIndexes)
+	}
+
+	// Validate the branch and pin every repo when searching as of a ref.
+	refs, err := githubLoader.ResolveRefs(ctx, repoInput, search.QueryIndexes(&topLevelQuery), topLevelQuery.Ref)
+	if err != nil {
+		log.Printf("Error resolving branch '%s' ref '%s': %v", branch, topLevelQuery.Ref, err)
+		if errors.Is(err, search.ErrInvalidRef) {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error resolving branch or ref."}, nil
+	}
+	repoInput.Refs = refs
+	input.Refs = refs
+
+	// Cached payloads are keyed by the query and the head commits it reads so new commits miss.
+	cacheKey := ""
+	if resultCache != nil {
+		heads, err := githubLoader.HeadCommits(ctx, repoInput, search.QueryIndexes(&topLevelQuery))
+		if err != nil {
+			log.Printf("Search cache bypassed: %v", err)
+		} else if cacheKey, err = search.SearchCacheKey(owner, repoName, branch, &topLevelQuery, heads, principal); err != nil {
+			log.Printf("Search cache bypassed: %v", err)
+			cacheKey = ""
+		} else if cached, ok := resultCache.Get(cacheKey); ok {
+			return searchResponse(cached, "HIT")
+		}
 	}
 
 	// 5. Delegate to the core engine method
@@ -130,7 +244,26 @@ func executeSearchRequest(ctx context.Context, owner, repoName string, requestBo
 			Body:       payload.ErrorMessage,
 		}, nil
 	}
-    
+
+	if cacheKey != "" {
+		resultCache.Set(cacheKey, payload)
+	}
+
+	return searchResponse(payload, "MISS")
+}
+
+// searchResponse serializes a payload along with the cache status and hit rate counters.
+func searchResponse(payload *search.SearchResultPayload, cacheStatus string) (events.APIGatewayProxyResponse, error) {
+    headers := map[string]string{"Content-Type": "application/json"}
+    if resultCache != nil {
+        hits, misses, hitRate := resultCache.Stats()
+        log.Printf("Search cache %s (hits: %d, misses: %d, hit rate: %.2f)", cacheStatus, hits, misses, hitRate)
+        headers["X-Cache"] = cacheStatus
+        headers["X-Cache-Hits"] = strconv.FormatUint(hits, 10)
+        headers["X-Cache-Misses"] = strconv.FormatUint(misses, 10)
+        headers["X-Cache-Hit-Rate"] = strconv.FormatFloat(hitRate, 'f', 4, 64)
+    }
+
     responseBody, marshalErr := json.Marshal(payload)
     if marshalErr != nil {
         log.Printf("Error marshaling final payload: %v", marshalErr)
@@ -142,11 +275,76 @@ func executeSearchRequest(ctx context.Context, owner, repoName string, requestBo
 
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
-		Headers:    map[string]string{"Content-Type": "application/json"},
+		Headers:    headers,
 		Body:       string(responseBody),
 	}, nil
 }
 
+// resolveOpenSearchIndexes maps the queried indexes to their OpenSearch index and security filter
+// when all of them declare "backend": "opensearch". It returns nil when they all live in GitHub index repos.
+func resolveOpenSearchIndexes(loader *search.GitHubLoader, repoInput *search.GetIndexConfigurationInput, queries []search.Query, principal *search.Principal) (map[string]string, map[string]*search.Bool, error) {
+	indexNames := make(map[string]string)
+	filters := make(map[string]*search.Bool)
+	githubIndexes := 0
+	for _, query := range queries {
+		indexInput := *repoInput
+		indexInput.Id = query.Index
+		indexObject, err := loader.GetIndexById(&indexInput)
+		if err != nil || indexObject == nil {
+			return nil, nil, fmt.Errorf("failed to retrieve index config for ID '%s'", query.Index)
+		}
+		if search.IndexBackend(indexObject) == search.OpenSearchBackend {
+			indexNames[query.Index] = search.OpenSearchIndexName(indexObject, query.Index)
+			security, err := search.IndexSecurity(indexObject)
+			if err != nil {
+				return nil, nil, err
+			}
+			if filters[query.Index], err = security.Filter(principal); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			githubIndexes++
+		}
+	}
+	if len(indexNames) == 0 {
+		return nil, nil, nil
+	}
+	if githubIndexes > 0 {
+		return nil, nil, fmt.Errorf("a search can not mix opensearch and github backed indexes")
+	}
+	return indexNames, filters, nil
+}
+
+// executeOpenSearchRequest translates the query to OpenSearch DSL and maps the response back.
+func executeOpenSearchRequest(ctx context.Context, input *search.UnionQueryInput, indexNames map[string]string) (events.APIGatewayProxyResponse, error) {
+	body, indices, err := search.TranslateToOpenSearch(input, indexNames)
+	if err != nil {
+		log.Printf("Error translating query to OpenSearch: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+	}
+
+	awsSigner := sign.AwsSigner{
+		Service: "es",
+		Region:  "us-east-1",
+	}
+	osClient, err := opensearch.NewClient(opensearch.Config{
+		Addresses: []string{os.Getenv("ELASTIC_URL")},
+		Signer:    awsSigner,
+	})
+	if err != nil {
+		log.Printf("Error creating OpenSearch client: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error creating OpenSearch client."}, nil
+	}
+
+	response, err := osearch.SearchResponse(ctx, osClient, body, indices)
+	if err != nil {
+		log.Printf("Error executing OpenSearch query: %v", err)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadGateway, Body: "Error executing OpenSearch query."}, nil
+	}
+
+	return searchResponse(search.MapOpenSearchResponse(input, response), "BYPASS")
+}
+
 // ====================================================================
 // === HANDLER: Minimal Lambda Entry Point (UNCHANGED) ================
 // ====================================================================
@@ -168,10 +366,26 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		owner,
 		repoName,
 		[]byte(request.Body),
+		requestPrincipal(&request),
 	)
 }
 
+// requestPrincipal collects the caller's claims from the Cognito or custom authorizer context.
+func requestPrincipal(req *events.APIGatewayProxyRequest) *search.Principal {
+	if claims, ok := req.RequestContext.Authorizer["claims"].(map[string]interface{}); ok {
+		return &search.Principal{Claims: claims}
+	}
+	claims := make(map[string]interface{})
+	for name, value := range req.RequestContext.Authorizer {
+		if name != "principalId" && name != "integrationLatency" {
+			claims[name] = value
+		}
+	}
+	return &search.Principal{Claims: claims}
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	resultCache = newResultCache()
 	lambda.Start(handler)
 }
\ No newline at end of file
@@ -6,11 +6,13 @@ import (
 	"log"
 	"os"
 	"fmt"
-	"strings"
+	"sort"
 	"encoding/json"
 	"encoding/base64" // Import the encoding/base64 package
+	"errors"
 
 	"goclassifieds/lib/repo"
+	"goclassifieds/lib/search"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"golang.org/x/oauth2"
@@ -19,41 +21,16 @@ import (
 
 func handler(ctx context.Context, event entity.AfterSaveExecEntityRequest) (entity.AfterSaveExecEntityResponse, error) {
 
-	var entityBase64 string
-	var oldEntityBase64 string
-
 	/**
 	 * This is where all the code goes to create action SECRETS
 	 * for a site. Both for repo and enviironment.
 	 */
-	log.Printf("Index entity %s in repo %s and owner %s", event.Contract, event.Repo, event.Owner)
-
-	// Log the entire content of event.Entity
-	entityJSON, err := json.Marshal(event.Entity) // Convert map[string]interface{} to JSON string
-	if err != nil {
-		log.Printf("Error marshalling event.Entity: %s", err)
-	} else {
-		// Base64 encode the JSON
-		entityBase64 = base64.StdEncoding.EncodeToString(entityJSON)
-		log.Printf("Entity content: %s", entityJSON)
-		log.Printf("Base64 encoded entity content: %s", entityBase64)
-	}
-
-	// Log the entire content of event.OldEntity
-	entityJSON, err = json.Marshal(event.OldEntity) // Convert map[string]interface{} to JSON string
-	if err != nil {
-		log.Printf("Error marshalling event.OldEntity: %s", err)
-	} else {
-		oldEntityBase64 = base64.StdEncoding.EncodeToString(entityJSON)
-		log.Printf("Old Entity content: %s", entityJSON)
-		log.Printf("Base64 encoded entity content: %s", oldEntityBase64)
-	}
+	log.Printf("Index entity %s in repo %s and owner %s (event: %s)", event.Contract, event.Repo, event.Owner, event.Event)
 
-	if entityBase64 == oldEntityBase64 {
-		log.Print("New and old match")
-	} else {
-		log.Print("Old does not match new")
+	if event.Event == "" {
+		event.Event = entity.AfterSaveEventSave
 	}
+	isDelete := event.Event == entity.AfterSaveEventDelete
 
 	githubAppID := os.Getenv("GITHUB_APP_ID")
 	if githubAppID == "" {
@@ -103,10 +80,21 @@ func handler(ctx context.Context, event entity.AfterSaveExecEntityRequest) (enti
 	
 	// Log the matching index entities
 	log.Printf("Discovered %d matching index entities.", len(matchingIndexes))
-	for _, indexEntity := range matchingIndexes {
 
-		/*indexJSON, _ := json.Marshal(index)
-		log.Printf("Match %d: %s", i+1, indexJSON)*/
+	oldEntity := event.OldEntity
+	newEntity := event.Entity
+	if isDelete {
+		if event.Entity != nil {
+			oldEntity = event.Entity
+		}
+		newEntity = nil
+	}
+
+	// Indexes are grouped per index repo so every repo receives a single commit.
+	indexesByRepo := make(map[string][]map[string]interface{})
+	var repoOrder []string
+
+	for _, indexEntity := range matchingIndexes {
 
 		// Extract `repoName` from the indexEntity, fallback to hardcoded value if missing
 		repoName, ok := indexEntity["repoName"].(string)
@@ -117,135 +105,289 @@ func handler(ctx context.Context, event entity.AfterSaveExecEntityRequest) (enti
 			log.Printf("Using repoName from index entity: %s", repoName)
 		}
 
-		// Extract and combine field values
-		prefix, err := extractAndCombineFields(event.Entity, indexEntity)
-		if err != nil {
-			log.Printf("Failed to extract and combine fields: %v", err)
-			continue // for now ignore
-		} else {
-			log.Printf("Extracted and combined into: %s", prefix)
-		}
-
-		// Handle renaming if OldEntity exists
-		if event.OldEntity != nil {
-			oldFilePath := fmt.Sprintf("%s/%s", prefix, oldEntityBase64)
-			newFilePath := fmt.Sprintf("%s/%s", prefix, entityBase64)
-
-			if (oldEntityBase64 != entityBase64) {
-				log.Printf("Attempting to rename file from '%s' to '%s'", oldFilePath, newFilePath)
-				if err := renameFile(ctx, githubRestClient, event.Owner, repoName, oldFilePath, newFilePath, branch); err != nil {
-					log.Printf("Error renaming file: %s", err)
-					continue // ignore for now
-					// return entity.AfterSaveExecEntityResponse{}, err
-				}
-				log.Printf("File renamed successfully.")
-			} else {
+		if _, seen := indexesByRepo[repoName]; !seen {
+			repoOrder = append(repoOrder, repoName)
+		}
+		indexesByRepo[repoName] = append(indexesByRepo[repoName], indexEntity)
+	}
+
+	// Segments and rollups are read, modified and written back, so when another save moves
+	// the branch first the changes are rebuilt from the new head before committing again.
+	for _, repoName := range repoOrder {
+		message := fmt.Sprintf("Index %s for %s", event.Event, event.Contract)
+		var err error
+		for attempt := 1; attempt <= 3; attempt++ {
+			changes := repoChanges(ctx, githubRestClient, event.Owner, repoName, branch, indexesByRepo[repoName], oldEntity, newEntity)
+			if len(changes) == 0 {
 				log.Print("Old entity is the same as new entity bail out without indexing.")
+				err = nil
+				break
 			}
-
-		} else {
-			// No old entity, create the file directly
-			filePath := fmt.Sprintf("%s/%s", prefix, entityBase64)
-			if err := repo.CreateFileIfNotExists(ctx, githubRestClient, event.Owner, repoName, filePath, "", branch); err != nil {
-				log.Printf("Error creating file: %s", err)
-				continue // ignore for now
-				// return entity.AfterSaveExecEntityResponse{}, err
+			if _, err = repo.CommitTreeChanges(ctx, githubRestClient, event.Owner, repoName, branch, message, changes); err == nil {
+				log.Printf("Committed %d index changes to %s", len(changes), repoName)
+				break
+			}
+			if !errors.Is(err, repo.ErrRefConflict) {
+				break
 			}
-			log.Printf("File created successfully at path: %s", filePath)
+			log.Printf("Branch %s of %s moved, rebuilding index changes (attempt %d)", branch, repoName, attempt)
+		}
+		if err != nil {
+			log.Printf("Error committing index changes to %s: %s", repoName, err)
+			return entity.AfterSaveExecEntityResponse{}, err
 		}
-
 	}
 
 	return entity.AfterSaveExecEntityResponse{}, nil
 }
 
+// Changes of every index kept in an index repo, read from the branch head.
+func repoChanges(ctx context.Context, client *github.Client, owner, repoName, branch string, indexEntities []map[string]interface{}, oldEntity, newEntity map[string]interface{}) []repo.TreeChange {
+	var changes []repo.TreeChange
+	for _, indexEntity := range indexEntities {
+		if search.GetIndexEntryLayout(indexEntity).Packed {
+			changes = append(changes, segmentChanges(ctx, client, owner, repoName, branch, indexEntity, oldEntity, newEntity)...)
+		} else {
+			changes = append(changes, entryChanges(ctx, client, owner, repoName, branch, indexEntity, oldEntity, newEntity)...)
+		}
+		if rollupFields := search.GetRollupFields(indexEntity); len(rollupFields) > 0 {
+			changes = append(changes, rollupChanges(ctx, client, owner, repoName, branch, indexEntity, rollupFields, oldEntity, newEntity)...)
+		}
+	}
+	return changes
+}
 
-// Helper function to extract nested field values using dot notation
-func getNestedValue(data map[string]interface{}, fieldPath string) (string, error) {
-	parts := strings.Split(fieldPath, ".")
-	var value interface{} = data
+// Changes for legacy and compact entry files. Old and new entries may live in different
+// partitions (prefixes) when composite fields change and fan-out fields produce several entries per entity.
+func entryChanges(ctx context.Context, client *github.Client, owner, repoName, branch string, indexEntity, oldEntity, newEntity map[string]interface{}) []repo.TreeChange {
+	oldFiles := make(map[string]string)
+	newFiles := make(map[string]string)
 
-	for _, part := range parts {
-		// Assert the current value is a map
-		if m, ok := value.(map[string]interface{}); ok {
-			value = m[part]
+	if oldEntity != nil {
+		files, err := search.IndexEntryFiles(oldEntity, indexEntity)
+		if err != nil {
+			log.Printf("Old entity was not indexable, nothing to remove: %v", err)
 		} else {
-			return "", fmt.Errorf("field '%s' does not exist in the provided data", fieldPath)
+			oldFiles = files
 		}
 	}
-
-	// Convert final value to string
-	if strValue, ok := value.(string); ok {
-		return strValue, nil
+	if newEntity != nil {
+		files, err := search.IndexEntryFiles(newEntity, indexEntity)
+		if err != nil {
+			// Still remove the old entries, the entity simply no longer belongs in this index.
+			log.Printf("Failed to extract and combine fields: %v", err)
+		} else {
+			newFiles = files
+		}
 	}
 
-	return "", fmt.Errorf("field '%s' does not resolve to a string value", fieldPath)
+	var changes []repo.TreeChange
+	for _, oldPath := range sortedKeys(oldFiles) {
+		if _, keep := newFiles[oldPath]; keep {
+			continue
+		}
+		if indexEntryExists(ctx, client, owner, repoName, oldPath, branch) {
+			log.Printf("Removing index entry '%s'", oldPath)
+			changes = append(changes, repo.TreeChange{Path: oldPath})
+		} else {
+			log.Printf("Index entry '%s' does not exist nothing to remove", oldPath)
+		}
+	}
+	for _, newPath := range sortedKeys(newFiles) {
+		content := newFiles[newPath]
+		if oldContent, existed := oldFiles[newPath]; existed && oldContent == content {
+			continue
+		}
+		log.Printf("Writing index entry '%s'", newPath)
+		changes = append(changes, repo.TreeChange{Path: newPath, Content: github.String(content)})
+	}
+	return changes
 }
 
-// Main function to process and extract combined field values
-func extractAndCombineFields(entityJSON map[string]interface{}, indexEntity map[string]interface{}) (string, error) {
-	// Extract the `fields` array from the index entity
-	fields, ok := indexEntity["fields"].([]interface{})
-	if !ok {
-		return "", fmt.Errorf("'fields' is missing or not an array in the index entity")
+// Changes for packed indexes. Every touched partition segment is read, updated and rewritten whole.
+func segmentChanges(ctx context.Context, client *github.Client, owner, repoName, branch string, indexEntity, oldEntity, newEntity map[string]interface{}) []repo.TreeChange {
+	removeFrom := make(map[string]string) // segment path -> id
+	addTo := make(map[string]bool)
+	var newId string
+	var newDoc map[string]interface{}
+
+	if oldEntity != nil {
+		paths, id, _, err := search.IndexEntrySegments(oldEntity, indexEntity)
+		if err != nil {
+			log.Printf("Old entity was not indexable, nothing to remove: %v", err)
+		}
+		for _, p := range paths {
+			removeFrom[p] = id
+		}
+	}
+	if newEntity != nil {
+		paths, id, doc, err := search.IndexEntrySegments(newEntity, indexEntity)
+		if err != nil {
+			log.Printf("Failed to extract and combine fields: %v", err)
+		}
+		newId = id
+		newDoc = doc
+		for _, p := range paths {
+			addTo[p] = true
+		}
 	}
 
-	// Iterate through the fields and extract corresponding values from the entity JSON
-	var extractedValues []string
-	for _, field := range fields {
-		fieldName, ok := field.(string)
-		if !ok {
-			return "", fmt.Errorf("field name '%v' is not a string", field)
+	touched := make(map[string]string)
+	for p := range removeFrom {
+		touched[p] = ""
+	}
+	for p := range addTo {
+		touched[p] = ""
+	}
+
+	var changes []repo.TreeChange
+	for _, segmentPath := range sortedKeys(touched) {
+		raw, existed, err := readIndexFile(ctx, client, owner, repoName, segmentPath, branch)
+		if err != nil {
+			log.Printf("Failed to read segment '%s': %v", segmentPath, err)
+			continue
+		}
+		segment, err := search.ParseIndexSegment(raw)
+		if err != nil {
+			log.Printf("Segment '%s' is corrupt and will be rewritten: %v", segmentPath, err)
+			segment, _ = search.ParseIndexSegment(nil)
 		}
 
-		value, err := getNestedValue(entityJSON, fieldName)
+		if id, ok := removeFrom[segmentPath]; ok {
+			delete(segment.Entries, id)
+		}
+		if addTo[segmentPath] {
+			segment.Entries[newId] = newDoc
+		}
+
+		if len(segment.Entries) == 0 {
+			if existed {
+				log.Printf("Removing empty segment '%s'", segmentPath)
+				changes = append(changes, repo.TreeChange{Path: segmentPath})
+			}
+			continue
+		}
+
+		b, err := json.Marshal(segment)
 		if err != nil {
-			return "", fmt.Errorf("error extracting field '%s': %v", fieldName, err)
+			log.Printf("Failed to encode segment '%s': %v", segmentPath, err)
+			continue
+		}
+		if existed && string(b) == string(raw) {
+			continue
+		}
+		log.Printf("Writing segment '%s' with %d entries", segmentPath, len(segment.Entries))
+		changes = append(changes, repo.TreeChange{Path: segmentPath, Content: github.String(string(b))})
+	}
+	return changes
+}
+
+// Changes to the partition rollups. The old entity is subtracted from its partitions and the
+// new one added to its partitions so creates, moves across partitions and deletes stay balanced.
+func rollupChanges(ctx context.Context, client *github.Client, owner, repoName, branch string, indexEntity map[string]interface{}, rollupFields []string, oldEntity, newEntity map[string]interface{}) []repo.TreeChange {
+	subtract := make(map[string]string)
+	add := make(map[string]string)
+
+	if oldEntity != nil {
+		if paths, err := search.IndexRollupPaths(oldEntity, indexEntity); err == nil {
+			for _, p := range paths {
+				subtract[p] = ""
+			}
 		}
+	}
+	if newEntity != nil {
+		if paths, err := search.IndexRollupPaths(newEntity, indexEntity); err == nil {
+			for _, p := range paths {
+				add[p] = ""
+			}
+		}
+	}
 
-		extractedValues = append(extractedValues, value)
+	touched := make(map[string]string)
+	for p := range subtract {
+		touched[p] = ""
+	}
+	for p := range add {
+		touched[p] = ""
 	}
 
-	// Combine the extracted values into a single string separated by `:`
-	return strings.Join(extractedValues, ":"), nil
+	var changes []repo.TreeChange
+	for _, rollupPath := range sortedKeys(touched) {
+		raw, existed, err := readIndexFile(ctx, client, owner, repoName, rollupPath, branch)
+		if err != nil {
+			log.Printf("Failed to read rollups '%s': %v", rollupPath, err)
+			continue
+		}
+		rollups, err := search.ParseIndexRollups(raw)
+		if err != nil {
+			log.Printf("Rollups '%s' are corrupt and will be rebuilt on the next reindex: %v", rollupPath, err)
+			continue
+		}
+
+		if _, ok := subtract[rollupPath]; ok {
+			rollups.Apply(oldEntity, rollupFields, -1)
+		}
+		if _, ok := add[rollupPath]; ok {
+			rollups.Apply(newEntity, rollupFields, 1)
+		}
+
+		if rollups.Total == 0 {
+			if existed {
+				log.Printf("Removing empty rollups '%s'", rollupPath)
+				changes = append(changes, repo.TreeChange{Path: rollupPath})
+			}
+			continue
+		}
+
+		b, err := json.Marshal(rollups)
+		if err != nil {
+			log.Printf("Failed to encode rollups '%s': %v", rollupPath, err)
+			continue
+		}
+		if existed && string(b) == string(raw) {
+			continue
+		}
+		log.Printf("Writing rollups '%s' (%d documents)", rollupPath, rollups.Total)
+		changes = append(changes, repo.TreeChange{Path: rollupPath, Content: github.String(string(b))})
+	}
+	return changes
 }
 
-func renameFile(ctx context.Context, client *github.Client, owner, repo, oldPath, newPath, branch string) error {
-	// Retrieve the old file's SHA to delete it
+func readIndexFile(ctx context.Context, client *github.Client, owner, repo, path, branch string) ([]byte, bool, error) {
 	opts := &github.RepositoryContentGetOptions{Ref: branch}
-	file, _, _, err := client.Repositories.GetContents(ctx, owner, repo, oldPath, opts)
+	file, _, res, err := client.Repositories.GetContents(ctx, owner, repo, path, opts)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve old file at path '%s': %w", oldPath, err)
+		if res != nil && res.StatusCode == 404 {
+			return nil, false, nil
+		}
+		return nil, false, err
 	}
-
-	if file == nil || file.SHA == nil {
-		return fmt.Errorf("old file at path '%s' is missing SHA", oldPath)
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, true, err
 	}
-	oldFileSHA := *file.SHA
+	return []byte(content), true, nil
+}
 
-	// Delete the old file
-	deleteOpts := &github.RepositoryContentFileOptions{
-		Message: github.String(fmt.Sprintf("Deleting old file at %s", oldPath)),
-		SHA:     github.String(oldFileSHA),
-		Branch:  github.String(branch),
-	}
-	if _, _, err := client.Repositories.DeleteFile(ctx, owner, repo, oldPath, deleteOpts); err != nil {
-		return fmt.Errorf("failed to delete old file at path '%s': %w", oldPath, err)
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	log.Printf("Deleted old file at path: %s", oldPath)
+	sort.Strings(keys)
+	return keys
+}
 
-	// Create the new file
-	createOpts := &github.RepositoryContentFileOptions{
-		Message: github.String(fmt.Sprintf("Creating new file at %s", newPath)),
-		Content: []byte{},
-		Branch:  github.String(branch),
-	}
-	if _, _, err := client.Repositories.CreateFile(ctx, owner, repo, newPath, createOpts); err != nil {
-		return fmt.Errorf("failed to create new file at path '%s': %w", newPath, err)
+func indexEntryExists(ctx context.Context, client *github.Client, owner, repo, path, branch string) bool {
+	opts := &github.RepositoryContentGetOptions{Ref: branch}
+	_, _, res, err := client.Repositories.GetContents(ctx, owner, repo, path, opts)
+	if err != nil {
+		if res == nil || res.StatusCode != 404 {
+			log.Printf("Failed to check index entry '%s': %v", path, err)
+		}
+		return false
 	}
-	log.Printf("Created new file at path: %s", newPath)
-
-	return nil
+	return true
 }
 
 func discoverIndexes(ctx context.Context, githubClient *github.Client, owner, repo, branch, contract string) ([]map[string]interface{}, error) {
@@ -302,6 +444,11 @@ func discoverIndexes(ctx context.Context, githubClient *github.Client, owner, re
             continue
         }
 
+        // Percolator indexes store queries not entities (see hooks/entity_percolate)
+        if indexType, _ := indexEntity["type"].(string); indexType == "percolator" {
+            continue
+        }
+
         // Check if the file's `entity` field matches the specified contract
         if entityField, exists := indexEntity["entity"].(string); exists && ("/contracts/" + entityField + ".json") == contractToFind {
             log.Printf("Found matching index entity in file: %s", content.GetPath())
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"goclassifieds/lib/entity"
+	"log"
+	"os"
+	"fmt"
+	"strings"
+	"encoding/json"
+	"encoding/base64"
+
+	"goclassifieds/lib/repo"
+	"goclassifieds/lib/search"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"golang.org/x/oauth2"
+	"github.com/google/go-github/v46/github"
+)
+
+func handler(ctx context.Context, event entity.AfterSaveExecEntityRequest) (entity.AfterSaveExecEntityResponse, error) {
+
+	/**
+	 * Evaluate the saved entity against every stored query of every
+	 * percolator index attached to the entity contract. Each match is
+	 * written as an event file so delivery can happen downstream.
+	 */
+	log.Printf("Percolate entity %s in repo %s and owner %s", event.Contract, event.Repo, event.Owner)
+
+	githubAppID := os.Getenv("GITHUB_APP_ID")
+	if githubAppID == "" {
+		err := fmt.Errorf("environment variable GITHUB_APP_ID is missing")
+		log.Print(err)
+		return entity.AfterSaveExecEntityResponse{}, err
+	}
+
+	// Load GitHub app PEM file
+	pemFilePath := fmt.Sprintf("rtc-vertigo-%s.private-key.pem", os.Getenv("STAGE"))
+	pem, err := os.ReadFile(pemFilePath)
+	if err != nil {
+		log.Printf("Failed to read PEM file '%s': %v", pemFilePath, err)
+		return entity.AfterSaveExecEntityResponse{}, fmt.Errorf("failed to load GitHub app PEM file: %w", err)
+	}
+	log.Print("GitHub app PEM file loaded successfully.")
+
+	// Generate GitHub Installation Token
+	getTokenInput := &repo.GetInstallationTokenInput{
+		GithubAppPem: pem,
+		Owner:        event.Owner,
+		GithubAppId:  githubAppID,
+	}
+	installationToken, err := repo.GetInstallationToken(getTokenInput)
+	if err != nil {
+		log.Printf("Error generating GitHub installation token for owner '%s': %v", event.Owner, err)
+		return entity.AfterSaveExecEntityResponse{}, fmt.Errorf("failed to generate GitHub installation token: %w", err)
+	}
+	log.Print("GitHub installation token generated successfully.")
+
+	// Create OAuth2 HTTP client
+	srcToken := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: *installationToken.Token})
+	httpClient := oauth2.NewClient(ctx, srcToken)
+	githubRestClient := github.NewClient(httpClient)
+
+	branch := "dev" // For now hard code.
+
+	percolatorIds, err := discoverPercolators(ctx, githubRestClient, event.Owner, event.Repo, branch, event.Contract)
+	if err != nil {
+		log.Printf("Failed to discover percolator indexes: %v", err)
+		return entity.AfterSaveExecEntityResponse{}, err
+	}
+	log.Printf("Discovered %d matching percolator indexes.", len(percolatorIds))
+
+	entityId := entityIdentifier(event.Entity)
+	loader := search.NewGitHubLoader(githubRestClient)
+
+	for _, percolatorId := range percolatorIds {
+
+		indexInput := &search.GetIndexConfigurationInput{
+			Owner:  event.Owner,
+			Stage:  os.Getenv("STAGE"),
+			Repo:   event.Owner + "/" + event.Repo,
+			Branch: branch,
+			Id:     percolatorId,
+		}
+
+		percolator, err := loader.LoadPercolatorIndex(ctx, indexInput)
+		if err != nil {
+			log.Printf("Failed to load percolator index %s: %v", percolatorId, err)
+			continue // for now ignore
+		}
+
+		matches := percolator.PercolateWithScores(ctx, event.Entity)
+		log.Printf("Entity %s matched %d stored queries in percolator %s", entityId, len(matches), percolatorId)
+
+		for _, match := range matches {
+			match.Contract = event.Contract
+			match.Entity = event.Entity
+
+			matchJSON, err := json.Marshal(match)
+			if err != nil {
+				log.Printf("Error marshalling match for query %s: %s", match.QueryId, err)
+				continue
+			}
+
+			// One event per query and entity. Saving an entity that already matched does not re-notify.
+			filePath := fmt.Sprintf("%s/%s/%s.json", search.PercolatorMatchesPath, match.QueryId, entityId)
+			if err := repo.CreateFileIfNotExists(ctx, githubRestClient, event.Owner, percolator.RepoName, filePath, string(matchJSON), branch); err != nil {
+				log.Printf("Error writing match event: %s", err)
+				continue // ignore for now
+			}
+			log.Printf("Match event written at path: %s", filePath)
+		}
+	}
+
+	return entity.AfterSaveExecEntityResponse{}, nil
+}
+
+// Use the entity id when present otherwise fall back to the encoded entity like the index hook does.
+func entityIdentifier(ent map[string]interface{}) string {
+	if id, ok := ent["id"].(string); ok && id != "" {
+		return id
+	}
+	entityJSON, _ := json.Marshal(ent)
+	return base64.URLEncoding.EncodeToString(entityJSON)
+}
+
+// Returns the ids of percolator indexes whose entity matches the contract.
+func discoverPercolators(ctx context.Context, githubClient *github.Client, owner, repo, branch, contract string) ([]string, error) {
+
+	_, dirContents, _, err := githubClient.Repositories.GetContents(ctx, owner, repo, "index", &github.RepositoryContentGetOptions{Ref: branch})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list contents of the `index` directory: %w", err)
+	}
+
+	if dirContents == nil {
+		return nil, fmt.Errorf("`index` directory is empty or not accessible")
+	}
+
+	var percolatorIds []string
+
+	for _, content := range dirContents {
+		if content.GetType() != "file" {
+			continue
+		}
+
+		file, _, _, err := githubClient.Repositories.GetContents(ctx, owner, repo, content.GetPath(), &github.RepositoryContentGetOptions{Ref: branch})
+		if err != nil {
+			log.Printf("Failed to retrieve file '%s': %v", content.GetPath(), err)
+			continue
+		}
+
+		if file.Content == nil || *file.Content == "" {
+			log.Printf("File '%s' has no content or is empty; skipping.", content.GetPath())
+			continue
+		}
+
+		decodedContent, err := base64.StdEncoding.DecodeString(*file.Content)
+		if err != nil {
+			decodedContent = []byte(*file.Content)
+		}
+
+		var indexEntity map[string]interface{}
+		if err := json.Unmarshal(decodedContent, &indexEntity); err != nil {
+			log.Printf("Failed to parse JSON content for file '%s': %v", content.GetPath(), err)
+			continue
+		}
+
+		if indexType, _ := indexEntity["type"].(string); indexType != search.PercolatorIndexType {
+			continue
+		}
+
+		if entityField, exists := indexEntity["entity"].(string); exists && ("/contracts/" + entityField + ".json") == contract {
+			log.Printf("Found matching percolator index in file: %s", content.GetPath())
+			percolatorIds = append(percolatorIds, strings.TrimSuffix(content.GetName(), ".json"))
+		}
+	}
+
+	return percolatorIds, nil
+}
+
+func main() {
+	log.SetFlags(0)
+	// Make the handler available for Remote Procedure Call by AWS Lambda
+	lambda.Start(handler)
+}
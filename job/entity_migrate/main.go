@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"goclassifieds/lib/entity"
+	"goclassifieds/lib/repo"
+
+	"github.com/google/go-github/v46/github"
+	"golang.org/x/oauth2"
+)
+
+/**
+ * Upgrades every stored entity of a type to the current version of its contract
+ * (contracts/{type}.json) using the contract migrations. Entities are upgraded on
+ * read anyway, this persists the upgrade in the objects repo and its chapter repos.
+ *
+ * Usage:
+ *   entity_migrate -owner rollthecloudinc -repo site-objects -type listings [-dry-run]
+ */
+
+type EntityMigration struct {
+	Source  string                `json:"source"`
+	Path    string                `json:"path"`
+	From    int                   `json:"from"`
+	To      int                   `json:"to"`
+	Changes []entity.EntityChange `json:"changes"`
+}
+
+type Report struct {
+	Type     string            `json:"type"`
+	Version  int               `json:"version"`
+	DryRun   bool              `json:"dryRun"`
+	Sources  []string          `json:"sources"`
+	Scanned  int               `json:"scanned"`
+	Current  int               `json:"current"`
+	Migrated []EntityMigration `json:"migrated"`
+	Failed   map[string]string `json:"failed"` // entity file -> error
+	Commits  []string          `json:"commits"`
+}
+
+func main() {
+	log.SetFlags(0)
+
+	owner := flag.String("owner", "", "Owner of the objects repo")
+	objectsRepo := flag.String("repo", "", "Objects repo holding contracts/{type}.json")
+	entityType := flag.String("type", "", "Entity type (contract name) to migrate")
+	branch := flag.String("branch", "dev", "Branch to read and write")
+	batchSize := flag.Int("batch", 500, "Max entities per commit")
+	dryRun := flag.Bool("dry-run", false, "Report the migrations without committing")
+	reportFile := flag.String("report", "", "Report file (default migrate-{type}.report.json)")
+	flag.Parse()
+
+	if *owner == "" || *objectsRepo == "" || *entityType == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *reportFile == "" {
+		*reportFile = fmt.Sprintf("migrate-%s.report.json", *entityType)
+	}
+
+	ctx := context.Background()
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		log.Fatal("GITHUB_TOKEN is required")
+	}
+	client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})))
+
+	contract, err := loadContract(ctx, client, *owner, *objectsRepo, *branch, *entityType)
+	if err != nil {
+		log.Fatalf("Unable to load contracts/%s.json: %v", *entityType, err)
+	}
+	migrations, err := entity.ParseContractMigrations(contract)
+	if err != nil {
+		log.Fatalf("Invalid contract migrations: %v", err)
+	}
+	// Stored entities hold x-encrypted values sealed, the schema tells where they belong.
+	var schema *entity.ContractSchema
+	if raw, ok := contract["schema"]; ok {
+		if schema, err = entity.CompileContractSchema("", raw); err != nil {
+			log.Fatalf("Invalid contract schema: %v", err)
+		}
+	}
+	log.Printf("Migrating %s to contract version %d", *entityType, migrations.Version)
+
+	report := &Report{
+		Type:    *entityType,
+		Version: migrations.Version,
+		DryRun:  *dryRun,
+		Failed:  make(map[string]string),
+	}
+
+	sources, err := repo.ChapterRepos(ctx, client, *owner, *objectsRepo, *entityType, *branch)
+	if err != nil {
+		log.Fatalf("Unable to read the %s catalog: %v", *entityType, err)
+	}
+
+	for _, source := range sources {
+		if _, res, err := client.Repositories.Get(ctx, *owner, source); err != nil {
+			if res != nil && res.StatusCode == 404 {
+				log.Printf("Chapter repo %s does not exist skipping.", source)
+				continue
+			}
+			log.Fatalf("Unable to check repo %s: %v", source, err)
+		}
+		report.Sources = append(report.Sources, source)
+
+		changes, err := migrateSource(ctx, client, *owner, source, *branch, *entityType, migrations, schema, report)
+		if err != nil {
+			writeReport(*reportFile, report)
+			log.Fatalf("Unable to migrate %s: %v", source, err)
+		}
+		log.Printf("%s: %d entities to migrate", source, len(changes))
+
+		if *dryRun || len(changes) == 0 {
+			continue
+		}
+		commits, err := commitInBatches(ctx, client, *owner, source, *branch, *batchSize, fmt.Sprintf("Migrate %s to contract version %d", *entityType, migrations.Version), changes)
+		report.Commits = append(report.Commits, commits...)
+		if err != nil {
+			// Entities committed so far are current on the next run and are skipped.
+			writeReport(*reportFile, report)
+			log.Fatalf("Commit failed, rerun to resume: %v", err)
+		}
+	}
+
+	writeReport(*reportFile, report)
+	log.Printf("Migration complete: %d scanned, %d current, %d migrated, %d failed", report.Scanned, report.Current, len(report.Migrated), len(report.Failed))
+}
+
+func loadContract(ctx context.Context, client *github.Client, owner, objectsRepo, branch, entityType string) (map[string]interface{}, error) {
+	file, _, _, err := client.Repositories.GetContents(ctx, owner, objectsRepo, "contracts/"+entityType+".json", &github.RepositoryContentGetOptions{Ref: branch})
+	if err != nil {
+		return nil, err
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	var contract map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &contract); err != nil {
+		return nil, err
+	}
+	return contract, nil
+}
+
+// Reads every entity file of the type in a source repo and returns the upgraded files.
+func migrateSource(ctx context.Context, client *github.Client, owner, source, branch, entityType string, migrations *entity.ContractMigrations, schema *entity.ContractSchema, report *Report) ([]repo.TreeChange, error) {
+	files, err := repo.ListTreeFiles(ctx, client, owner, source, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		if strings.HasPrefix(p, entityType+"/") && strings.HasSuffix(p, ".json") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []repo.TreeChange
+	for _, p := range paths {
+		report.Scanned++
+		raw, _, err := client.Git.GetBlobRaw(ctx, owner, source, files[p])
+		if err != nil {
+			report.Failed[source+"/"+p] = err.Error()
+			continue
+		}
+		var ent map[string]interface{}
+		if err := json.Unmarshal(raw, &ent); err != nil {
+			report.Failed[source+"/"+p] = err.Error()
+			continue
+		}
+		migrated, changed, err := migrations.MigrateStored(schema, ent)
+		if err != nil {
+			report.Failed[source+"/"+p] = err.Error()
+			continue
+		}
+		if !changed {
+			report.Current++
+			continue
+		}
+		report.Migrated = append(report.Migrated, EntityMigration{
+			Source:  source,
+			Path:    p,
+			From:    entity.ContractVersion(ent),
+			To:      migrations.Version,
+			Changes: entity.DiffEntities(ent, migrated),
+		})
+		changes = append(changes, repo.TreeChange{Path: p, Content: github.String(string(entity.EncodeGithubRestFile(migrated)))})
+	}
+	return changes, nil
+}
+
+func commitInBatches(ctx context.Context, client *github.Client, owner, repoName, branch string, batchSize int, message string, changes []repo.TreeChange) ([]string, error) {
+	var commits []string
+	for start := 0; start < len(changes); start += batchSize {
+		end := start + batchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+		sha, err := repo.CommitTreeChanges(ctx, client, owner, repoName, branch, fmt.Sprintf("%s (%d-%d of %d)", message, start+1, end, len(changes)), changes[start:end])
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, sha)
+	}
+	return commits, nil
+}
+
+func writeReport(file string, report *Report) {
+	b, _ := json.MarshalIndent(report, "", "  ")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		log.Printf("Failed to write report: %v", err)
+		return
+	}
+	log.Printf("Report written to %s", file)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"goclassifieds/lib/repo"
+	"goclassifieds/lib/search"
+
+	"github.com/google/go-github/v46/github"
+	"golang.org/x/oauth2"
+)
+
+/**
+ * Rebuilds an index repo from the entities stored in the objects repo
+ * (and its clustered chapter repos). Entries are written in large tree
+ * commits instead of one contents API call per entry like hooks/entity_index.
+ *
+ * Usage:
+ *   entity_reindex -owner rollthecloudinc -repo site-objects -index listings [-dry-run] [-prune]
+ */
+
+type Progress struct {
+	Index     string                       `json:"index"`
+	StartedAt time.Time                    `json:"startedAt"`
+	UpdatedAt time.Time                    `json:"updatedAt"`
+	Completed map[string]map[string]string `json:"completed"` // source repo -> index entry path -> content
+	Commits   []string                     `json:"commits"`
+}
+
+type Report struct {
+	Index    string   `json:"index"`
+	RepoName string   `json:"repoName"`
+	DryRun   bool     `json:"dryRun"`
+	Sources  []string `json:"sources"`
+	Expected int      `json:"expected"`
+	Existing int      `json:"existing"`
+	Written  []string `json:"written"` // created or rewritten entries
+	Stale    []string `json:"stale"`
+	Pruned   bool     `json:"pruned"`
+	Skipped  []string `json:"skipped"` // entity files that could not be indexed
+	Commits  []string `json:"commits"`
+}
+
+func main() {
+	log.SetFlags(0)
+
+	owner := flag.String("owner", "", "Owner of the objects repo")
+	objectsRepo := flag.String("repo", "", "Objects repo holding the entities and index/{id}.json")
+	indexId := flag.String("index", "", "Index id to rebuild")
+	branch := flag.String("branch", "dev", "Branch to read and write")
+	batchSize := flag.Int("batch", 1000, "Max index entries per commit")
+	dryRun := flag.Bool("dry-run", false, "Compute and report changes without committing")
+	prune := flag.Bool("prune", false, "Delete stale index entries")
+	progressFile := flag.String("progress", "", "Progress file used to resume (default reindex-{index}.progress.json)")
+	reportFile := flag.String("report", "", "Report file (default reindex-{index}.report.json)")
+	pemFile := flag.String("pem", "", "GitHub app private key (default rtc-vertigo-{STAGE}.private-key.pem)")
+	flag.Parse()
+
+	if *owner == "" || *objectsRepo == "" || *indexId == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *progressFile == "" {
+		*progressFile = fmt.Sprintf("reindex-%s.progress.json", *indexId)
+	}
+	if *reportFile == "" {
+		*reportFile = fmt.Sprintf("reindex-%s.report.json", *indexId)
+	}
+
+	ctx := context.Background()
+
+	client, err := newGithubClient(ctx, *owner, *pemFile)
+	if err != nil {
+		log.Fatalf("Unable to create GitHub client: %v", err)
+	}
+
+	loader := search.NewGitHubLoader(client)
+	indexEntity, err := loader.GetIndexById(&search.GetIndexConfigurationInput{
+		Owner:  *owner,
+		Stage:  os.Getenv("STAGE"),
+		Repo:   *owner + "/" + *objectsRepo,
+		Branch: *branch,
+		Id:     *indexId,
+	})
+	if err != nil || indexEntity == nil {
+		log.Fatalf("Unable to load index/%s.json: %v", *indexId, err)
+	}
+
+	repoName, _ := indexEntity["repoName"].(string)
+	entityName, _ := indexEntity["entity"].(string)
+	if repoName == "" || entityName == "" {
+		log.Fatalf("Index %s is missing 'repoName' or 'entity'", *indexId)
+	}
+	log.Printf("Reindexing entity %s into %s/%s", entityName, *owner, repoName)
+
+	progress := loadProgress(*progressFile, *indexId)
+
+	report := &Report{
+		Index:    *indexId,
+		RepoName: repoName,
+		DryRun:   *dryRun,
+	}
+
+	existing, err := repo.ListTreeFiles(ctx, client, *owner, repoName, *branch)
+	if err != nil {
+		log.Fatalf("Unable to list index repo: %v", err)
+	}
+	report.Existing = len(existing)
+
+	expected := make(map[string]string)
+
+	// The catalog lists the chapters holding entities, each chapter being a clustering repo.
+	sources, err := repo.ChapterRepos(ctx, client, *owner, *objectsRepo, entityName, *branch)
+	if err != nil {
+		log.Fatalf("Unable to read the %s catalog: %v", entityName, err)
+	}
+
+	for _, source := range sources {
+
+		if files, done := progress.Completed[source]; done {
+			log.Printf("Skipping %s already completed (%d entries)", source, len(files))
+			for p, content := range files {
+				if current, ok := expected[p]; ok {
+					content = mergeIndexFiles(p, current, content)
+				}
+				expected[p] = content
+			}
+			report.Sources = append(report.Sources, source)
+			continue
+		}
+
+		if _, res, err := client.Repositories.Get(ctx, *owner, source); err != nil {
+			if res != nil && res.StatusCode == 404 {
+				log.Printf("Chapter repo %s does not exist skipping.", source)
+				continue
+			}
+			log.Fatalf("Unable to check repo %s: %v", source, err)
+		}
+		report.Sources = append(report.Sources, source)
+
+		files, skipped, err := collectEntries(ctx, client, *owner, source, *branch, entityName, indexEntity)
+		if err != nil {
+			log.Fatalf("Unable to collect entities from %s: %v", source, err)
+		}
+		report.Skipped = append(report.Skipped, skipped...)
+
+		for p, content := range files {
+			if current, ok := expected[p]; ok {
+				content = mergeIndexFiles(p, current, content)
+			}
+			expected[p] = content
+		}
+		log.Printf("%s: %d index entries", source, len(files))
+
+		// Packed segments and rollups are only complete once every source has been read.
+		if changes := missingChanges(filterIndexFiles(files, false), existing, report); !*dryRun && len(changes) > 0 {
+			commitOrResume(ctx, client, *owner, repoName, *branch, *batchSize, fmt.Sprintf("Reindex %s from %s", *indexId, source), changes, progress, *progressFile, report, *reportFile)
+		}
+
+		if !*dryRun {
+			progress.Completed[source] = files
+			saveProgress(*progressFile, progress)
+		}
+	}
+
+	if changes := missingChanges(filterIndexFiles(expected, true), existing, report); !*dryRun && len(changes) > 0 {
+		commitOrResume(ctx, client, *owner, repoName, *branch, *batchSize, fmt.Sprintf("Reindex %s segments and rollups", *indexId), changes, progress, *progressFile, report, *reportFile)
+	}
+
+	report.Expected = len(expected)
+
+	// Anything in the index repo that no entity produces anymore is stale.
+	for p := range existing {
+		if _, ok := expected[p]; isIndexEntry(p) && !ok {
+			report.Stale = append(report.Stale, p)
+		}
+	}
+	sort.Strings(report.Stale)
+	log.Printf("Found %d stale index entries", len(report.Stale))
+
+	if *prune && !*dryRun && len(report.Stale) > 0 {
+		var deletes []repo.TreeChange
+		for _, p := range report.Stale {
+			deletes = append(deletes, repo.TreeChange{Path: p})
+		}
+		commits, err := commitInBatches(ctx, client, *owner, repoName, *branch, *batchSize, fmt.Sprintf("Prune stale entries of %s", *indexId), deletes)
+		report.Commits = append(report.Commits, commits...)
+		if err != nil {
+			writeReport(*reportFile, report)
+			log.Fatalf("Prune failed: %v", err)
+		}
+		report.Pruned = true
+	}
+
+	writeReport(*reportFile, report)
+
+	if !*dryRun {
+		// Finished cleanly so the next run starts fresh.
+		os.Remove(*progressFile)
+	}
+
+	log.Printf("Reindex complete: %d expected, %d written, %d stale, %d skipped", report.Expected, len(report.Written), len(report.Stale), len(report.Skipped))
+}
+
+// Entries whose content differs from (or is missing in) the index repo.
+func missingChanges(files map[string]string, existing map[string]string, report *Report) []repo.TreeChange {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var changes []repo.TreeChange
+	for _, p := range paths {
+		if sha, ok := existing[p]; ok && sha == gitBlobSha(files[p]) {
+			continue
+		}
+		report.Written = append(report.Written, p)
+		changes = append(changes, repo.TreeChange{Path: p, Content: github.String(files[p])})
+	}
+	log.Printf("%d index entries to write", len(changes))
+	return changes
+}
+
+func commitOrResume(ctx context.Context, client *github.Client, owner, repoName, branch string, batchSize int, message string, changes []repo.TreeChange, progress *Progress, progressFile string, report *Report, reportFile string) {
+	commits, err := commitInBatches(ctx, client, owner, repoName, branch, batchSize, message, changes)
+	report.Commits = append(report.Commits, commits...)
+	progress.Commits = append(progress.Commits, commits...)
+	if err != nil {
+		// Entries committed so far match by SHA on the next run and are skipped.
+		saveProgress(progressFile, progress)
+		writeReport(reportFile, report)
+		log.Fatalf("Commit failed, rerun to resume: %v", err)
+	}
+}
+
+// Reads every entity json file under the entity directory and computes its index entry files
+// (path -> content). Packed indexes return one partial segment per partition.
+func collectEntries(ctx context.Context, client *github.Client, owner, source, branch, entityName string, indexEntity map[string]interface{}) (map[string]string, []string, error) {
+	files, err := repo.ListTreeFiles(ctx, client, owner, source, branch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	packed := search.GetIndexEntryLayout(indexEntity).Packed
+	rollupFields := search.GetRollupFields(indexEntity)
+	entries := make(map[string]string)
+	segments := make(map[string]*search.IndexSegment)
+	rollups := make(map[string]*search.IndexRollups)
+	var skipped []string
+
+	for path, sha := range files {
+		if !strings.HasPrefix(path, entityName+"/") || !strings.HasSuffix(path, ".json") {
+			continue
+		}
+
+		raw, _, err := client.Git.GetBlobRaw(ctx, owner, source, sha)
+		if err != nil {
+			log.Printf("Failed to read %s/%s: %v", source, path, err)
+			skipped = append(skipped, source+"/"+path)
+			continue
+		}
+
+		var ent map[string]interface{}
+		if err := json.Unmarshal(raw, &ent); err != nil {
+			log.Printf("Invalid entity %s/%s: %v", source, path, err)
+			skipped = append(skipped, source+"/"+path)
+			continue
+		}
+
+		if packed {
+			segmentPaths, id, doc, err := search.IndexEntrySegments(ent, indexEntity)
+			if err != nil {
+				log.Printf("Unable to index %s/%s: %v", source, path, err)
+				skipped = append(skipped, source+"/"+path)
+				continue
+			}
+			for _, p := range segmentPaths {
+				if _, ok := segments[p]; !ok {
+					segments[p], _ = search.ParseIndexSegment(nil)
+				}
+				segments[p].Entries[id] = doc
+			}
+		} else {
+			entryFiles, err := search.IndexEntryFiles(ent, indexEntity)
+			if err != nil {
+				log.Printf("Unable to index %s/%s: %v", source, path, err)
+				skipped = append(skipped, source+"/"+path)
+				continue
+			}
+			for p, content := range entryFiles {
+				entries[p] = content
+			}
+		}
+
+		if len(rollupFields) > 0 {
+			rollupPaths, _ := search.IndexRollupPaths(ent, indexEntity)
+			for _, p := range rollupPaths {
+				if _, ok := rollups[p]; !ok {
+					rollups[p], _ = search.ParseIndexRollups(nil)
+				}
+				rollups[p].Apply(ent, rollupFields, 1)
+			}
+		}
+	}
+
+	for p, rollup := range rollups {
+		b, err := json.Marshal(rollup)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[p] = string(b)
+	}
+
+	for p, segment := range segments {
+		b, err := json.Marshal(segment)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[p] = string(b)
+	}
+	return entries, skipped, nil
+}
+
+// Segments and rollups are aggregated per partition which can receive entities from several source repos.
+func isAggregateFile(p string) bool {
+	return path.Base(p) == search.IndexSegmentFileName || path.Base(p) == search.IndexRollupsFileName
+}
+
+func filterIndexFiles(files map[string]string, aggregates bool) map[string]string {
+	filtered := make(map[string]string)
+	for p, content := range files {
+		if isAggregateFile(p) == aggregates {
+			filtered[p] = content
+		}
+	}
+	return filtered
+}
+
+func mergeIndexFiles(p string, a string, b string) string {
+	switch path.Base(p) {
+	case search.IndexSegmentFileName:
+		left, errLeft := search.ParseIndexSegment([]byte(a))
+		right, errRight := search.ParseIndexSegment([]byte(b))
+		if errLeft != nil || errRight != nil {
+			return b
+		}
+		for id, doc := range right.Entries {
+			left.Entries[id] = doc
+		}
+		merged, _ := json.Marshal(left)
+		return string(merged)
+	case search.IndexRollupsFileName:
+		left, errLeft := search.ParseIndexRollups([]byte(a))
+		right, errRight := search.ParseIndexRollups([]byte(b))
+		if errLeft != nil || errRight != nil {
+			return b
+		}
+		left.Merge(right)
+		merged, _ := json.Marshal(left)
+		return string(merged)
+	}
+	return b
+}
+
+// Same SHA git assigns to a blob so existing entries can be compared without fetching them.
+func gitBlobSha(content string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write([]byte(content))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func commitInBatches(ctx context.Context, client *github.Client, owner, repoName, branch string, batchSize int, message string, changes []repo.TreeChange) ([]string, error) {
+	var commits []string
+	for start := 0; start < len(changes); start += batchSize {
+		end := start + batchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+		sha, err := repo.CommitTreeChanges(ctx, client, owner, repoName, branch, fmt.Sprintf("%s (%d-%d of %d)", message, start+1, end, len(changes)), changes[start:end])
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, sha)
+	}
+	return commits, nil
+}
+
+// Index entries live in a composite directory. Root files like README.md and dot files are not entries.
+func isIndexEntry(path string) bool {
+	if !strings.Contains(path, "/") {
+		return false
+	}
+	for _, piece := range strings.Split(path, "/") {
+		if strings.HasPrefix(piece, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func loadProgress(file string, index string) *Progress {
+	progress := &Progress{Index: index, StartedAt: time.Now(), Completed: make(map[string]map[string]string)}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return progress
+	}
+	if err := json.Unmarshal(b, progress); err != nil || progress.Index != index {
+		log.Printf("Ignoring progress file %s", file)
+		return &Progress{Index: index, StartedAt: time.Now(), Completed: make(map[string]map[string]string)}
+	}
+	if progress.Completed == nil {
+		progress.Completed = make(map[string]map[string]string)
+	}
+	log.Printf("Resuming reindex started at %s", progress.StartedAt)
+	return progress
+}
+
+func saveProgress(file string, progress *Progress) {
+	progress.UpdatedAt = time.Now()
+	b, _ := json.MarshalIndent(progress, "", "  ")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		log.Printf("Failed to save progress: %v", err)
+	}
+}
+
+func writeReport(file string, report *Report) {
+	b, _ := json.MarshalIndent(report, "", "  ")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		log.Printf("Failed to write report: %v", err)
+		return
+	}
+	log.Printf("Report written to %s", file)
+}
+
+// GITHUB_TOKEN wins otherwise an installation token is generated for the GitHub app.
+func newGithubClient(ctx context.Context, owner string, pemFile string) (*github.Client, error) {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		githubAppID := os.Getenv("GITHUB_APP_ID")
+		if githubAppID == "" {
+			return nil, fmt.Errorf("GITHUB_TOKEN or GITHUB_APP_ID is required")
+		}
+		if pemFile == "" {
+			pemFile = fmt.Sprintf("rtc-vertigo-%s.private-key.pem", os.Getenv("STAGE"))
+		}
+		pem, err := os.ReadFile(pemFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GitHub app PEM file: %w", err)
+		}
+		installationToken, err := repo.GetInstallationToken(&repo.GetInstallationTokenInput{
+			GithubAppPem: pem,
+			Owner:        owner,
+			GithubAppId:  githubAppID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate GitHub installation token: %w", err)
+		}
+		token = *installationToken.Token
+	}
+	srcToken := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	return github.NewClient(oauth2.NewClient(ctx, srcToken)), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"goclassifieds/lib/repo"
+	"goclassifieds/lib/search"
+
+	"github.com/google/go-github/v46/github"
+	"golang.org/x/oauth2"
+)
+
+/**
+ * Migrates an index repo from legacy entries ({prefix}/{base64(entity)}) to the
+ * compact format declared by the index config (entryFormat 2, optionally packed).
+ * Legacy entries carry the whole entity in their name so no objects repo access is needed.
+ *
+ * Usage:
+ *   index_migrate -owner rollthecloudinc -repo site-objects -index listings [-dry-run]
+ */
+
+type Report struct {
+	Index    string   `json:"index"`
+	RepoName string   `json:"repoName"`
+	DryRun   bool     `json:"dryRun"`
+	Legacy   int      `json:"legacy"`
+	Written  []string `json:"written"`
+	Removed  []string `json:"removed"`
+	Skipped  []string `json:"skipped"`
+	Commits  []string `json:"commits"`
+}
+
+func main() {
+	log.SetFlags(0)
+
+	owner := flag.String("owner", "", "Owner of the objects repo")
+	objectsRepo := flag.String("repo", "", "Objects repo holding index/{id}.json")
+	indexId := flag.String("index", "", "Index id to migrate")
+	branch := flag.String("branch", "dev", "Branch to read and write")
+	batchSize := flag.Int("batch", 1000, "Max file changes per commit")
+	dryRun := flag.Bool("dry-run", false, "Compute and report changes without committing")
+	reportFile := flag.String("report", "", "Report file (default migrate-{index}.report.json)")
+	flag.Parse()
+
+	if *owner == "" || *objectsRepo == "" || *indexId == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *reportFile == "" {
+		*reportFile = fmt.Sprintf("migrate-%s.report.json", *indexId)
+	}
+
+	ctx := context.Background()
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		log.Fatal("GITHUB_TOKEN is required")
+	}
+	client := github.NewClient(oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})))
+
+	loader := search.NewGitHubLoader(client)
+	indexEntity, err := loader.GetIndexById(&search.GetIndexConfigurationInput{
+		Owner:  *owner,
+		Stage:  os.Getenv("STAGE"),
+		Repo:   *owner + "/" + *objectsRepo,
+		Branch: *branch,
+		Id:     *indexId,
+	})
+	if err != nil || indexEntity == nil {
+		log.Fatalf("Unable to load index/%s.json: %v", *indexId, err)
+	}
+
+	repoName, _ := indexEntity["repoName"].(string)
+	if repoName == "" {
+		log.Fatalf("Index %s is missing 'repoName'", *indexId)
+	}
+
+	layout := search.GetIndexEntryLayout(indexEntity)
+	if layout.Format != search.IndexEntryFormatCompact {
+		log.Fatalf("Index %s does not declare \"entryFormat\": %d, nothing to migrate to", *indexId, search.IndexEntryFormatCompact)
+	}
+
+	existing, err := repo.ListTreeFiles(ctx, client, *owner, repoName, *branch)
+	if err != nil {
+		log.Fatalf("Unable to list index repo: %v", err)
+	}
+
+	report := &Report{Index: *indexId, RepoName: repoName, DryRun: *dryRun}
+
+	written := make(map[string]string)
+	segments := make(map[string]*search.IndexSegment)
+	var removed []string
+
+	for _, p := range sortedPaths(existing) {
+		entity, ok := decodeLegacyEntry(p)
+		if !ok {
+			continue
+		}
+		report.Legacy++
+
+		if layout.Packed {
+			segmentPaths, id, doc, err := search.IndexEntrySegments(entity, indexEntity)
+			if err != nil {
+				log.Printf("Unable to migrate %s: %v", p, err)
+				report.Skipped = append(report.Skipped, p)
+				continue
+			}
+			for _, segmentPath := range segmentPaths {
+				segment, err := loadSegment(ctx, client, *owner, repoName, segmentPath, existing, segments)
+				if err != nil {
+					log.Fatalf("Unable to read segment %s: %v", segmentPath, err)
+				}
+				segment.Entries[id] = doc
+			}
+		} else {
+			files, err := search.IndexEntryFiles(entity, indexEntity)
+			if err != nil {
+				log.Printf("Unable to migrate %s: %v", p, err)
+				report.Skipped = append(report.Skipped, p)
+				continue
+			}
+			for filePath, content := range files {
+				written[filePath] = content
+			}
+		}
+		removed = append(removed, p)
+	}
+
+	for segmentPath, segment := range segments {
+		b, err := json.Marshal(segment)
+		if err != nil {
+			log.Fatalf("Unable to encode segment %s: %v", segmentPath, err)
+		}
+		written[segmentPath] = string(b)
+	}
+
+	// Writes are committed before removals so entries never disappear from searches mid migration.
+	var changes []repo.TreeChange
+	for _, p := range sortedPaths(written) {
+		report.Written = append(report.Written, p)
+		changes = append(changes, repo.TreeChange{Path: p, Content: github.String(written[p])})
+	}
+	for _, p := range removed {
+		report.Removed = append(report.Removed, p)
+		changes = append(changes, repo.TreeChange{Path: p})
+	}
+
+	log.Printf("Migrating %d legacy entries: %d files written, %d removed, %d skipped", report.Legacy, len(report.Written), len(report.Removed), len(report.Skipped))
+
+	if !*dryRun {
+		for start := 0; start < len(changes); start += *batchSize {
+			end := start + *batchSize
+			if end > len(changes) {
+				end = len(changes)
+			}
+			sha, err := repo.CommitTreeChanges(ctx, client, *owner, repoName, *branch, fmt.Sprintf("Migrate %s to entry format %d (%d-%d of %d)", *indexId, layout.Format, start+1, end, len(changes)), changes[start:end])
+			if err != nil {
+				writeReport(*reportFile, report)
+				// Already migrated entries are no longer legacy so a rerun picks up where this stopped.
+				log.Fatalf("Commit failed, rerun to resume: %v", err)
+			}
+			report.Commits = append(report.Commits, sha)
+		}
+	}
+
+	writeReport(*reportFile, report)
+}
+
+// Legacy entries are {prefix}/{base64(entity json)}. The encoded name may itself contain "/".
+func decodeLegacyEntry(p string) (map[string]interface{}, bool) {
+	pieces := strings.SplitN(p, "/", 2)
+	if len(pieces) != 2 || strings.HasPrefix(pieces[0], ".") || strings.HasSuffix(p, ".json") {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(pieces[1])
+	if err != nil {
+		return nil, false
+	}
+	var entity map[string]interface{}
+	if err := json.Unmarshal(decoded, &entity); err != nil {
+		return nil, false
+	}
+	return entity, true
+}
+
+func loadSegment(ctx context.Context, client *github.Client, owner, repoName, segmentPath string, existing map[string]string, segments map[string]*search.IndexSegment) (*search.IndexSegment, error) {
+	if segment, ok := segments[segmentPath]; ok {
+		return segment, nil
+	}
+	var raw []byte
+	if sha, ok := existing[segmentPath]; ok {
+		b, _, err := client.Git.GetBlobRaw(ctx, owner, repoName, sha)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+	segment, err := search.ParseIndexSegment(raw)
+	if err != nil {
+		return nil, err
+	}
+	segments[segmentPath] = segment
+	return segment, nil
+}
+
+func sortedPaths(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeReport(file string, report *Report) {
+	b, _ := json.MarshalIndent(report, "", "  ")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		log.Printf("Failed to write report: %v", err)
+		return
+	}
+	log.Printf("Report written to %s", file)
+}
@@ -0,0 +1,268 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"goclassifieds/lib/repo"
+)
+
+// Batches validate every entity on its own and write the ones that pass through the
+// default storage in one go. Atomic batches write nothing unless every entity passes,
+// best effort batches write what passed and report the rest.
+
+type BatchMode string
+
+const (
+	BatchAtomic     BatchMode = "atomic"
+	BatchBestEffort BatchMode = "best-effort"
+)
+
+// BatchMaxEntities caps a batch so it fits in a single request and commit. The batch
+// is one tree request with every entity inline and GitHub rejects oversized tree
+// payloads, so 500 entities of a few KB each keep the commit well below that limit.
+const BatchMaxEntities = 500
+
+// Validation calls a lambda per entity, this bounds how many run at once.
+const batchValidationConcurrency = 8
+
+var (
+	ErrInvalidBatch     = errors.New("invalid batch")
+	ErrBatchUnsupported = errors.New("storage does not support batch writes")
+)
+
+// BatchStorage is implemented by storages that can write many entities at once. It
+// returns the version of the write (the commit SHA for github storage).
+type BatchStorage interface {
+	StoreBatch(entities []map[string]interface{}, m *EntityManager) (string, error)
+}
+
+// BatchEntityResult is the outcome of one entity, Index is its position in the request.
+type BatchEntityResult struct {
+	Index   int                      `json:"index"`
+	Id      string                   `json:"id"`
+	Success bool                     `json:"success"`
+	Created bool                     `json:"created"`
+	Entity  map[string]interface{}   `json:"entity,omitempty"`
+	Errors  []map[string]interface{} `json:"errors,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+}
+
+type BatchEntityResponse struct {
+	Mode    BatchMode           `json:"mode"`
+	Success bool                `json:"success"` // every entity was written
+	Version string              `json:"version,omitempty"`
+	Written int                 `json:"written"`
+	Results []BatchEntityResult `json:"results"`
+}
+
+func (m EntityManager) Batch(entities []map[string]interface{}, mode BatchMode) (*BatchEntityResponse, error) {
+
+	log.Printf("EntityManager:batch %d entities (%s)", len(entities), mode)
+	res := &BatchEntityResponse{Mode: mode, Results: make([]BatchEntityResult, len(entities))}
+
+	if mode != BatchAtomic && mode != BatchBestEffort {
+		return res, fmt.Errorf("%w: unknown mode %q", ErrInvalidBatch, mode)
+	}
+	if len(entities) == 0 || len(entities) > BatchMaxEntities {
+		return res, fmt.Errorf("%w: a batch holds between 1 and %d entities", ErrInvalidBatch, BatchMaxEntities)
+	}
+	storage, ok := m.Storages["default"].(BatchStorage)
+	if !ok {
+		return res, ErrBatchUnsupported
+	}
+
+	allowed, _ := m.Allow("", "write", "default")
+	if !allowed {
+		log.Print("not allowed to write entities")
+		return res, errors.New("unauthorized to write entities.")
+	}
+
+	// Ids are checked up front so duplicates are rejected regardless of validation order.
+	seen := make(map[string]bool)
+	for i, ent := range entities {
+		r := &res.Results[i]
+		r.Index = i
+		r.Id, _ = ent[m.Config.IdKey].(string)
+		if r.Id == "" {
+			r.Error = fmt.Sprintf("missing %s", m.Config.IdKey)
+		} else if strings.ContainsAny(r.Id, "/\\") {
+			r.Error = fmt.Sprintf("invalid %s %s", m.Config.IdKey, r.Id)
+		} else if seen[r.Id] {
+			r.Error = fmt.Sprintf("duplicate %s %s", m.Config.IdKey, r.Id)
+		}
+		seen[r.Id] = true
+	}
+
+	oldEntities := make([]map[string]interface{}, len(entities))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchValidationConcurrency)
+	for i := range entities {
+		if res.Results[i].Error != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			oldEntities[i] = m.validateBatchEntity(entities[i], &res.Results[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// Entity hooks are not written for concurrent use so they run one entity at a time.
+	for i := range res.Results {
+		r := &res.Results[i]
+		if r.Error != "" {
+			continue
+		}
+		ent, err := m.ExecuteHook(BeforeSave, r.Entity)
+		if err != nil {
+			r.Error = err.Error()
+			continue
+		}
+		if m.BeforeSaveHooks != nil {
+			m.ExecBeforeSaveHooks(ent, "default")
+		}
+		r.Entity = ent
+	}
+
+	passing := make([]*BatchEntityResult, 0, len(res.Results))
+	for i := range res.Results {
+		if res.Results[i].Error == "" {
+			passing = append(passing, &res.Results[i])
+		}
+	}
+	if len(passing) != len(res.Results) && mode == BatchAtomic {
+		for _, r := range passing {
+			r.Error = "not written, another entity in the atomic batch failed"
+		}
+		return res, nil
+	}
+	if len(passing) == 0 {
+		return res, nil
+	}
+
+	written := make([]map[string]interface{}, len(passing))
+	changes := make([]*ReferenceChange, len(passing))
+	for i, r := range passing {
+		written[i] = r.Entity
+		changes[i] = m.referenceChange(r.Id, oldEntities[r.Index], r.Entity)
+	}
+	if err := m.addReferences(changes...); err != nil {
+		for _, r := range passing {
+			r.Error = "not written: " + err.Error()
+		}
+		return res, err
+	}
+	version, err := storage.StoreBatch(written, &m)
+	if err != nil {
+		log.Printf("Batch write failed: %s", err.Error())
+		for _, r := range passing {
+			r.Error = "not written: " + err.Error()
+		}
+		return res, err
+	}
+	res.Version = version
+	res.Written = len(passing)
+	res.Success = len(passing) == len(res.Results)
+
+	m.removeReferences(changes...)
+
+	for name, s := range m.Storages {
+		if name == "default" {
+			continue
+		}
+		for _, ent := range written {
+			s.Store(fmt.Sprint(ent[m.Config.IdKey]), m.storageEntity(s, ent))
+		}
+	}
+
+	// Hooks never see encrypted fields.
+	redacted := make([]map[string]interface{}, len(written))
+	for i, ent := range written {
+		redacted[i] = m.Encryption.Redact(ent)
+	}
+
+	olds := make([]map[string]interface{}, len(passing))
+	for i, r := range passing {
+		r.Success = true
+		olds[i] = m.Encryption.Redact(oldEntities[r.Index])
+		if _, err := m.ExecuteHook(AfterSave, r.Entity); err != nil {
+			log.Print(err)
+		}
+	}
+
+	// One batch event, contract hooks decide whether they receive it whole or per entity.
+	if m.AfterSaveHooks != nil {
+		m.ExecAfterSaveHooks(&ExecAfterSaveHooksInput{
+			Storage:     "default",
+			Event:       AfterSaveEventBatch,
+			Entities:    redacted,
+			OldEntities: olds,
+		})
+	}
+
+	return res, nil
+}
+
+// validateBatchEntity authorizes and validates one entity of a batch, recording the
+// outcome on r. It returns the stored entity being replaced, if any.
+func (m EntityManager) validateBatchEntity(ent map[string]interface{}, r *BatchEntityResult) map[string]interface{} {
+	old := m.Load(r.Id, "default")
+	r.Created = old == nil
+	if old != nil {
+		if allowed, _ := m.Allow(r.Id, "write", "default"); !allowed {
+			r.Error = "unauthorized to write to entity."
+			return old
+		}
+	}
+	ent, fieldErrs, err := m.applyFields(ent, func() map[string]interface{} { return old })
+	if err != nil || len(fieldErrs) != 0 {
+		r.Error = "Entity invalid"
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Errors = fieldErrs
+		return old
+	}
+	validateRes, err := m.Validate("default", ent)
+	if err != nil {
+		r.Error = err.Error()
+		if validateRes != nil {
+			r.Errors = validateRes.Errors
+		}
+		return old
+	}
+	r.Entity = validateRes.Entity
+	return old
+}
+
+// StoreBatch commits every entity as one commit on the branch.
+func (s GithubRestFileUploadAdaptor) StoreBatch(entities []map[string]interface{}, m *EntityManager) (string, error) {
+	changes := make([]repo.TreeChange, len(entities))
+	ids := make([]string, len(entities))
+	for i, ent := range entities {
+		ids[i] = fmt.Sprint(ent[m.Config.IdKey])
+		ent, err := s.Config.Encryption.Encrypt(ids[i], ent)
+		if err != nil {
+			return "", err
+		}
+		content := string(EncodeGithubRestFile(ent))
+		changes[i] = repo.TreeChange{
+			Path:    s.Config.Path + "/" + ids[i] + ".json",
+			Content: &content,
+		}
+	}
+	params := repo.CommitParams{
+		Repo:     s.Config.Repo,
+		Branch:   s.Config.Branch,
+		UserName: s.Config.UserName,
+	}
+	message := fmt.Sprintf("Write %d entities to %s\n\n%s", len(entities), s.Config.Path, strings.Join(ids, "\n"))
+	return repo.CommitTreeRestOptimized(s.Config.Client, &params, message, changes)
+}
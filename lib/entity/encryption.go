@@ -0,0 +1,473 @@
+package entity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// Fields marked x-encrypted are committed as envelopes instead of plain values since
+// entity repos may be public:
+//
+//	"phone": {"type": "string", "x-encrypted": true}
+//
+// is stored as
+//
+//	"phone": {"x-encrypted": {"v": 1, "kid": "...", "owner": "...", "key": "...", "nonce": "...", "data": "..."}}
+//
+// The value is sealed with AES-256-GCM bound to the entity id using a data key of the
+// entity owner (userId). The data key is generated by a KeyManagement with the owner as
+// encryption context and only its wrapped form is stored. Loaders decrypt envelopes for
+// callers with a read grant, everyone else gets the envelope. Contract after save hooks
+// (indexes) never receive encrypted fields.
+
+const (
+	EncryptedKeyword         = "x-encrypted"
+	encryptedEnvelopeVersion = 1
+	aesGCMOverhead           = 16
+)
+
+var ErrDecrypt = errors.New("unable to decrypt field")
+
+// ErrNoKeyManagement is returned rather than storing x-encrypted fields in plain text.
+var ErrNoKeyManagement = errors.New("x-encrypted fields require key management")
+
+// KeyManagement generates and unwraps data keys bound to an encryption context.
+type KeyManagement interface {
+	GenerateDataKey(context map[string]string) (plaintext []byte, wrapped []byte, keyId string, err error)
+	Decrypt(wrapped []byte, context map[string]string) ([]byte, error)
+}
+
+// AwsKeyManagement wraps data keys with an AWS KMS key.
+type AwsKeyManagement struct {
+	Client kmsiface.KMSAPI
+	KeyId  string
+}
+
+// FileKeyManagement wraps data keys with a local AES-256 key. It stands in for KMS
+// in development, the key file holds 32 base64 encoded bytes.
+type FileKeyManagement struct {
+	key []byte
+}
+
+type encryptedEnvelope struct {
+	Version int    `json:"v"`
+	KeyId   string `json:"kid"`
+	Owner   string `json:"owner"`
+	Key     string `json:"key"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+type dataKey struct {
+	plaintext []byte
+	wrapped   string
+	keyId     string
+}
+
+// FieldEncryption encrypts the x-encrypted fields of a contract. Data keys are reused
+// per owner for the life of the value.
+type FieldEncryption struct {
+	Keys      KeyManagement
+	Schema    func() (*ContractSchema, error)
+	OwnerKey  string
+	mu        sync.Mutex
+	owners    map[string]*dataKey
+	unwrapped map[string][]byte
+}
+
+// NewFieldEncryption encrypts the fields of the schema with keys. Without keys entities
+// with x-encrypted fields are not stored at all.
+func NewFieldEncryption(keys KeyManagement, schema func() (*ContractSchema, error)) *FieldEncryption {
+	return &FieldEncryption{
+		Keys:      keys,
+		Schema:    schema,
+		OwnerKey:  "userId",
+		owners:    make(map[string]*dataKey),
+		unwrapped: make(map[string][]byte),
+	}
+}
+
+func NewFileKeyManagement(file string) (*FileKeyManagement, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s is not base64: %w", file, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key file %s must hold 32 bytes, got %d", file, len(key))
+	}
+	return &FileKeyManagement{key: key}, nil
+}
+
+func (k AwsKeyManagement) GenerateDataKey(context map[string]string) ([]byte, []byte, string, error) {
+	out, err := k.Client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(k.KeyId),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: aws.StringMap(context),
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return out.Plaintext, out.CiphertextBlob, aws.StringValue(out.KeyId), nil
+}
+
+func (k AwsKeyManagement) Decrypt(wrapped []byte, context map[string]string) ([]byte, error) {
+	out, err := k.Client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: aws.StringMap(context),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func (k *FileKeyManagement) GenerateDataKey(context map[string]string) ([]byte, []byte, string, error) {
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, err := seal(k.key, plaintext, encryptionContextBytes(context))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return plaintext, wrapped, "file", nil
+}
+
+func (k *FileKeyManagement) Decrypt(wrapped []byte, context map[string]string) ([]byte, error) {
+	return open(k.key, wrapped, encryptionContextBytes(context))
+}
+
+// encryptionContextBytes is the context in a stable order to authenticate it like KMS does.
+func encryptionContextBytes(context map[string]string) []byte {
+	keys := make([]string, 0, len(context))
+	for k := range context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + context[k] + "\n")
+	}
+	return []byte(b.String())
+}
+
+// seal encrypts with AES-GCM and prefixes the nonce.
+func seal(key, plaintext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(key, sealed, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncryptedValue reports whether a value is an x-encrypted envelope.
+func IsEncryptedValue(value interface{}) bool {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return false
+	}
+	_, ok = obj[EncryptedKeyword].(map[string]interface{})
+	return ok
+}
+
+func (e *FieldEncryption) ownerKey(owner string) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if key, ok := e.owners[owner]; ok {
+		return key, nil
+	}
+	plaintext, wrapped, keyId, err := e.Keys.GenerateDataKey(map[string]string{"owner": owner})
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	key := &dataKey{plaintext: plaintext, wrapped: base64.StdEncoding.EncodeToString(wrapped), keyId: keyId}
+	e.owners[owner] = key
+	e.unwrapped[owner+"/"+key.wrapped] = plaintext
+	return key, nil
+}
+
+func (e *FieldEncryption) unwrap(envelope *encryptedEnvelope) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cacheKey := envelope.Owner + "/" + envelope.Key
+	if plaintext, ok := e.unwrapped[cacheKey]; ok {
+		return plaintext, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(envelope.Key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := e.Keys.Decrypt(wrapped, map[string]string{"owner": envelope.Owner})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, err.Error())
+	}
+	e.unwrapped[cacheKey] = plaintext
+	return plaintext, nil
+}
+
+// encryptedPaths are the instance paths of the present x-encrypted values, outermost
+// first. Paths inside another encrypted value are left out.
+func (e *FieldEncryption) encryptedPaths(entity map[string]interface{}) ([]string, error) {
+	if e.Schema == nil {
+		return nil, nil
+	}
+	schema, err := e.Schema()
+	if err != nil || schema == nil || !schema.Declares(EncryptedKeyword) {
+		return nil, err
+	}
+	var paths []string
+	for _, a := range flagged(schema.Annotations(EncryptedKeyword, entity)) {
+		if a.Present && a.InstancePath != "" {
+			paths = append(paths, a.InstancePath)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return comparePointers(paths[i], paths[j]) < 0 })
+	outermost := paths[:0]
+	for _, p := range paths {
+		if n := len(outermost); n != 0 && (p == outermost[n-1] || strings.HasPrefix(p, outermost[n-1]+"/")) {
+			continue
+		}
+		outermost = append(outermost, p)
+	}
+	return outermost, nil
+}
+
+// Encrypt returns a copy of the entity with its x-encrypted values replaced by envelopes.
+// Values that already are envelopes are kept as they are.
+func (e *FieldEncryption) Encrypt(id string, entity map[string]interface{}) (map[string]interface{}, error) {
+	if e == nil || entity == nil {
+		return entity, nil
+	}
+	paths, err := e.encryptedPaths(entity)
+	if err != nil || len(paths) == 0 {
+		return entity, err
+	}
+	copied, err := copyDocument(entity)
+	if err != nil {
+		return nil, err
+	}
+	doc := copied.(map[string]interface{})
+	owner := fmt.Sprint(entity[e.OwnerKey])
+	if entity[e.OwnerKey] == nil {
+		owner = ""
+	}
+	for _, p := range paths {
+		tokens := mustParsePointer(p)
+		value, err := pointerGet(doc, tokens)
+		if err != nil || value == nil || IsEncryptedValue(value) {
+			continue
+		}
+		if e.Keys == nil {
+			return nil, ErrNoKeyManagement
+		}
+		envelope, err := e.seal(id, owner, value)
+		if err != nil {
+			return nil, err
+		}
+		fieldSet(doc, tokens, envelope)
+	}
+	return doc, nil
+}
+
+func (e *FieldEncryption) seal(id string, owner string, value interface{}) (map[string]interface{}, error) {
+	key, err := e.ownerKey(owner)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(key.plaintext, plaintext, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := len(sealed) - len(plaintext) - aesGCMOverhead
+	return map[string]interface{}{
+		EncryptedKeyword: map[string]interface{}{
+			"v":     encryptedEnvelopeVersion,
+			"kid":   key.keyId,
+			"owner": owner,
+			"key":   key.wrapped,
+			"nonce": base64.StdEncoding.EncodeToString(sealed[:nonceSize]),
+			"data":  base64.StdEncoding.EncodeToString(sealed[nonceSize:]),
+		},
+	}, nil
+}
+
+func (e *FieldEncryption) open(id string, value interface{}) (interface{}, error) {
+	var envelope encryptedEnvelope
+	b, _ := json.Marshal(value.(map[string]interface{})[EncryptedKeyword])
+	if err := json.Unmarshal(b, &envelope); err != nil || envelope.Version != encryptedEnvelopeVersion {
+		return nil, ErrDecrypt
+	}
+	key, err := e.unwrap(&envelope)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	data, err := base64.StdEncoding.DecodeString(envelope.Data)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := open(key, append(nonce, data...), []byte(id))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	var decrypted interface{}
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		return nil, ErrDecrypt
+	}
+	return decrypted, nil
+}
+
+// Decrypt replaces the envelopes of a loaded entity with their values when the manager
+// grants read access to it. Envelopes that fail to decrypt are kept.
+func (e *FieldEncryption) Decrypt(id string, entity map[string]interface{}, m *EntityManager) map[string]interface{} {
+	if e == nil || e.Keys == nil || entity == nil || !containsEncrypted(entity) {
+		return entity
+	}
+	if allowed, _ := m.Allow(id, "read", "default"); !allowed {
+		log.Printf("Encrypted fields of %s stay encrypted without read access", id)
+		return entity
+	}
+	return e.transform(entity, func(value interface{}) interface{} {
+		decrypted, err := e.open(id, value)
+		if err != nil {
+			log.Printf("Unable to decrypt field of %s: %s", id, err.Error())
+			return value
+		}
+		return decrypted
+	}).(map[string]interface{})
+}
+
+// Redact returns a copy of the entity without its x-encrypted values and envelopes, for
+// hooks that publish entity data like indexes.
+func (e *FieldEncryption) Redact(entity map[string]interface{}) map[string]interface{} {
+	if e == nil || entity == nil {
+		return entity
+	}
+	paths, err := e.encryptedPaths(entity)
+	if err != nil {
+		log.Printf("Unable to find encrypted fields: %s", err.Error())
+	}
+	if len(paths) == 0 && !containsEncrypted(entity) {
+		return entity
+	}
+	copied, err := copyDocument(entity)
+	if err != nil {
+		return nil
+	}
+	doc := copied.(map[string]interface{})
+	// Removing from the last path back keeps array indexes valid.
+	for i := len(paths) - 1; i >= 0; i-- {
+		pointerRemove(doc, mustParsePointer(paths[i]))
+	}
+	return e.transform(doc, func(value interface{}) interface{} { return nil }).(map[string]interface{})
+}
+
+// storageEntity is the entity a storage receives. Only the github rest storage encrypts
+// x-encrypted fields, every other storage (search indexes, s3, cql) gets them redacted.
+func (m EntityManager) storageEntity(s Storage, entity map[string]interface{}) map[string]interface{} {
+	if _, ok := s.(GithubRestFileUploadAdaptor); ok {
+		return entity
+	}
+	return m.Encryption.Redact(entity)
+}
+
+// transform replaces every envelope with the result of f, members mapped to nil are
+// removed.
+func (e *FieldEncryption) transform(value interface{}, f func(interface{}) interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			if IsEncryptedValue(item) {
+				if replaced := f(item); replaced != nil {
+					out[k] = replaced
+				}
+				continue
+			}
+			out[k] = e.transform(item, f)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if IsEncryptedValue(item) {
+				if replaced := f(item); replaced != nil {
+					out = append(out, replaced)
+				}
+				continue
+			}
+			out = append(out, e.transform(item, f))
+		}
+		return out
+	}
+	return value
+}
+
+func containsEncrypted(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if IsEncryptedValue(v) {
+			return true
+		}
+		for _, item := range v {
+			if containsEncrypted(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if containsEncrypted(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
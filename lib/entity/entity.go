@@ -50,6 +50,8 @@ const (
 	AfterSave
 	BeforeFind
 	AfterFind
+	BeforeDelete
+	AfterDelete
 )
 
 type HookSignals int32
@@ -140,6 +142,13 @@ type UpdateEntityResponse struct {
 	Errors  []map[string]interface{}
 }
 
+type DeleteEntityResponse struct {
+	Success bool
+	Entity  map[string]interface{}
+}
+
+var ErrEntityNotFound = errors.New("entity not found")
+
 type EntityValidationResponse struct {
 	Entity map[string]interface{}
 	Errors []map[string]interface{}
@@ -170,6 +179,8 @@ type DefaultManagerConfig struct {
 	AfterSave           EntityHook
 	BeforeFind          EntityCollectionHook
 	AfterFind           EntityCollectionHook
+	References          EntityReferences
+	Keys                KeyManagement
 }
 
 type EntityAdaptorConfig struct {
@@ -198,15 +209,32 @@ type EntityManager struct {
 	AfterValidateAlterHooks		AfterValidateAlterHooks
 	BeforeSaveHooks  			BeforeSaveHooks
 	AfterSaveHooks   			AfterSaveHooks
+	BeforeDeleteHooks			BeforeDeleteHooks
+	AfterDeleteHooks			AfterDeleteHooks
+	Versioning					*EntityVersioning
+	Migrator					Migrator
+	References					EntityReferences
+	Fields						ContractFields
+	Encryption					*FieldEncryption
 }
 
 type Manager interface {
 	Create(entity map[string]interface{}) (*CreateEntityResponse, error)
 	Update(entity map[string]interface{}) (*UpdateEntityResponse, error)
+	Delete(id string) (*DeleteEntityResponse, error)
+	Patch(id string, contentType string, patch []byte) (*UpdateEntityResponse, error)
+	Restore(id string, revision string) (*UpdateEntityResponse, error)
+	Batch(entities []map[string]interface{}, mode BatchMode) (*BatchEntityResponse, error)
+	Expand(entities []map[string]interface{}, expand []string) error
+	Revisions(id string, limit int) ([]EntityRevision, error)
+	LoadRevision(id string, revision string) (map[string]interface{}, error)
+	DiffRevisions(id string, from string, to string) ([]EntityChange, error)
 	Validate(name string, entity map[string]interface{}) (*EntityValidationResponse, error)
 	Purge(storage string, entities ...map[string]interface{})
-	Save(entity map[string]interface{}, storage string)
+	Save(entity map[string]interface{}, storage string) error
 	Load(id string, loader string) map[string]interface{}
+	LoadVersion(id string, loader string) (map[string]interface{}, string)
+	Versions() *EntityVersioning
 	Find(finder string, query string, data *EntityFinderDataBag) []map[string]interface{}
 	Allow(id string, op string, loader string) (bool, map[string]interface{})
 	AddFinder(name string, finder Finder)
@@ -221,6 +249,8 @@ type Manager interface {
 	ExecAfterValidateAlterHooks(name string, entity map[string]interface{}, res *EntityValidationResponse) error
 	ExecAfterSaveHooks(input *ExecAfterSaveHooksInput) error
 	ExecBeforeSaveHooks(entity map[string]interface{}, storage string) error
+	ExecBeforeDeleteHooks(input *ExecDeleteHooksInput) error
+	ExecAfterDeleteHooks(input *ExecDeleteHooksInput) error
 }
 
 type Storage interface {
@@ -252,6 +282,14 @@ type BeforeSaveHooks interface {
 	ExecBeforeSaveHooks(entity map[string]interface{}, storage string) error
 }
 
+type BeforeDeleteHooks interface {
+	ExecBeforeDeleteHooks(input *ExecDeleteHooksInput) error
+}
+
+type AfterDeleteHooks interface {
+	ExecAfterDeleteHooks(input *ExecDeleteHooksInput) error
+}
+
 type Updator interface {
 	Update(entity map[string]interface{}, m *EntityManager) (*UpdateEntityResponse, error)
 }
@@ -268,6 +306,16 @@ type Authorization interface {
 	CanWrite(id string, m *EntityManager) (bool, map[string]interface{})
 }
 
+// Authorizers without CanDelete fall back to CanWrite for deletes.
+type DeleteAuthorization interface {
+	CanDelete(id string, m *EntityManager) (bool, map[string]interface{})
+}
+
+// Authorizers without CanRead allow reads, loads are not authorized otherwise.
+type ReadAuthorization interface {
+	CanRead(id string, m *EntityManager) (bool, map[string]interface{})
+}
+
 type S3AdaptorConfig struct {
 	Bucket  string           `json:"bucket"`
 	Prefix  string           `json:"prefix"`
@@ -304,11 +352,12 @@ type GithubFileUploadConfig struct {
 }
 
 type GithubRestFileUploadConfig struct {
-	Client   *github.Client `json:"-"`
-	Repo     string         `json:"repo"`
-	Branch   string         `json:"branch"`
-	Path     string         `json:"path"`
-	UserName string         `json:"userName"`
+	Client     *github.Client   `json:"-"`
+	Repo       string           `json:"repo"`
+	Branch     string           `json:"branch"`
+	Path       string           `json:"path"`
+	UserName   string           `json:"userName"`
+	Encryption *FieldEncryption `json:"-"`
 }
 
 type ElasticTemplateFinderConfig struct {
@@ -397,6 +446,7 @@ type ContractValidatorConfig struct {
 	Repo     string         `json:"repo"`
 	Branch   string         `json:"branch"`
 	Contract string         `json:"contract"`
+	Enforcer string         `json:"enforcer"` // ContractEnforcerNative (default) or ContractEnforcerLambda
 }
 
 type GithubHooksConfig struct {
@@ -543,6 +593,14 @@ type GithubAfterSaveHooks struct {
 	Config GithubHooksConfig `json:"config"`
 }
 
+type GithubBeforeDeleteHooks struct {
+	Config GithubHooksConfig `json:"config"`
+}
+
+type GithubAfterDeleteHooks struct {
+	Config GithubHooksConfig `json:"config"`
+}
+
 type EntityType struct {
 	Id         string            `form:"id" json:"id" binding:"required" validate:"required"`
 	UserId     string            `form:"userId" json:"userId" binding:"required" validate:"required"`
@@ -574,8 +632,17 @@ type AfterSaveExecEntityRequest struct {
 	Owner 		string                   `json:"owner"`
 	Repo 		string                   `json:"repo"`
 	OldEntity 	map[string]interface{}   `json:"oldEntity"`
+	Event 		string                   `json:"event,omitempty"` // AfterSaveEventSave (default), AfterSaveEventDelete or AfterSaveEventBatch
+	Entities 	[]map[string]interface{} `json:"entities,omitempty"` // only for AfterSaveEventBatch
+	OldEntities []map[string]interface{} `json:"oldEntities,omitempty"` // only for AfterSaveEventBatch
 }
 
+const (
+	AfterSaveEventSave   = "save"
+	AfterSaveEventDelete = "delete"
+	AfterSaveEventBatch  = "batch"
+)
+
 type AfterSaveExecEntityResponse struct {
 
 }
@@ -584,6 +651,14 @@ type ExecAfterSaveHooksInput struct {
 	Entity map[string]interface{}
 	Storage string
 	OldEntity map[string]interface{}
+	Event string
+	Entities []map[string]interface{} // batch event, OldEntities lines up with Entities
+	OldEntities []map[string]interface{}
+}
+
+type ExecDeleteHooksInput struct {
+	Entity map[string]interface{}
+	Storage string
 }
 
 func (m EntityManager) Create(entity map[string]interface{}) (*CreateEntityResponse, error) {
@@ -594,6 +669,23 @@ func (m EntityManager) Update(entity map[string]interface{}) (*UpdateEntityRespo
 	return m.Updator.Update(entity, &m)
 }
 
+// Patch applies a merge patch or json patch to the current entity and saves the result
+// through Update so validation, hooks and storage behave like a full replacement.
+func (m EntityManager) Patch(id string, contentType string, patch []byte) (*UpdateEntityResponse, error) {
+	current := m.Load(id, "default")
+	if current == nil {
+		return &UpdateEntityResponse{}, ErrEntityNotFound
+	}
+	patched, err := ApplyPatch(current, contentType, patch)
+	if err != nil {
+		return &UpdateEntityResponse{Entity: current}, err
+	}
+	if fmt.Sprint(patched[m.Config.IdKey]) != id {
+		return &UpdateEntityResponse{Entity: current}, fmt.Errorf("%w: %s cannot be changed", ErrInvalidPatch, m.Config.IdKey)
+	}
+	return m.Update(patched)
+}
+
 func (m EntityManager) Validate(name string, entity map[string]interface{}) (*EntityValidationResponse, error) {
 	return m.Validators[name].Validate(entity, &m)
 }
@@ -603,20 +695,32 @@ func (m EntityManager) Purge(storage string, entities ...map[string]interface{})
 	m.Storages[storage].Purge(&m, entities...)
 }
 
-func (m EntityManager) Save(entity map[string]interface{}, storage string) {
+func (m EntityManager) Save(entity map[string]interface{}, storage string) error {
 
 	log.Print("EntityManager:save " + storage)
 	id := fmt.Sprint(entity[m.Config.IdKey])
 
 	var oldEntity map[string]interface{}
+	var oldVersion string
 	if id != "" {
 		// Try loading the old entity
-		oldEntity = m.Load(id, "default") // Use the default loader
+		oldEntity, oldVersion = m.LoadVersion(id, "default") // Use the default loader
 		if oldEntity != nil {
 			log.Printf("Old entity with ID %s successfully loaded", id)
 		}
 	}
 
+	// Preconditions only apply to storages that keep versions. Checking them up front
+	// keeps hooks from running for a write that would be rejected anyway.
+	versionedStorage, versioned := m.Storages[storage].(VersionedStorage)
+	versioned = versioned && m.Versioning != nil
+	if versioned {
+		if err := m.Versioning.Check(oldVersion, oldEntity != nil); err != nil {
+			log.Printf("Precondition failed for entity %s at version %s", id, oldVersion)
+			return err
+		}
+	}
+
 	ent, err := m.ExecuteHook(BeforeSave, entity)
 
 	// @todo: These ause issue when no github connection exists
@@ -627,7 +731,29 @@ func (m EntityManager) Save(entity map[string]interface{}, storage string) {
 		log.Print(err)
 	}
 
-	m.Storages[storage].Store(id, ent)
+	var references *ReferenceChange
+	if storage == "default" {
+		references = m.referenceChange(id, oldEntity, ent)
+		if err := m.addReferences(references); err != nil {
+			return err
+		}
+	}
+
+	if versioned {
+		expected := ""
+		if len(m.Versioning.IfMatch) != 0 {
+			expected = oldVersion
+		}
+		version, err := versionedStorage.StoreVersion(id, ent, expected, m.Versioning.IfNoneMatch)
+		if err != nil {
+			return err
+		}
+		m.Versioning.Version = version
+	} else {
+		m.Storages[storage].Store(id, m.storageEntity(m.Storages[storage], ent))
+	}
+
+	m.removeReferences(references)
 
 	if _, err := m.ExecuteHook(AfterSave, entity); err != nil {
 		log.Print(err)
@@ -636,12 +762,88 @@ func (m EntityManager) Save(entity map[string]interface{}, storage string) {
 	// @todo: These cause issue when no github connection exists
 	// Like with chat and stream...
 	execAfterSaveHooksInput := &ExecAfterSaveHooksInput{
-		Entity: entity,
+		Entity: m.Encryption.Redact(entity),
 		Storage: storage,
-		OldEntity: oldEntity,
+		OldEntity: m.Encryption.Redact(oldEntity),
 	}
 	m.ExecAfterSaveHooks(execAfterSaveHooksInput)
 
+	return nil
+}
+
+func (m EntityManager) Delete(id string) (*DeleteEntityResponse, error) {
+
+	log.Print("EntityManager:delete " + id)
+	res := &DeleteEntityResponse{}
+
+	allowed, _ := m.Allow(id, "delete", "default")
+	if !allowed {
+		log.Printf("not allowed to delete entity %s", id)
+		return res, errors.New("unauthorized to delete entity.")
+	}
+
+	entity := m.Load(id, "default")
+	if entity == nil {
+		return res, ErrEntityNotFound
+	}
+	res.Entity = entity
+
+	// Referrers are checked before anything runs so a restricted delete changes nothing.
+	referrerActions, err := m.checkReferrers(id)
+	if err != nil {
+		return res, err
+	}
+
+	if _, err := m.ExecuteHook(BeforeDelete, entity); err != nil {
+		return res, err
+	}
+
+	// Hooks never see encrypted fields, the loaded entity holds them decrypted.
+	redacted := m.Encryption.Redact(entity)
+	hooksInput := &ExecDeleteHooksInput{
+		Entity: redacted,
+		Storage: "default",
+	}
+	if err := m.ExecBeforeDeleteHooks(hooksInput); err != nil {
+		return res, err
+	}
+
+	// The default storage is the source of truth so nothing else is touched when it fails.
+	if storage, ok := m.Storages["default"]; ok {
+		if err := storage.Purge(&m, entity); err != nil {
+			log.Printf("Failed to purge entity %s from default storage: %s", id, err.Error())
+			return res, err
+		}
+	}
+	for name, storage := range m.Storages {
+		if name == "default" {
+			continue
+		}
+		if err := storage.Purge(&m, entity); err != nil {
+			log.Printf("Failed to purge entity %s from %s storage: %s", id, name, err.Error())
+		}
+	}
+
+	m.removeReferences(m.referenceChange(id, entity, nil))
+	applyReferrerActions(referrerActions)
+
+	if _, err := m.ExecuteHook(AfterDelete, entity); err != nil {
+		log.Print(err)
+	}
+
+	// Save hooks are told about the delete as well so indexes drop the entity.
+	if m.AfterSaveHooks != nil {
+		m.ExecAfterSaveHooks(&ExecAfterSaveHooksInput{
+			Entity: redacted,
+			Storage: "default",
+			OldEntity: redacted,
+			Event: AfterSaveEventDelete,
+		})
+	}
+	m.ExecAfterDeleteHooks(hooksInput)
+
+	res.Success = true
+	return res, nil
 }
 
 func (m EntityManager) AddStorage(name string, storage Storage) {
@@ -690,12 +892,46 @@ func (m EntityManager) Find(finder string, query string, data *EntityFinderDataB
 }
 
 func (m EntityManager) Load(id string, loader string) map[string]interface{} {
-	return m.Loaders[loader].Load(id, &m)
+	return m.migrate(m.Loaders[loader].Load(id, &m))
+}
+
+// Versions returns the per request write preconditions, nil when the manager does not
+// track versions.
+func (m EntityManager) Versions() *EntityVersioning {
+	return m.Versioning
+}
+
+// LoadVersion loads an entity with its version. Loaders that do not track versions
+// report an empty version.
+func (m EntityManager) LoadVersion(id string, loader string) (map[string]interface{}, string) {
+	if versionedLoader, ok := m.Loaders[loader].(VersionedLoader); ok {
+		entity, version := versionedLoader.LoadVersion(id, &m)
+		return m.migrate(entity), version
+	}
+	return m.Load(id, loader), ""
 }
 
 func (m EntityManager) Allow(id string, op string, loader string) (bool, map[string]interface{}) {
 	if op == "write" {
 		return m.Authorizers["default"].CanWrite(id, &m)
+	} else if op == "delete" {
+		authorizer, ok := m.Authorizers["default"]
+		if !ok {
+			return false, nil
+		}
+		if deleteAuthorizer, ok := authorizer.(DeleteAuthorization); ok {
+			return deleteAuthorizer.CanDelete(id, &m)
+		}
+		return authorizer.CanWrite(id, &m)
+	} else if op == "read" {
+		authorizer, ok := m.Authorizers["default"]
+		if !ok {
+			return false, nil
+		}
+		if readAuthorizer, ok := authorizer.(ReadAuthorization); ok {
+			return readAuthorizer.CanRead(id, &m)
+		}
+		return true, nil
 	} else {
 		return false, nil
 	}
@@ -732,6 +968,20 @@ func (m EntityManager) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput) error
 	return m.AfterSaveHooks.ExecAfterSaveHooks(input)
 }
 
+func (m EntityManager) ExecBeforeDeleteHooks(input *ExecDeleteHooksInput) error {
+	if m.BeforeDeleteHooks == nil {
+		return nil
+	}
+	return m.BeforeDeleteHooks.ExecBeforeDeleteHooks(input)
+}
+
+func (m EntityManager) ExecAfterDeleteHooks(input *ExecDeleteHooksInput) error {
+	if m.AfterDeleteHooks == nil {
+		return nil
+	}
+	return m.AfterDeleteHooks.ExecAfterDeleteHooks(input)
+}
+
 func (l S3LoaderAdaptor) Load(id string, m *EntityManager) map[string]interface{} {
 
 	buf := aws.NewWriteAtBuffer([]byte{})
@@ -830,6 +1080,12 @@ func (s GithubFileLoaderAdaptor) Load(id string, m *EntityManager) map[string]in
 }
 
 func (s GithubRestFileLoaderAdaptor) Load(id string, m *EntityManager) map[string]interface{} {
+	obj, _ := s.LoadVersion(id, m)
+	return obj
+}
+
+// LoadVersion reports the blob SHA of the entity file as its version.
+func (s GithubRestFileLoaderAdaptor) LoadVersion(id string, m *EntityManager) (map[string]interface{}, string) {
 	log.Printf("BEGIN GithubRestFileLoaderAdaptor::LOAD %s", id)
 	var obj map[string]interface{}
 	pieces := strings.Split(s.Config.Repo, "/")
@@ -846,28 +1102,28 @@ func (s GithubRestFileLoaderAdaptor) Load(id string, m *EntityManager) map[strin
 	if err != nil {
 		if res != nil && res.StatusCode == 404 {
 			log.Printf("Entity with ID %s not found in GitHub repository.", id)
-			return nil // Return nil if the entity does not exist
+			return nil, "" // Return nil if the entity does not exist
 		}
 		log.Fatalf("Error fetching GitHub content: %v", err)
 	}
 	if file == nil || file.Content == nil {
 		log.Printf("No content found for entity ID %s", id)
-		return nil // Safeguard against unexpected nil content
+		return nil, "" // Safeguard against unexpected nil content
 	}
 
 	content, err := base64.StdEncoding.DecodeString(*file.Content)
 	if err != nil {
 		log.Printf("Failed to decode base64 content for entity ID %s: %v", id, err)
-		return nil
+		return nil, ""
 	}
 
 	err = json.Unmarshal(content, &obj)
 	if err != nil {
 		log.Printf("Failed to unmarshal JSON for entity ID %s: %v", id, err)
-		return nil
+		return nil, ""
 	}
 	log.Printf("END GithubRestFileLoaderAdaptor::LOAD %s", id)
-	return obj
+	return s.Config.Encryption.Decrypt(id, obj, m), file.GetSHA()
 }
 
 func (s S3StorageAdaptor) Store(id string, entity map[string]interface{}) {
@@ -899,6 +1155,18 @@ func (s S3StorageAdaptor) Store(id string, entity map[string]interface{}) {
 }
 
 func (s S3StorageAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	svc := s3.New(s.Config.Session)
+	for _, ent := range entities {
+		id := fmt.Sprint(ent[m.Config.IdKey])
+		log.Printf("purge from bucket: %s", s.Config.Bucket)
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Config.Bucket),
+			Key:    aws.String(s.Config.Prefix + "" + id + ".json.gz"),
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -955,10 +1223,44 @@ func (s OpensearchStorageAdaptor) Store(id string, entity map[string]interface{}
 }
 
 func (s ElasticStorageAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	for _, ent := range entities {
+		req := esapi.DeleteRequest{
+			Index:      s.Config.Index,
+			DocumentID: fmt.Sprint(ent[m.Config.IdKey]),
+			Refresh:    "true",
+		}
+		res, err := req.Do(context.Background(), s.Config.Client)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.IsError() && res.StatusCode != 404 {
+			return fmt.Errorf("elastic delete error status %s", res.Status())
+		}
+	}
 	return nil
 }
 
 func (s OpensearchStorageAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	for _, ent := range entities {
+		id := fmt.Sprint(ent[m.Config.IdKey])
+		log.Print("OpensearchStorageAdaptor delete from index " + s.Config.Index + " for id " + id)
+		req := opensearchapi.DeleteRequest{
+			Index:      s.Config.Index,
+			DocumentID: id,
+			Refresh:    "true",
+		}
+		res, err := req.Do(context.Background(), s.Config.Client)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		// A document that was never indexed is already gone.
+		if res.IsError() && res.StatusCode != 404 {
+			return fmt.Errorf("opensearch delete error status %s, body: %s", res.Status(), string(body))
+		}
+	}
 	return nil
 }
 
@@ -995,8 +1297,12 @@ func (s CqlStorageAdaptor) Store(id string, entity map[string]interface{}) {
 }
 
 func (s CqlStorageAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	stmt := fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, s.Config.Table, strings.ToLower(m.Config.IdKey))
 	for _, ent := range entities {
 		log.Printf("Purge = %s", ent[m.Config.IdKey])
+		if err := s.Config.Session.Query(stmt, ent[m.Config.IdKey]).Consistency(gocql.LocalQuorum).Exec(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -1087,7 +1393,14 @@ func (s CqlAutoDiscoveryExpansionStorageAdaptor) Store(id string, entity map[str
 
 }
 
+// Expanded rows share the entity id as their partition key so a single delete removes them all.
 func (s CqlAutoDiscoveryExpansionStorageAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	stmt := fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, s.Config.Table, strings.ToLower(m.Config.IdKey))
+	for _, ent := range entities {
+		if err := s.Config.Session.Query(stmt, ent[m.Config.IdKey]).Consistency(gocql.LocalQuorum).Exec(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1114,17 +1427,29 @@ func (s GithubFileUploadAdaptor) Store(id string, entity map[string]interface{})
 }
 
 func (s GithubFileUploadAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	for _, ent := range entities {
+		params := repo.CommitParams{
+			Repo:     s.Config.Repo,
+			Branch:   s.Config.Branch,
+			Path:     s.Config.Path + "/" + fmt.Sprint(ent[m.Config.IdKey]) + ".json",
+			UserName: s.Config.UserName,
+		}
+		if err := repo.Delete(s.Config.Client, &params); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (s GithubRestFileUploadAdaptor) Store(id string, entity map[string]interface{}) {
 
-	dataBuffer := bytes.Buffer{}
-	encoder := json.NewEncoder(&dataBuffer)
-	encoder.SetIndent("", "\t")
-	encoder.SetEscapeHTML(false)
-	encoder.Encode(entity)
-	data := []byte(dataBuffer.String())
+	// Better not stored at all than sensitive fields committed in plain text.
+	entity, err := s.Config.Encryption.Encrypt(id, entity)
+	if err != nil {
+		log.Printf("Unable to encrypt entity %s not stored: %s", id, err.Error())
+		return
+	}
+	data := EncodeGithubRestFile(entity)
 	params := repo.CommitParams{
 		Repo:     s.Config.Repo,
 		Branch:   s.Config.Branch,
@@ -1140,7 +1465,55 @@ func (s GithubRestFileUploadAdaptor) Store(id string, entity map[string]interfac
 
 }
 
+// StoreVersion commits the entity only when the file is still at the expected blob SHA.
+func (s GithubRestFileUploadAdaptor) StoreVersion(id string, entity map[string]interface{}, expected string, create bool) (string, error) {
+
+	entity, err := s.Config.Encryption.Encrypt(id, entity)
+	if err != nil {
+		return "", err
+	}
+	data := EncodeGithubRestFile(entity)
+	params := repo.CommitParams{
+		Repo:        s.Config.Repo,
+		Branch:      s.Config.Branch,
+		Path:        s.Config.Path + "/" + id + ".json",
+		Data:        &data,
+		UserName:    s.Config.UserName,
+		IfMatch:     expected,
+		IfNoneMatch: create,
+	}
+
+	version, err := repo.CommitRestVersioned(s.Config.Client, &params)
+	if errors.Is(err, repo.ErrVersionMismatch) {
+		return "", ErrPreconditionFailed
+	}
+	return version, err
+
+}
+
+// EncodeGithubRestFile is the file format of entities stored in github: tab indented
+// json without html escaping.
+func EncodeGithubRestFile(entity map[string]interface{}) []byte {
+	dataBuffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&dataBuffer)
+	encoder.SetIndent("", "\t")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(entity)
+	return []byte(dataBuffer.String())
+}
+
 func (s GithubRestFileUploadAdaptor) Purge(m *EntityManager, entities ...map[string]interface{}) error {
+	for _, ent := range entities {
+		params := repo.CommitParams{
+			Repo:     s.Config.Repo,
+			Branch:   s.Config.Branch,
+			Path:     s.Config.Path + "/" + fmt.Sprint(ent[m.Config.IdKey]) + ".json",
+			UserName: s.Config.UserName,
+		}
+		if err := repo.DeleteRestOptimized(s.Config.Client, &params); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -1205,12 +1578,24 @@ func (a ResourceOrOwnerAuthorizationAdaptor) CanWrite(id string, m *EntityManage
 }
 
 func (a ResourceAuthorizationAdaptor) CanWrite(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Write, m)
+}
+
+func (a ResourceAuthorizationAdaptor) CanDelete(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Delete, m)
+}
+
+func (a ResourceAuthorizationAdaptor) CanRead(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Read, m)
+}
+
+func (a ResourceAuthorizationAdaptor) grantAccess(op gov.ResourceOperations, m *EntityManager) (bool, map[string]interface{}) {
 
 	grantAccessRequest := gov.GrantAccessRequest{
 		User:                a.Config.UserId,
 		Type:                gov.User,
 		Resource:            a.Config.Resource,
-		Operation:           gov.Write,
+		Operation:           op,
 		Asset:               a.Config.Asset,
 		AdditionalResources: *a.Config.AdditionalResources,
 		LogUsageLambdaInput: m.Config.LogUsageLambdaInput,
@@ -1240,12 +1625,24 @@ func (a ResourceAuthorizationAdaptor) CanWrite(id string, m *EntityManager) (boo
 }
 
 func (a ResourceAuthorizationEmbeddedAdaptor) CanWrite(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Write, m)
+}
+
+func (a ResourceAuthorizationEmbeddedAdaptor) CanDelete(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Delete, m)
+}
+
+func (a ResourceAuthorizationEmbeddedAdaptor) CanRead(id string, m *EntityManager) (bool, map[string]interface{}) {
+	return a.grantAccess(gov.Read, m)
+}
+
+func (a ResourceAuthorizationEmbeddedAdaptor) grantAccess(op gov.ResourceOperations, m *EntityManager) (bool, map[string]interface{}) {
 
 	grantAccessRequest := gov.GrantAccessRequest{
 		User:                a.Config.UserId,
 		Type:                gov.User,
 		Resource:            a.Config.Resource,
-		Operation:           gov.Write,
+		Operation:           op,
 		Asset:               a.Config.Asset,
 		AdditionalResources: *a.Config.AdditionalResources,
 		LogUsageLambdaInput: m.Config.LogUsageLambdaInput,
@@ -1376,6 +1773,20 @@ func (v ContractValidatorAdaptor) Validate(entity map[string]interface{}, m *Ent
 		}
 	}
 
+	// The version is stamped after validation so clients never have to send it back.
+	delete(entity, ContractVersionKey)
+
+	if v.Config.Enforcer != ContractEnforcerLambda {
+		valRes, err := enforceContract(entity, contract, file.GetSHA(), v.Config.UserId)
+		if err == nil {
+			err = m.enforceReferences(valRes, contract, file.GetSHA())
+		}
+		if err == nil {
+			stampContractVersion(valRes.Entity, contract)
+		}
+		return valRes, err
+	}
+
 	request := EnforceContractRequest{
 		EntityName:          m.Config.SingularName,
 		Entity:              entity,
@@ -1412,6 +1823,10 @@ func (v ContractValidatorAdaptor) Validate(entity map[string]interface{}, m *Ent
 	if contractRes.Valid {
 		log.Printf("Lambda Response valid contract")
 		valRes.Entity = contractRes.Entity
+		if err := m.enforceReferences(valRes, contract, file.GetSHA()); err != nil {
+			return valRes, err
+		}
+		stampContractVersion(valRes.Entity, contract)
 		return valRes, nil
 	}
 
@@ -1433,6 +1848,14 @@ func (c DefaultCreatorAdaptor) Create(entity map[string]interface{}, m *EntityMa
 		return res, errors.New("unauthorized to write entity.")
 	}
 
+	entity, fieldErrs, err := m.applyFields(entity, m.storedEntity(entity))
+	if err != nil || len(fieldErrs) != 0 {
+		res.Entity = entity
+		res.Success = false
+		res.Errors = fieldErrs
+		return res, err
+	}
+
 	validateRes, err := m.Validate("default", entity)
 
 	/*request := ValidateEntityRequest{
@@ -1491,7 +1914,11 @@ func (c DefaultCreatorAdaptor) Create(entity map[string]interface{}, m *EntityMa
 
 	if err == nil {
 		log.Printf("Entity passes validation")
-		m.Save(validateRes.Entity, c.Config.Save)
+		if err := m.Save(validateRes.Entity, c.Config.Save); err != nil {
+			res.Entity = entity
+			res.Success = false
+			return res, err
+		}
 		res.Entity = validateRes.Entity
 		res.Success = true
 		return res, nil
@@ -1568,6 +1995,14 @@ func (c DefaultUpdatorAdaptor) Update(entity map[string]interface{}, m *EntityMa
 		return res, errors.New("unauthorized to write to entity.")
 	}
 
+	entity, fieldErrs, err := m.applyFields(entity, m.storedEntity(entity))
+	if err != nil || len(fieldErrs) != 0 {
+		res.Entity = entity
+		res.Success = false
+		res.Errors = fieldErrs
+		return res, err
+	}
+
 	validateRes, err := m.Validate("default", entity)
 
 	/*request := ValidateEntityRequest{
@@ -1625,7 +2060,11 @@ func (c DefaultUpdatorAdaptor) Update(entity map[string]interface{}, m *EntityMa
 
 	if err == nil {
 		log.Printf("Entity passes validation")
-		m.Save(validateRes.Entity, c.Config.Save)
+		if err := m.Save(validateRes.Entity, c.Config.Save); err != nil {
+			res.Entity = entity
+			res.Success = false
+			return res, err
+		}
 		res.Entity = validateRes.Entity
 		res.Success = true
 		return res, nil
@@ -1784,7 +2223,8 @@ func (h GithubAfterSaveHooks) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput)
 				{"name": "gosite-%stage-SiteInit", "type": "lambda"},
 				{"name": "gosite-%stage-SiteEnvironment", "type": "lambda"},
 				{"name": "gosite-%stage-SiteWrite", "type": "lambda"},
-				{"name": "gosite-%stage-ParentWorkflow", "type": "statemachine"}  // Example for state machine
+				{"name": "gosite-%stage-ParentWorkflow", "type": "statemachine"},  // Example for state machine
+				{"name": "gosite-%stage-SiteIndex", "type": "lambda", "batch": true}  // Receives batch writes as one event
 			]
 		},
 		"id": "site",
@@ -1793,6 +2233,10 @@ func (h GithubAfterSaveHooks) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput)
 	}
 	*/
 
+	if input.Event == AfterSaveEventBatch {
+		return h.execAfterSaveBatchHooks(input)
+	}
+
 	entity := input.Entity
 	storage := input.Storage
 	oldEntity := input.OldEntity
@@ -1808,6 +2252,10 @@ func (h GithubAfterSaveHooks) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput)
 		Owner: pieces[0],
 		Repo: pieces[1],
 		OldEntity: oldEntity,
+		Event: input.Event,
+	}
+	if payload.Event == "" {
+		payload.Event = AfterSaveEventSave
 	}
 	payloadBytes, err := json.Marshal(payload) // Encode to JSON
 	if err != nil {
@@ -1815,8 +2263,91 @@ func (h GithubAfterSaveHooks) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput)
 		return err
 	}
 
+	return execContractHooks(&h.Config, "AfterSave", [][]byte{payloadBytes}, nil, false)
+}
+
+// Hooks flagged with "batch" receive the whole batch as one event, every other hook
+// receives a save event per entity like a regular write.
+func (h GithubAfterSaveHooks) execAfterSaveBatchHooks(input *ExecAfterSaveHooksInput) error {
+	pieces := strings.Split(h.Config.Repo, "/")
+	batchPayload := AfterSaveExecEntityRequest{
+		Storage: input.Storage,
+		Stage:   h.Config.Stage,
+		Contract: h.Config.Contract,
+		Owner: pieces[0],
+		Repo: pieces[1],
+		Event: AfterSaveEventBatch,
+		Entities: input.Entities,
+		OldEntities: input.OldEntities,
+	}
+	batchPayloadBytes, err := json.Marshal(batchPayload)
+	if err != nil {
+		log.Printf("Error marshalling batch AfterSaveExecEntityRequest: %s", err.Error())
+		return err
+	}
+	payloads := make([][]byte, len(input.Entities))
+	for i, ent := range input.Entities {
+		payload := batchPayload
+		payload.Event = AfterSaveEventSave
+		payload.Entities = nil
+		payload.OldEntities = nil
+		payload.Entity = ent
+		if i < len(input.OldEntities) {
+			payload.OldEntity = input.OldEntities[i]
+		}
+		if payloads[i], err = json.Marshal(payload); err != nil {
+			log.Printf("Error marshalling AfterSaveExecEntityRequest: %s", err.Error())
+			return err
+		}
+	}
+	return execContractHooks(&h.Config, "AfterSave", payloads, batchPayloadBytes, false)
+}
+
+func (h GithubBeforeDeleteHooks) ExecBeforeDeleteHooks(input *ExecDeleteHooksInput) error {
+	payloadBytes, err := githubDeleteHooksPayload(&h.Config, input)
+	if err != nil {
+		return err
+	}
+	// Before delete hooks run to completion so a failing lambda can veto the delete.
+	return execContractHooks(&h.Config, "BeforeDelete", [][]byte{payloadBytes}, nil, true)
+}
+
+func (h GithubAfterDeleteHooks) ExecAfterDeleteHooks(input *ExecDeleteHooksInput) error {
+	payloadBytes, err := githubDeleteHooksPayload(&h.Config, input)
+	if err != nil {
+		return err
+	}
+	return execContractHooks(&h.Config, "AfterDelete", [][]byte{payloadBytes}, nil, false)
+}
+
+// Delete hooks receive the same payload as save hooks with the delete event.
+func githubDeleteHooksPayload(c *GithubHooksConfig, input *ExecDeleteHooksInput) ([]byte, error) {
+	pieces := strings.Split(c.Repo, "/")
+	payload := AfterSaveExecEntityRequest{
+		Storage: input.Storage,
+		Entity:  input.Entity,
+		Stage:   c.Stage,
+		Contract: c.Contract,
+		Owner: pieces[0],
+		Repo: pieces[1],
+		OldEntity: input.Entity,
+		Event: AfterSaveEventDelete,
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling delete hooks request: %s", err.Error())
+		return nil, err
+	}
+	return payloadBytes, nil
+}
+
+// execContractHooks runs the hooks the contract lists under name once per payload, or once
+// with batchPayload for hooks flagged "batch" when one is given. Hooks run in the
+// background unless wait is set, in which case the first failure is returned.
+func execContractHooks(c *GithubHooksConfig, name string, payloads [][]byte, batchPayload []byte, wait bool) error {
+
 	// Fetch the contract
-	contract, err := GithubSaveHooksHelperContract(&h.Config)
+	contract, err := GithubSaveHooksHelperContract(c)
 	if err != nil {
 		log.Printf("Error fetching contract: %v", err)
 		return err
@@ -1828,86 +2359,104 @@ func (h GithubAfterSaveHooks) ExecAfterSaveHooks(input *ExecAfterSaveHooksInput)
 		return nil
 	}
 
-	// Check if the contract contains AfterSave hooks
-	afterSaveHooks, ok := contract["hooks"].(map[string]interface{})["AfterSave"].([]interface{})
+	// Check if the contract contains hooks for the event
+	contractHooks, ok := contract["hooks"].(map[string]interface{})[name].([]interface{})
 	if !ok {
-		log.Println("No AfterSave hooks found in contract")
+		log.Printf("No %s hooks found in contract", name)
 		return nil
 	}
 
-	// Iterate through each AfterSave hook in the contract
-	for _, rawHook := range afterSaveHooks {
-		hook, ok := rawHook.(map[string]interface{})
-		if !ok {
-			log.Printf("Invalid hook format: %v", rawHook)
-			continue
-		}
+	runHook := func(localHookName string, localHookType string, localPayloadBytes []byte) error {
+		switch localHookType  {
+		case "lambda":
+			log.Print("Starting execution of a lambda hook")
 
-		// Replace %stage with Config.Stage in the hook name
-		rawHookName := fmt.Sprint(hook["name"])
-		hookName := strings.Replace(rawHookName, "%stage", h.Config.Stage, -1)
-		hookType := fmt.Sprint(hook["type"])
+			// Invoke Lambda function
+			res, err := c.Lambda.Invoke(&lambda.InvokeInput{
+				FunctionName: aws.String(localHookName),
+				Payload:      localPayloadBytes, // Use the JSON-encoded bytes
+			})
 
-		log.Printf("Executing AfterSave hook: name=%s, type=%s", hookName, hookType)
+			if err != nil {
+				log.Printf("Error invoking Lambda function %s: %v", localHookName, err)
+				return err
+			}
+			if res.FunctionError != nil {
+				log.Printf("Lambda hook %s failed: %s", localHookName, string(res.Payload))
+				return fmt.Errorf("%s hook %s failed: %s", name, localHookName, string(res.Payload))
+			}
 
-		// Execute the hook in a separate goroutine
-		go func(localHookName string, localHookType string, localPayloadBytes []byte) {
-			switch localHookType  {
-			case "lambda":
-				log.Print("Starting execution of a lambda hook")
+			log.Printf("Successfully invoked Lambda hook: %s", localHookName)
 
-				// Invoke Lambda function
-				_, err = h.Config.Lambda.Invoke(&lambda.InvokeInput{
-					FunctionName: aws.String(localHookName),
-					Payload:      localPayloadBytes, // Use the JSON-encoded bytes
-				})
+		case "statemachine":
 
-				if err != nil {
-					log.Printf("Error invoking Lambda function %s: %v", localHookName, err)
-					return
-				}
+			if c.Step == nil {
+				log.Printf("State Machine client is nil, cannot start State Machine: %s", localHookName)
+				return fmt.Errorf("state machine client is nil, cannot start %s", localHookName)
+			}
 
-				log.Printf("Successfully invoked Lambda hook: %s", localHookName)
-				break
+			log.Print("Starting execution of a statemachine hook 1")
+			log.Printf(string(localPayloadBytes))
 
-			case "statemachine":
+			stepInput := &sfn.StartExecutionInput{
+				StateMachineArn: aws.String(localHookName), // Expect the hookName to represent a State Machine ARN
+				Input:           aws.String(string(localPayloadBytes)),
+			}
 
-				if h.Config.Step == nil {
-					log.Printf("State Machine client is nil, cannot start State Machine: %s", localHookName)
-					return
-				}
+			log.Print("Starting execution of a statemachine hook 2")
 
-				log.Print("Starting execution of a statemachine hook 1")
-				log.Printf(string(localPayloadBytes))
+			// Start execution of the state machine
+			_, err := c.Step.StartExecution(stepInput)
 
-				stepInput := &sfn.StartExecutionInput{
-					StateMachineArn: aws.String(localHookName), // Expect the hookName to represent a State Machine ARN
-					Input:           aws.String(string(localPayloadBytes)),
-				}
+			log.Print("Starting execution of a statemachine hook 3")
+			if err != nil {
+				log.Printf("Error starting State Machine %s: %v", localHookName, err)
+				return err
+			}
 
-				log.Print("Starting execution of a statemachine hook 2")
+			log.Printf("Successfully started State Machine: %s", localHookName)
 
-				// Start execution of the state machine
-				_, err = h.Config.Step.StartExecution(stepInput)
+		default:
+			log.Printf("Unsupported hook type: %s (hook name: %s)", localHookType, localHookName)
+		}
+		return nil
+	}
 
-				log.Print("Starting execution of a statemachine hook 3")
-				if err != nil {
-					log.Printf("Error starting State Machine %s: %v", localHookName, err)
-					return
-				}
+	// Iterate through each hook in the contract
+	for _, rawHook := range contractHooks {
+		hook, ok := rawHook.(map[string]interface{})
+		if !ok {
+			log.Printf("Invalid hook format: %v", rawHook)
+			continue
+		}
 
-				log.Printf("Successfully started State Machine: %s", localHookName)
-				break
+		// Replace %stage with Config.Stage in the hook name
+		rawHookName := fmt.Sprint(hook["name"])
+		hookName := strings.Replace(rawHookName, "%stage", c.Stage, -1)
+		hookType := fmt.Sprint(hook["type"])
 
-			default:
-				log.Printf("Unsupported hook type: %s (hook name: %s)", localHookType, localHookName)
+		log.Printf("Executing %s hook: name=%s, type=%s", name, hookName, hookType)
+
+		hookPayloads := payloads
+		if batch, _ := hook["batch"].(bool); batch && batchPayload != nil {
+			hookPayloads = [][]byte{batchPayload}
+		}
+
+		for _, payloadBytes := range hookPayloads {
+			if wait {
+				if err := runHook(hookName, hookType, payloadBytes); err != nil {
+					return err
+				}
+				continue
 			}
-		}(hookName, hookType, payloadBytes) // Pass hookName and hookType as arguments to ensure goroutine safety
+
+			// Execute the hook in a separate goroutine
+			go runHook(hookName, hookType, payloadBytes) // Pass hookName and hookType as arguments to ensure goroutine safety
+		}
 	}
 
 	return nil
 }
-
 func GithubSaveHooksHelperContract(c *GithubHooksConfig) (map[string]interface{}, error) {
 
 	var contract map[string]interface{}
@@ -2313,6 +2862,10 @@ func NewDefaultManager(config DefaultManagerConfig) EntityManager {
 		Contract: config.Contract,
 		Stage: config.Stage,
 	}
+	fields := &GithubContractFields{
+		Config: githubConfig,
+		UserId: config.UserId,
+	}
 	return EntityManager{
 		Config: EntityConfig{
 			SingularName:        config.SingularName,
@@ -2395,8 +2948,21 @@ func NewDefaultManager(config DefaultManagerConfig) EntityManager {
 		AfterSaveHooks: GithubAfterSaveHooks {
 			Config: githubConfig,
 		},
+		BeforeDeleteHooks: GithubBeforeDeleteHooks {
+			Config: githubConfig,
+		},
+		AfterDeleteHooks: GithubAfterDeleteHooks {
+			Config: githubConfig,
+		},
 		Authorizers: map[string]Authorization{},
 		Hooks: map[Hooks]EntityHook{},
+		Versioning: &EntityVersioning{},
+		Migrator: &GithubContractMigrator{
+			Config: githubConfig,
+		},
+		References: config.References,
+		Fields: fields,
+		Encryption: NewFieldEncryption(config.Keys, fields.Schema),
 	}
 }
 
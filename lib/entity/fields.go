@@ -0,0 +1,638 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"goclassifieds/lib/utils"
+)
+
+// Contracts declare the bookkeeping fields of an entity type so it needs no Go code:
+//
+//	"status":    {"type": "string", "x-default": "draft", "x-readOnly": true}
+//	"createdAt": {"type": "string", "x-default": "now", "x-immutable": true}
+//	"ownerId":   {"type": "string", "x-default": "userId", "x-immutable": true}
+//	"slug":      {"type": "string", "x-computed": "slug(title)"}
+//	"total":     {"type": "number", "x-computed": "price * quantity"}
+//
+// When an entity is created or updated, before validation and in this order:
+//   - x-readOnly values sent by the client are dropped, updates keep the stored value.
+//   - x-immutable values can be set once, changing a stored value fails validation and
+//     leaving it out keeps it.
+//   - x-default fills absent values. "now", "uuid" and "userId" are generated.
+//   - x-computed sets the value from an expression over the members of the object
+//     holding it. Expressions support + - * / % and parentheses, "strings", numbers,
+//     true, false, null, dotted member paths and slug, lower, upper, trim, round and
+//     coalesce. + concatenates when either side is a string.
+
+const (
+	DefaultKeyword   = "x-default"
+	ComputedKeyword  = "x-computed"
+	ReadOnlyKeyword  = "x-readOnly"
+	ImmutableKeyword = "x-immutable"
+)
+
+// ContractFields applies the field annotations of a contract to an entity about to be
+// validated. stored loads the entity being replaced, nil when there is none.
+type ContractFields interface {
+	Apply(entity map[string]interface{}, stored func() map[string]interface{}, m *EntityManager) (map[string]interface{}, []map[string]interface{}, error)
+}
+
+// GithubContractFields reads the schema of the contract the manager validates against,
+// once per manager.
+type GithubContractFields struct {
+	Config GithubHooksConfig
+	UserId string
+	once   sync.Once
+	schema *ContractSchema
+	err    error
+}
+
+func (g *GithubContractFields) Apply(entity map[string]interface{}, stored func() map[string]interface{}, m *EntityManager) (map[string]interface{}, []map[string]interface{}, error) {
+	schema, err := g.Schema()
+	if err != nil {
+		return entity, nil, err
+	}
+	return ApplyFieldAnnotations(schema, entity, stored, g.UserId, time.Now())
+}
+
+// Schema is the compiled schema of the contract, nil without a contract or schema.
+func (g *GithubContractFields) Schema() (*ContractSchema, error) {
+	if g.Config.GithubClient == nil || g.Config.Contract == "" {
+		return nil, nil
+	}
+	g.once.Do(func() {
+		contract, err := GithubSaveHooksHelperContract(&g.Config)
+		if err != nil {
+			g.err = err
+			return
+		}
+		if raw, ok := contract["schema"]; ok {
+			g.schema, g.err = CompileSchema(raw)
+		}
+	})
+	if g.err != nil {
+		return nil, fmt.Errorf("Invalid contract schema: %w", g.err)
+	}
+	return g.schema, nil
+}
+
+// ApplyFieldAnnotations applies x-readOnly, x-immutable, x-default and x-computed to a
+// copy of the entity. Immutable values that changed are returned as validation errors.
+func ApplyFieldAnnotations(schema *ContractSchema, entity map[string]interface{}, stored func() map[string]interface{}, userId string, now time.Time) (map[string]interface{}, []map[string]interface{}, error) {
+	if schema == nil || entity == nil {
+		return entity, nil, nil
+	}
+	needsStored := schema.Declares(ReadOnlyKeyword) || schema.Declares(ImmutableKeyword)
+	if !needsStored && !schema.Declares(DefaultKeyword) && !schema.Declares(ComputedKeyword) {
+		return entity, nil, nil
+	}
+	copied, err := copyDocument(entity)
+	if err != nil {
+		return entity, nil, err
+	}
+	doc := copied.(map[string]interface{})
+
+	var old interface{}
+	if needsStored && stored != nil {
+		if storedEntity := stored(); storedEntity != nil {
+			if old, err = copyDocument(storedEntity); err != nil {
+				return entity, nil, err
+			}
+		}
+	}
+	storedValue := func(tokens []string) (interface{}, bool) {
+		if old == nil {
+			return nil, false
+		}
+		value, err := pointerGet(old, tokens)
+		return value, err == nil
+	}
+
+	// Removing from the last path back keeps array indexes valid.
+	readOnly := flagged(schema.Annotations(ReadOnlyKeyword, doc))
+	sort.Slice(readOnly, func(i, j int) bool { return comparePointers(readOnly[i].InstancePath, readOnly[j].InstancePath) > 0 })
+	for _, a := range readOnly {
+		tokens := mustParsePointer(a.InstancePath)
+		if len(tokens) == 0 {
+			continue
+		}
+		if value, ok := storedValue(tokens); ok {
+			fieldSet(doc, tokens, value)
+		} else if a.Present {
+			pointerRemove(doc, tokens)
+		}
+	}
+
+	var errs []map[string]interface{}
+	for _, a := range flagged(schema.Annotations(ImmutableKeyword, doc)) {
+		tokens := mustParsePointer(a.InstancePath)
+		value, ok := storedValue(tokens)
+		if !ok || len(tokens) == 0 {
+			continue
+		}
+		if !a.Present {
+			fieldSet(doc, tokens, value)
+			continue
+		}
+		if current, _ := pointerGet(doc, tokens); !schemaEqual(current, value) {
+			errs = append(errs, SchemaError{
+				InstancePath: a.InstancePath,
+				SchemaPath:   a.SchemaPath,
+				Keyword:      ImmutableKeyword,
+				Message:      "must NOT be changed",
+			}.Map())
+		}
+	}
+	if len(errs) != 0 {
+		return entity, errs, nil
+	}
+
+	for _, a := range schema.Annotations(DefaultKeyword, doc) {
+		if a.Present {
+			continue
+		}
+		value, err := defaultFieldValue(a.Value, userId, now)
+		if err != nil {
+			return entity, nil, err
+		}
+		fieldSet(doc, mustParsePointer(a.InstancePath), value)
+	}
+
+	for _, a := range schema.Annotations(ComputedKeyword, doc) {
+		tokens := mustParsePointer(a.InstancePath)
+		if len(tokens) == 0 {
+			continue
+		}
+		expression, ok := a.Value.(string)
+		if !ok {
+			return entity, nil, fmt.Errorf("%s at %s must be an expression", ComputedKeyword, a.SchemaPath)
+		}
+		scope, _ := pointerGet(doc, tokens[:len(tokens)-1])
+		value, err := EvalFieldExpression(expression, scope)
+		if err != nil {
+			return entity, nil, fmt.Errorf("%s at %s: %w", ComputedKeyword, a.SchemaPath, err)
+		}
+		if value == nil {
+			if a.Present {
+				pointerRemove(doc, tokens)
+			}
+			continue
+		}
+		fieldSet(doc, tokens, value)
+	}
+
+	return doc, nil, nil
+}
+
+// flagged keeps the annotations switched on with true.
+func flagged(annotations []SchemaAnnotation) []SchemaAnnotation {
+	on := make([]SchemaAnnotation, 0, len(annotations))
+	for _, a := range annotations {
+		if b, ok := a.Value.(bool); ok && b {
+			on = append(on, a)
+		}
+	}
+	return on
+}
+
+// fieldSet sets a member of an object or item of an array that already holds it.
+func fieldSet(doc interface{}, tokens []string, value interface{}) {
+	if len(tokens) == 0 {
+		return
+	}
+	parent, err := pointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return
+	}
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[last] = value
+	case []interface{}:
+		if i, err := arrayIndex(last, len(p), false); err == nil {
+			p[i] = value
+		}
+	}
+}
+
+func defaultFieldValue(value interface{}, userId string, now time.Time) (interface{}, error) {
+	switch value {
+	case "now":
+		return now.UTC().Format(time.RFC3339), nil
+	case "uuid":
+		return utils.GenerateId(), nil
+	case "userId":
+		return userId, nil
+	}
+	// Literals are copied so entities never share objects or arrays of the contract.
+	return copyDocument(value)
+}
+
+// applyFields runs the contract field annotations of the manager, if any.
+func (m EntityManager) applyFields(entity map[string]interface{}, stored func() map[string]interface{}) (map[string]interface{}, []map[string]interface{}, error) {
+	if m.Fields == nil {
+		return entity, nil, nil
+	}
+	applied, errs, err := m.Fields.Apply(entity, stored, &m)
+	if err != nil {
+		log.Printf("Unable to apply contract fields: %s", err.Error())
+	}
+	return applied, errs, err
+}
+
+// storedEntity loads the entity an entity replaces when it is asked for.
+func (m EntityManager) storedEntity(entity map[string]interface{}) func() map[string]interface{} {
+	return func() map[string]interface{} {
+		id, ok := entity[m.Config.IdKey].(string)
+		if !ok || id == "" {
+			return nil
+		}
+		return m.Load(id, "default")
+	}
+}
+
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// EvalFieldExpression evaluates an x-computed expression with member paths resolved
+// against scope. Operations on missing (null) values result in null.
+func EvalFieldExpression(expression string, scope interface{}) (interface{}, error) {
+	p := &expressionParser{src: expression}
+	p.next()
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("%w: unexpected %q in %q", ErrInvalidExpression, p.tok.text, expression)
+	}
+	return node.eval(scope)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type expressionToken struct {
+	kind tokenKind
+	text string
+	num  float64
+}
+
+type expressionParser struct {
+	src string
+	pos int
+	tok expressionToken
+	err error
+}
+
+func (p *expressionParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = expressionToken{kind: tokEOF}
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil && p.err == nil {
+			p.err = fmt.Errorf("%w: bad number %q", ErrInvalidExpression, p.src[start:p.pos])
+		}
+		p.tok = expressionToken{kind: tokNumber, text: p.src[start:p.pos], num: n}
+	case c == '"' || c == '\'':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.src) && p.src[p.pos] != c {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			b.WriteByte(p.src[p.pos])
+			p.pos++
+		}
+		if p.pos >= len(p.src) && p.err == nil {
+			p.err = fmt.Errorf("%w: unterminated string", ErrInvalidExpression)
+		}
+		p.pos++
+		p.tok = expressionToken{kind: tokString, text: b.String()}
+	case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) {
+			r := rune(p.src[p.pos])
+			if r != '_' && r != '$' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			p.pos++
+		}
+		p.tok = expressionToken{kind: tokIdent, text: p.src[start:p.pos]}
+	default:
+		p.pos++
+		p.tok = expressionToken{kind: tokOp, text: string(c)}
+	}
+}
+
+type expressionNode interface {
+	eval(scope interface{}) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type memberNode struct{ path []string }
+
+type unaryNode struct{ operand expressionNode }
+
+type binaryNode struct {
+	op          string
+	left, right expressionNode
+}
+
+type callNode struct {
+	name string
+	args []expressionNode
+}
+
+func (p *expressionParser) parseSum() (expressionNode, error) {
+	left, err := p.parseProduct()
+	for err == nil && p.tok.kind == tokOp && (p.tok.text == "+" || p.tok.text == "-") {
+		op := p.tok.text
+		p.next()
+		var right expressionNode
+		if right, err = p.parseProduct(); err == nil {
+			left = binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseProduct() (expressionNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.tok.kind == tokOp && (p.tok.text == "*" || p.tok.text == "/" || p.tok.text == "%") {
+		op := p.tok.text
+		p.next()
+		var right expressionNode
+		if right, err = p.parseUnary(); err == nil {
+			left = binaryNode{op: op, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	if p.tok.kind == tokOp && p.tok.text == "-" {
+		p.next()
+		operand, err := p.parseUnary()
+		return unaryNode{operand: operand}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		return literalNode{tok.num}, nil
+	case tokString:
+		p.next()
+		return literalNode{tok.text}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		if p.tok.kind != tokOp || p.tok.text != "(" {
+			return memberNode{path: strings.Split(tok.text, ".")}, nil
+		}
+		if _, ok := expressionFuncs[tok.text]; !ok {
+			return nil, fmt.Errorf("%w: unknown function %s", ErrInvalidExpression, tok.text)
+		}
+		p.next()
+		call := callNode{name: tok.text}
+		for !(p.tok.kind == tokOp && p.tok.text == ")") {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.tok.kind == tokOp && p.tok.text == "," {
+				p.next()
+			} else if !(p.tok.kind == tokOp && p.tok.text == ")") {
+				return nil, fmt.Errorf("%w: expected , or ) after argument of %s", ErrInvalidExpression, tok.text)
+			}
+		}
+		p.next()
+		return call, nil
+	case tokOp:
+		if tok.text == "(" {
+			p.next()
+			node, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokOp || p.tok.text != ")" {
+				return nil, fmt.Errorf("%w: missing )", ErrInvalidExpression)
+			}
+			p.next()
+			return node, nil
+		}
+	}
+	if tok.kind == tokEOF {
+		return nil, fmt.Errorf("%w: unexpected end", ErrInvalidExpression)
+	}
+	return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, tok.text)
+}
+
+func (n literalNode) eval(scope interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n memberNode) eval(scope interface{}) (interface{}, error) {
+	value := scope
+	for _, name := range n.path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		value = obj[name]
+	}
+	return value, nil
+}
+
+func (n unaryNode) eval(scope interface{}) (interface{}, error) {
+	v, err := n.operand.eval(scope)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %v", v)
+	}
+	return -f, nil
+}
+
+func (n binaryNode) eval(scope interface{}) (interface{}, error) {
+	left, err := n.left.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "+" {
+		_, leftString := left.(string)
+		_, rightString := right.(string)
+		if leftString || rightString {
+			return expressionString(left) + expressionString(right), nil
+		}
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+func (n callNode) eval(scope interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return expressionFuncs[n.name](args)
+}
+
+// expressionString formats a value for concatenation, null is empty.
+func expressionString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	default:
+		return fmt.Sprint(s)
+	}
+}
+
+func stringFunc(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expects one argument")
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		return f(expressionString(args[0])), nil
+	}
+}
+
+var expressionFuncs map[string]func(args []interface{}) (interface{}, error)
+
+func init() {
+	expressionFuncs = map[string]func(args []interface{}) (interface{}, error){
+		"slug":  stringFunc(Slugify),
+		"lower": stringFunc(strings.ToLower),
+		"upper": stringFunc(strings.ToUpper),
+		"trim":  stringFunc(strings.TrimSpace),
+		"round": func(args []interface{}) (interface{}, error) {
+			if len(args) == 0 || len(args) > 2 {
+				return nil, errors.New("round expects a number and optional digits")
+			}
+			if args[0] == nil {
+				return nil, nil
+			}
+			f, ok := args[0].(float64)
+			if !ok {
+				return nil, fmt.Errorf("cannot round %v", args[0])
+			}
+			scale := 1.0
+			if len(args) == 2 {
+				digits, ok := args[1].(float64)
+				if !ok {
+					return nil, fmt.Errorf("round digits must be a number")
+				}
+				scale = math.Pow(10, digits)
+			}
+			return math.Round(f*scale) / scale, nil
+		},
+		"coalesce": func(args []interface{}) (interface{}, error) {
+			for _, arg := range args {
+				if arg != nil && arg != "" {
+					return arg, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+}
+
+// Slugify lower cases text and joins its runs of letters and digits with dashes.
+func Slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() != 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,529 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Contracts have a version (1 when missing) and list the migrations that upgrade
+// entities written against an older version:
+//
+//	{
+//		"version": 3,
+//		"migrations": [
+//			{"version": 2, "steps": [{"op": "rename", "from": "title", "to": "name"}]},
+//			{"version": 3, "steps": [
+//				{"op": "split", "from": "name", "fields": ["firstName", "lastName"], "separator": " "},
+//				{"op": "default", "path": "/address/country", "value": "US"},
+//				{"op": "convert", "path": "price", "type": "number"},
+//				{"op": "hook", "name": "normalizePhone"}
+//			]}
+//		]
+//	}
+//
+// Entities carry the version they were written against in _contractVersion. Older
+// entities are upgraded when they are loaded and saved upgraded on their next write.
+// Fields are top level names or JSON pointers.
+
+const ContractVersionKey = "_contractVersion"
+
+var (
+	ErrMigrationFailed    = errors.New("entity migration failed")
+	ErrMigrationEncrypted = errors.New("migration targets encrypted fields")
+)
+
+// MigrationHook is a migration step written in Go, referenced from contracts by the
+// name it was registered under.
+type MigrationHook func(entity map[string]interface{}) (map[string]interface{}, error)
+
+var migrationHooks = struct {
+	sync.RWMutex
+	byName map[string]MigrationHook
+}{byName: make(map[string]MigrationHook)}
+
+// RegisterMigrationHook makes a hook available to the "hook" migration step.
+func RegisterMigrationHook(name string, hook MigrationHook) {
+	migrationHooks.Lock()
+	defer migrationHooks.Unlock()
+	migrationHooks.byName[name] = hook
+}
+
+type MigrationStep struct {
+	Op        string      `json:"op"` // rename, default, split, merge, convert, remove or hook
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Path      string      `json:"path,omitempty"`
+	Fields    []string    `json:"fields,omitempty"` // split targets or merge sources
+	Separator *string     `json:"separator,omitempty"`
+	Type      string      `json:"type,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+	Name      string      `json:"name,omitempty"`
+}
+
+// ContractMigration upgrades entities from Version-1 to Version.
+type ContractMigration struct {
+	Version int             `json:"version"`
+	Steps   []MigrationStep `json:"steps"`
+}
+
+type ContractMigrations struct {
+	Version    int
+	Migrations []ContractMigration
+}
+
+// Migrator upgrades entities written against older contract versions.
+type Migrator interface {
+	Migrate(entity map[string]interface{}, m *EntityManager) (map[string]interface{}, error)
+}
+
+// ParseContractMigrations reads the version and migrations of a contract.
+func ParseContractMigrations(contract map[string]interface{}) (*ContractMigrations, error) {
+	c := &ContractMigrations{Version: 1}
+	if v, ok := contract["version"]; ok {
+		version, ok := migrationVersion(v)
+		if !ok || version < 1 {
+			return nil, fmt.Errorf("%w: contract version must be a positive integer", ErrMigrationFailed)
+		}
+		c.Version = version
+	}
+	raw, ok := contract["migrations"]
+	if !ok {
+		return c, nil
+	}
+	// Round trip through JSON so the steps decode into their struct.
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.Migrations); err != nil {
+		return nil, fmt.Errorf("%w: invalid migrations: %v", ErrMigrationFailed, err)
+	}
+	sort.Slice(c.Migrations, func(i, j int) bool { return c.Migrations[i].Version < c.Migrations[j].Version })
+	for i, migration := range c.Migrations {
+		if migration.Version < 2 || migration.Version > c.Version {
+			return nil, fmt.Errorf("%w: migration version %d is outside 2..%d", ErrMigrationFailed, migration.Version, c.Version)
+		}
+		if i > 0 && c.Migrations[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("%w: duplicate migration version %d", ErrMigrationFailed, migration.Version)
+		}
+		for _, step := range migration.Steps {
+			if err := checkMigrationStep(step); err != nil {
+				return nil, fmt.Errorf("%w: version %d: %v", ErrMigrationFailed, migration.Version, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+// ContractVersion is the contract version an entity was written against.
+func ContractVersion(entity map[string]interface{}) int {
+	if version, ok := migrationVersion(entity[ContractVersionKey]); ok {
+		return version
+	}
+	return 1
+}
+
+func migrationVersion(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, false
+		}
+		return int(n), true
+	case int:
+		return n, true
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// Migrate upgrades a copy of the entity to the current contract version. The entity is
+// returned as is when it is already current.
+func (c *ContractMigrations) Migrate(entity map[string]interface{}) (map[string]interface{}, bool, error) {
+	from := ContractVersion(entity)
+	if from >= c.Version {
+		return entity, false, nil
+	}
+	doc, err := copyDocument(entity)
+	if err != nil {
+		return entity, false, err
+	}
+	migrated := doc.(map[string]interface{})
+	for _, migration := range c.Migrations {
+		if migration.Version <= from {
+			continue
+		}
+		for i, step := range migration.Steps {
+			if migrated, err = applyMigrationStep(migrated, step); err != nil {
+				return entity, false, fmt.Errorf("%w: version %d step %d (%s): %v", ErrMigrationFailed, migration.Version, i, step.Op, err)
+			}
+		}
+	}
+	migrated[ContractVersionKey] = c.Version
+	return migrated, true, nil
+}
+
+// MigrateStored is Migrate for entities read straight from storage, where x-encrypted
+// values are still sealed. Steps reading a sealed value (split, merge, convert and hooks)
+// would corrupt it and are rejected. Renames may move sealed values, but the upgraded
+// entity must hold them at fields the schema encrypts and must not hold plaintext there.
+func (c *ContractMigrations) MigrateStored(schema *ContractSchema, entity map[string]interface{}) (map[string]interface{}, bool, error) {
+	from := ContractVersion(entity)
+	for _, migration := range c.Migrations {
+		if migration.Version <= from {
+			continue
+		}
+		for i, step := range migration.Steps {
+			var read []string
+			switch step.Op {
+			case "hook":
+				if containsEncrypted(entity) {
+					return entity, false, fmt.Errorf("%w: version %d step %d (%s) on an entity with encrypted values", ErrMigrationEncrypted, migration.Version, i, step.Op)
+				}
+			case "split":
+				read = []string{step.From}
+			case "merge":
+				read = step.Fields
+			case "convert":
+				read = []string{step.Path}
+			}
+			for _, field := range read {
+				if value, ok := migrationGet(entity, field); ok && containsEncrypted(value) {
+					return entity, false, fmt.Errorf("%w: version %d step %d (%s) reads %s", ErrMigrationEncrypted, migration.Version, i, step.Op, field)
+				}
+			}
+		}
+	}
+
+	migrated, changed, err := c.Migrate(entity)
+	if err != nil || !changed {
+		return migrated, changed, err
+	}
+	encrypted := make(map[string]bool)
+	if schema != nil && schema.Declares(EncryptedKeyword) {
+		for _, a := range flagged(schema.Annotations(EncryptedKeyword, migrated)) {
+			if !a.Present || a.InstancePath == "" {
+				continue
+			}
+			encrypted[a.InstancePath] = true
+			value, err := pointerGet(migrated, mustParsePointer(a.InstancePath))
+			if err == nil && value != nil && !IsEncryptedValue(value) {
+				return entity, false, fmt.Errorf("%w: %s would be stored unencrypted", ErrMigrationEncrypted, a.InstancePath)
+			}
+		}
+	}
+	for _, p := range sealedPaths(migrated, "") {
+		if !encrypted[p] {
+			return entity, false, fmt.Errorf("%w: %s holds an encrypted value the schema does not encrypt", ErrMigrationEncrypted, p)
+		}
+	}
+	return migrated, true, nil
+}
+
+// sealedPaths are the instance paths of the x-encrypted envelopes within a value.
+func sealedPaths(value interface{}, path string) []string {
+	if IsEncryptedValue(value) {
+		return []string{path}
+	}
+	var paths []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			paths = append(paths, sealedPaths(item, path+"/"+escapePointerToken(key))...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			paths = append(paths, sealedPaths(item, path+"/"+strconv.Itoa(i))...)
+		}
+	}
+	return paths
+}
+
+func checkMigrationStep(step MigrationStep) error {
+	switch step.Op {
+	case "rename":
+		if step.From == "" || step.To == "" {
+			return errors.New("rename needs from and to")
+		}
+	case "default", "remove":
+		if step.Path == "" {
+			return fmt.Errorf("%s needs path", step.Op)
+		}
+	case "split":
+		if step.From == "" || len(step.Fields) == 0 {
+			return errors.New("split needs from and fields")
+		}
+	case "merge":
+		if step.To == "" || len(step.Fields) == 0 {
+			return errors.New("merge needs fields and to")
+		}
+	case "convert":
+		if step.Path == "" || step.Type == "" {
+			return errors.New("convert needs path and type")
+		}
+	case "hook":
+		if step.Name == "" {
+			return errors.New("hook needs name")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", step.Op)
+	}
+	return nil
+}
+
+func applyMigrationStep(entity map[string]interface{}, step MigrationStep) (map[string]interface{}, error) {
+	separator := " "
+	if step.Separator != nil {
+		separator = *step.Separator
+	}
+	switch step.Op {
+	case "rename":
+		value, ok := migrationGet(entity, step.From)
+		if !ok {
+			return entity, nil
+		}
+		migrationRemove(entity, step.From)
+		return entity, migrationSet(entity, step.To, value)
+	case "default":
+		if _, ok := migrationGet(entity, step.Path); ok {
+			return entity, nil
+		}
+		value, err := copyDocument(step.Value)
+		if err != nil {
+			return nil, err
+		}
+		return entity, migrationSet(entity, step.Path, value)
+	case "remove":
+		migrationRemove(entity, step.Path)
+		return entity, nil
+	case "split":
+		value, ok := migrationGet(entity, step.From)
+		if !ok || value == nil {
+			return entity, nil
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a string", step.From)
+		}
+		parts := strings.SplitN(s, separator, len(step.Fields))
+		migrationRemove(entity, step.From)
+		for i, field := range step.Fields {
+			part := ""
+			if i < len(parts) {
+				part = parts[i]
+			}
+			if err := migrationSet(entity, field, part); err != nil {
+				return nil, err
+			}
+		}
+		return entity, nil
+	case "merge":
+		var parts []string
+		for _, field := range step.Fields {
+			value, ok := migrationGet(entity, field)
+			if !ok || value == nil {
+				continue
+			}
+			parts = append(parts, fmt.Sprint(value))
+			migrationRemove(entity, field)
+		}
+		if len(parts) == 0 {
+			return entity, nil
+		}
+		return entity, migrationSet(entity, step.To, strings.Join(parts, separator))
+	case "convert":
+		value, ok := migrationGet(entity, step.Path)
+		if !ok || value == nil {
+			return entity, nil
+		}
+		converted, err := convertMigrationValue(value, step.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Path, err)
+		}
+		return entity, migrationSet(entity, step.Path, converted)
+	case "hook":
+		migrationHooks.RLock()
+		hook, ok := migrationHooks.byName[step.Name]
+		migrationHooks.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("migration hook %s is not registered", step.Name)
+		}
+		migrated, err := hook(entity)
+		if err == nil && migrated == nil {
+			err = fmt.Errorf("migration hook %s returned no entity", step.Name)
+		}
+		return migrated, err
+	}
+	return nil, fmt.Errorf("unknown op %q", step.Op)
+}
+
+func convertMigrationValue(value interface{}, to string) (interface{}, error) {
+	switch to {
+	case "string":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		if f, ok := value.(float64); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+		return fmt.Sprint(value), nil
+	case "number", "integer":
+		var f float64
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case string:
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			f = parsed
+		case bool:
+			if v {
+				f = 1
+			}
+		default:
+			return nil, fmt.Errorf("cannot convert %T to %s", value, to)
+		}
+		if to == "integer" {
+			f = math.Trunc(f)
+		}
+		return f, nil
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a boolean", v)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("cannot convert %T to boolean", value)
+	case "array":
+		if list, ok := value.([]interface{}); ok {
+			return list, nil
+		}
+		return []interface{}{value}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", to)
+}
+
+// migrationPointer turns a top level field name or JSON pointer into reference tokens.
+func migrationPointer(field string) []string {
+	if strings.HasPrefix(field, "/") {
+		return mustParsePointer(field)
+	}
+	return []string{field}
+}
+
+func migrationGet(entity map[string]interface{}, field string) (interface{}, bool) {
+	value, err := pointerGet(entity, migrationPointer(field))
+	return value, err == nil
+}
+
+func migrationRemove(entity map[string]interface{}, field string) {
+	tokens := migrationPointer(field)
+	if len(tokens) == 0 {
+		return
+	}
+	pointerRemove(entity, tokens)
+}
+
+// migrationSet sets a member, creating missing parent objects along the way.
+func migrationSet(entity map[string]interface{}, field string, value interface{}) error {
+	tokens := migrationPointer(field)
+	if len(tokens) == 0 {
+		return errors.New("cannot replace the whole entity")
+	}
+	node := entity
+	for _, token := range tokens[:len(tokens)-1] {
+		child, ok := node[token]
+		if !ok || child == nil {
+			created := make(map[string]interface{})
+			node[token] = created
+			node = created
+			continue
+		}
+		obj, ok := child.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not inside an object", field)
+		}
+		node = obj
+	}
+	node[tokens[len(tokens)-1]] = value
+	return nil
+}
+
+// stampContractVersion records the contract version a validated entity was written against.
+// Contracts without a version leave entities unstamped.
+func stampContractVersion(entity map[string]interface{}, contract map[string]interface{}) {
+	if entity == nil {
+		return
+	}
+	if version, ok := migrationVersion(contract["version"]); ok {
+		entity[ContractVersionKey] = version
+	}
+}
+
+// GithubContractMigrator migrates entities with the migrations of the contract the
+// manager validates against. The contract is read once per manager.
+type GithubContractMigrator struct {
+	Config     GithubHooksConfig
+	once       sync.Once
+	migrations *ContractMigrations
+	err        error
+}
+
+func (g *GithubContractMigrator) Migrate(entity map[string]interface{}, m *EntityManager) (map[string]interface{}, error) {
+	if g.Config.GithubClient == nil || entity == nil {
+		return entity, nil
+	}
+	g.once.Do(func() {
+		contract, err := GithubSaveHooksHelperContract(&g.Config)
+		if err != nil {
+			g.err = err
+			return
+		}
+		if contract == nil {
+			return
+		}
+		g.migrations, g.err = ParseContractMigrations(contract)
+	})
+	if g.err != nil {
+		return entity, g.err
+	}
+	if g.migrations == nil {
+		return entity, nil
+	}
+	migrated, changed, err := g.migrations.Migrate(entity)
+	if changed {
+		log.Printf("Migrated entity %v to contract version %d", entity[m.Config.IdKey], g.migrations.Version)
+	}
+	return migrated, err
+}
+
+// migrate upgrades a loaded entity, falling back to the stored entity when the upgrade fails.
+func (m EntityManager) migrate(entity map[string]interface{}) map[string]interface{} {
+	if m.Migrator == nil || entity == nil {
+		return entity
+	}
+	migrated, err := m.Migrator.Migrate(entity, &m)
+	if err != nil {
+		log.Printf("Unable to migrate entity %v: %s", entity[m.Config.IdKey], err.Error())
+		return entity
+	}
+	return migrated
+}
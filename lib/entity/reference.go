@@ -0,0 +1,819 @@
+package entity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"goclassifieds/lib/repo"
+
+	"github.com/google/go-github/v46/github"
+)
+
+// Contracts declare references to other entities with x-ref on the schema of the value
+// holding the id, either as the referenced type or as an object:
+//
+//	"sellerId":   {"type": "string", "x-ref": "profile"}
+//	"categoryId": {"type": "string", "x-ref": {"type": "category", "as": "category", "onDelete": "nullify"}}
+//	"tagIds":     {"type": "array", "items": {"type": "string", "x-ref": "tag"}}
+//
+// Writes fail validation when a referenced entity does not exist or the writer may not
+// read it. Reads inline top level references by name (?expand=seller) and references of
+// the inlined entities (?expand=category.parent). Deleting a referenced entity applies
+// the onDelete policy of the references to it: restrict (default), cascade or nullify.
+//
+// Writes keep a reverse reference index in the objects repo so deletes find referrers
+// without reading every entity: references/{type}/{id}.json lists the entities that
+// referenced the entity when they were last saved. References a write adds are recorded
+// before it is stored and the write fails when they cannot be, references it removes are
+// dropped afterwards. Listed referrers are loaded and checked against their current
+// contract, so entries gone stale are ignored.
+
+const ReferenceKeyword = "x-ref"
+
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteNullify  = "nullify"
+)
+
+// ExpandMaxDepth bounds expand paths, category.parent.parent has a depth of 3.
+const ExpandMaxDepth = 3
+
+// ReferenceIndexDir is the directory of the reverse reference index in the objects repo.
+const ReferenceIndexDir = "references"
+
+// referenceIndexAttempts bounds the commits of an index update when the branch keeps moving.
+const referenceIndexAttempts = 3
+
+var (
+	ErrInvalidExpand = errors.New("invalid expand")
+	ErrReferenced    = errors.New("entity is referenced")
+)
+
+// EntityReference is a reference held by an entity. Path points at the id, As is the
+// name the referenced entity expands to.
+type EntityReference struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Id       string `json:"id"`
+	As       string `json:"as,omitempty"`
+	OnDelete string `json:"onDelete"`
+	// SchemaPath points at the x-ref keyword in the contract.
+	SchemaPath string `json:"-"`
+}
+
+// EntityReferrer is an entity holding references to an entity being deleted.
+type EntityReferrer struct {
+	Type       string            `json:"type"`
+	Id         string            `json:"id"`
+	References []EntityReference `json:"references"`
+}
+
+// ReferenceError is returned by Delete when restricting references remain.
+type ReferenceError struct {
+	Type      string           `json:"type"`
+	Id        string           `json:"id"`
+	Referrers []EntityReferrer `json:"referrers"`
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("%s %s is referenced by %d entities", e.Type, e.Id, len(e.Referrers))
+}
+
+func (e *ReferenceError) Unwrap() error {
+	return ErrReferenced
+}
+
+// ReferenceChange is the references an entity held before and after a write.
+type ReferenceChange struct {
+	Id  string
+	Old []EntityReference
+	New []EntityReference
+}
+
+type referenceIndexFile struct {
+	Referrers []string `json:"referrers"` // {type}/{id}
+}
+
+// EntityReferences gives a manager access to the entities its entities reference.
+type EntityReferences interface {
+	// Type is the contract name of the entities of the manager.
+	Type() string
+	// Schema returns the compiled contract schema of a type, nil when it has none.
+	Schema(entityType string) (*ContractSchema, error)
+	// Manager returns a manager that loads, authorizes and writes an entity of a type.
+	Manager(entityType string, id string) (Manager, error)
+	// Referrers returns the entities referencing an entity of the manager's type.
+	Referrers(id string) ([]EntityReferrer, error)
+	// RecordReferences updates the reverse reference index for writes of entities of the
+	// manager's type.
+	RecordReferences(changes []ReferenceChange) error
+}
+
+// FindReferences returns the references an entity holds according to the schema.
+func FindReferences(schema *ContractSchema, entity map[string]interface{}) ([]EntityReference, error) {
+	if schema == nil || !schema.Declares(ReferenceKeyword) {
+		return nil, nil
+	}
+	// Walked as JSON so entities built in Go see the same types as decoded ones.
+	doc, err := copyDocument(entity)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]EntityReference, 0)
+	for _, a := range schema.Annotations(ReferenceKeyword, doc) {
+		if !a.Present {
+			continue
+		}
+		value, err := pointerGet(doc, mustParsePointer(a.InstancePath))
+		if err != nil {
+			continue
+		}
+		id, ok := value.(string)
+		if !ok || id == "" {
+			continue
+		}
+		ref, err := parseReference(a)
+		if err != nil {
+			return nil, err
+		}
+		ref.Id = id
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func parseReference(a SchemaAnnotation) (EntityReference, error) {
+	ref := EntityReference{Path: a.InstancePath, OnDelete: OnDeleteRestrict, SchemaPath: a.SchemaPath}
+	switch spec := a.Value.(type) {
+	case string:
+		ref.Type = spec
+	case map[string]interface{}:
+		ref.Type, _ = spec["type"].(string)
+		ref.As, _ = spec["as"].(string)
+		if onDelete, ok := spec["onDelete"].(string); ok {
+			ref.OnDelete = onDelete
+		}
+	}
+	if ref.Type == "" || strings.ContainsAny(ref.Type, "/\\") {
+		return ref, fmt.Errorf("%s at %s must name an entity type", ReferenceKeyword, a.SchemaPath)
+	}
+	switch ref.OnDelete {
+	case OnDeleteRestrict, OnDeleteCascade, OnDeleteNullify:
+	default:
+		return ref, fmt.Errorf("%s at %s has unknown onDelete %q", ReferenceKeyword, a.SchemaPath, ref.OnDelete)
+	}
+	tokens := mustParsePointer(a.InstancePath)
+	topLevel := len(tokens) == 1
+	many := len(tokens) == 2 && isArrayIndex(tokens[1])
+	if ref.As == "" && (topLevel || many) {
+		ref.As = referenceName(tokens[0], many)
+	} else if !topLevel && !many {
+		// Only top level references expand.
+		ref.As = ""
+	}
+	return ref, nil
+}
+
+// referenceName drops the id suffix of the property holding the reference, sellerId
+// expands to seller and tagIds to tags. Other properties expand in place.
+func referenceName(property string, many bool) string {
+	if many && strings.HasSuffix(property, "Ids") && len(property) > 3 {
+		return strings.TrimSuffix(property, "Ids") + "s"
+	}
+	if !many && strings.HasSuffix(property, "Id") && len(property) > 2 {
+		return strings.TrimSuffix(property, "Id")
+	}
+	return property
+}
+
+func isArrayIndex(token string) bool {
+	_, err := strconv.Atoi(token)
+	return err == nil
+}
+
+// referenceResolver loads referenced entities once per request.
+type referenceResolver struct {
+	references EntityReferences
+	entities   map[string]map[string]interface{}
+	errs       map[string]string
+}
+
+func newReferenceResolver(references EntityReferences) *referenceResolver {
+	return &referenceResolver{
+		references: references,
+		entities:   make(map[string]map[string]interface{}),
+		errs:       make(map[string]string),
+	}
+}
+
+// resolve returns the referenced entity when it exists and may be read, otherwise why not.
+func (r *referenceResolver) resolve(entityType string, id string) (map[string]interface{}, string) {
+	key := entityType + "/" + id
+	if ent, ok := r.entities[key]; ok {
+		return ent, ""
+	}
+	if reason, ok := r.errs[key]; ok {
+		return nil, reason
+	}
+	ent, reason := r.load(entityType, id)
+	if ent != nil {
+		r.entities[key] = ent
+	} else {
+		r.errs[key] = reason
+	}
+	return ent, reason
+}
+
+func (r *referenceResolver) load(entityType string, id string) (map[string]interface{}, string) {
+	if strings.ContainsAny(id, "/\\") {
+		return nil, fmt.Sprintf("invalid %s id %s", entityType, id)
+	}
+	manager, err := r.references.Manager(entityType, id)
+	if err != nil {
+		log.Printf("Unable to resolve %s %s: %s", entityType, id, err.Error())
+		return nil, fmt.Sprintf("unable to resolve %s %s", entityType, id)
+	}
+	if allowed, _ := manager.Allow(id, "read", "default"); !allowed {
+		return nil, fmt.Sprintf("not allowed to reference %s %s", entityType, id)
+	}
+	ent := manager.Load(id, "default")
+	if ent == nil {
+		return nil, fmt.Sprintf("must reference an existing %s", entityType)
+	}
+	return ent, ""
+}
+
+// enforceReferences fails validation of an entity with references that do not exist or
+// may not be read by the writer.
+func (m EntityManager) enforceReferences(res *EntityValidationResponse, contract map[string]interface{}, sha string) error {
+	if m.References == nil {
+		return nil
+	}
+	schema, ok := contract["schema"]
+	if !ok {
+		return nil
+	}
+	compiled, err := CompileContractSchema(sha, schema)
+	if err != nil {
+		return fmt.Errorf("Invalid contract schema: %w", err)
+	}
+	refs, err := FindReferences(compiled, res.Entity)
+	if err != nil {
+		return fmt.Errorf("Invalid contract schema: %w", err)
+	}
+	resolver := newReferenceResolver(m.References)
+	for _, ref := range refs {
+		if _, reason := resolver.resolve(ref.Type, ref.Id); reason != "" {
+			res.Errors = append(res.Errors, SchemaError{
+				InstancePath: ref.Path,
+				SchemaPath:   ref.SchemaPath,
+				Keyword:      ReferenceKeyword,
+				Message:      reason,
+				Params:       map[string]interface{}{"type": ref.Type, "id": ref.Id},
+			}.Map())
+		}
+	}
+	if len(res.Errors) != 0 {
+		return errors.New("Entity invalid")
+	}
+	return nil
+}
+
+// Expand inlines the referenced entities named by the expand paths into the entities.
+// References that do not exist or may not be read are left as they are.
+func (m EntityManager) Expand(entities []map[string]interface{}, expand []string) error {
+	tree := make(expandTree)
+	for _, path := range expand {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		names := strings.Split(path, ".")
+		if len(names) > ExpandMaxDepth {
+			return fmt.Errorf("%w: %s is deeper than %d", ErrInvalidExpand, path, ExpandMaxDepth)
+		}
+		node := tree
+		for _, name := range names {
+			if name == "" {
+				return fmt.Errorf("%w: %s", ErrInvalidExpand, path)
+			}
+			if node[name] == nil {
+				node[name] = make(expandTree)
+			}
+			node = node[name]
+		}
+	}
+	if len(tree) == 0 || m.References == nil {
+		return nil
+	}
+	newReferenceResolver(m.References).expand(m.References.Type(), entities, tree)
+	return nil
+}
+
+type expandTree map[string]expandTree
+
+func (r *referenceResolver) expand(entityType string, entities []map[string]interface{}, tree expandTree) {
+	schema, err := r.references.Schema(entityType)
+	if err != nil {
+		log.Printf("Unable to expand %s: %s", entityType, err.Error())
+		return
+	}
+	for _, ent := range entities {
+		if ent == nil {
+			continue
+		}
+		refs, err := FindReferences(schema, ent)
+		if err != nil {
+			log.Printf("Unable to expand %s: %s", entityType, err.Error())
+			return
+		}
+		byName := make(map[string][]EntityReference)
+		for _, ref := range refs {
+			if ref.As != "" {
+				byName[ref.As] = append(byName[ref.As], ref)
+			}
+		}
+		for _, name := range sortedExpandNames(tree) {
+			named, ok := byName[name]
+			if !ok {
+				continue
+			}
+			resolved := make([]interface{}, len(named))
+			for i, ref := range named {
+				cached, _ := r.resolve(ref.Type, ref.Id)
+				if cached == nil {
+					continue
+				}
+				// Resolved entities are shared by every reference to them, each inlined
+				// copy is expanded on its own so cycles and sibling names cannot alias.
+				copied, err := copyDocument(cached)
+				if err != nil {
+					log.Printf("Unable to expand %s: %s", ref.Id, err.Error())
+					continue
+				}
+				child := copied.(map[string]interface{})
+				if len(tree[name]) != 0 {
+					r.expand(ref.Type, []map[string]interface{}{child}, tree[name])
+				}
+				resolved[i] = child
+			}
+			if tokens := mustParsePointer(named[0].Path); len(tokens) == 2 {
+				ent[name] = resolved
+			} else if resolved[0] != nil {
+				ent[name] = resolved[0]
+			}
+		}
+	}
+}
+
+func sortedExpandNames(tree expandTree) []string {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// referrerAction is what a delete does to one referrer once the entity is gone.
+type referrerAction struct {
+	manager  Manager
+	referrer EntityReferrer
+	cascade  bool
+}
+
+// checkReferrers returns what deleting the entity does to the entities referencing it.
+// It fails when a reference restricts the delete or the user may not change a referrer.
+func (m EntityManager) checkReferrers(id string) ([]referrerAction, error) {
+	if m.References == nil {
+		return nil, nil
+	}
+	referrers, err := m.References.Referrers(id)
+	if err != nil {
+		return nil, err
+	}
+	restricting := make([]EntityReferrer, 0)
+	actions := make([]referrerAction, 0, len(referrers))
+	for _, referrer := range referrers {
+		action := referrerAction{referrer: referrer}
+		restricted := false
+		for _, ref := range referrer.References {
+			switch ref.OnDelete {
+			case OnDeleteRestrict:
+				restricted = true
+			case OnDeleteCascade:
+				action.cascade = true
+			}
+		}
+		if restricted {
+			restricting = append(restricting, referrer)
+		}
+		actions = append(actions, action)
+	}
+	if len(restricting) != 0 {
+		return nil, &ReferenceError{Type: m.References.Type(), Id: id, Referrers: restricting}
+	}
+	for i := range actions {
+		a := &actions[i]
+		manager, err := m.References.Manager(a.referrer.Type, a.referrer.Id)
+		if err != nil {
+			return nil, err
+		}
+		op := "write"
+		if a.cascade {
+			op = "delete"
+		}
+		if allowed, _ := manager.Allow(a.referrer.Id, op, "default"); !allowed {
+			return nil, fmt.Errorf("unauthorized to %s %s %s referencing the entity.", op, a.referrer.Type, a.referrer.Id)
+		}
+		a.manager = manager
+	}
+	return actions, nil
+}
+
+// applyReferrerActions cascades the delete or drops the references to the deleted
+// entity. The entity is gone by now so failures are only logged.
+func applyReferrerActions(actions []referrerAction) {
+	for _, a := range actions {
+		if a.cascade {
+			if _, err := a.manager.Delete(a.referrer.Id); err != nil && !errors.Is(err, ErrEntityNotFound) {
+				log.Printf("Unable to cascade delete to %s %s: %s", a.referrer.Type, a.referrer.Id, err.Error())
+			}
+			continue
+		}
+		ent := a.manager.Load(a.referrer.Id, "default")
+		if ent == nil {
+			continue
+		}
+		// Removed from the last path back so array indexes stay valid.
+		paths := make([]string, len(a.referrer.References))
+		for i, ref := range a.referrer.References {
+			paths[i] = ref.Path
+		}
+		sort.Slice(paths, func(i, j int) bool { return comparePointers(paths[i], paths[j]) > 0 })
+		var doc interface{} = ent
+		for _, path := range paths {
+			updated, _, err := pointerRemove(doc, mustParsePointer(path))
+			if err != nil {
+				log.Printf("Unable to nullify %s of %s %s: %s", path, a.referrer.Type, a.referrer.Id, err.Error())
+				continue
+			}
+			doc = updated
+		}
+		if err := a.manager.Save(doc.(map[string]interface{}), "default"); err != nil {
+			log.Printf("Unable to nullify references of %s %s: %s", a.referrer.Type, a.referrer.Id, err.Error())
+		}
+	}
+}
+
+// referenceChange is what a write changes about the references of an entity, nil when
+// the manager does not track references or the entity holds none before and after.
+func (m EntityManager) referenceChange(id string, old map[string]interface{}, entity map[string]interface{}) *ReferenceChange {
+	if m.References == nil {
+		return nil
+	}
+	schema, err := m.References.Schema(m.References.Type())
+	if err != nil {
+		log.Printf("Unable to find references of %s: %s", id, err.Error())
+		return nil
+	}
+	change := &ReferenceChange{Id: id}
+	if old != nil {
+		if change.Old, err = FindReferences(schema, old); err != nil {
+			log.Printf("Unable to find references of %s: %s", id, err.Error())
+			return nil
+		}
+	}
+	if entity != nil {
+		if change.New, err = FindReferences(schema, entity); err != nil {
+			log.Printf("Unable to find references of %s: %s", id, err.Error())
+			return nil
+		}
+	}
+	if len(change.Old) == 0 && len(change.New) == 0 {
+		return nil
+	}
+	return change
+}
+
+// addReferences records the references writes add before they are stored, so a delete
+// never misses a referrer. Entries of writes that then fail are skipped by Referrers.
+func (m EntityManager) addReferences(changes ...*ReferenceChange) error {
+	recorded := make([]ReferenceChange, 0, len(changes))
+	for _, change := range changes {
+		if change != nil {
+			// Keeping the old references drops nothing before the write.
+			recorded = append(recorded, ReferenceChange{Id: change.Id, Old: change.Old, New: append(append([]EntityReference{}, change.Old...), change.New...)})
+		}
+	}
+	if m.References == nil || len(recorded) == 0 {
+		return nil
+	}
+	if err := m.References.RecordReferences(recorded); err != nil {
+		log.Printf("Unable to record references of %d %s entities: %s", len(recorded), m.References.Type(), err.Error())
+		return err
+	}
+	return nil
+}
+
+// removeReferences drops the references writes removed once they are stored. Entries left
+// behind only cost a load when the entity is deleted, so failures are logged.
+func (m EntityManager) removeReferences(changes ...*ReferenceChange) {
+	recorded := make([]ReferenceChange, 0, len(changes))
+	for _, change := range changes {
+		if change != nil {
+			recorded = append(recorded, ReferenceChange{Id: change.Id, Old: append(append([]EntityReference{}, change.Old...), change.New...), New: change.New})
+		}
+	}
+	if m.References == nil || len(recorded) == 0 {
+		return
+	}
+	if err := m.References.RecordReferences(recorded); err != nil {
+		log.Printf("Unable to remove references of %d %s entities: %s", len(recorded), m.References.Type(), err.Error())
+	}
+}
+
+// comparePointers orders JSON pointers token by token, array indexes numerically.
+func comparePointers(a string, b string) int {
+	at, bt := mustParsePointer(a), mustParsePointer(b)
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if at[i] == bt[i] {
+			continue
+		}
+		ai, aErr := strconv.Atoi(at[i])
+		bi, bErr := strconv.Atoi(bt[i])
+		if aErr == nil && bErr == nil {
+			if ai < bi {
+				return -1
+			}
+			return 1
+		}
+		if at[i] < bt[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(at) - len(bt)
+}
+
+type GithubEntityReferencesConfig struct {
+	Client *github.Client `json:"-"`
+	Repo   string         `json:"repo"` // owner/repo of the objects repo holding contracts and catalogs
+	Branch string         `json:"branch"`
+	Type   string         `json:"type"`
+	// Manager builds the manager of an entity of a type, entities live in the objects
+	// repo or one of its chapter repos.
+	Manager func(entityType string, id string) (Manager, error) `json:"-"`
+}
+
+// GithubEntityReferences resolves references between the entity types of a shapeshifter
+// repo. Contract schemas are read once per type.
+type GithubEntityReferences struct {
+	Config  GithubEntityReferencesConfig
+	mu      sync.Mutex
+	schemas map[string]*ContractSchema
+}
+
+func (g *GithubEntityReferences) Type() string {
+	return g.Config.Type
+}
+
+func (g *GithubEntityReferences) Manager(entityType string, id string) (Manager, error) {
+	return g.Config.Manager(entityType, id)
+}
+
+func (g *GithubEntityReferences) Schema(entityType string) (*ContractSchema, error) {
+	g.mu.Lock()
+	schema, ok := g.schemas[entityType]
+	g.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	pieces := strings.Split(g.Config.Repo, "/")
+	file, _, res, err := g.Config.Client.Repositories.GetContents(context.Background(), pieces[0], pieces[1], "contracts/"+entityType+".json", &github.RepositoryContentGetOptions{Ref: g.Config.Branch})
+	if err != nil && (res == nil || res.StatusCode != 404) {
+		return nil, err
+	}
+	if file != nil {
+		content, err := file.GetContent()
+		if err != nil {
+			return nil, err
+		}
+		var contract map[string]interface{}
+		if err := json.Unmarshal([]byte(content), &contract); err != nil {
+			return nil, fmt.Errorf("Invalid contract %s: %w", entityType, err)
+		}
+		if raw, ok := contract["schema"]; ok {
+			if schema, err = CompileContractSchema(file.GetSHA(), raw); err != nil {
+				return nil, fmt.Errorf("Invalid contract %s: %w", entityType, err)
+			}
+		}
+	}
+
+	g.mu.Lock()
+	if g.schemas == nil {
+		g.schemas = make(map[string]*ContractSchema)
+	}
+	g.schemas[entityType] = schema
+	g.mu.Unlock()
+	return schema, nil
+}
+
+// Referrers loads the entities the reverse reference index lists for the entity and
+// keeps those still referencing it.
+func (g *GithubEntityReferences) Referrers(id string) ([]EntityReferrer, error) {
+	ctx := context.Background()
+	pieces := strings.Split(g.Config.Repo, "/")
+	index, _, err := g.readReferenceIndex(ctx, pieces[0], pieces[1], referenceIndexPath(g.Config.Type, id))
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := make([]EntityReferrer, 0)
+	for _, key := range index.Referrers {
+		keyPieces := strings.SplitN(key, "/", 2)
+		if len(keyPieces) != 2 {
+			continue
+		}
+		entityType, referrerId := keyPieces[0], keyPieces[1]
+		if entityType == g.Config.Type && referrerId == id {
+			continue
+		}
+		schema, err := g.Schema(entityType)
+		if err != nil {
+			return nil, err
+		}
+		if schema == nil || !schema.Declares(ReferenceKeyword) {
+			continue
+		}
+		manager, err := g.Manager(entityType, referrerId)
+		if err != nil {
+			return nil, err
+		}
+		// Loaded through the manager so migrations apply and encrypted fields decrypt.
+		ent := manager.Load(referrerId, "default")
+		if ent == nil {
+			continue
+		}
+		refs, err := FindReferences(schema, ent)
+		if err != nil {
+			return nil, err
+		}
+		matching := make([]EntityReference, 0)
+		for _, ref := range refs {
+			if ref.Type == g.Config.Type && ref.Id == id {
+				matching = append(matching, ref)
+			}
+		}
+		if len(matching) != 0 {
+			referrers = append(referrers, EntityReferrer{Type: entityType, Id: referrerId, References: matching})
+		}
+	}
+	return referrers, nil
+}
+
+// RecordReferences adds the written entities to the index files of the entities they
+// started referencing and removes them from those they stopped referencing, in a single
+// commit. Every write to the objects repo moves the branch, so when the commit conflicts
+// the index files are read again from the new head and the update is rebuilt.
+func (g *GithubEntityReferences) RecordReferences(changes []ReferenceChange) error {
+	// index file -> referrer -> whether it references the entity after the writes
+	updates := make(map[string]map[string]bool)
+	for _, change := range changes {
+		referrer := g.Config.Type + "/" + change.Id
+		before, after := referenceTargets(change.Old), referenceTargets(change.New)
+		for path := range before {
+			if !after[path] {
+				if updates[path] == nil {
+					updates[path] = make(map[string]bool)
+				}
+				updates[path][referrer] = false
+			}
+		}
+		for path := range after {
+			if !before[path] {
+				if updates[path] == nil {
+					updates[path] = make(map[string]bool)
+				}
+				updates[path][referrer] = true
+			}
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	pieces := strings.Split(g.Config.Repo, "/")
+	owner, objectsRepo := pieces[0], pieces[1]
+	message := fmt.Sprintf("Update references of %d %s entities", len(changes), g.Config.Type)
+	var err error
+	for attempt := 1; attempt <= referenceIndexAttempts; attempt++ {
+		var treeChanges []repo.TreeChange
+		if treeChanges, err = g.referenceIndexChanges(ctx, owner, objectsRepo, updates); err != nil || len(treeChanges) == 0 {
+			return err
+		}
+		_, err = repo.CommitTreeChanges(ctx, g.Config.Client, owner, objectsRepo, g.Config.Branch, message, treeChanges)
+		if !errors.Is(err, repo.ErrRefConflict) {
+			return err
+		}
+		log.Printf("Branch %s of %s moved, rebuilding reference index update (attempt %d)", g.Config.Branch, g.Config.Repo, attempt)
+	}
+	return err
+}
+
+// referenceIndexChanges reads the index files at the branch head and applies the updates.
+func (g *GithubEntityReferences) referenceIndexChanges(ctx context.Context, owner string, objectsRepo string, updates map[string]map[string]bool) ([]repo.TreeChange, error) {
+	paths := make([]string, 0, len(updates))
+	for path := range updates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	treeChanges := make([]repo.TreeChange, 0, len(paths))
+	for _, path := range paths {
+		index, exists, err := g.readReferenceIndex(ctx, owner, objectsRepo, path)
+		if err != nil {
+			return nil, err
+		}
+		referrers := make(map[string]bool, len(index.Referrers))
+		for _, referrer := range index.Referrers {
+			referrers[referrer] = true
+		}
+		changed := false
+		for referrer, references := range updates[path] {
+			if referrers[referrer] != references {
+				changed = true
+			}
+			if references {
+				referrers[referrer] = true
+			} else {
+				delete(referrers, referrer)
+			}
+		}
+		if !changed {
+			continue
+		}
+		if len(referrers) == 0 {
+			if exists {
+				treeChanges = append(treeChanges, repo.TreeChange{Path: path})
+			}
+			continue
+		}
+		index.Referrers = make([]string, 0, len(referrers))
+		for referrer := range referrers {
+			index.Referrers = append(index.Referrers, referrer)
+		}
+		sort.Strings(index.Referrers)
+		b, err := json.MarshalIndent(index, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		content := string(b) + "\n"
+		treeChanges = append(treeChanges, repo.TreeChange{Path: path, Content: &content})
+	}
+	return treeChanges, nil
+}
+
+func (g *GithubEntityReferences) readReferenceIndex(ctx context.Context, owner string, objectsRepo string, path string) (*referenceIndexFile, bool, error) {
+	index := &referenceIndexFile{}
+	file, _, res, err := g.Config.Client.Repositories.GetContents(ctx, owner, objectsRepo, path, &github.RepositoryContentGetOptions{Ref: g.Config.Branch})
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return index, false, nil
+		}
+		return nil, false, err
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal([]byte(content), index); err != nil {
+		return nil, false, fmt.Errorf("invalid reference index %s: %w", path, err)
+	}
+	return index, true, nil
+}
+
+// referenceTargets are the index files of the entities references point at.
+func referenceTargets(refs []EntityReference) map[string]bool {
+	targets := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		if strings.ContainsAny(ref.Id, "/\\") {
+			continue
+		}
+		targets[referenceIndexPath(ref.Type, ref.Id)] = true
+	}
+	return targets
+}
+
+func referenceIndexPath(entityType string, id string) string {
+	return ReferenceIndexDir + "/" + entityType + "/" + id + ".json"
+}
@@ -0,0 +1,177 @@
+package entity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"goclassifieds/lib/repo"
+)
+
+// Entities stored in git keep every write as a commit. Revisions expose that history,
+// and restoring a revision writes it again through Update.
+
+var (
+	ErrRevisionsUnsupported = errors.New("loader does not keep revisions")
+	ErrRevisionNotFound     = errors.New("revision not found")
+)
+
+// EntityRevision is a stored version of an entity.
+type EntityRevision struct {
+	Revision string    `json:"revision"`
+	Author   string    `json:"author"`
+	Email    string    `json:"email"`
+	Date     time.Time `json:"date"`
+	Message  string    `json:"message"`
+}
+
+// EntityChange is a field level difference between two revisions. Path is a JSON pointer.
+type EntityChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // add, remove or replace
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// RevisionLoader is implemented by loaders that keep the history of entities.
+type RevisionLoader interface {
+	Revisions(id string, limit int, m *EntityManager) ([]EntityRevision, error)
+	LoadRevision(id string, revision string, m *EntityManager) (map[string]interface{}, error)
+}
+
+func (m EntityManager) Revisions(id string, limit int) ([]EntityRevision, error) {
+	loader, ok := m.Loaders["default"].(RevisionLoader)
+	if !ok {
+		return nil, ErrRevisionsUnsupported
+	}
+	return loader.Revisions(id, limit, &m)
+}
+
+func (m EntityManager) LoadRevision(id string, revision string) (map[string]interface{}, error) {
+	loader, ok := m.Loaders["default"].(RevisionLoader)
+	if !ok {
+		return nil, ErrRevisionsUnsupported
+	}
+	entity, err := loader.LoadRevision(id, revision, &m)
+	if err != nil {
+		return nil, err
+	}
+	return m.migrate(entity), nil
+}
+
+// DiffRevisions compares two revisions of an entity. An empty revision is the current entity.
+func (m EntityManager) DiffRevisions(id string, from string, to string) ([]EntityChange, error) {
+	load := func(revision string) (map[string]interface{}, error) {
+		if revision == "" {
+			current := m.Load(id, "default")
+			if current == nil {
+				return nil, ErrEntityNotFound
+			}
+			return current, nil
+		}
+		return m.LoadRevision(id, revision)
+	}
+	fromEntity, err := load(from)
+	if err != nil {
+		return nil, err
+	}
+	toEntity, err := load(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffEntities(fromEntity, toEntity), nil
+}
+
+// Restore writes an old revision as the new version of the entity, so it goes through
+// authorization, validation, hooks and storage like any update.
+func (m EntityManager) Restore(id string, revision string) (*UpdateEntityResponse, error) {
+	if m.Load(id, "default") == nil {
+		return &UpdateEntityResponse{}, ErrEntityNotFound
+	}
+	restored, err := m.LoadRevision(id, revision)
+	if err != nil {
+		return &UpdateEntityResponse{}, err
+	}
+	restored[m.Config.IdKey] = id
+	return m.Update(restored)
+}
+
+// DiffEntities lists the changes turning one entity into another. Objects are compared
+// member by member, any other value (including arrays) as a whole.
+func DiffEntities(from map[string]interface{}, to map[string]interface{}) []EntityChange {
+	changes := make([]EntityChange, 0)
+	diffValues("", from, to, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+func diffValues(path string, from interface{}, to interface{}, changes *[]EntityChange) {
+	fromObj, fromIsObj := from.(map[string]interface{})
+	toObj, toIsObj := to.(map[string]interface{})
+	if fromIsObj && toIsObj {
+		for key, fromValue := range fromObj {
+			child := path + "/" + escapePointerToken(key)
+			if toValue, ok := toObj[key]; ok {
+				diffValues(child, fromValue, toValue, changes)
+			} else {
+				*changes = append(*changes, EntityChange{Path: child, Op: "remove", From: fromValue})
+			}
+		}
+		for key, toValue := range toObj {
+			if _, ok := fromObj[key]; !ok {
+				*changes = append(*changes, EntityChange{Path: path + "/" + escapePointerToken(key), Op: "add", To: toValue})
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, EntityChange{Path: path, Op: "replace", From: from, To: to})
+	}
+}
+
+func escapePointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+func (s GithubRestFileLoaderAdaptor) Revisions(id string, limit int, m *EntityManager) ([]EntityRevision, error) {
+	pieces := strings.Split(s.Config.Repo, "/")
+	history, err := repo.FileHistory(context.Background(), s.Config.Client, pieces[0], pieces[1], s.Config.Path+"/"+id+".json", s.Config.Branch, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, ErrEntityNotFound
+	}
+	revisions := make([]EntityRevision, len(history))
+	for i, h := range history {
+		revisions[i] = EntityRevision{
+			Revision: h.SHA,
+			Author:   h.Author,
+			Email:    h.Email,
+			Date:     h.Date,
+			Message:  h.Message,
+		}
+	}
+	return revisions, nil
+}
+
+func (s GithubRestFileLoaderAdaptor) LoadRevision(id string, revision string, m *EntityManager) (map[string]interface{}, error) {
+	pieces := strings.Split(s.Config.Repo, "/")
+	content, _, err := repo.GetFileAtRef(context.Background(), s.Config.Client, pieces[0], pieces[1], s.Config.Path+"/"+id+".json", revision)
+	if err != nil {
+		if errors.Is(err, repo.ErrFileNotFound) {
+			return nil, ErrRevisionNotFound
+		}
+		return nil, err
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(content, &obj); err != nil {
+		return nil, fmt.Errorf("revision %s of %s is not valid json: %w", revision, id, err)
+	}
+	return s.Config.Encryption.Decrypt(id, obj, m), nil
+}
@@ -0,0 +1,1115 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Contracts carry a JSON Schema (draft 2020-12) that entities are validated against.
+// Schemas are compiled once per contract SHA and validated in process. For schemas
+// written against draft-07, an array valued items and definitions are understood too.
+// References resolve within the contract only ("#", "#/json/pointer" and "#anchor").
+
+// Contract enforcers selected by ContractValidatorConfig.Enforcer.
+const (
+	ContractEnforcerNative = "native"
+	ContractEnforcerLambda = "lambda"
+)
+
+// SchemaError is a failed schema keyword. InstancePath points at the offending value,
+// SchemaPath at the keyword in the schema.
+type SchemaError struct {
+	InstancePath string                 `json:"instancePath"`
+	SchemaPath   string                 `json:"schemaPath"`
+	Keyword      string                 `json:"keyword"`
+	Message      string                 `json:"message"`
+	Params       map[string]interface{} `json:"params,omitempty"`
+}
+
+func (e SchemaError) Map() map[string]interface{} {
+	m := map[string]interface{}{
+		"instancePath": e.InstancePath,
+		"schemaPath":   e.SchemaPath,
+		"keyword":      e.Keyword,
+		"message":      e.Message,
+	}
+	if e.Params != nil {
+		m["params"] = e.Params
+	}
+	return m
+}
+
+// ContractSchema is a compiled schema, safe for concurrent use.
+type ContractSchema struct {
+	root       *schemaNode
+	extensions map[string]bool
+}
+
+type schemaNode struct {
+	path string
+
+	boolean *bool
+	ref     *schemaNode
+
+	types    []string
+	enum     []interface{}
+	hasEnum  bool
+	constant interface{}
+	hasConst bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+	format    string
+
+	prefixItems      []*schemaNode
+	items            *schemaNode
+	contains         *schemaNode
+	minContains      *int
+	maxContains      *int
+	minItems         *int
+	maxItems         *int
+	uniqueItems      bool
+	unevaluatedItems *schemaNode
+
+	properties            map[string]*schemaNode
+	patternProperties     []patternSchema
+	additionalProperties  *schemaNode
+	propertyNames         *schemaNode
+	unevaluatedProperties *schemaNode
+	required              []string
+	minProperties         *int
+	maxProperties         *int
+	dependentRequired     map[string][]string
+	dependentSchemas      map[string]*schemaNode
+
+	allOf []*schemaNode
+	anyOf []*schemaNode
+	oneOf []*schemaNode
+	not   *schemaNode
+	ifS   *schemaNode
+	thenS *schemaNode
+	elseS *schemaNode
+
+	// Vendor keywords ("x-...") are kept for Annotations, they never fail validation.
+	extensions map[string]interface{}
+}
+
+type patternSchema struct {
+	re     *regexp.Regexp
+	schema *schemaNode
+}
+
+type schemaCompiler struct {
+	doc        interface{}
+	nodes      map[string]*schemaNode
+	anchors    map[string]string
+	extensions map[string]bool
+}
+
+// CompileSchema compiles a decoded JSON Schema document.
+func CompileSchema(doc interface{}) (*ContractSchema, error) {
+	c := &schemaCompiler{
+		doc:        doc,
+		nodes:      make(map[string]*schemaNode),
+		anchors:    make(map[string]string),
+		extensions: make(map[string]bool),
+	}
+	c.collectAnchors("", doc)
+	root, err := c.compile("", doc)
+	if err != nil {
+		return nil, err
+	}
+	return &ContractSchema{root: root, extensions: c.extensions}, nil
+}
+
+// Declares reports whether a vendor keyword appears anywhere in the schema.
+func (s *ContractSchema) Declares(keyword string) bool {
+	return s.extensions[keyword]
+}
+
+func (c *schemaCompiler) collectAnchors(path string, v interface{}) {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"$anchor", "$dynamicAnchor"} {
+			if anchor, ok := n[key].(string); ok {
+				c.anchors[anchor] = path
+			}
+		}
+		for key, child := range n {
+			c.collectAnchors(path+"/"+escapePointerToken(key), child)
+		}
+	case []interface{}:
+		for i, child := range n {
+			c.collectAnchors(path+"/"+strconv.Itoa(i), child)
+		}
+	}
+}
+
+func (c *schemaCompiler) resolve(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return "", fmt.Errorf("unsupported $ref %q, only references within the contract are resolved", ref)
+	}
+	fragment, err := url.PathUnescape(ref[1:])
+	if err != nil {
+		return "", fmt.Errorf("invalid $ref %q: %v", ref, err)
+	}
+	if fragment == "" || strings.HasPrefix(fragment, "/") {
+		return fragment, nil
+	}
+	path, ok := c.anchors[fragment]
+	if !ok {
+		return "", fmt.Errorf("unknown anchor in $ref %q", ref)
+	}
+	return path, nil
+}
+
+func (c *schemaCompiler) compile(path string, raw interface{}) (*schemaNode, error) {
+	if node, ok := c.nodes[path]; ok {
+		return node, nil
+	}
+	node := &schemaNode{path: path}
+	// Registered before the children so recursive references terminate.
+	c.nodes[path] = node
+
+	if b, ok := raw.(bool); ok {
+		node.boolean = &b
+		return node, nil
+	}
+	s, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema at %q must be an object or boolean", "#"+path)
+	}
+
+	var err error
+	sub := func(keyword string) (*schemaNode, error) {
+		v, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		return c.compile(path+"/"+keyword, v)
+	}
+	subs := func(keyword string) ([]*schemaNode, error) {
+		v, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s at %q must be an array", keyword, "#"+path)
+		}
+		nodes := make([]*schemaNode, len(list))
+		for i, item := range list {
+			if nodes[i], err = c.compile(path+"/"+keyword+"/"+strconv.Itoa(i), item); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	subMap := func(keyword string) (map[string]*schemaNode, error) {
+		v, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s at %q must be an object", keyword, "#"+path)
+		}
+		nodes := make(map[string]*schemaNode, len(obj))
+		for key, item := range obj {
+			if nodes[key], err = c.compile(path+"/"+keyword+"/"+escapePointerToken(key), item); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	number := func(keyword string) (*float64, error) {
+		v, ok := s[keyword]
+		if !ok {
+			return nil, nil
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s at %q must be a number", keyword, "#"+path)
+		}
+		return &f, nil
+	}
+	count := func(keyword string) (*int, error) {
+		f, err := number(keyword)
+		if err != nil || f == nil {
+			return nil, err
+		}
+		if *f < 0 || *f != math.Trunc(*f) {
+			return nil, fmt.Errorf("%s at %q must be a non-negative integer", keyword, "#"+path)
+		}
+		i := int(*f)
+		return &i, nil
+	}
+
+	for _, keyword := range []string{"$ref", "$dynamicRef"} {
+		if ref, ok := s[keyword].(string); ok {
+			target, err := c.resolve(ref)
+			if err != nil {
+				return nil, err
+			}
+			refDoc, err := pointerGet(c.doc, mustParsePointer(target))
+			if err != nil {
+				return nil, fmt.Errorf("$ref %q does not resolve: %v", ref, err)
+			}
+			if node.ref, err = c.compile(target, refDoc); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	for key, value := range s {
+		if strings.HasPrefix(key, "x-") {
+			if node.extensions == nil {
+				node.extensions = make(map[string]interface{})
+			}
+			node.extensions[key] = value
+			c.extensions[key] = true
+		}
+	}
+
+	switch t := s["type"].(type) {
+	case string:
+		node.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("type at %q must be a string or array of strings", "#"+path)
+			}
+			node.types = append(node.types, name)
+		}
+	}
+	if v, ok := s["enum"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("enum at %q must be an array", "#"+path)
+		}
+		node.enum, node.hasEnum = list, true
+	}
+	node.constant, node.hasConst = s["const"]
+
+	if node.minimum, err = number("minimum"); err != nil {
+		return nil, err
+	}
+	if node.maximum, err = number("maximum"); err != nil {
+		return nil, err
+	}
+	// Draft-04 style boolean exclusive bounds are left alone, only numbers apply.
+	if _, ok := s["exclusiveMinimum"].(float64); ok {
+		node.exclusiveMinimum, _ = number("exclusiveMinimum")
+	}
+	if _, ok := s["exclusiveMaximum"].(float64); ok {
+		node.exclusiveMaximum, _ = number("exclusiveMaximum")
+	}
+	if node.multipleOf, err = number("multipleOf"); err != nil {
+		return nil, err
+	}
+	if node.multipleOf != nil && *node.multipleOf <= 0 {
+		return nil, fmt.Errorf("multipleOf at %q must be greater than 0", "#"+path)
+	}
+
+	if node.minLength, err = count("minLength"); err != nil {
+		return nil, err
+	}
+	if node.maxLength, err = count("maxLength"); err != nil {
+		return nil, err
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		if node.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("pattern at %q: %v", "#"+path, err)
+		}
+	}
+	node.format, _ = s["format"].(string)
+
+	if node.prefixItems, err = subs("prefixItems"); err != nil {
+		return nil, err
+	}
+	if _, tuple := s["items"].([]interface{}); tuple {
+		// draft-07 tuple: items is the prefix and additionalItems the rest
+		if node.prefixItems, err = subs("items"); err != nil {
+			return nil, err
+		}
+		if node.items, err = sub("additionalItems"); err != nil {
+			return nil, err
+		}
+	} else if node.items, err = sub("items"); err != nil {
+		return nil, err
+	}
+	if node.contains, err = sub("contains"); err != nil {
+		return nil, err
+	}
+	if node.minContains, err = count("minContains"); err != nil {
+		return nil, err
+	}
+	if node.maxContains, err = count("maxContains"); err != nil {
+		return nil, err
+	}
+	if node.minItems, err = count("minItems"); err != nil {
+		return nil, err
+	}
+	if node.maxItems, err = count("maxItems"); err != nil {
+		return nil, err
+	}
+	node.uniqueItems, _ = s["uniqueItems"].(bool)
+	if node.unevaluatedItems, err = sub("unevaluatedItems"); err != nil {
+		return nil, err
+	}
+
+	if node.properties, err = subMap("properties"); err != nil {
+		return nil, err
+	}
+	patterns, err := subMap("patternProperties")
+	if err != nil {
+		return nil, err
+	}
+	for pattern, schema := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("patternProperties at %q: %v", "#"+path, err)
+		}
+		node.patternProperties = append(node.patternProperties, patternSchema{re: re, schema: schema})
+	}
+	sort.Slice(node.patternProperties, func(i, j int) bool {
+		return node.patternProperties[i].re.String() < node.patternProperties[j].re.String()
+	})
+	if node.additionalProperties, err = sub("additionalProperties"); err != nil {
+		return nil, err
+	}
+	if node.propertyNames, err = sub("propertyNames"); err != nil {
+		return nil, err
+	}
+	if node.unevaluatedProperties, err = sub("unevaluatedProperties"); err != nil {
+		return nil, err
+	}
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			node.required = append(node.required, fmt.Sprint(name))
+		}
+	}
+	if node.minProperties, err = count("minProperties"); err != nil {
+		return nil, err
+	}
+	if node.maxProperties, err = count("maxProperties"); err != nil {
+		return nil, err
+	}
+	dependentRequired, _ := s["dependentRequired"].(map[string]interface{})
+	dependentSchemas, _ := s["dependentSchemas"].(map[string]interface{})
+	if dependencies, ok := s["dependencies"].(map[string]interface{}); ok {
+		// draft-07 dependencies split into their 2020-12 keywords
+		for key, v := range dependencies {
+			if _, isList := v.([]interface{}); isList {
+				if dependentRequired == nil {
+					dependentRequired = make(map[string]interface{})
+				}
+				dependentRequired[key] = v
+			} else {
+				if dependentSchemas == nil {
+					dependentSchemas = make(map[string]interface{})
+				}
+				dependentSchemas[key] = v
+			}
+		}
+	}
+	for key, v := range dependentRequired {
+		list, _ := v.([]interface{})
+		if node.dependentRequired == nil {
+			node.dependentRequired = make(map[string][]string)
+		}
+		for _, name := range list {
+			node.dependentRequired[key] = append(node.dependentRequired[key], fmt.Sprint(name))
+		}
+	}
+	for key, v := range dependentSchemas {
+		if node.dependentSchemas == nil {
+			node.dependentSchemas = make(map[string]*schemaNode)
+		}
+		if node.dependentSchemas[key], err = c.compile(path+"/dependentSchemas/"+escapePointerToken(key), v); err != nil {
+			return nil, err
+		}
+	}
+
+	if node.allOf, err = subs("allOf"); err != nil {
+		return nil, err
+	}
+	if node.anyOf, err = subs("anyOf"); err != nil {
+		return nil, err
+	}
+	if node.oneOf, err = subs("oneOf"); err != nil {
+		return nil, err
+	}
+	if node.not, err = sub("not"); err != nil {
+		return nil, err
+	}
+	if node.ifS, err = sub("if"); err != nil {
+		return nil, err
+	}
+	if node.thenS, err = sub("then"); err != nil {
+		return nil, err
+	}
+	if node.elseS, err = sub("else"); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func mustParsePointer(pointer string) []string {
+	tokens, _ := parseJSONPointer(pointer)
+	return tokens
+}
+
+// evaluated tracks which members and items of an instance were looked at by passing
+// subschemas, for unevaluatedProperties and unevaluatedItems.
+type evaluated struct {
+	props    map[string]bool
+	items    map[int]bool
+	allItems bool
+}
+
+func (e *evaluated) merge(o evaluated) {
+	for k := range o.props {
+		e.prop(k)
+	}
+	for i := range o.items {
+		e.item(i)
+	}
+	e.allItems = e.allItems || o.allItems
+}
+
+func (e *evaluated) prop(name string) {
+	if e.props == nil {
+		e.props = make(map[string]bool)
+	}
+	e.props[name] = true
+}
+
+func (e *evaluated) item(i int) {
+	if e.items == nil {
+		e.items = make(map[int]bool)
+	}
+	e.items[i] = true
+}
+
+// Validate returns every schema error of the instance, nil when it is valid.
+func (s *ContractSchema) Validate(instance interface{}) []SchemaError {
+	errs, _ := s.root.validate(instance, "")
+	return errs
+}
+
+func (n *schemaNode) fail(instancePath string, keyword string, message string, params map[string]interface{}) SchemaError {
+	return SchemaError{
+		InstancePath: instancePath,
+		SchemaPath:   "#" + n.path + "/" + keyword,
+		Keyword:      keyword,
+		Message:      message,
+		Params:       params,
+	}
+}
+
+func (n *schemaNode) validate(v interface{}, at string) ([]SchemaError, evaluated) {
+	var errs []SchemaError
+	var ev evaluated
+
+	if n.boolean != nil {
+		if !*n.boolean {
+			errs = append(errs, SchemaError{InstancePath: at, SchemaPath: "#" + n.path, Keyword: "false schema", Message: "boolean schema is false"})
+		}
+		return errs, ev
+	}
+
+	apply := func(child *schemaNode) bool {
+		childErrs, childEv := child.validate(v, at)
+		errs = append(errs, childErrs...)
+		if len(childErrs) == 0 {
+			ev.merge(childEv)
+			return true
+		}
+		return false
+	}
+
+	if n.ref != nil {
+		apply(n.ref)
+	}
+
+	if len(n.types) != 0 {
+		matched := false
+		for _, t := range n.types {
+			if schemaTypeMatches(t, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, n.fail(at, "type", "must be "+strings.Join(n.types, ","), map[string]interface{}{"type": strings.Join(n.types, ",")}))
+		}
+	}
+	if n.hasEnum {
+		found := false
+		for _, allowed := range n.enum {
+			if schemaEqual(allowed, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, n.fail(at, "enum", "must be equal to one of the allowed values", map[string]interface{}{"allowedValues": n.enum}))
+		}
+	}
+	if n.hasConst && !schemaEqual(n.constant, v) {
+		errs = append(errs, n.fail(at, "const", "must be equal to constant", map[string]interface{}{"allowedValue": n.constant}))
+	}
+
+	switch value := v.(type) {
+	case float64:
+		errs = append(errs, n.validateNumber(value, at)...)
+	case string:
+		errs = append(errs, n.validateString(value, at)...)
+	case []interface{}:
+		errs = append(errs, n.validateArray(value, at, &ev)...)
+	case map[string]interface{}:
+		errs = append(errs, n.validateObject(value, at, &ev)...)
+	}
+
+	for _, child := range n.allOf {
+		apply(child)
+	}
+	if len(n.anyOf) != 0 {
+		var branchErrs []SchemaError
+		passed := false
+		for _, child := range n.anyOf {
+			childErrs, childEv := child.validate(v, at)
+			if len(childErrs) == 0 {
+				passed = true
+				ev.merge(childEv)
+			}
+			branchErrs = append(branchErrs, childErrs...)
+		}
+		if !passed {
+			errs = append(errs, branchErrs...)
+			errs = append(errs, n.fail(at, "anyOf", "must match a schema in anyOf", nil))
+		}
+	}
+	if len(n.oneOf) != 0 {
+		var branchErrs []SchemaError
+		var passing []int
+		for i, child := range n.oneOf {
+			childErrs, childEv := child.validate(v, at)
+			if len(childErrs) == 0 {
+				passing = append(passing, i)
+				ev.merge(childEv)
+			}
+			branchErrs = append(branchErrs, childErrs...)
+		}
+		if len(passing) == 0 {
+			errs = append(errs, branchErrs...)
+		}
+		if len(passing) != 1 {
+			errs = append(errs, n.fail(at, "oneOf", "must match exactly one schema in oneOf", map[string]interface{}{"passingSchemas": passing}))
+		}
+	}
+	if n.not != nil {
+		if notErrs, _ := n.not.validate(v, at); len(notErrs) == 0 {
+			errs = append(errs, n.fail(at, "not", "must NOT be valid", nil))
+		}
+	}
+	if n.ifS != nil {
+		ifErrs, ifEv := n.ifS.validate(v, at)
+		if len(ifErrs) == 0 {
+			ev.merge(ifEv)
+			if n.thenS != nil && !apply(n.thenS) {
+				errs = append(errs, n.fail(at, "if", `must match "then" schema`, map[string]interface{}{"failingKeyword": "then"}))
+			}
+		} else if n.elseS != nil && !apply(n.elseS) {
+			errs = append(errs, n.fail(at, "if", `must match "else" schema`, map[string]interface{}{"failingKeyword": "else"}))
+		}
+	}
+
+	// unevaluated* see everything the keywords above evaluated, so they go last.
+	if list, ok := v.([]interface{}); ok && n.unevaluatedItems != nil && !ev.allItems {
+		for i, item := range list {
+			if ev.items[i] {
+				continue
+			}
+			itemErrs, _ := n.unevaluatedItems.validate(item, at+"/"+strconv.Itoa(i))
+			if len(itemErrs) != 0 {
+				if n.unevaluatedItems.boolean == nil {
+					errs = append(errs, itemErrs...)
+				}
+				errs = append(errs, n.fail(at, "unevaluatedItems", "must NOT have unevaluated items", map[string]interface{}{"unevaluatedItem": i}))
+			}
+		}
+		ev.allItems = true
+	}
+	if obj, ok := v.(map[string]interface{}); ok && n.unevaluatedProperties != nil {
+		for _, key := range sortedKeys(obj) {
+			if ev.props[key] {
+				continue
+			}
+			propErrs, _ := n.unevaluatedProperties.validate(obj[key], at+"/"+escapePointerToken(key))
+			if len(propErrs) != 0 {
+				if n.unevaluatedProperties.boolean == nil {
+					errs = append(errs, propErrs...)
+				}
+				errs = append(errs, n.fail(at, "unevaluatedProperties", "must NOT have unevaluated properties", map[string]interface{}{"unevaluatedProperty": key}))
+			}
+			ev.prop(key)
+		}
+	}
+
+	return errs, ev
+}
+
+func (n *schemaNode) validateNumber(v float64, at string) []SchemaError {
+	var errs []SchemaError
+	bound := func(keyword string, limit *float64, comparison string, ok bool) {
+		if limit != nil && !ok {
+			errs = append(errs, n.fail(at, keyword, fmt.Sprintf("must be %s %v", comparison, *limit), map[string]interface{}{"comparison": comparison, "limit": *limit}))
+		}
+	}
+	bound("minimum", n.minimum, ">=", n.minimum == nil || v >= *n.minimum)
+	bound("maximum", n.maximum, "<=", n.maximum == nil || v <= *n.maximum)
+	bound("exclusiveMinimum", n.exclusiveMinimum, ">", n.exclusiveMinimum == nil || v > *n.exclusiveMinimum)
+	bound("exclusiveMaximum", n.exclusiveMaximum, "<", n.exclusiveMaximum == nil || v < *n.exclusiveMaximum)
+	if n.multipleOf != nil {
+		q := v / *n.multipleOf
+		if math.IsInf(q, 0) || math.Abs(q-math.Round(q)) > 1e-9 {
+			errs = append(errs, n.fail(at, "multipleOf", fmt.Sprintf("must be multiple of %v", *n.multipleOf), map[string]interface{}{"multipleOf": *n.multipleOf}))
+		}
+	}
+	return errs
+}
+
+func (n *schemaNode) validateString(v string, at string) []SchemaError {
+	var errs []SchemaError
+	length := utf8.RuneCountInString(v)
+	if n.minLength != nil && length < *n.minLength {
+		errs = append(errs, n.fail(at, "minLength", fmt.Sprintf("must NOT have fewer than %d characters", *n.minLength), map[string]interface{}{"limit": *n.minLength}))
+	}
+	if n.maxLength != nil && length > *n.maxLength {
+		errs = append(errs, n.fail(at, "maxLength", fmt.Sprintf("must NOT have more than %d characters", *n.maxLength), map[string]interface{}{"limit": *n.maxLength}))
+	}
+	if n.pattern != nil && !n.pattern.MatchString(v) {
+		errs = append(errs, n.fail(at, "pattern", fmt.Sprintf("must match pattern %q", n.pattern.String()), map[string]interface{}{"pattern": n.pattern.String()}))
+	}
+	if n.format != "" && !schemaFormatMatches(n.format, v) {
+		errs = append(errs, n.fail(at, "format", fmt.Sprintf("must match format %q", n.format), map[string]interface{}{"format": n.format}))
+	}
+	return errs
+}
+
+func (n *schemaNode) validateArray(v []interface{}, at string, ev *evaluated) []SchemaError {
+	var errs []SchemaError
+	if n.minItems != nil && len(v) < *n.minItems {
+		errs = append(errs, n.fail(at, "minItems", fmt.Sprintf("must NOT have fewer than %d items", *n.minItems), map[string]interface{}{"limit": *n.minItems}))
+	}
+	if n.maxItems != nil && len(v) > *n.maxItems {
+		errs = append(errs, n.fail(at, "maxItems", fmt.Sprintf("must NOT have more than %d items", *n.maxItems), map[string]interface{}{"limit": *n.maxItems}))
+	}
+	if n.uniqueItems {
+	unique:
+		for i := 1; i < len(v); i++ {
+			for j := 0; j < i; j++ {
+				if schemaEqual(v[i], v[j]) {
+					errs = append(errs, n.fail(at, "uniqueItems", fmt.Sprintf("must NOT have duplicate items (items ## %d and %d are identical)", j, i), map[string]interface{}{"i": i, "j": j}))
+					break unique
+				}
+			}
+		}
+	}
+	for i, child := range n.prefixItems {
+		if i >= len(v) {
+			break
+		}
+		childErrs, _ := child.validate(v[i], at+"/"+strconv.Itoa(i))
+		errs = append(errs, childErrs...)
+		ev.item(i)
+	}
+	if n.items != nil && n.items.boolean != nil && !*n.items.boolean {
+		if len(v) > len(n.prefixItems) {
+			errs = append(errs, n.fail(at, "items", fmt.Sprintf("must NOT have more than %d items", len(n.prefixItems)), map[string]interface{}{"limit": len(n.prefixItems)}))
+		}
+		ev.allItems = true
+	} else if n.items != nil {
+		for i := len(n.prefixItems); i < len(v); i++ {
+			childErrs, _ := n.items.validate(v[i], at+"/"+strconv.Itoa(i))
+			errs = append(errs, childErrs...)
+		}
+		ev.allItems = true
+	}
+	if n.contains != nil {
+		matches := 0
+		for i, item := range v {
+			if itemErrs, _ := n.contains.validate(item, at+"/"+strconv.Itoa(i)); len(itemErrs) == 0 {
+				matches++
+				ev.item(i)
+			}
+		}
+		min := 1
+		if n.minContains != nil {
+			min = *n.minContains
+		}
+		if matches < min {
+			errs = append(errs, n.fail(at, "contains", fmt.Sprintf("must contain at least %d valid item(s)", min), map[string]interface{}{"minContains": min}))
+		}
+		if n.maxContains != nil && matches > *n.maxContains {
+			errs = append(errs, n.fail(at, "contains", fmt.Sprintf("must contain at most %d valid item(s)", *n.maxContains), map[string]interface{}{"maxContains": *n.maxContains}))
+		}
+	}
+	return errs
+}
+
+func (n *schemaNode) validateObject(v map[string]interface{}, at string, ev *evaluated) []SchemaError {
+	var errs []SchemaError
+	for _, name := range n.required {
+		if _, ok := v[name]; !ok {
+			errs = append(errs, n.fail(at, "required", fmt.Sprintf("must have required property '%s'", name), map[string]interface{}{"missingProperty": name}))
+		}
+	}
+	if n.minProperties != nil && len(v) < *n.minProperties {
+		errs = append(errs, n.fail(at, "minProperties", fmt.Sprintf("must NOT have fewer than %d properties", *n.minProperties), map[string]interface{}{"limit": *n.minProperties}))
+	}
+	if n.maxProperties != nil && len(v) > *n.maxProperties {
+		errs = append(errs, n.fail(at, "maxProperties", fmt.Sprintf("must NOT have more than %d properties", *n.maxProperties), map[string]interface{}{"limit": *n.maxProperties}))
+	}
+
+	for _, key := range sortedKeys(v) {
+		value := v[key]
+		childAt := at + "/" + escapePointerToken(key)
+		matched := false
+		if child, ok := n.properties[key]; ok {
+			childErrs, _ := child.validate(value, childAt)
+			errs = append(errs, childErrs...)
+			matched = true
+		}
+		for _, pp := range n.patternProperties {
+			if pp.re.MatchString(key) {
+				childErrs, _ := pp.schema.validate(value, childAt)
+				errs = append(errs, childErrs...)
+				matched = true
+			}
+		}
+		if !matched && n.additionalProperties != nil {
+			childErrs, _ := n.additionalProperties.validate(value, childAt)
+			if len(childErrs) != 0 {
+				if n.additionalProperties.boolean != nil {
+					errs = append(errs, n.fail(at, "additionalProperties", "must NOT have additional properties", map[string]interface{}{"additionalProperty": key}))
+				} else {
+					errs = append(errs, childErrs...)
+				}
+			}
+			matched = true
+		}
+		if matched {
+			ev.prop(key)
+		}
+		if n.propertyNames != nil {
+			if nameErrs, _ := n.propertyNames.validate(key, childAt); len(nameErrs) != 0 {
+				errs = append(errs, n.fail(at, "propertyNames", fmt.Sprintf("property name '%s' is invalid", key), map[string]interface{}{"propertyName": key}))
+			}
+		}
+		if deps, ok := n.dependentRequired[key]; ok {
+			for _, dep := range deps {
+				if _, ok := v[dep]; !ok {
+					errs = append(errs, n.fail(at, "dependentRequired", fmt.Sprintf("must have property %s when property %s is present", dep, key), map[string]interface{}{"property": key, "missingProperty": dep}))
+				}
+			}
+		}
+		if dep, ok := n.dependentSchemas[key]; ok {
+			depErrs, depEv := dep.validate(v, at)
+			errs = append(errs, depErrs...)
+			if len(depErrs) == 0 {
+				ev.merge(depEv)
+			}
+		}
+	}
+	return errs
+}
+
+// SchemaAnnotation is a vendor keyword ("x-...") that applies to a value of an instance.
+// Declared properties are annotated even when the instance does not have them, Present
+// tells whether the value exists.
+type SchemaAnnotation struct {
+	InstancePath string
+	SchemaPath   string
+	Value        interface{}
+	Present      bool
+}
+
+// Recursive schemas over recursive data are fine, this only stops $ref cycles that do
+// not descend into the instance.
+const schemaAnnotationMaxDepth = 64
+
+// Annotations walks the instance along with the schema and returns every value the
+// keyword applies to. Only subschemas that apply are walked: the anyOf and oneOf
+// branches the value passes and the if branch that is taken.
+func (s *ContractSchema) Annotations(keyword string, instance interface{}) []SchemaAnnotation {
+	var found []SchemaAnnotation
+	s.root.annotate(keyword, instance, true, "", 0, &found)
+	seen := make(map[string]bool, len(found))
+	annotations := make([]SchemaAnnotation, 0, len(found))
+	for _, a := range found {
+		if key := a.InstancePath + " " + a.SchemaPath; !seen[key] {
+			seen[key] = true
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+func (n *schemaNode) annotate(keyword string, v interface{}, present bool, at string, depth int, found *[]SchemaAnnotation) {
+	if n.boolean != nil || depth > schemaAnnotationMaxDepth {
+		return
+	}
+	if value, ok := n.extensions[keyword]; ok {
+		*found = append(*found, SchemaAnnotation{InstancePath: at, SchemaPath: "#" + n.path + "/" + escapePointerToken(keyword), Value: value, Present: present})
+	}
+	if n.ref != nil {
+		n.ref.annotate(keyword, v, present, at, depth+1, found)
+	}
+	for _, child := range n.allOf {
+		child.annotate(keyword, v, present, at, depth+1, found)
+	}
+	if !present {
+		return
+	}
+	passes := func(child *schemaNode) bool {
+		errs, _ := child.validate(v, at)
+		return len(errs) == 0
+	}
+	for _, branches := range [][]*schemaNode{n.anyOf, n.oneOf} {
+		for _, child := range branches {
+			if passes(child) {
+				child.annotate(keyword, v, present, at, depth+1, found)
+			}
+		}
+	}
+	if n.ifS != nil {
+		if passes(n.ifS) {
+			if n.thenS != nil {
+				n.thenS.annotate(keyword, v, present, at, depth+1, found)
+			}
+		} else if n.elseS != nil {
+			n.elseS.annotate(keyword, v, present, at, depth+1, found)
+		}
+	}
+
+	switch value := v.(type) {
+	case []interface{}:
+		for i, item := range value {
+			itemAt := at + "/" + strconv.Itoa(i)
+			if i < len(n.prefixItems) {
+				n.prefixItems[i].annotate(keyword, item, true, itemAt, depth+1, found)
+			} else if n.items != nil {
+				n.items.annotate(keyword, item, true, itemAt, depth+1, found)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range sortedKeys(value) {
+			childAt := at + "/" + escapePointerToken(key)
+			matched := false
+			if child, ok := n.properties[key]; ok {
+				child.annotate(keyword, value[key], true, childAt, depth+1, found)
+				matched = true
+			}
+			for _, pp := range n.patternProperties {
+				if pp.re.MatchString(key) {
+					pp.schema.annotate(keyword, value[key], true, childAt, depth+1, found)
+					matched = true
+				}
+			}
+			if !matched && n.additionalProperties != nil {
+				n.additionalProperties.annotate(keyword, value[key], true, childAt, depth+1, found)
+			}
+		}
+		names := make([]string, 0, len(n.properties))
+		for key := range n.properties {
+			if _, ok := value[key]; !ok {
+				names = append(names, key)
+			}
+		}
+		sort.Strings(names)
+		for _, key := range names {
+			n.properties[key].annotate(keyword, nil, false, at+"/"+escapePointerToken(key), depth+1, found)
+		}
+	}
+}
+
+func schemaTypeMatches(t string, v interface{}) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
+	}
+	return false
+}
+
+// schemaEqual compares decoded JSON values, where all numbers are float64.
+func schemaEqual(a interface{}, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	schemaUUIDPattern     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	schemaHostnamePattern = regexp.MustCompile(`^(?i)[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)*$`)
+	schemaTimePattern     = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?(?i:z|[+-]\d{2}:\d{2})$`)
+)
+
+// schemaFormatMatches asserts the formats ajv-formats asserted for the contract lambda.
+// Unknown formats pass.
+func schemaFormatMatches(format string, v string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, strings.ToUpper(v))
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", v)
+		return err == nil
+	case "time":
+		if !schemaTimePattern.MatchString(v) {
+			return false
+		}
+		_, err := time.Parse("15:04:05", v[:8])
+		return err == nil
+	case "email":
+		addr, err := mail.ParseAddress(v)
+		return err == nil && addr.Address == v
+	case "hostname":
+		return len(v) <= 253 && schemaHostnamePattern.MatchString(v)
+	case "ipv4":
+		ip := net.ParseIP(v)
+		return ip != nil && ip.To4() != nil && !strings.Contains(v, ":")
+	case "ipv6":
+		return net.ParseIP(v) != nil && strings.Contains(v, ":")
+	case "uri":
+		u, err := url.Parse(v)
+		return err == nil && u.IsAbs()
+	case "uri-reference":
+		_, err := url.Parse(v)
+		return err == nil
+	case "uuid":
+		return schemaUUIDPattern.MatchString(v)
+	case "regex":
+		_, err := regexp.Compile(v)
+		return err == nil
+	case "json-pointer":
+		_, err := parseJSONPointer(v)
+		return err == nil
+	}
+	return true
+}
+
+// Compiled contract schemas by contract blob SHA. A new contract gets a new SHA so
+// entries never go stale, the cache is only bounded.
+var contractSchemas = struct {
+	sync.Mutex
+	bySHA map[string]*ContractSchema
+}{bySHA: make(map[string]*ContractSchema)}
+
+const contractSchemaCacheSize = 64
+
+// CompileContractSchema compiles the schema of a contract, reusing the compiled schema
+// of an earlier call with the same SHA.
+func CompileContractSchema(sha string, schema interface{}) (*ContractSchema, error) {
+	if sha != "" {
+		contractSchemas.Lock()
+		compiled, ok := contractSchemas.bySHA[sha]
+		contractSchemas.Unlock()
+		if ok {
+			return compiled, nil
+		}
+	}
+	compiled, err := CompileSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	if sha != "" {
+		contractSchemas.Lock()
+		if len(contractSchemas.bySHA) >= contractSchemaCacheSize {
+			contractSchemas.bySHA = make(map[string]*ContractSchema)
+		}
+		contractSchemas.bySHA[sha] = compiled
+		contractSchemas.Unlock()
+	}
+	return compiled, nil
+}
+
+// enforceContract validates an entity against the contract schema in process, the way
+// the EnforceContract lambda did.
+func enforceContract(entity map[string]interface{}, contract map[string]interface{}, sha string, userId string) (*EntityValidationResponse, error) {
+	valRes := &EntityValidationResponse{Entity: entity}
+	schema, ok := contract["schema"]
+	if !ok {
+		entity["userId"] = userId
+		return valRes, nil
+	}
+	compiled, err := CompileContractSchema(sha, schema)
+	if err != nil {
+		log.Printf("Invalid contract schema: %s", err.Error())
+		return valRes, fmt.Errorf("Invalid contract schema: %w", err)
+	}
+	// Validated as JSON so entities built in Go see the same types as decoded ones.
+	doc, err := copyDocument(entity)
+	if err != nil {
+		return valRes, err
+	}
+	if schemaErrs := compiled.Validate(doc); len(schemaErrs) != 0 {
+		valRes.Errors = make([]map[string]interface{}, len(schemaErrs))
+		for i, schemaErr := range schemaErrs {
+			valRes.Errors[i] = schemaErr.Map()
+		}
+		return valRes, errors.New("Entity invalid")
+	}
+	entity["userId"] = userId
+	return valRes, nil
+}
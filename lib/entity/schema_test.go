@@ -0,0 +1,247 @@
+package entity
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func decodeSchemaTestJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", raw, err)
+	}
+	return v
+}
+
+// Errors are compared as "keyword instancePath schemaPath", params of the first error
+// when the case sets them.
+func TestContractSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		instance string
+		errors   []string
+		params   string
+	}{
+		{
+			name:     "type matches",
+			schema:   `{"type": "string"}`,
+			instance: `"hello"`,
+		},
+		{
+			name:     "type mismatch",
+			schema:   `{"type": "string"}`,
+			instance: `5`,
+			errors:   []string{"type  #/type"},
+		},
+		{
+			name:     "type list",
+			schema:   `{"type": ["string", "null"]}`,
+			instance: `null`,
+		},
+		{
+			name:     "integer accepts whole numbers",
+			schema:   `{"type": "integer"}`,
+			instance: `3.0`,
+		},
+		{
+			name:     "integer rejects fractions",
+			schema:   `{"type": "integer"}`,
+			instance: `3.5`,
+			errors:   []string{"type  #/type"},
+		},
+		{
+			name:     "number accepts integers",
+			schema:   `{"type": "number"}`,
+			instance: `3`,
+		},
+		{
+			name:     "required present",
+			schema:   `{"type": "object", "required": ["title"]}`,
+			instance: `{"title": "Bike"}`,
+		},
+		{
+			name:     "required missing",
+			schema:   `{"type": "object", "required": ["title", "price"]}`,
+			instance: `{"title": "Bike"}`,
+			errors:   []string{"required  #/required"},
+			params:   "map[missingProperty:price]",
+		},
+		{
+			name:     "additionalProperties false",
+			schema:   `{"type": "object", "properties": {"title": {"type": "string"}}, "additionalProperties": false}`,
+			instance: `{"title": "Bike", "color": "red"}`,
+			errors:   []string{"additionalProperties  #/additionalProperties"},
+			params:   "map[additionalProperty:color]",
+		},
+		{
+			name:     "additionalProperties schema",
+			schema:   `{"type": "object", "properties": {"title": {"type": "string"}}, "additionalProperties": {"type": "number"}}`,
+			instance: `{"title": "Bike", "price": 10, "color": "red"}`,
+			errors:   []string{"type /color #/additionalProperties/type"},
+		},
+		{
+			name:     "additionalProperties ignores patternProperties",
+			schema:   `{"type": "object", "patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`,
+			instance: `{"x-color": "red"}`,
+		},
+		{
+			name:     "unevaluatedProperties sees allOf",
+			schema:   `{"type": "object", "allOf": [{"properties": {"title": {"type": "string"}}}], "unevaluatedProperties": false}`,
+			instance: `{"title": "Bike"}`,
+		},
+		{
+			name:     "unevaluatedProperties rejects the rest",
+			schema:   `{"type": "object", "allOf": [{"properties": {"title": {"type": "string"}}}], "unevaluatedProperties": false}`,
+			instance: `{"title": "Bike", "color": "red"}`,
+			errors:   []string{"unevaluatedProperties  #/unevaluatedProperties"},
+			params:   "map[unevaluatedProperty:color]",
+		},
+		{
+			name:     "$ref to $defs",
+			schema:   `{"$defs": {"price": {"type": "number", "minimum": 0}}, "properties": {"price": {"$ref": "#/$defs/price"}}}`,
+			instance: `{"price": -1}`,
+			errors:   []string{"minimum /price #/$defs/price/minimum"},
+		},
+		{
+			name:     "$ref to definitions",
+			schema:   `{"definitions": {"title": {"type": "string"}}, "properties": {"title": {"$ref": "#/definitions/title"}}}`,
+			instance: `{"title": 5}`,
+			errors:   []string{"type /title #/definitions/title/type"},
+		},
+		{
+			name:     "$ref to $anchor",
+			schema:   `{"$defs": {"tag": {"$anchor": "tag", "type": "string", "minLength": 2}}, "properties": {"tags": {"type": "array", "items": {"$ref": "#tag"}}}}`,
+			instance: `{"tags": ["ok", "x"]}`,
+			errors:   []string{"minLength /tags/1 #/$defs/tag/minLength"},
+		},
+		{
+			name:     "recursive $ref",
+			schema:   `{"type": "object", "properties": {"name": {"type": "string"}, "children": {"type": "array", "items": {"$ref": "#"}}}}`,
+			instance: `{"name": "root", "children": [{"name": "child", "children": [{"name": 1}]}]}`,
+			errors:   []string{"type /children/0/children/0/name #/properties/name/type"},
+		},
+		{
+			name:     "format email",
+			schema:   `{"type": "string", "format": "email"}`,
+			instance: `"seller@example.com"`,
+		},
+		{
+			name:     "format email invalid",
+			schema:   `{"type": "string", "format": "email"}`,
+			instance: `"not an email"`,
+			errors:   []string{"format  #/format"},
+		},
+		{
+			name:     "format date-time",
+			schema:   `{"type": "string", "format": "date-time"}`,
+			instance: `"2024-02-30T10:00:00Z"`,
+			errors:   []string{"format  #/format"},
+		},
+		{
+			name:     "format uuid",
+			schema:   `{"type": "string", "format": "uuid"}`,
+			instance: `"3f2504e0-4f89-11d3-9a0c-0305e82c3301"`,
+		},
+		{
+			name:     "format ignores other types",
+			schema:   `{"format": "email"}`,
+			instance: `5`,
+		},
+		{
+			name:     "uniqueItems",
+			schema:   `{"type": "array", "uniqueItems": true}`,
+			instance: `["a", "b", "c"]`,
+		},
+		{
+			name:     "uniqueItems duplicate",
+			schema:   `{"type": "array", "uniqueItems": true}`,
+			instance: `["a", "b", "a"]`,
+			errors:   []string{"uniqueItems  #/uniqueItems"},
+			params:   "map[i:2 j:0]",
+		},
+		{
+			name:     "uniqueItems compares objects by value",
+			schema:   `{"type": "array", "uniqueItems": true}`,
+			instance: `[{"a": 1, "b": 2}, {"b": 2, "a": 1}]`,
+			errors:   []string{"uniqueItems  #/uniqueItems"},
+		},
+		{
+			name:     "nested error pointers",
+			schema:   `{"type": "object", "properties": {"seller": {"type": "object", "properties": {"emails": {"type": "array", "items": {"type": "string", "format": "email"}}}}}}`,
+			instance: `{"seller": {"emails": ["a@example.com", "nope"]}}`,
+			errors:   []string{"format /seller/emails/1 #/properties/seller/properties/emails/items/format"},
+		},
+		{
+			name:     "escaped error pointers",
+			schema:   `{"type": "object", "properties": {"a/b": {"type": "string"}, "c~d": {"type": "string"}}}`,
+			instance: `{"a/b": 1, "c~d": 2}`,
+			errors:   []string{"type /a~1b #/properties/a~1b/type", "type /c~0d #/properties/c~0d/type"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := CompileSchema(decodeSchemaTestJSON(t, tt.schema))
+			if err != nil {
+				t.Fatalf("CompileSchema() error = %v", err)
+			}
+			errs := schema.Validate(decodeSchemaTestJSON(t, tt.instance))
+			got := []string{}
+			for _, e := range errs {
+				got = append(got, fmt.Sprintf("%s %s %s", e.Keyword, e.InstancePath, e.SchemaPath))
+			}
+			want := tt.errors
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Validate() = %q, want %q", got, want)
+			}
+			if tt.params != "" && len(errs) != 0 && fmt.Sprint(errs[0].Params) != tt.params {
+				t.Errorf("Validate() params = %v, want %s", errs[0].Params, tt.params)
+			}
+		})
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "unresolved $ref", schema: `{"properties": {"a": {"$ref": "#/$defs/missing"}}}`},
+		{name: "unknown $anchor", schema: `{"$ref": "#missing"}`},
+		{name: "remote $ref", schema: `{"$ref": "https://example.com/schema.json"}`},
+		{name: "invalid pattern", schema: `{"pattern": "("}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileSchema(decodeSchemaTestJSON(t, tt.schema)); err == nil {
+				t.Errorf("CompileSchema(%s) succeeded, want an error", tt.schema)
+			}
+		})
+	}
+}
+
+func TestSchemaErrorMap(t *testing.T) {
+	schema, err := CompileSchema(decodeSchemaTestJSON(t, `{"properties": {"price": {"type": "number", "maximum": 10}}}`))
+	if err != nil {
+		t.Fatalf("CompileSchema() error = %v", err)
+	}
+	errs := schema.Validate(decodeSchemaTestJSON(t, `{"price": 11}`))
+	if len(errs) != 1 {
+		t.Fatalf("Validate() = %v, want one error", errs)
+	}
+	m := errs[0].Map()
+	if m["instancePath"] != "/price" || m["schemaPath"] != "#/properties/price/maximum" || m["keyword"] != "maximum" {
+		t.Errorf("Map() = %v", m)
+	}
+	if m["message"] == "" {
+		t.Errorf("Map() has no message")
+	}
+}
@@ -0,0 +1,56 @@
+package entity
+
+import (
+	"errors"
+)
+
+// Versions are opaque tokens identifying the stored revision of an entity (blob SHAs for
+// github storage). They are exposed as ETags so clients can make conditional writes.
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// EntityVersioning carries the preconditions of a write and reports the version the
+// write produced. It is set per request on the EntityManager.
+type EntityVersioning struct {
+	IfMatch     []string // the current version must be one of these, "*" matches any existing entity
+	IfNoneMatch bool     // the entity must not exist yet
+	Version     string   // version written by the last versioned store
+}
+
+// VersionedLoader is implemented by loaders that can report the version of what they load.
+type VersionedLoader interface {
+	LoadVersion(id string, m *EntityManager) (map[string]interface{}, string)
+}
+
+// VersionedStorage is implemented by storages that can write conditionally. An empty
+// expected version writes unconditionally, create requires the entity not to exist.
+type VersionedStorage interface {
+	StoreVersion(id string, entity map[string]interface{}, expected string, create bool) (string, error)
+}
+
+// Conditional reports whether the write carries preconditions.
+func (v *EntityVersioning) Conditional() bool {
+	return v != nil && (len(v.IfMatch) != 0 || v.IfNoneMatch)
+}
+
+// Check evaluates the preconditions against the current version of the entity.
+func (v *EntityVersioning) Check(current string, exists bool) error {
+	if v == nil {
+		return nil
+	}
+	if v.IfNoneMatch && exists {
+		return ErrPreconditionFailed
+	}
+	if len(v.IfMatch) == 0 {
+		return nil
+	}
+	if !exists {
+		return ErrPreconditionFailed
+	}
+	for _, tag := range v.IfMatch {
+		if tag == "*" || (current != "" && tag == current) {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
 	"text/template"
@@ -122,3 +123,35 @@ func ExecuteSearch(esClient *opensearch.Client, query *map[string]interface{}, i
 	}
 	return docs*/
 }
+
+// SearchResponse runs a query against one or more indices and returns the whole decoded
+// response (hits, totals and aggregations). Unlike ExecuteSearch errors are returned.
+func SearchResponse(ctx context.Context, esClient *opensearch.Client, query map[string]interface{}, indices []string) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return nil, fmt.Errorf("error encoding query: %w", err)
+	}
+	log.Printf("Search Query: %s", buf.String())
+
+	res, err := esClient.Search(
+		esClient.Search.WithContext(ctx),
+		esClient.Search.WithIndex(indices...),
+		esClient.Search.WithBody(&buf),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %w", err)
+	}
+	defer res.Body.Close()
+
+	var r map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %w", err)
+	}
+	if res.IsError() {
+		if e, ok := r["error"].(map[string]interface{}); ok {
+			return nil, fmt.Errorf("[%s] %v: %v", res.Status(), e["type"], e["reason"])
+		}
+		return nil, fmt.Errorf("[%s] open search request failure", res.Status())
+	}
+	return r, nil
+}
@@ -17,10 +17,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"crypto/sha1"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	crand "crypto/rand"
+	"sort"
+	"strconv"
 
 	// "golang.org/x/crypto/nacl/box"
 	// Import the kevinburke/nacl/box package, aliasing it to avoid conflict if you also use golang.org/x/crypto/nacl/box
@@ -44,8 +47,13 @@ type CommitParams struct {
 	Path     string
 	Data     *[]byte
 	UserName string
+	IfMatch     string // blob SHA the file must still have ("*" for any), only for CommitRestVersioned
+	IfNoneMatch bool   // the file must not exist yet, only for CommitRestVersioned
 }
 
+// ErrVersionMismatch is returned by versioned commits when the file changed underneath.
+var ErrVersionMismatch = errors.New("file version mismatch")
+
 type GithubUserInfo struct {
 	Name  string
 	Email string
@@ -141,6 +149,68 @@ func Commit(c *githubv4.Client, params *CommitParams) {
 
 }
 
+// Delete removes params.Path from the branch in a single commit through the GraphQL API.
+func Delete(c *githubv4.Client, params *CommitParams) error {
+
+	log.Printf("BEGIN Delete %s", params.Path)
+	pieces := strings.Split(params.Repo, "/")
+	var q struct {
+		Repository struct {
+			Object struct {
+				Commit struct {
+					History struct {
+						Edges []struct {
+							Node struct {
+								Oid githubv4.GitObjectID
+							}
+						}
+					} `graphql:"history(first:1)"`
+				} `graphql:"... on Commit"`
+			} `graphql:"object(expression: $branch)"`
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+	qVars := map[string]interface{}{
+		"branch": githubv4.String(params.Branch),
+		"owner":  githubv4.String(pieces[0]),
+		"name":   githubv4.String(pieces[1]),
+	}
+	if err := c.Query(context.Background(), &q, qVars); err != nil {
+		return fmt.Errorf("github latest commit failure: %w", err)
+	}
+	if len(q.Repository.Object.Commit.History.Edges) == 0 {
+		return fmt.Errorf("branch %s has no commits", params.Branch)
+	}
+	var m struct {
+		CreateCommitOnBranch struct {
+			Commit struct {
+				Url githubv4.String
+			}
+		} `graphql:"createCommitOnBranch(input: $input)"`
+	}
+	deletions := []githubv4.FileDeletion{
+		{Path: githubv4.String(params.Path)},
+	}
+	input := githubv4.CreateCommitOnBranchInput{
+		Branch: githubv4.CommittableBranch{
+			RepositoryNameWithOwner: (*githubv4.String)(&params.Repo),
+			BranchName:              (*githubv4.String)(&params.Branch),
+		},
+		Message: githubv4.CommitMessage{
+			Headline: githubv4.String("Delete File: " + params.Path),
+		},
+		ExpectedHeadOid: *githubv4.NewGitObjectID(q.Repository.Object.Commit.History.Edges[0].Node.Oid),
+		FileChanges: &githubv4.FileChanges{
+			Deletions: &deletions,
+		},
+	}
+	if err := c.Mutate(context.Background(), &m, input, nil); err != nil {
+		return fmt.Errorf("github file delete failure: %w", err)
+	}
+	log.Printf("END Delete %s", params.Path)
+	return nil
+
+}
+
 func CommitRest(c *github.Client, params *CommitParams) {
 	pieces := strings.Split(params.Repo, "/")
 	/*userInfo, err := GetUserInfo(c)
@@ -315,6 +385,183 @@ func CommitToFileSystem(params *CommitParams) {
 	log.Print("Data saved to filesystem at: " + filePath)
 }
 
+// Entry point function for conditional commits. It returns the blob SHA of the committed
+// file, which is the version conditional commits compare against.
+func CommitRestVersioned(c *github.Client, params *CommitParams) (string, error) {
+	if os.Getenv("SAVE_TO_FILE_SYSTEM") == "true" {
+		return CommitToFileSystemVersioned(params)
+	}
+	return CommitToGitHubVersioned(c, params)
+}
+
+// Function for committing to GitHub only when the file is still at the expected version.
+// The expected SHA is sent along with the update so GitHub rejects a concurrent change.
+func CommitToGitHubVersioned(c *github.Client, params *CommitParams) (string, error) {
+
+	pieces := strings.Split(params.Repo, "/") // Split "org/repo" into ["org", "repo"]
+
+	opts := &github.RepositoryContentGetOptions{
+		Ref: params.Branch,
+	}
+	exists := true
+	file, _, res, err := c.Repositories.GetContents(context.Background(), pieces[0], pieces[1], params.Path, opts)
+	if err != nil {
+		if res == nil || res.StatusCode != 404 {
+			return "", fmt.Errorf("github get content failure: %w", err)
+		}
+		exists = false
+	}
+
+	sha := ""
+	if exists {
+		sha = file.GetSHA()
+	}
+	if err := checkFileVersion(params, sha, exists); err != nil {
+		return "", err
+	}
+	if exists && params.IfMatch != "" && params.IfMatch != "*" {
+		sha = params.IfMatch
+	}
+
+	fileOpts := &github.RepositoryContentFileOptions{
+		Branch:  github.String(params.Branch),
+		Content: *params.Data,
+		Author: &github.CommitAuthor{
+			Name:  github.String("Todd Zmijewski"),
+			Email: github.String("angular.druid@gmail.com"),
+		},
+	}
+	var contentRes *github.RepositoryContentResponse
+	if exists {
+		fileOpts.Message = github.String("Update file " + params.Path)
+		fileOpts.SHA = github.String(sha)
+		contentRes, res, err = c.Repositories.UpdateFile(context.Background(), pieces[0], pieces[1], params.Path, fileOpts)
+	} else {
+		fileOpts.Message = github.String("Create file " + params.Path)
+		contentRes, res, err = c.Repositories.CreateFile(context.Background(), pieces[0], pieces[1], params.Path, fileOpts)
+	}
+	if err != nil {
+		// 409 is a stale sha on update, 422 a file created since it was checked.
+		if res != nil && (res.StatusCode == 409 || res.StatusCode == 422) {
+			return "", ErrVersionMismatch
+		}
+		return "", fmt.Errorf("github commit failure: %w", err)
+	}
+	log.Print("Committed GitHub file " + params.Path)
+	return contentRes.GetContent().GetSHA(), nil
+}
+
+// Function for conditionally saving data to the local filesystem. Versions are git blob
+// SHAs so they match what the GitHub loader reports.
+func CommitToFileSystemVersioned(params *CommitParams) (string, error) {
+	root := os.Getenv("FILESYSTEM_ROOT")
+	if root == "" {
+		return "", errors.New("FILESYSTEM_ROOT environment variable is not set")
+	}
+
+	filePath := filepath.Join(root, params.Repo, params.UserName, params.Path)
+	existing, err := os.ReadFile(filePath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+	sha := ""
+	if exists {
+		sha = BlobSHA(existing)
+	}
+	if err := checkFileVersion(params, sha, exists); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directories: %w", err)
+	}
+	if err := os.WriteFile(filePath, *params.Data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write data to file: %w", err)
+	}
+
+	log.Print("Data saved to filesystem at: " + filePath)
+	return BlobSHA(*params.Data), nil
+}
+
+// BlobSHA computes the git blob SHA of a file's content.
+func BlobSHA(data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func checkFileVersion(params *CommitParams, sha string, exists bool) error {
+	if params.IfNoneMatch && exists {
+		return ErrVersionMismatch
+	}
+	if params.IfMatch != "" && (!exists || (params.IfMatch != "*" && params.IfMatch != sha)) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// Entry point function that decides where to delete the data from, mirroring CommitRestOptimized.
+func DeleteRestOptimized(c *github.Client, params *CommitParams) error {
+	if os.Getenv("SAVE_TO_FILE_SYSTEM") == "true" {
+		return DeleteFromFileSystem(params)
+	}
+	return DeleteFromGitHub(c, params)
+}
+
+// Function for deleting a file directly on GitHub. A file that is already gone is not an error.
+func DeleteFromGitHub(c *github.Client, params *CommitParams) error {
+
+	pieces := strings.Split(params.Repo, "/") // Split "org/repo" into ["org", "repo"]
+
+	opts := &github.RepositoryContentGetOptions{
+		Ref: params.Branch,
+	}
+	file, _, res, err := c.Repositories.GetContents(context.Background(), pieces[0], pieces[1], params.Path, opts)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			log.Print("GitHub file already deleted " + params.Path)
+			return nil
+		}
+		return fmt.Errorf("github get content failure: %w", err)
+	}
+	if file == nil {
+		return fmt.Errorf("%s is not a file", params.Path)
+	}
+
+	deleteOpts := &github.RepositoryContentFileOptions{
+		Branch:  github.String(params.Branch),
+		Message: github.String("Delete file " + params.Path),
+		Author: &github.CommitAuthor{
+			Name:  github.String("Todd Zmijewski"),
+			Email: github.String("angular.druid@gmail.com"),
+		},
+		SHA: file.SHA,
+	}
+	if _, _, err := c.Repositories.DeleteFile(context.Background(), pieces[0], pieces[1], params.Path, deleteOpts); err != nil {
+		return fmt.Errorf("github delete failure: %w", err)
+	}
+	log.Print("Deleted GitHub file " + params.Path)
+	return nil
+}
+
+// Function for deleting data saved by CommitToFileSystem.
+func DeleteFromFileSystem(params *CommitParams) error {
+	root := os.Getenv("FILESYSTEM_ROOT")
+	if root == "" {
+		return errors.New("FILESYSTEM_ROOT environment variable is not set")
+	}
+
+	filePath := filepath.Join(root, params.Repo, params.UserName, params.Path)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", filePath, err)
+	}
+
+	log.Print("Data deleted from filesystem at: " + filePath)
+	return nil
+}
+
 func GetUserInfo(client *github.Client) (*GithubUserInfo, error) {
 	user, _, err := client.Users.Get(context.Background(), "")
 	if err != nil {
@@ -488,6 +735,138 @@ func AppendToFile(ctx context.Context, client *github.Client, owner, repo, fileP
 	return nil
 }
 
+// AppendManyToFile appends several GUIDs to a catalog page in one update, so a batch
+// of new entities does not commit the page once per entity.
+func AppendManyToFile(ctx context.Context, client *github.Client, owner, repo, filePath string, guids []string, branch string) error {
+	if len(guids) == 0 {
+		return nil
+	}
+	opts := &github.RepositoryContentGetOptions{Ref: branch}
+	fileContent, _, _, err := client.Repositories.GetContents(ctx, owner, repo, filePath, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get file contents: %w", err)
+	}
+	existingContent, err := fileContent.GetContent()
+	if err != nil {
+		return fmt.Errorf("failed to decode existing content: %w", err)
+	}
+
+	allGUIDs := catalogGUIDs(existingContent)
+	for _, guid := range guids {
+		binaryGUID, err := utils.EncodeStringToFixedBytes(guid, 16)
+		if err != nil {
+			return fmt.Errorf("failed to encode GUID %s: %w", guid, err)
+		}
+		allGUIDs = append(allGUIDs, hex.EncodeToString(binaryGUID))
+	}
+
+	options := &github.RepositoryContentFileOptions{
+		Message: github.String(fmt.Sprintf("Append %d ids to %s", len(guids), filePath)),
+		Content: []byte(catalogContent(allGUIDs)),
+		SHA:     github.String(fileContent.GetSHA()),
+		Branch:  github.String(branch),
+	}
+	if _, _, err := client.Repositories.UpdateFile(ctx, owner, repo, filePath, options); err != nil {
+		return fmt.Errorf("failed to update file in repository: %w", err)
+	}
+	return nil
+}
+
+// RemoveFromCatalog removes a GUID from whichever page of catalog/{directoryPath} lists it
+// (the inverse of AppendToFile). It reports whether the GUID was found.
+func RemoveFromCatalog(ctx context.Context, client *github.Client, owner, repo, directoryPath, guid string, branch string) (bool, error) {
+	basePath := fmt.Sprintf("catalog/%s", directoryPath)
+	opts := &github.RepositoryContentGetOptions{Ref: branch}
+
+	binaryGUID, err := utils.EncodeStringToFixedBytes(guid, 16)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode GUID: %w", err)
+	}
+	hexGUID := hex.EncodeToString(binaryGUID)
+
+	_, chapters, res, err := client.Repositories.GetContents(ctx, owner, repo, basePath, opts)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to fetch chapters: %w", err)
+	}
+
+	for _, chapter := range chapters {
+		if chapter.GetType() != "dir" {
+			continue
+		}
+		_, pages, _, err := client.Repositories.GetContents(ctx, owner, repo, chapter.GetPath(), opts)
+		if err != nil {
+			return false, fmt.Errorf("failed to fetch pages for chapter %s: %w", chapter.GetPath(), err)
+		}
+		for _, page := range pages {
+			if page.GetType() == "dir" || !strings.HasSuffix(page.GetName(), ".txt") {
+				continue
+			}
+			pageFile, _, _, err := client.Repositories.GetContents(ctx, owner, repo, page.GetPath(), opts)
+			if err != nil {
+				return false, fmt.Errorf("failed to fetch content for page %s: %w", page.GetPath(), err)
+			}
+			content, err := pageFile.GetContent()
+			if err != nil {
+				return false, fmt.Errorf("failed to decode content for page %s: %w", page.GetPath(), err)
+			}
+			guids := catalogGUIDs(content)
+			kept := make([]string, 0, len(guids))
+			for _, g := range guids {
+				if g != hexGUID {
+					kept = append(kept, g)
+				}
+			}
+			if len(kept) == len(guids) {
+				continue
+			}
+
+			options := &github.RepositoryContentFileOptions{
+				Message: github.String("Removing content via go-github"),
+				Content: []byte(catalogContent(kept)),
+				SHA:     github.String(pageFile.GetSHA()),
+				Branch:  github.String(branch),
+			}
+			if _, _, err := client.Repositories.UpdateFile(ctx, owner, repo, page.GetPath(), options); err != nil {
+				return false, fmt.Errorf("failed to update file in repository: %w", err)
+			}
+			log.Printf("Removed GUID %s from catalog page %s", guid, page.GetPath())
+			return true, nil
+		}
+	}
+
+	log.Printf("GUID %s not found in catalog %s", guid, basePath)
+	return false, nil
+}
+
+// catalogGUIDs splits a catalog page into its hex encoded GUIDs.
+func catalogGUIDs(content string) []string {
+	const guidLength = 32 // Hex-encoded 16 bytes = 32 characters.
+	var guids []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		for i := 0; i+guidLength <= len(line); i += guidLength {
+			guids = append(guids, line[i:i+guidLength])
+		}
+	}
+	return guids
+}
+
+// catalogContent groups GUIDs into lines of three, each line without spaces.
+func catalogContent(guids []string) string {
+	var lines []string
+	for i := 0; i < len(guids); i += 3 {
+		endIndex := i + 3
+		if endIndex > len(guids) {
+			endIndex = len(guids)
+		}
+		lines = append(lines, strings.Join(guids[i:endIndex], ""))
+	}
+	return strings.Join(lines, "\n")
+}
+
 func CreateFileIfNotExists(ctx context.Context, client *github.Client, owner, repo, path, content string, branch string) error {
 	
 	//
@@ -583,6 +962,31 @@ func EnsureCatalog(ctx context.Context, client *github.Client, owner, repo, dire
 	return file, nil
 }
 
+// AppendManyToCatalog appends the GUIDs of new entities stored in one chapter to
+// catalog/{directoryPath}/{chapter}, spreading them over its pages like EnsureCatalog
+// does for single entities. Each page is updated once.
+func AppendManyToCatalog(ctx context.Context, client *github.Client, owner, repo, directoryPath, chapter string, guids []string, branch string, pageMax int) error {
+	rand.Seed(time.Now().UnixNano())
+	pages := make(map[int][]string)
+	for _, guid := range guids {
+		page := 0
+		if pageMax > 0 {
+			page = rand.Intn(pageMax)
+		}
+		pages[page] = append(pages[page], guid)
+	}
+	for page, pageGUIDs := range pages {
+		pagePath := fmt.Sprintf("catalog/%s/%s/%d.txt", directoryPath, chapter, page)
+		if err := CreateFileIfNotExists(ctx, client, owner, repo, pagePath, "", branch); err != nil {
+			return fmt.Errorf("error ensuring %s: %w", pagePath, err)
+		}
+		if err := AppendManyToFile(ctx, client, owner, repo, pagePath, pageGUIDs, branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // createRepo creates a GitHub repository for a specified owner/user or organization.
 // Parameters:
 // - client: A preconfigured GitHub client to make API calls
@@ -752,6 +1156,91 @@ func CreateDevBranch(client *github.Client, owner string, repoName string) error
 	return nil
 }
 
+// CatalogGUID encodes an id the way catalog pages store it.
+func CatalogGUID(id string) (string, error) {
+	binaryGUID, err := utils.EncodeStringToFixedBytes(id, 16)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode GUID %s: %w", id, err)
+	}
+	return hex.EncodeToString(binaryGUID), nil
+}
+
+// CatalogChapters reads every page of catalog/{directoryPath} once and maps each listed
+// GUID (as returned by CatalogGUID) to its chapter. It saves a FindChapterByGUID walk
+// per id when many ids are looked up together.
+func CatalogChapters(ctx context.Context, client *github.Client, owner, repo, directoryPath, branch string) (map[string]string, error) {
+	basePath := fmt.Sprintf("catalog/%s", directoryPath)
+	opts := &github.RepositoryContentGetOptions{Ref: branch}
+	index := make(map[string]string)
+
+	_, chapters, res, err := client.Repositories.GetContents(ctx, owner, repo, basePath, opts)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return index, nil
+		}
+		return nil, fmt.Errorf("failed to fetch chapters: %w", err)
+	}
+
+	for _, chapter := range chapters {
+		if chapter.GetType() != "dir" {
+			continue
+		}
+		_, pages, _, err := client.Repositories.GetContents(ctx, owner, repo, chapter.GetPath(), opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch pages for chapter %s: %w", chapter.GetPath(), err)
+		}
+		for _, page := range pages {
+			if page.GetType() == "dir" {
+				continue
+			}
+			pageFile, _, _, err := client.Repositories.GetContents(ctx, owner, repo, page.GetPath(), opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch content for page %s: %w", page.GetPath(), err)
+			}
+			content, err := pageFile.GetContent()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode content for page %s: %w", page.GetPath(), err)
+			}
+			for _, guid := range catalogGUIDs(content) {
+				index[guid] = chapter.GetName()
+			}
+		}
+	}
+	return index, nil
+}
+
+// ChapterRepos returns the repos holding the entities of a catalog directory: the objects
+// repo followed by the clustering repo {prefix}-{chapter}-objects of every chapter the
+// catalog lists. Chapter 0 is the objects repo itself.
+func ChapterRepos(ctx context.Context, client *github.Client, owner, objectsRepo, directoryPath, branch string) ([]string, error) {
+	chapters, err := CatalogChapters(ctx, client, owner, objectsRepo, directoryPath, branch)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{"0": true}
+	var numbers []int
+	for _, chapter := range chapters {
+		if seen[chapter] {
+			continue
+		}
+		seen[chapter] = true
+		number, err := strconv.Atoi(chapter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chapter %s in catalog/%s", chapter, directoryPath)
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	repos := []string{objectsRepo}
+	repoPieces := strings.Split(objectsRepo, "-")
+	clusteringRepoPrefix := strings.Join(repoPieces[0:len(repoPieces)-1], "-")
+	for _, number := range numbers {
+		repos = append(repos, fmt.Sprintf("%s-%d-objects", clusteringRepoPrefix, number))
+	}
+	return repos, nil
+}
+
 func FindChapterByGUID(
 	ctx context.Context, 
 	client *github.Client, 
@@ -1471,4 +1960,210 @@ func CreateGithubDeployKey(ctx context.Context, httpClient *http.Client, owner,
 
 	log.Printf("Successfully created deploy key '%s' for repository '%s/%s'.", keyTitle, owner, repo)
 	return nil
-}
\ No newline at end of file
+}
+// TreeChange is a single file change applied by CommitTreeChanges.
+// A nil Content deletes the file at Path.
+type TreeChange struct {
+	Path    string
+	Content *string
+}
+
+// ListTreeFiles returns the paths of every file (blob) on a branch along with their blob SHA.
+// It uses the recursive tree API so large directories are listed in one call, and fails
+// when GitHub truncates the tree rather than return a partial listing.
+func ListTreeFiles(ctx context.Context, client *github.Client, owner, repo, branch string) (map[string]string, error) {
+	b, _, err := client.Repositories.GetBranch(ctx, owner, repo, branch, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get branch %s of %s/%s: %w", branch, owner, repo, err)
+	}
+
+	tree, _, err := client.Git.GetTree(ctx, owner, repo, b.GetCommit().GetSHA(), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree of %s/%s: %w", owner, repo, err)
+	}
+	if tree.GetTruncated() {
+		return nil, fmt.Errorf("tree of %s/%s is truncated by GitHub", owner, repo)
+	}
+
+	files := make(map[string]string)
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" {
+			files[entry.GetPath()] = entry.GetSHA()
+		}
+	}
+	return files, nil
+}
+
+// CommitTreeChanges writes many file changes to a branch as a single commit
+// (inline tree entries -> tree -> commit -> ref update) and returns the new commit SHA.
+func CommitTreeChanges(ctx context.Context, client *github.Client, owner, repo, branch, message string, changes []TreeChange) (string, error) {
+	if len(changes) == 0 {
+		return "", errors.New("no changes to commit")
+	}
+
+	b, _, err := client.Repositories.GetBranch(ctx, owner, repo, branch, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to get branch %s of %s/%s: %w", branch, owner, repo, err)
+	}
+	headSha := b.GetCommit().GetSHA()
+
+	entries := make([]*github.TreeEntry, 0, len(changes))
+	for _, change := range changes {
+		entries = append(entries, &github.TreeEntry{
+			Path:    github.String(change.Path),
+			Mode:    github.String("100644"),
+			Type:    github.String("blob"),
+			Content: change.Content,
+		})
+	}
+
+	tree, _, err := client.Git.CreateTree(ctx, owner, repo, headSha, entries)
+	if err != nil {
+		return "", fmt.Errorf("failed to create tree in %s/%s: %w", owner, repo, err)
+	}
+
+	newCommit := &github.Commit{
+		Parents: []*github.Commit{{SHA: github.String(headSha)}},
+		Tree:    tree,
+		Message: github.String(message),
+	}
+	commit, _, err := client.Git.CreateCommit(ctx, owner, repo, newCommit)
+	if err != nil {
+		return "", fmt.Errorf("failed to create commit in %s/%s: %w", owner, repo, err)
+	}
+
+	updateRef := &github.Reference{
+		Ref: github.String("refs/heads/" + branch),
+		Object: &github.GitObject{
+			SHA:  commit.SHA,
+			Type: github.String("commit"),
+		},
+	}
+	if _, res, err := client.Git.UpdateRef(ctx, owner, repo, updateRef, false); err != nil {
+		if res != nil && res.StatusCode == http.StatusUnprocessableEntity {
+			return "", fmt.Errorf("%w: %s of %s/%s: %v", ErrRefConflict, branch, owner, repo, err)
+		}
+		return "", fmt.Errorf("failed to update ref %s of %s/%s: %w", branch, owner, repo, err)
+	}
+
+	log.Printf("Committed %d changes to %s/%s@%s in %s", len(changes), owner, repo, branch, commit.GetSHA())
+	return commit.GetSHA(), nil
+}
+
+// ErrRefConflict is returned by CommitTreeChanges when the branch moved while the commit
+// was built. The commit is not applied, it can be rebuilt on the new head.
+var ErrRefConflict = errors.New("branch moved during commit")
+
+// CommitTreeRestOptimized writes many files as a single commit. When the branch moves
+// underneath the commit is rebuilt on the new head, up to three attempts. With
+// SAVE_TO_FILE_SYSTEM the files are written to disk like CommitToFileSystem.
+func CommitTreeRestOptimized(c *github.Client, params *CommitParams, message string, changes []TreeChange) (string, error) {
+	if os.Getenv("SAVE_TO_FILE_SYSTEM") == "true" {
+		return "", CommitTreeToFileSystem(params, changes)
+	}
+	pieces := strings.Split(params.Repo, "/") // Split "org/repo" into ["org", "repo"]
+	var sha string
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		sha, err = CommitTreeChanges(context.Background(), c, pieces[0], pieces[1], params.Branch, message, changes)
+		if !errors.Is(err, ErrRefConflict) {
+			return sha, err
+		}
+		log.Printf("Branch %s of %s moved, retrying tree commit (attempt %d)", params.Branch, params.Repo, attempt)
+	}
+	return "", err
+}
+
+// CommitTreeToFileSystem writes or removes every changed file below FILESYSTEM_ROOT.
+func CommitTreeToFileSystem(params *CommitParams, changes []TreeChange) error {
+	root := os.Getenv("FILESYSTEM_ROOT")
+	if root == "" {
+		return errors.New("FILESYSTEM_ROOT environment variable is not set")
+	}
+	for _, change := range changes {
+		filePath := filepath.Join(root, params.Repo, params.UserName, change.Path)
+		if change.Content == nil {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", filePath, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directories for %s: %w", filePath, err)
+		}
+		if err := os.WriteFile(filePath, []byte(*change.Content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", filePath, err)
+		}
+	}
+	log.Printf("Wrote %d files to the filesystem", len(changes))
+	return nil
+}
+
+// FileRevision is a commit that touched a file.
+type FileRevision struct {
+	SHA     string    `json:"sha"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+}
+
+// ErrFileNotFound is returned when a file does not exist at the requested ref.
+var ErrFileNotFound = errors.New("file not found")
+
+// FileHistory lists up to limit commits of a branch that touched a file, newest first.
+func FileHistory(ctx context.Context, client *github.Client, owner, repo, path, branch string, limit int) ([]FileRevision, error) {
+	perPage := 100
+	if limit > 0 && limit < perPage {
+		perPage = limit
+	}
+	opts := &github.CommitsListOptions{
+		SHA:         branch,
+		Path:        path,
+		ListOptions: github.ListOptions{PerPage: perPage},
+	}
+
+	revisions := make([]FileRevision, 0)
+	for {
+		commits, res, err := client.Repositories.ListCommits(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list commits of %s in %s/%s: %w", path, owner, repo, err)
+		}
+		for _, c := range commits {
+			author := c.GetCommit().GetAuthor()
+			revisions = append(revisions, FileRevision{
+				SHA:     c.GetSHA(),
+				Author:  author.GetName(),
+				Email:   author.GetEmail(),
+				Date:    author.GetDate(),
+				Message: c.GetCommit().GetMessage(),
+			})
+			if limit > 0 && len(revisions) == limit {
+				return revisions, nil
+			}
+		}
+		if res.NextPage == 0 {
+			return revisions, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+// GetFileAtRef returns the content and blob SHA of a file at a commit, branch or tag.
+func GetFileAtRef(ctx context.Context, client *github.Client, owner, repo, path, ref string) ([]byte, string, error) {
+	file, _, res, err := client.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{Ref: ref})
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return nil, "", ErrFileNotFound
+		}
+		return nil, "", fmt.Errorf("failed to get %s at %s: %w", path, ref, err)
+	}
+	if file == nil {
+		return nil, "", fmt.Errorf("%s is not a file", path)
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode %s at %s: %w", path, ref, err)
+	}
+	return []byte(content), file.GetSHA(), nil
+}
@@ -0,0 +1,359 @@
+package search
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ====================================================================
+// === SEARCH RESULT CACHE ============================================
+// ====================================================================
+//
+// Payloads are cached under a hash of the canonical query and the head commits of
+// the repos it reads (objects repo for index configs plus each index repo), so any
+// new commit produces new keys and stale entries simply age out.
+
+// ResultCache stores search payloads by key. Implementations must be safe for concurrent use.
+type ResultCache interface {
+	Get(key string) (*SearchResultPayload, bool)
+	Set(key string, payload *SearchResultPayload)
+}
+
+// SearchCacheKey hashes the canonical form of a query with the head commits it was computed from
+// and the principal, since security predicates make results differ between callers.
+func SearchCacheKey(owner string, repoName string, branch string, query *TopLevelQuery, heads []string, principal *Principal) (string, error) {
+	// Struct fields marshal in declaration order and map keys sorted, which makes the JSON canonical.
+	canonical, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s@%s\n%s\n", owner, repoName, branch, principal.CacheKey())
+	h.Write(canonical)
+	for _, head := range heads {
+		fmt.Fprintf(h, "\n%s", head)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// QueryIndexes returns the distinct indexes a top level query reads: the indexes of its
+// queries and of the subqueries, moreLikeThis conditions and filters within them. The
+// indexes read by security predicates are added by the loader (see queryRepos).
+func QueryIndexes(query *TopLevelQuery) []string {
+	c := &indexCollector{seen: make(map[string]bool)}
+	if query.Query != nil {
+		c.query(query.Query)
+	}
+	if query.Union != nil {
+		for i := range query.Union.Queries {
+			c.query(&query.Union.Queries[i])
+		}
+	}
+	return c.indexes
+}
+
+// indexCollector walks a query tree collecting the indexes it reads in first seen order.
+type indexCollector struct {
+	seen    map[string]bool
+	indexes []string
+}
+
+func (c *indexCollector) add(index string) {
+	if !c.seen[index] {
+		c.seen[index] = true
+		c.indexes = append(c.indexes, index)
+	}
+}
+
+func (c *indexCollector) query(q *Query) {
+	c.add(q.Index)
+	c.bool(&q.Bool)
+	if q.PostFilter != nil {
+		c.bool(q.PostFilter)
+	}
+	for name := range q.Aggs {
+		agg := q.Aggs[name]
+		c.aggregation(&agg)
+	}
+	for _, agg := range q.FacetingAggs {
+		if agg != nil {
+			c.aggregation(agg)
+		}
+	}
+}
+
+func (c *indexCollector) bool(b *Bool) {
+	for _, cases := range [][]Case{b.All, b.One, b.None, b.Not} {
+		for i := range cases {
+			c.condition(&cases[i])
+		}
+	}
+}
+
+func (c *indexCollector) condition(cs *Case) {
+	if cs.Term != nil && cs.Term.SubQuery != nil {
+		c.query(cs.Term.SubQuery)
+	}
+	if cs.Filter != nil && cs.Filter.SubQuery != nil {
+		c.query(cs.Filter.SubQuery)
+	}
+	if cs.Match != nil && cs.Match.SubQuery != nil {
+		c.query(cs.Match.SubQuery)
+	}
+	if cs.Bool != nil {
+		c.bool(cs.Bool)
+	}
+	if cs.NestedDoc != nil {
+		c.bool(&cs.NestedDoc.Bool)
+	}
+	// Without an index the liked document comes from the index being searched.
+	if cs.MoreLikeThis != nil && cs.MoreLikeThis.Index != "" {
+		c.add(cs.MoreLikeThis.Index)
+	}
+}
+
+func (c *indexCollector) aggregation(agg *Aggregation) {
+	if agg.Filter != nil {
+		c.bool(agg.Filter)
+	}
+	for name := range agg.Filters {
+		filter := agg.Filters[name]
+		c.bool(&filter)
+	}
+	if agg.Having != nil {
+		c.bool(agg.Having)
+	}
+	for _, sub := range agg.Aggs {
+		if sub != nil {
+			c.aggregation(sub)
+		}
+	}
+}
+
+// HeadCommits returns the commit SHA the objects repo and the index repos are read at
+// (branch heads unless pinned by a point-in-time ref).
+func (l *GitHubLoader) HeadCommits(ctx context.Context, config *GetIndexConfigurationInput, indexIds []string) ([]string, error) {
+	repos, err := l.queryRepos(config, indexIds)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := strings.Split(config.Repo, "/")[0]
+	heads := make([]string, 0, len(repos))
+	for _, repoName := range repos {
+		sha, _, err := l.GitHubClient.Repositories.GetCommitSHA1(ctx, owner, repoName, config.RefFor(repoName), "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve head of %s@%s: %v", repoName, config.RefFor(repoName), err)
+		}
+		heads = append(heads, sha)
+	}
+	return heads, nil
+}
+
+// --------------------------------------------------------------------
+// Hit rate counters
+// --------------------------------------------------------------------
+
+// CountingResultCache wraps a cache with hit and miss counters.
+type CountingResultCache struct {
+	Cache  ResultCache
+	hits   uint64
+	misses uint64
+}
+
+// NewCountingResultCache wraps a cache with hit and miss counters.
+func NewCountingResultCache(cache ResultCache) *CountingResultCache {
+	return &CountingResultCache{Cache: cache}
+}
+
+func (c *CountingResultCache) Get(key string) (*SearchResultPayload, bool) {
+	payload, ok := c.Cache.Get(key)
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return payload, ok
+}
+
+func (c *CountingResultCache) Set(key string, payload *SearchResultPayload) {
+	c.Cache.Set(key, payload)
+}
+
+// Stats returns the hits, misses and hit rate since the cache was created.
+func (c *CountingResultCache) Stats() (uint64, uint64, float64) {
+	hits := atomic.LoadUint64(&c.hits)
+	misses := atomic.LoadUint64(&c.misses)
+	if hits+misses == 0 {
+		return 0, 0, 0
+	}
+	return hits, misses, float64(hits) / float64(hits+misses)
+}
+
+// --------------------------------------------------------------------
+// In-memory LRU
+// --------------------------------------------------------------------
+
+// MemoryResultCache keeps the most recently used payloads in memory.
+type MemoryResultCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key     string
+	payload *SearchResultPayload
+}
+
+// NewMemoryResultCache creates an LRU cache holding up to capacity payloads.
+func NewMemoryResultCache(capacity int) *MemoryResultCache {
+	if capacity <= 0 {
+		capacity = 100
+	}
+	return &MemoryResultCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *MemoryResultCache) Get(key string) (*SearchResultPayload, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*memoryCacheEntry).payload, true
+}
+
+func (c *MemoryResultCache) Set(key string, payload *SearchResultPayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*memoryCacheEntry).payload = payload
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, payload: payload})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+// --------------------------------------------------------------------
+// Local disk (also the local stand-in for remote caches)
+// --------------------------------------------------------------------
+
+// DiskResultCache stores payloads as {dir}/{key}.json.
+type DiskResultCache struct {
+	Dir string
+}
+
+// NewDiskResultCache creates the cache directory if needed.
+func NewDiskResultCache(dir string) (*DiskResultCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskResultCache{Dir: dir}, nil
+}
+
+func (c *DiskResultCache) Get(key string) (*SearchResultPayload, bool) {
+	b, err := os.ReadFile(filepath.Join(c.Dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	return decodeCachedPayload(b)
+}
+
+func (c *DiskResultCache) Set(key string, payload *SearchResultPayload) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("DiskResultCache: Unable to encode payload: %v", err)
+		return
+	}
+	// Write then rename so concurrent readers never see a partial file.
+	tmp := filepath.Join(c.Dir, key+".json.tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("DiskResultCache: Unable to write %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(c.Dir, key+".json")); err != nil {
+		log.Printf("DiskResultCache: Unable to store %s: %v", key, err)
+	}
+}
+
+// --------------------------------------------------------------------
+// S3 (shared between lambda instances)
+// --------------------------------------------------------------------
+
+// S3ResultCache stores payloads as s3://{bucket}/{prefix}{key}.json. Expiry is left
+// to a bucket lifecycle rule since keys change with every commit.
+type S3ResultCache struct {
+	Bucket string
+	Prefix string
+	client *s3.S3
+}
+
+// NewS3ResultCache creates an S3 backed cache.
+func NewS3ResultCache(sess *session.Session, bucket string, prefix string) *S3ResultCache {
+	return &S3ResultCache{Bucket: bucket, Prefix: prefix, client: s3.New(sess)}
+}
+
+func (c *S3ResultCache) Get(key string) (*SearchResultPayload, bool) {
+	obj, err := c.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(c.Prefix + key + ".json"),
+	})
+	if err != nil {
+		return nil, false
+	}
+	defer obj.Body.Close()
+	b, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, false
+	}
+	return decodeCachedPayload(b)
+}
+
+func (c *S3ResultCache) Set(key string, payload *SearchResultPayload) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("S3ResultCache: Unable to encode payload: %v", err)
+		return
+	}
+	_, err = c.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(c.Bucket),
+		Key:         aws.String(c.Prefix + key + ".json"),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		log.Printf("S3ResultCache: Unable to store %s: %v", key, err)
+	}
+}
+
+func decodeCachedPayload(b []byte) (*SearchResultPayload, bool) {
+	var payload SearchResultPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, false
+	}
+	return &payload, true
+}
@@ -0,0 +1,327 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ====================================================================
+// === INDEX ENTRY COMPOSITES (Shared by hooks and jobs) ==============
+// ====================================================================
+
+// FieldTransform declares how a composite field value is turned into a partition
+// segment. Index configs declare them under "transforms" keyed by field name, e.g.
+//
+//	"transforms": {
+//	  "tags":      {"fanOut": true, "normalize": "slug"},
+//	  "price":     {"bucket": 100},
+//	  "createdAt": {"truncate": "month"}
+//	}
+type FieldTransform struct {
+	FanOut    bool    `json:"fanOut,omitempty"`    // Arrays produce one entry per value
+	Bucket    float64 `json:"bucket,omitempty"`    // Numbers are floored to a multiple of the bucket size
+	Precision *int    `json:"precision,omitempty"` // Decimal places used when formatting numbers
+	Truncate  string  `json:"truncate,omitempty"`  // Dates are truncated to day, month or year
+	Normalize string  `json:"normalize,omitempty"` // lowercase or slug
+}
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// GetFieldTransforms reads the "transforms" section of an index configuration.
+func GetFieldTransforms(indexEntity map[string]interface{}) map[string]FieldTransform {
+	transforms := make(map[string]FieldTransform)
+	raw, ok := indexEntity["transforms"]
+	if !ok || raw == nil {
+		return transforms
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return transforms
+	}
+	if err := json.Unmarshal(b, &transforms); err != nil {
+		log.Printf("GetFieldTransforms: Invalid transforms in index config: %v", err)
+	}
+	return transforms
+}
+
+// Apply converts a single scalar value into its partition segment.
+func (t FieldTransform) Apply(value interface{}) (string, error) {
+	var segment string
+
+	switch v := value.(type) {
+	case string:
+		segment = v
+		if t.Bucket > 0 || t.Precision != nil {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				segment = t.formatNumber(f)
+			}
+		}
+	case float64:
+		segment = t.formatNumber(v)
+	case int:
+		segment = t.formatNumber(float64(v))
+	case int64:
+		segment = t.formatNumber(float64(v))
+	case bool:
+		segment = strconv.FormatBool(v)
+	default:
+		return "", fmt.Errorf("value '%v' can not be used in a composite", value)
+	}
+
+	if t.Truncate != "" {
+		// Values that are not full dates are assumed to already be truncated (e.g. query composites).
+		if parsed, err := tryParseDate(segment); err == nil {
+			switch t.Truncate {
+			case "day":
+				segment = parsed.UTC().Format("2006-01-02")
+			case "month":
+				segment = parsed.UTC().Format("2006-01")
+			case "year":
+				segment = parsed.UTC().Format("2006")
+			default:
+				return "", fmt.Errorf("unknown date truncation '%s'", t.Truncate)
+			}
+		}
+	}
+
+	switch t.Normalize {
+	case "":
+	case "lowercase":
+		segment = strings.ToLower(segment)
+	case "slug":
+		segment = strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(segment), "-"), "-")
+	default:
+		return "", fmt.Errorf("unknown normalization '%s'", t.Normalize)
+	}
+
+	return segment, nil
+}
+
+func (t FieldTransform) formatNumber(f float64) string {
+	if t.Bucket > 0 {
+		f = math.Floor(f/t.Bucket) * t.Bucket
+	}
+	if t.Precision != nil {
+		return strconv.FormatFloat(f, 'f', *t.Precision, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// GetNestedValue extracts a field value using dot notation and returns its partition segments.
+// Only fan-out fields may return more than one segment.
+func GetNestedValue(data map[string]interface{}, fieldPath string, t FieldTransform) ([]string, error) {
+	value, ok := resolveRawDotNotation(data, fieldPath)
+	if !ok || value == nil {
+		return nil, fmt.Errorf("field '%s' does not exist in the provided data", fieldPath)
+	}
+	if IsEncryptedValue(value) {
+		return nil, fmt.Errorf("field '%s' is encrypted and cannot be part of a composite", fieldPath)
+	}
+
+	if arr, isArray := value.([]interface{}); isArray {
+		if !t.FanOut {
+			return nil, fmt.Errorf("field '%s' is an array but the index does not fan it out", fieldPath)
+		}
+		seen := make(map[string]bool)
+		var segments []string
+		for _, item := range arr {
+			if IsEncryptedValue(item) {
+				return nil, fmt.Errorf("field '%s' is encrypted and cannot be part of a composite", fieldPath)
+			}
+			segment, err := t.Apply(item)
+			if err != nil {
+				return nil, fmt.Errorf("field '%s': %v", fieldPath, err)
+			}
+			if !seen[segment] {
+				seen[segment] = true
+				segments = append(segments, segment)
+			}
+		}
+		if len(segments) == 0 {
+			return nil, fmt.Errorf("field '%s' is an empty array", fieldPath)
+		}
+		return segments, nil
+	}
+
+	segment, err := t.Apply(value)
+	if err != nil {
+		return nil, fmt.Errorf("field '%s': %v", fieldPath, err)
+	}
+	return []string{segment}, nil
+}
+
+// ExtractCompositePrefixes builds every composite directory of an entity for the
+// given index configuration by joining the index `fields` values with ":".
+// Fan-out fields multiply the prefixes (one per combination of values).
+func ExtractCompositePrefixes(entityJSON map[string]interface{}, indexEntity map[string]interface{}) ([]string, error) {
+	// Extract the `fields` array from the index entity
+	fields, ok := indexEntity["fields"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'fields' is missing or not an array in the index entity")
+	}
+
+	transforms := GetFieldTransforms(indexEntity)
+
+	prefixes := []string{""}
+	for idx, field := range fields {
+		fieldName, ok := field.(string)
+		if !ok {
+			return nil, fmt.Errorf("field name '%v' is not a string", field)
+		}
+
+		segments, err := GetNestedValue(entityJSON, fieldName, transforms[fieldName])
+		if err != nil {
+			return nil, fmt.Errorf("error extracting field '%s': %v", fieldName, err)
+		}
+
+		var next []string
+		for _, prefix := range prefixes {
+			for _, segment := range segments {
+				if idx > 0 {
+					next = append(next, prefix+":"+segment)
+				} else {
+					next = append(next, segment)
+				}
+			}
+		}
+		prefixes = next
+	}
+
+	return prefixes, nil
+}
+
+// ExtractAndCombineFields builds the single composite directory of an entity.
+// It fails for entities that fan out into several partitions.
+func ExtractAndCombineFields(entityJSON map[string]interface{}, indexEntity map[string]interface{}) (string, error) {
+	prefixes, err := ExtractCompositePrefixes(entityJSON, indexEntity)
+	if err != nil {
+		return "", err
+	}
+	if len(prefixes) != 1 {
+		return "", fmt.Errorf("entity fans out into %d partitions", len(prefixes))
+	}
+	return prefixes[0], nil
+}
+
+// PartitionFields returns the composite `fields` of an index configuration, nil for
+// indexes that are not partitioned (e.g. the opensearch backend).
+func PartitionFields(indexEntity map[string]interface{}) []string {
+	if IndexBackend(indexEntity) == OpenSearchBackend {
+		return nil
+	}
+	fields, _ := indexEntity["fields"].([]interface{})
+	partitions := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if fieldName, ok := field.(string); ok {
+			partitions = append(partitions, fieldName)
+		}
+	}
+	return partitions
+}
+
+// TransformCompositeValue converts a query composite value into the partition segment
+// the writer produced for the same field. Fields without a declared transform still go
+// through the zero transform, which formats numbers the way the writer does.
+func TransformCompositeValue(transforms map[string]FieldTransform, field string, value interface{}) string {
+	segment, err := transforms[field].Apply(value)
+	if err != nil {
+		log.Printf("TransformCompositeValue: %v", err)
+		return fmt.Sprintf("%v", value)
+	}
+	return segment
+}
+
+// EncodeIndexEntryName encodes an entity as the file name of its index entry.
+// GitHubFileIterator reverses this when loading documents.
+func EncodeIndexEntryName(entityJSON map[string]interface{}) (string, error) {
+	doc, _ := withoutEncrypted(entityJSON)
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// IndexEntryPaths returns the full paths of an entity's index entries for an index configuration.
+func IndexEntryPaths(entityJSON map[string]interface{}, indexEntity map[string]interface{}) ([]string, error) {
+	prefixes, err := ExtractCompositePrefixes(entityJSON, indexEntity)
+	if err != nil {
+		return nil, err
+	}
+	name, err := EncodeIndexEntryName(entityJSON)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		paths = append(paths, prefix+"/"+name)
+	}
+	return paths, nil
+}
+
+// EncryptedValueKey is the member of the envelopes entity storage commits in place of
+// x-encrypted contract fields.
+const EncryptedValueKey = "x-encrypted"
+
+// IsEncryptedValue reports whether a value is an encrypted field envelope.
+func IsEncryptedValue(value interface{}) bool {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return false
+	}
+	_, ok = obj[EncryptedValueKey].(map[string]interface{})
+	return ok
+}
+
+// withoutEncrypted drops encrypted field envelopes, values without any are returned as is.
+func withoutEncrypted(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var out map[string]interface{}
+		for k, item := range v {
+			stripped, changed := withoutEncrypted(item)
+			encrypted := IsEncryptedValue(item)
+			if !encrypted && !changed {
+				continue
+			}
+			if out == nil {
+				out = make(map[string]interface{}, len(v))
+				for key, value := range v {
+					out[key] = value
+				}
+			}
+			if encrypted {
+				delete(out, k)
+			} else {
+				out[k] = stripped
+			}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case []interface{}:
+		changed := false
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if IsEncryptedValue(item) {
+				changed = true
+				continue
+			}
+			stripped, itemChanged := withoutEncrypted(item)
+			changed = changed || itemChanged
+			out = append(out, stripped)
+		}
+		if !changed {
+			return v, false
+		}
+		return out, true
+	}
+	return value, false
+}
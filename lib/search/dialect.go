@@ -179,6 +179,7 @@ type Case struct {
 	Missing     *Missing 	 `json:"missing,omitempty"`
 	Exists      *Exists 	 `json:"exists,omitempty"`
 	Template    *Template    `json:"template,omitempty"`   // NEW: Template-based condition
+	MoreLikeThis *MoreLikeThis `json:"moreLikeThis,omitempty"` // Similar documents by liked document or text
 }
 
 // Bool implements the recursive AND/OR/NOT logic.
@@ -244,6 +245,19 @@ type Aggregation struct {
 	// NEW: For histogram/range aggregation (only one field per map is usually used)
 	RangeBuckets map[string][]RangeBucket `json:"rangeBuckets,omitempty"` // Key=Field Name, Value=Buckets
 
+    // NEW: Single bucket of the documents matching the Bool (type "filter")
+    Filter *Bool `json:"filter,omitempty"`
+
+    // NEW: One bucket per named Bool (type "filters"). Documents may fall into several buckets.
+    Filters map[string]Bool `json:"filters,omitempty"`
+
+    // NEW: Adds a bucket for documents matching none of the Filters, keyed by OtherBucketKey (default "_other_").
+    OtherBucket    bool   `json:"otherBucket,omitempty"`
+    OtherBucketKey string `json:"otherBucketKey,omitempty"`
+
+    // NEW: Single bucket of the documents where the field is missing or null (type "missing")
+    Missing *Missing `json:"missing,omitempty"`
+
 	// Metrics is a slice of requests, supporting multiple types and fields
 	Metrics []MetricRequest `json:"metrics,omitempty"`
 
@@ -255,6 +269,10 @@ type Aggregation struct {
 
     // NEW: Pipeline Aggregations that operate on the results of the primary buckets
     PipelineAggs map[string]PipelineRequest `json:"pipelineAggs,omitempty"` 
+
+    // NEW: Keeps only the buckets matching the Bool. Conditions see the bucket as a document
+    // of its metrics plus "key" and "_count" (SQL HAVING).
+    Having *Bool `json:"having,omitempty"`
 }
 
 // NEW STRUCT
@@ -270,6 +288,14 @@ type TopHits struct {
     Source []string `json:"source,omitempty"` // Which fields to project (reuses existing source projection)
 }
 
+// NEW STRUCT
+// Collapse keeps only the top hit per distinct value of Field (e.g., one ad per "userId").
+// Documents without the field are never collapsed together.
+type Collapse struct {
+    Field string `json:"field"` // Field whose value identifies the group
+    InnerHits *TopHits `json:"innerHits,omitempty"` // Optional hits of the rest of the group (reuses existing TopHits)
+}
+
 // SortField defines how to sort the final result set
 type SortField struct {
 	Field string    `json:"field"`
@@ -300,6 +326,16 @@ type Query struct {
     
     // Faceting
     FacetingAggs map[string]*Aggregation `json:"facetingAggs,omitempty"`
+
+    // Field collapsing
+    Collapse *Collapse `json:"collapse,omitempty"`
+
+    // Only the facets are wanted (answered from partition rollups when possible)
+    FacetsOnly bool `json:"facetsOnly,omitempty"`
+
+    // "Did you mean" for Match conditions when nothing matched, optionally rerunning the correction
+    SuggestCorrections bool `json:"suggestCorrections,omitempty"`
+    AutoCorrect        bool `json:"autoCorrect,omitempty"`
 }
 
 // UnionQuery combines the results of multiple standard Queries.
@@ -307,10 +343,14 @@ type UnionQuery struct {
 	Queries []Query `json:"queries"`
 }
 
-// TopLevelQuery wraps either a single Query or a UnionQuery.
+// TopLevelQuery wraps either a single Query, a UnionQuery or a SQL statement (see ParseSQL).
 type TopLevelQuery struct {
 	Query *Query      `json:"query,omitempty"`
 	Union *UnionQuery `json:"union,omitempty"`
+	SQL   string      `json:"sql,omitempty"`
+
+	Branch string `json:"branch,omitempty"` // Defaults to dev
+	Ref    string `json:"ref,omitempty"`    // Commit SHA or tag to search as of
 }
 
 // GetIndexConfigurationInput holds the necessary parameters for fetching the index config.
@@ -321,6 +361,7 @@ type GetIndexConfigurationInput struct {
 	Repo string
 	Branch string
 	Id string // Index ID (e.g., "ads", "users")
+	Refs map[string]string // Pinned commit per repo name for point-in-time search (see ResolveRefs)
 }
 
 // ----------------------------------------------------
@@ -1422,6 +1463,11 @@ func (c *Case) Evaluate(data map[string]interface{}, ctx context.Context, loader
         return EvaluateMatchPhrase(data, c.MatchPhrase) 
     }
 
+    // Handle MoreLikeThis logic (Relevancy, scored like Match)
+    if c.MoreLikeThis != nil {
+        return EvaluateMoreLikeThis(data, c.MoreLikeThis, ctx, loader, indexInput)
+    }
+
 	// I) Extract Condition and default Operation (for Term/Filter)
 	var condition Condition
 	var defaultOp Operation = Equal
@@ -2080,6 +2126,11 @@ func ProjectFields(docs []map[string]interface{}, source []string) []map[string]
         if score, ok := doc["_score"]; ok {
             newDoc["_score"] = score
         }
+
+        // Inner hits from field collapsing are projected separately, keep them as-is.
+        if innerHits, ok := doc["_innerHits"]; ok {
+            newDoc["_innerHits"] = innerHits
+        }
         
         projectedDocs = append(projectedDocs, newDoc)
     }
@@ -2201,6 +2252,58 @@ func ApplyPaging(docs []map[string]interface{}, limit, offset int) []map[string]
 	return docs[start:end]
 }
 
+// ApplyCollapse reduces an already sorted document list to the first document per value
+// of collapse.Field. When InnerHits is requested, every group member (top hit included)
+// is attached to the top hit under "_innerHits" after its own sort, size and source.
+// It returns the collapsed documents; the input order of the top hits is preserved.
+func ApplyCollapse(docs []map[string]interface{}, collapse *Collapse) []map[string]interface{} {
+    if collapse == nil || collapse.Field == "" {
+        return docs
+    }
+
+    collapsed := make([]map[string]interface{}, 0, len(docs))
+    groups := make(map[string][]map[string]interface{})
+    tops := make(map[string]map[string]interface{})
+    keys := make([]string, 0)
+
+    for _, doc := range docs {
+        key, exists := resolveDotNotation(doc, collapse.Field)
+        if !exists {
+            // No value to group on, the document stands on its own.
+            collapsed = append(collapsed, doc)
+            continue
+        }
+        if _, seen := groups[key]; !seen {
+            // Copy the top hit so inner hits never reference the document they are attached to.
+            top := make(map[string]interface{}, len(doc)+1)
+            for k, v := range doc {
+                top[k] = v
+            }
+            tops[key] = top
+            keys = append(keys, key)
+            collapsed = append(collapsed, top)
+        }
+        groups[key] = append(groups[key], doc)
+    }
+
+    if collapse.InnerHits != nil {
+        for _, key := range keys {
+            hitsDocs := groups[key]
+            if len(collapse.InnerHits.Sort) > 0 {
+                hitsDocs = ApplySort(hitsDocs, collapse.InnerHits.Sort)
+            }
+            hitsDocs = ApplyPaging(hitsDocs, collapse.InnerHits.Size, 0)
+            if len(collapse.InnerHits.Source) > 0 {
+                hitsDocs = ProjectFields(hitsDocs, collapse.InnerHits.Source)
+            }
+            tops[key]["_innerHits"] = hitsDocs
+        }
+    }
+
+    log.Printf("ApplyCollapse: Collapsed %d documents into %d hits on field '%s'.", len(docs), len(collapsed), collapse.Field)
+    return collapsed
+}
+
 func ApplyScoreModifiers(docs []map[string]interface{}, fs *FunctionScore) {
     if fs == nil || len(fs.Functions) == 0 {
         return
@@ -2394,13 +2497,14 @@ func ExecuteSubQuery(
 // ExecuteAggregation recursively groups and calculates metrics on a list of documents.
 // ExecuteAggregation recursively groups and calculates metrics on a list of documents.
 // It is the entry point for all aggregation requests.
-func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) AggregationResult {
+func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) AggregationResult {
     
     // Default empty result for error/no-op paths
     emptyResult := AggregationResult{Buckets: []Bucket{}, PipelineMetrics: make(map[string]interface{})}
 
     // Determine if we need to group the documents (primary grouping/bucketization)
-    hasGrouping := len(agg.GroupBy) > 0 || len(agg.RangeBuckets) > 0 || agg.DateHistogram != nil || agg.Path != "" 
+    hasGrouping := len(agg.GroupBy) > 0 || len(agg.RangeBuckets) > 0 || agg.DateHistogram != nil || agg.Path != "" ||
+        agg.Filter != nil || len(agg.Filters) > 0 || agg.Missing != nil
     hasMetrics := agg != nil && (len(agg.Metrics) > 0 || len(agg.Aggs) > 0 || len(agg.PipelineAggs) > 0)
 
     // --- Placeholder for the generated buckets list ---
@@ -2413,7 +2517,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
         if hasMetrics {
             log.Print("ExecuteAggregation: No primary grouping defined. Calculating top-level metrics/aggregations.")
             // Create a single, anonymous bucket for the entire document set and process it.
-            topBucket := processGroup(agg, "", docs) 
+            topBucket := processGroup(agg, "", docs, ctx, loader, indexInput) 
             buckets = []Bucket{topBucket} // Store in the buckets slice
         } else {
             // Final exit if neither grouping nor metrics/aggs are defined.
@@ -2429,7 +2533,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
         if agg.Path != "" {
             log.Printf("ExecuteAggregation: Detected Nested Aggregation on path '%s'.", agg.Path)
             // Nested aggregation handles both unnesting and recursive processing via its inner Aggs map.
-            buckets = executeNestedAggregation(docs, agg)
+            buckets = executeNestedAggregation(docs, agg, ctx, loader, indexInput)
 
         } else if len(agg.GroupBy) > 0 {
             groupByField := agg.GroupBy[0] 
@@ -2446,7 +2550,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
             buckets = make([]Bucket, 0, len(groups))
             for key, groupDocs := range groups {
                 // Process the group to calculate metrics and run sub-aggs
-                newBucket := processGroup(agg, key, groupDocs)
+                newBucket := processGroup(agg, key, groupDocs, ctx, loader, indexInput)
                 buckets = append(buckets, newBucket)
             }
             
@@ -2482,7 +2586,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
             buckets = make([]Bucket, 0, len(ranges))
             for _, r := range ranges { 
                 groupDocs := rangeGroups[r.Key]
-                newBucket := processGroup(agg, r.Key, groupDocs)
+                newBucket := processGroup(agg, r.Key, groupDocs, ctx, loader, indexInput)
                 buckets = append(buckets, newBucket)
             }
 
@@ -2515,7 +2619,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
             // Convert map to buckets and process each group
             buckets = make([]Bucket, 0, len(groups))
             for key, groupDocs := range groups {
-                newBucket := processGroup(agg, key, groupDocs)
+                newBucket := processGroup(agg, key, groupDocs, ctx, loader, indexInput)
                 buckets = append(buckets, newBucket)
             }
             
@@ -2523,9 +2627,17 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
             sort.Slice(buckets, func(i, j int) bool {
                 return buckets[i].Key < buckets[j].Key
             })
+
+        } else if agg.Filter != nil || len(agg.Filters) > 0 || agg.Missing != nil {
+            // Filter, filters and missing all bucket on Bool.Evaluate rather than field values.
+            buckets = executeFilterAggregation(docs, agg, ctx, loader, indexInput)
         }
     }
 
+    if agg.Having != nil {
+        buckets = filterBuckets(buckets, agg.Having, ctx, loader, indexInput)
+    }
+
     // ----------------------------------------------------------------------
     // --- STEP 2: Execute Pipeline Aggregations (e.g., StatsBucket) ---
     // This runs AFTER all primary buckets and their intra-bucket metrics (Pass 1 & 2) are complete.
@@ -2545,6 +2657,98 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
     }
 }
 
+// filterBuckets drops the buckets that do not satisfy the having condition.
+func filterBuckets(buckets []Bucket, having *Bool, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) []Bucket {
+    kept := make([]Bucket, 0, len(buckets))
+    for _, bucket := range buckets {
+        doc := make(map[string]interface{}, len(bucket.Metrics)+2)
+        for name, value := range bucket.Metrics {
+            doc[name] = value
+        }
+        doc["key"] = bucket.Key
+        doc["_count"] = bucket.Count
+        if ok, _ := having.Evaluate(doc, ctx, loader, indexInput); ok {
+            kept = append(kept, bucket)
+        }
+    }
+    log.Printf("ExecuteAggregation: Having kept %d of %d buckets.", len(kept), len(buckets))
+    return kept
+}
+
+// executeFilterAggregation builds the single-bucket "filter" and "missing" aggregations
+// and the multi-bucket "filters" aggregation. Membership is decided by Bool.Evaluate so
+// every condition type (including subqueries) is available to custom buckets.
+func executeFilterAggregation(documents []map[string]interface{}, agg *Aggregation, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) []Bucket {
+
+    // matching collects the documents that satisfy a single Bool.
+    matching := func(filter *Bool) []map[string]interface{} {
+        matched := make([]map[string]interface{}, 0)
+        for _, doc := range documents {
+            if ok, _ := filter.Evaluate(doc, ctx, loader, indexInput); ok {
+                matched = append(matched, doc)
+            }
+        }
+        return matched
+    }
+
+    // --- Single bucket: filter / missing ---
+    if agg.Filter != nil || agg.Missing != nil {
+        filter := agg.Filter
+        key := "filter"
+        if filter == nil {
+            // A missing aggregation is a filter on the Missing case.
+            filter = &Bool{All: []Case{{Missing: agg.Missing}}}
+            key = "missing"
+        }
+        if agg.Name != "" {
+            key = agg.Name
+        }
+        log.Printf("executeFilterAggregation: Building '%s' bucket from %d documents.", key, len(documents))
+        return []Bucket{processGroup(agg, key, matching(filter), ctx, loader, indexInput)}
+    }
+
+    // --- Multi bucket: filters ---
+    // Map iteration order is random, so keys are sorted to keep the response stable.
+    keys := make([]string, 0, len(agg.Filters))
+    for k := range agg.Filters {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    log.Printf("executeFilterAggregation: Building %d named filter buckets from %d documents.", len(keys), len(documents))
+
+    buckets := make([]Bucket, 0, len(keys)+1)
+    for _, k := range keys {
+        filter := agg.Filters[k]
+        buckets = append(buckets, processGroup(agg, k, matching(&filter), ctx, loader, indexInput))
+    }
+
+    if agg.OtherBucket {
+        otherKey := agg.OtherBucketKey
+        if otherKey == "" {
+            otherKey = "_other_"
+        }
+
+        otherDocs := make([]map[string]interface{}, 0)
+        for _, doc := range documents {
+            matchedAny := false
+            for _, k := range keys {
+                filter := agg.Filters[k]
+                if ok, _ := filter.Evaluate(doc, ctx, loader, indexInput); ok {
+                    matchedAny = true
+                    break
+                }
+            }
+            if !matchedAny {
+                otherDocs = append(otherDocs, doc)
+            }
+        }
+        buckets = append(buckets, processGroup(agg, otherKey, otherDocs, ctx, loader, indexInput))
+    }
+
+    return buckets
+}
+
 // goclassifieds/lib/search/aggregation.go (Modified for Nested Logic)
 
 // goclassifieds/lib/search/aggregation.go (with debugging logs)
@@ -2553,7 +2757,7 @@ func ExecuteAggregation(docs []map[string]interface{}, agg *Aggregation) Aggrega
 // and recursively running the sub-aggregations on the new set of documents.
 // executeNestedAggregation processes documents by flattening a nested array field 
 // and recursively running the sub-aggregations on the new set of documents.
-func executeNestedAggregation(documents []map[string]interface{}, agg *Aggregation) []Bucket {
+func executeNestedAggregation(documents []map[string]interface{}, agg *Aggregation, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) []Bucket {
     // Corrected check: look for 'Aggs' instead of 'SubAggs'
     if agg.Path == "" || agg.Aggs == nil || len(agg.Aggs) == 0 { 
         log.Printf("ERROR: Nested aggregation '%s' failed. Missing 'path' or inner 'Aggs' definition.", agg.Name)
@@ -2617,10 +2821,10 @@ func executeNestedAggregation(documents []map[string]interface{}, agg *Aggregati
 
     // Run all sub-aggregations defined under the nested path.
     for subAggName, innerAgg := range agg.Aggs { // Iterate over the Aggs map
-        log.Printf("DEBUG: Executing inner aggregation '%s' (Type: %v) on the unnested set.", subAggName)
+        log.Printf("DEBUG: Executing inner aggregation '%s' (Type: %v) on the unnested set.", subAggName, innerAgg.Type)
         
         // ExecuteAggregation now returns AggregationResult, so we must access the .Buckets field.
-        innerAggResult := ExecuteAggregation(unnestedDocuments, innerAgg)
+        innerAggResult := ExecuteAggregation(unnestedDocuments, innerAgg, ctx, loader, indexInput)
 
         // The result of a nested aggregation is represented as a single bucket 
         // per inner aggregation, containing the results of that inner agg.
@@ -2788,6 +2992,9 @@ func ExecuteTopLevelPipeline(
 func ExecuteFaceting(
 	documents []map[string]interface{},
 	facetingAggs map[string]*Aggregation,
+	ctx context.Context,
+	loader DocumentLoader,
+	indexInput *GetIndexConfigurationInput,
 ) map[string][]Bucket { // Returns a map where the key is the facet name and the value is a list of Buckets.
     
 	if len(documents) == 0 || len(facetingAggs) == 0 {
@@ -2798,10 +3005,16 @@ func ExecuteFaceting(
 
     // Iterate through each requested facet aggregation
 	for aggName, aggConfig := range facetingAggs {
+
+        // NEW: Custom-defined buckets (filter, filters, missing) share the aggregation path.
+        if aggConfig.Filter != nil || len(aggConfig.Filters) > 0 || aggConfig.Missing != nil {
+            allFacetResults[aggName] = executeFilterAggregation(documents, aggConfig, ctx, loader, indexInput)
+            continue
+        }
         
         // 1. Validation: Ensure it's a "terms" aggregation and has a field to group by
 		if aggConfig.Type != "terms" || len(aggConfig.GroupBy) == 0 {
-			log.Printf("ExecuteFaceting: Skipping aggregation '%s'. Only 'terms' type with a 'groupBy' field is supported for faceting.", aggName)
+			log.Printf("ExecuteFaceting: Skipping aggregation '%s'. Only 'terms' with a 'groupBy' field, 'filter', 'filters' or 'missing' are supported for faceting.", aggName)
 			continue
 		}
 
@@ -2879,7 +3092,7 @@ func findMetricValueInBucket(b Bucket, aggPath []string, metricName string) (int
 // and calculates all requested metrics and sub-aggregations on them.
 // processGroup is the worker function that takes a subset of documents (a group) 
 // and calculates all requested metrics and sub-aggregations on them.
-func processGroup(agg *Aggregation, key string, groupDocs []map[string]interface{}) Bucket {
+func processGroup(agg *Aggregation, key string, groupDocs []map[string]interface{}, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) Bucket {
     
     bucket := Bucket{
         // FIX 1: The correct variable name is 'bucket'
@@ -3001,7 +3214,7 @@ func processGroup(agg *Aggregation, key string, groupDocs []map[string]interface
         // Loop through all named sub-aggregations
         for subAggName, subAgg := range agg.Aggs {
             // Recursively call ExecuteAggregation on the documents in this group/bucket.
-            subResult := ExecuteAggregation(groupDocs, subAgg)
+            subResult := ExecuteAggregation(groupDocs, subAgg, ctx, loader, indexInput)
             
             // Store the result in the bucket's Aggs map using the aggregation name as the key
             bucket.Aggs[subAggName] = subResult
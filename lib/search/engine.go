@@ -36,6 +36,7 @@ type UnionQueryInput struct {
 	Owner                 string
 	RepoName              string
 	Branch                string
+	Refs                  map[string]string // Pinned commits for point-in-time search
 	QueriesToExecute      []Query
 	AggregationMap        map[string]Aggregation
 	SortRequest           []SortField
@@ -45,6 +46,11 @@ type UnionQueryInput struct {
 	ScoreModifiersRequest *FunctionScore
 	PostFilter            *Bool
     FacetingAggs          map[string]*Aggregation
+    Collapse              *Collapse
+    FacetsOnly            bool
+    SuggestCorrections    bool
+    AutoCorrect           bool
+    Principal             *Principal // Caller the index security predicates are resolved for (nil is anonymous)
 }
 
 // SearchResultPayload represents the final, unified response sent back to the client.
@@ -54,6 +60,9 @@ type SearchResultPayload struct {
     
     // TotalHits reflects the count AFTER applying the PostFilter.
     TotalHits          int                    `json:"totalHits"` 
+
+    // TotalGroups reflects the count AFTER collapsing (only set when Collapse was requested).
+    TotalGroups        int                    `json:"totalGroups,omitempty"`
     IsAggregation      bool                   `json:"isAggregation"`
 
     // ----------------------------------------------------
@@ -76,6 +85,12 @@ type SearchResultPayload struct {
     // calculated using the final filtered document set.
     // Type: map[string][]Bucket
     FacetingResults map[string][]Bucket     `json:"facetingResults,omitempty"` 
+
+    // DidYouMean holds the corrected Match phrasing when the query had no hits.
+    DidYouMean      string                  `json:"didYouMean,omitempty"`
+
+    // AutoCorrected is set when the hits are those of the DidYouMean query.
+    AutoCorrected   bool                    `json:"autoCorrected,omitempty"`
 }
 
 // QueryResult holds the results from a single parallel query execution.
@@ -84,6 +99,7 @@ type QueryResult struct {
 	Error           error
 	IndexName       string
 	DocumentsCount  int
+	Dictionary      *TermDictionary
 }
 
 // SearchEngine holds the single, swappable loader dependency.
@@ -106,6 +122,27 @@ func NewSearchEngine(loader DocumentLoader) *SearchEngine {
 // It uses a worker pool (MaxFanOutLimit) to prevent resource exhaustion during the I/O phase.
 func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultPayload, error) {
 
+    // --- DOCUMENT LEVEL SECURITY ---
+    // Every load (queries, subqueries, moreLikeThis, rollups) goes through the index security
+    // predicates, so post filters and aggregations only see documents the caller may see.
+    if _, secured := e.Loader.(*SecureLoader); !secured {
+        securedEngine := &SearchEngine{Loader: NewSecureLoader(e.Loader, input.Principal)}
+        return securedEngine.ExecuteUnionQuery(input)
+    }
+
+    // --- 0. ROLLUP SHORTCUT ---
+    // Unfiltered facets are answered from the partition rollups maintained by the index hook.
+    rollupFacets, rollupTotal, fromRollups := e.facetsFromRollups(input)
+    if fromRollups && input.FacetsOnly {
+        log.Printf("Answered facet only request from rollups (%d documents).", rollupTotal)
+        return &SearchResultPayload{
+            StatusCode: http.StatusOK,
+            TotalHits: rollupTotal,
+            FacetingResults: rollupFacets,
+            IsAggregation: false,
+        }, nil
+    }
+
     // Set up concurrency controls
     var wg sync.WaitGroup
     
@@ -147,6 +184,7 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
                 Stage:        os.Getenv("STAGE"),
                 Repo:         input.Owner + "/" + input.RepoName,
                 Branch:       input.Branch,
+                Refs:         input.Refs,
                 Id:           query.Index,
             }
             
@@ -160,9 +198,25 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
             }
             defer iterator.Close()
 
+            // Term dictionary for "did you mean", built from the documents already being iterated.
+            var dictionary *TermDictionary
+            var dictionaryKey string
+            matchFields := MatchFields(query.Bool)
+            if input.SuggestCorrections && len(matchFields) > 0 {
+                dictionaryKey = termDictionaryKey(e.Loader, getIndexInput, query.Composite, matchFields)
+                if cached, ok := getCachedTermDictionary(dictionaryKey); ok {
+                    res.Dictionary = cached
+                } else {
+                    dictionary = NewTermDictionary()
+                }
+            }
+
             // Process documents (filtering/scoring)
             count := 0
             for doc, ok := iterator.Next(); ok; doc, ok = iterator.Next() {
+                if dictionary != nil {
+                    dictionary.AddDocument(doc, matchFields)
+                }
                 // Bool.Evaluate uses fuzzy MatchPhrase and other logic
                 matched, score := query.Bool.Evaluate(doc, input.Ctx, e.Loader, getIndexInput)
                 if matched {
@@ -175,6 +229,11 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
             
             if err := iterator.Error(); err != nil {
                 log.Printf("WARN: Iterator for index %s finished with non-fatal error: %v.", query.Index, err)
+            } else if dictionary != nil {
+                cacheTermDictionary(dictionaryKey, dictionary)
+            }
+            if dictionary != nil {
+                res.Dictionary = dictionary
             }
             resultsChan <- res
         }()
@@ -188,6 +247,7 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
 
     totalDocumentsProcessed := 0
     allDocuments := make([]map[string]interface{}, 0)
+    dictionary := NewTermDictionary()
     
     for res := range resultsChan {
         if res.Error != nil {
@@ -203,6 +263,7 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
         }
         allDocuments = append(allDocuments, res.Documents...)
         totalDocumentsProcessed += res.DocumentsCount
+        dictionary.Merge(res.Dictionary)
     }
     
     // --- 3. SEQUENTIAL POST-PROCESSING: FILTERING, AGGREGATION, SORT, PAGING ---
@@ -215,15 +276,19 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
     // --- 3A. POST-FILTERING (NEW STAGE) ---
     // Documents are filtered in-memory after initial parallel fetch.
     finalFilteredResults := allDocuments
+
+    // The other one is not in scope it is buried in a sub routine.
+    // Shared by the post-filter and aggregations that evaluate Bool conditions.
+    getIndexInput := &GetIndexConfigurationInput{
+        Owner:        input.Owner,
+        Stage:        os.Getenv("STAGE"),
+        Repo:         input.Owner + "/" + input.RepoName,
+        Branch:       input.Branch,
+        Refs:         input.Refs,
+        //Id:           query.Index, // We shouldn't be doing subqueries anyway here. Noop loader?
+    }
+
     if input.PostFilter != nil {
-		// The other one is not in scope it is buried in a sub routine.
-        getIndexInput := &GetIndexConfigurationInput{
-            Owner:        input.Owner,
-            Stage:        os.Getenv("STAGE"),
-            Repo:         input.Owner + "/" + input.RepoName,
-            Branch:       input.Branch,
-            //Id:           query.Index, // We shouldn't be doing subqueries anyway here. Noop loader?
-        }
         log.Printf("Applying Post-Filter Query with %d initial documents.", len(allDocuments))
         // Reuses existing BoolQuery evaluation logic.
         finalFilteredResults = ApplyPostFilter(allDocuments, input.PostFilter, input.Ctx, e.Loader, getIndexInput) 
@@ -237,9 +302,11 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
     // --- 3B. FACETING AND AGGREGATION ---
 
     // 1. Faceting Aggregations (Bucket counts for UI Filters)
-    if len(input.FacetingAggs) > 0 {
+    if fromRollups {
+        finalFacetingResults = rollupFacets
+    } else if len(input.FacetingAggs) > 0 {
         // ExecuteFaceting uses GroupDocumentsByField and runs on the filtered set
-        finalFacetingResults = ExecuteFaceting(finalFilteredResults, input.FacetingAggs)
+        finalFacetingResults = ExecuteFaceting(finalFilteredResults, input.FacetingAggs, input.Ctx, e.Loader, getIndexInput)
     }
     
     // 2. Standard and Pipeline Aggregation Handling
@@ -262,7 +329,7 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
         primaryAggName := "" 
         for name, agg := range bucketAggregations {
             // ExecuteAggregation must now use the finalFilteredResults
-            result := ExecuteAggregation(finalFilteredResults, &agg) 
+            result := ExecuteAggregation(finalFilteredResults, &agg, input.Ctx, e.Loader, getIndexInput) 
             finalAggsResults[name] = result
             if primaryAggName == "" { primaryAggName = name }
         }
@@ -305,15 +372,109 @@ func (e *SearchEngine) ExecuteUnionQuery(input *UnionQueryInput) (*SearchResultP
         if len(input.SortRequest) == 0 { input.SortRequest = []SortField{{Field: "_score", Order: SortDesc}} }
         
         ApplySort(finalFilteredResults, input.SortRequest)
+
+        // Collapsing runs on the sorted set so the top hit per group is the best one, before paging.
+        totalHits := len(finalFilteredResults)
+        totalGroups := 0
+        if input.Collapse != nil {
+            finalFilteredResults = ApplyCollapse(finalFilteredResults, input.Collapse)
+            totalGroups = len(finalFilteredResults)
+        }
+
         if len(input.SourceFields) > 0 { finalFilteredResults = ProjectFields(finalFilteredResults, input.SourceFields) }
         pagedDocuments := ApplyPaging(finalFilteredResults, input.Limit, input.Offset)
+        if input.FacetsOnly {
+            pagedDocuments = nil
+        }
         
-        return &SearchResultPayload{
+        payload := &SearchResultPayload{
             StatusCode: http.StatusOK, 
             Hits: pagedDocuments, 
-            TotalHits: len(finalFilteredResults), // TotalHits is the filtered count
+            TotalHits: totalHits, // TotalHits is the filtered count
+            TotalGroups: totalGroups,
             FacetingResults: finalFacetingResults, // Included Facets
             IsAggregation: false,
-        }, nil
+        }
+
+        // 3D. "Did you mean": only offered when nothing matched.
+        if totalHits == 0 && input.SuggestCorrections {
+            return e.suggestCorrections(input, payload, dictionary)
+        }
+        return payload, nil
+    }
+}
+
+// suggestCorrections adds the corrected phrasing to an empty result and, when AutoCorrect
+// is set, reruns the corrected queries and returns their hits instead.
+func (e *SearchEngine) suggestCorrections(input *UnionQueryInput, payload *SearchResultPayload, dictionary *TermDictionary) (*SearchResultPayload, error) {
+    corrections := SuggestCorrections(input.QueriesToExecute, dictionary)
+    if len(corrections) == 0 {
+        return payload, nil
+    }
+    payload.DidYouMean = DidYouMean(input.QueriesToExecute, corrections)
+    log.Printf("No hits, did you mean: %s", payload.DidYouMean)
+
+    if !input.AutoCorrect {
+        return payload, nil
+    }
+
+    corrected := *input
+    corrected.SuggestCorrections = false
+    corrected.AutoCorrect = false
+    corrected.QueriesToExecute = make([]Query, len(input.QueriesToExecute))
+    for i, query := range input.QueriesToExecute {
+        query.Bool = RewriteMatches(query.Bool, corrections)
+        corrected.QueriesToExecute[i] = query
+    }
+
+    rerun, err := e.ExecuteUnionQuery(&corrected)
+    if err != nil || rerun.StatusCode != http.StatusOK || rerun.TotalHits == 0 {
+        return payload, nil
+    }
+    rerun.DidYouMean = payload.DidYouMean
+    rerun.AutoCorrected = true
+    return rerun, nil
+}
+// facetsFromRollups answers the faceting aggs from partition rollups when nothing filters
+// the documents (no query conditions, no post filter) and every facet is a rolled up terms facet.
+func (e *SearchEngine) facetsFromRollups(input *UnionQueryInput) (map[string][]Bucket, int, bool) {
+    if len(input.FacetingAggs) == 0 || input.PostFilter != nil {
+        return nil, 0, false
+    }
+    rollupLoader, ok := e.Loader.(RollupLoader)
+    if !ok {
+        return nil, 0, false
     }
-}
\ No newline at end of file
+    for _, query := range input.QueriesToExecute {
+        if len(query.Bool.All) > 0 || len(query.Bool.None) > 0 || len(query.Bool.One) > 0 || len(query.Bool.Not) > 0 {
+            return nil, 0, false
+        }
+    }
+
+    merged, _ := ParseIndexRollups(nil)
+    for _, query := range input.QueriesToExecute {
+        getIndexInput := &GetIndexConfigurationInput{
+            Owner:        input.Owner,
+            Stage:        os.Getenv("STAGE"),
+            Repo:         input.Owner + "/" + input.RepoName,
+            Branch:       input.Branch,
+            Refs:         input.Refs,
+            Id:           query.Index,
+        }
+        rollups, err := rollupLoader.LoadRollups(input.Ctx, getIndexInput, query.Composite)
+        if err != nil {
+            log.Printf("Rollups unavailable for index %s, faceting from documents: %v", query.Index, err)
+            return nil, 0, false
+        }
+        if _, ok := RollupFacets(rollups, input.FacetingAggs); !ok {
+            return nil, 0, false
+        }
+        merged.Merge(rollups)
+    }
+
+    facets, ok := RollupFacets(merged, input.FacetingAggs)
+    if !ok {
+        return nil, 0, false
+    }
+    return facets, merged.Total, true
+}
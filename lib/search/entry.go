@@ -0,0 +1,217 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ====================================================================
+// === INDEX ENTRY FORMATS ============================================
+// ====================================================================
+//
+// Format 1 (legacy): {prefix}/{base64(entity json)} with empty content.
+// Format 2 (compact): {prefix}/{id}.json holding an IndexEntry, or when the
+// index config sets "packed": true a single {prefix}/_segment.json holding an
+// IndexSegment with every entry of the partition.
+//
+// Index configs opt in with:
+//
+//	"entryFormat": 2,
+//	"packed": false,
+//	"projection": ["title", "price", "tags"]
+
+const (
+	IndexEntryFormatLegacy  = 1
+	IndexEntryFormatCompact = 2
+)
+
+// IndexSegmentFileName is the packed segment file inside a partition.
+const IndexSegmentFileName = "_segment.json"
+
+// IndexEntry is the content of a compact index entry file.
+type IndexEntry struct {
+	Version int                    `json:"v"`
+	Id      string                 `json:"id"`
+	Doc     map[string]interface{} `json:"doc"`
+}
+
+// IndexSegment is the content of a packed partition segment file.
+type IndexSegment struct {
+	Version int                               `json:"v"`
+	Entries map[string]map[string]interface{} `json:"entries"` // id -> projected doc
+}
+
+// IndexEntryLayout is the entry format declared by an index config.
+type IndexEntryLayout struct {
+	Format     int
+	Packed     bool
+	Projection []string
+}
+
+// GetIndexEntryLayout reads the entry format settings of an index config. Configs
+// without "entryFormat" keep the legacy format.
+func GetIndexEntryLayout(indexEntity map[string]interface{}) IndexEntryLayout {
+	layout := IndexEntryLayout{Format: IndexEntryFormatLegacy}
+	if f, ok := indexEntity["entryFormat"].(float64); ok && int(f) == IndexEntryFormatCompact {
+		layout.Format = IndexEntryFormatCompact
+	}
+	if packed, ok := indexEntity["packed"].(bool); ok && layout.Format == IndexEntryFormatCompact {
+		layout.Packed = packed
+	}
+	if projection, ok := indexEntity["projection"].([]interface{}); ok {
+		for _, p := range projection {
+			if pStr, ok := p.(string); ok {
+				layout.Projection = append(layout.Projection, pStr)
+			}
+		}
+	}
+	return layout
+}
+
+// ProjectIndexDocument keeps the id and the projected fields of an entity. No projection keeps everything.
+// Encrypted fields are never part of the document.
+func ProjectIndexDocument(entityJSON map[string]interface{}, projection []string) map[string]interface{} {
+	if len(projection) == 0 {
+		doc, _ := withoutEncrypted(entityJSON)
+		return doc.(map[string]interface{})
+	}
+	doc := make(map[string]interface{})
+	if id, ok := entityJSON["id"]; ok {
+		doc["id"] = id
+	}
+	for _, field := range projection {
+		value, ok := resolveRawDotNotation(entityJSON, field)
+		if !ok {
+			continue
+		}
+		// Rebuild nested structure for dot notation fields
+		parts := strings.Split(field, ".")
+		current := doc
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				current[part] = value
+				break
+			}
+			next, ok := current[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				current[part] = next
+			}
+			current = next
+		}
+	}
+	stripped, _ := withoutEncrypted(doc)
+	return stripped.(map[string]interface{})
+}
+
+func indexEntityId(entityJSON map[string]interface{}) (string, error) {
+	id, ok := entityJSON["id"].(string)
+	if !ok || id == "" {
+		return "", fmt.Errorf("entity has no 'id' required by the compact index entry format")
+	}
+	return id, nil
+}
+
+// IndexEntryFiles returns path -> content of every unpacked index entry file of an entity.
+// Packed indexes use IndexEntrySegments instead.
+func IndexEntryFiles(entityJSON map[string]interface{}, indexEntity map[string]interface{}) (map[string]string, error) {
+	layout := GetIndexEntryLayout(indexEntity)
+	files := make(map[string]string)
+
+	if layout.Format == IndexEntryFormatLegacy {
+		paths, err := IndexEntryPaths(entityJSON, indexEntity)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			files[p] = ""
+		}
+		return files, nil
+	}
+
+	if layout.Packed {
+		return nil, fmt.Errorf("index uses packed segments")
+	}
+
+	prefixes, err := ExtractCompositePrefixes(entityJSON, indexEntity)
+	if err != nil {
+		return nil, err
+	}
+	id, err := indexEntityId(entityJSON)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(IndexEntry{Version: IndexEntryFormatCompact, Id: id, Doc: ProjectIndexDocument(entityJSON, layout.Projection)})
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range prefixes {
+		files[prefix+"/"+id+".json"] = string(b)
+	}
+	return files, nil
+}
+
+// IndexEntrySegments returns the segment paths an entity belongs to in a packed index
+// along with its id and projected document.
+func IndexEntrySegments(entityJSON map[string]interface{}, indexEntity map[string]interface{}) ([]string, string, map[string]interface{}, error) {
+	layout := GetIndexEntryLayout(indexEntity)
+	prefixes, err := ExtractCompositePrefixes(entityJSON, indexEntity)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	id, err := indexEntityId(entityJSON)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	paths := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		paths = append(paths, prefix+"/"+IndexSegmentFileName)
+	}
+	return paths, id, ProjectIndexDocument(entityJSON, layout.Projection), nil
+}
+
+// ParseIndexSegment decodes a segment file. Empty content is an empty segment.
+func ParseIndexSegment(content []byte) (*IndexSegment, error) {
+	segment := &IndexSegment{Version: IndexEntryFormatCompact, Entries: make(map[string]map[string]interface{})}
+	if len(content) == 0 {
+		return segment, nil
+	}
+	if err := json.Unmarshal(content, segment); err != nil {
+		return nil, err
+	}
+	if segment.Entries == nil {
+		segment.Entries = make(map[string]map[string]interface{})
+	}
+	return segment, nil
+}
+
+// DecodeIndexEntryFile turns the content of a compact entry or segment file into documents.
+func DecodeIndexEntryFile(name string, content []byte) ([]map[string]interface{}, error) {
+	if name == IndexSegmentFileName {
+		segment, err := ParseIndexSegment(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index segment: %v", err)
+		}
+		ids := make([]string, 0, len(segment.Entries))
+		for id := range segment.Entries {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		docs := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			docs = append(docs, segment.Entries[id])
+		}
+		return docs, nil
+	}
+
+	var entry IndexEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("invalid index entry: %v", err)
+	}
+	if entry.Version != IndexEntryFormatCompact {
+		return nil, fmt.Errorf("unsupported index entry version %d", entry.Version)
+	}
+	return []map[string]interface{}{entry.Doc}, nil
+}
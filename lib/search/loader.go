@@ -54,47 +54,57 @@ func (l *GitHubLoader) Load(
 		return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", config.Id)
 	}
 
-	var contentPath string
+	// 2. Build Composite Path (using the composite data from the query)
+	contentPath, err := compositePath(indexObject, queryComposite)
+	if err != nil {
+		return nil, err
+	}
+
+	repoToFetch, ok := indexObject["repoName"].(string)
+	if !ok || repoToFetch == "" {
+		return nil, fmt.Errorf("index configuration missing 'repoName'")
+	}
+
+	// 3. Fetch Directory Contents
+	_, dirContents, _, err := l.GitHubClient.Repositories.GetContents(
+		ctx, config.Owner, repoToFetch, contentPath,
+		&github.RepositoryContentGetOptions{Ref: config.RefFor(repoToFetch)},
+	)
+
+	if err != nil || dirContents == nil {
+		return nil, fmt.Errorf("failed to list contents at path %s: %v", contentPath, err)
+	}
+
+	// 4. Return the concrete iterator implementation (reads legacy and compact entries)
+	return NewGitHubEntryIterator(ctx, l.GitHubClient, config.Owner, repoToFetch, dirContents), nil
+}
+
+// compositePath builds the partition directory addressed by a query composite.
+func compositePath(indexObject map[string]interface{}, queryComposite map[string]interface{}) (string, error) {
 	fieldsInterface, fieldsOk := indexObject["fields"].([]interface{})
 	if !fieldsOk {
-		return nil, fmt.Errorf("index configuration missing 'fields'")
+		return "", fmt.Errorf("index configuration missing 'fields'")
 	}
 
-	// 2. Build Composite Path (using the composite data from the query)
 	if len(queryComposite) > 0 {
 		compositePath := ""
+		// Same transforms the index hook applied when writing the entries
+		transforms := GetFieldTransforms(indexObject)
 		for idx, f := range fieldsInterface {
 			fStr := f.(string)
 			compositeVal, found := queryComposite[fStr]
 			if found {
-				compositePath += fmt.Sprintf("%v", compositeVal)
+				compositePath += TransformCompositeValue(transforms, fStr, compositeVal)
 			}
 			if idx < (len(fieldsInterface) - 1) {
 				compositePath += ":"
 			}
 		}
-		contentPath = compositePath
+		return compositePath, nil
 	} else {
-		return nil, fmt.Errorf("query configuration missing 'Composite'")
-	}
-
-	repoToFetch, ok := indexObject["repoName"].(string)
-	if !ok || repoToFetch == "" {
-		return nil, fmt.Errorf("index configuration missing 'repoName'")
-	}
-
-	// 3. Fetch Directory Contents
-	_, dirContents, _, err := l.GitHubClient.Repositories.GetContents(
-		ctx, config.Owner, repoToFetch, contentPath,
-		&github.RepositoryContentGetOptions{Ref: config.Branch},
-	)
-
-	if err != nil || dirContents == nil {
-		return nil, fmt.Errorf("failed to list contents at path %s: %v", contentPath, err)
+		return "", fmt.Errorf("query configuration missing 'Composite'")
 	}
 
-	// 4. Return the concrete iterator implementation
-	return NewGitHubFileIterator(dirContents), nil
 }
 
 // GetIndexById retrieves the index configuration JSON file from the GitHub repository.
@@ -104,7 +114,7 @@ func (l *GitHubLoader) GetIndexById(c *GetIndexConfigurationInput) (map[string]i
 
 	pieces := strings.Split(c.Repo, "/")
 	opts := &github.RepositoryContentGetOptions{
-		Ref: c.Branch,
+		Ref: c.RefFor(pieces[1]),
 	}
 	// File path is assumed to be index/{ID}.json
 	file, _, res, err := l.GitHubClient.Repositories.GetContents(context.Background(), pieces[0], pieces[1], "index/"+c.Id+".json", opts)
@@ -134,6 +144,10 @@ type GitHubFileIterator struct {
 	contents []*github.RepositoryContent
 	index    int
 	lastErr  error
+
+	// Compact entries (see entry.go) need their content fetched. Legacy entries only need the name.
+	fetch   func(content *github.RepositoryContent) ([]byte, error)
+	pending []map[string]interface{}
 }
 
 // StaticIterator implements the DocumentIterator interface for in-memory data.
@@ -147,13 +161,25 @@ func NewGitHubFileIterator(contents []*github.RepositoryContent) *GitHubFileIter
 	files := make([]*github.RepositoryContent, 0, len(contents))
 	for _, content := range contents {
 		// Filter non-file items, assuming file name is base64 encoded JSON document
-		if content.GetType() == "file" && content.GetName() != "" {
+		// Partition rollups are metadata not documents.
+		if content.GetType() == "file" && content.GetName() != "" && content.GetName() != IndexRollupsFileName {
 			files = append(files, content)
 		}
 	}
 	return &GitHubFileIterator{contents: files}
 }
 
+// NewGitHubEntryIterator creates an iterator that reads both legacy (name encoded) and
+// compact (content) index entries from the fetched GitHub directory contents.
+func NewGitHubEntryIterator(ctx context.Context, client *github.Client, owner, repo string, contents []*github.RepositoryContent) *GitHubFileIterator {
+	iterator := NewGitHubFileIterator(contents)
+	iterator.fetch = func(content *github.RepositoryContent) ([]byte, error) {
+		raw, _, err := client.Git.GetBlobRaw(ctx, owner, repo, content.GetSHA())
+		return raw, err
+	}
+	return iterator
+}
+
 // NewStaticIterator creates a new iterator instance.
 func NewStaticIterator(data []map[string]interface{}) *StaticIterator {
 	return &StaticIterator{
@@ -163,6 +189,13 @@ func NewStaticIterator(data []map[string]interface{}) *StaticIterator {
 
 // Next fetches, decodes, and unmarshals the next document file content.
 func (i *GitHubFileIterator) Next() (map[string]interface{}, bool) {
+	// Remaining documents of a packed segment
+	if len(i.pending) > 0 {
+		doc := i.pending[0]
+		i.pending = i.pending[1:]
+		return doc, true
+	}
+
 	if i.index >= len(i.contents) {
 		return nil, false
 	}
@@ -170,6 +203,25 @@ func (i *GitHubFileIterator) Next() (map[string]interface{}, bool) {
 	content := i.contents[i.index]
 	i.index++
 
+	// Compact entry or packed segment
+	if i.fetch != nil && strings.HasSuffix(content.GetName(), ".json") {
+		raw, err := i.fetch(content)
+		if err != nil {
+			i.lastErr = fmt.Errorf("iterator failed to fetch content '%s': %v", content.GetName(), err)
+			return nil, true // Continue to next item
+		}
+		docs, err := DecodeIndexEntryFile(content.GetName(), raw)
+		if err != nil {
+			i.lastErr = fmt.Errorf("iterator failed to decode entry '%s': %v", content.GetName(), err)
+			return nil, true // Continue to next item
+		}
+		if len(docs) == 0 {
+			return i.Next()
+		}
+		i.pending = docs[1:]
+		return docs[0], true
+	}
+
 	decodedBytes, err := base64.StdEncoding.DecodeString(content.GetName())
 	if err != nil {
 		i.lastErr = fmt.Errorf("iterator failed to decode content '%s': %v", content.GetName(), err)
@@ -0,0 +1,214 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MoreLikeThis matches documents similar to a liked document (loaded by id through the
+// DocumentLoader) or to raw text. The most significant analyzed terms of the liked
+// fields (TF-IDF over the partition) become the query, scored with EvaluateMatch.
+type MoreLikeThis struct {
+	Fields    []string               `json:"fields"`
+	Id        string                 `json:"id,omitempty"`        // Liked document id
+	Text      string                 `json:"text,omitempty"`      // Raw text used instead of a document
+	Index     string                 `json:"index,omitempty"`     // Defaults to the index being searched
+	Composite map[string]interface{} `json:"composite,omitempty"` // Partition holding the liked document and the term statistics
+
+	MaxQueryTerms      int      `json:"maxQueryTerms,omitempty"`      // Default 25
+	MinTermFreq        int      `json:"minTermFreq,omitempty"`        // Min occurrences in the liked fields. Default 1
+	MinDocFreq         int      `json:"minDocFreq,omitempty"`         // Min documents of the partition containing a term. Default 1
+	MinimumShouldMatch float64  `json:"minimumShouldMatch,omitempty"` // Percentage of terms a candidate must contain. Default 30
+	Boost              *float64 `json:"boost,omitempty"`
+
+	// Terms are selected once per query, not per evaluated document.
+	prepare sync.Once
+	terms   []string
+	likedId string
+}
+
+const (
+	defaultMoreLikeThisMaxQueryTerms      = 25
+	defaultMoreLikeThisMinimumShouldMatch = 30.0
+)
+
+// EvaluateMoreLikeThis determines if a document is similar enough to the liked document or text.
+func EvaluateMoreLikeThis(data map[string]interface{}, mlt *MoreLikeThis, ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) (bool, float64) {
+	if mlt == nil || len(mlt.Fields) == 0 {
+		return false, 0.0
+	}
+
+	mlt.prepare.Do(func() {
+		if err := mlt.selectTerms(ctx, loader, indexInput); err != nil {
+			log.Printf("EvaluateMoreLikeThis: %v", err)
+		}
+	})
+	if len(mlt.terms) == 0 {
+		return false, 0.0
+	}
+
+	// The liked document is not similar to itself for our purposes.
+	if mlt.likedId != "" {
+		if id, ok := resolveDotNotation(data, "id"); ok && id == mlt.likedId {
+			return false, 0.0
+		}
+	}
+
+	docTokens := make(map[string]struct{})
+	for _, field := range mlt.Fields {
+		if value, ok := resolveDotNotation(data, field); ok {
+			for _, token := range Analyze(value) {
+				docTokens[token] = struct{}{}
+			}
+		}
+	}
+	var matched []string
+	for _, term := range mlt.terms {
+		if _, ok := docTokens[term]; ok {
+			matched = append(matched, term)
+		}
+	}
+
+	minimumShouldMatch := mlt.MinimumShouldMatch
+	if minimumShouldMatch <= 0 {
+		minimumShouldMatch = defaultMoreLikeThisMinimumShouldMatch
+	}
+	if len(matched) == 0 || float64(len(matched))*100/float64(len(mlt.terms)) < minimumShouldMatch {
+		return false, 0.0
+	}
+
+	// Score the matched terms with the regular Match relevance per field.
+	score := 0.0
+	for _, field := range mlt.Fields {
+		if ok, fieldScore := EvaluateMatch(data, &Match{Field: field, Value: strings.Join(matched, " "), Boost: mlt.Boost}); ok {
+			score += fieldScore
+		}
+	}
+	log.Printf("EvaluateMoreLikeThis: MATCH. Score=%.4f (Terms: %d/%d)", score, len(matched), len(mlt.terms))
+	return true, score
+}
+
+// selectTerms picks the liked terms ordered by TF-IDF.
+func (mlt *MoreLikeThis) selectTerms(ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) error {
+	var liked map[string]interface{}
+	var stats *IndexStats
+
+	// Both the liked document and the statistics come from the same partition scan.
+	if len(mlt.Composite) > 0 && loader != nil && indexInput != nil {
+		var err error
+		liked, stats, err = mlt.scanPartition(ctx, loader, indexInput)
+		if err != nil {
+			return err
+		}
+	}
+
+	termFrequency := make(map[string]int)
+	if mlt.Id != "" {
+		if liked == nil {
+			return fmt.Errorf("liked document '%s' not found (moreLikeThis by id requires 'composite')", mlt.Id)
+		}
+		mlt.likedId = mlt.Id
+		for _, field := range mlt.Fields {
+			if value, ok := resolveDotNotation(liked, field); ok {
+				for _, token := range AnalyzeForPhrase(value) {
+					termFrequency[token]++
+				}
+			}
+		}
+	} else {
+		for _, token := range AnalyzeForPhrase(mlt.Text) {
+			termFrequency[token]++
+		}
+	}
+
+	minTermFreq := mlt.MinTermFreq
+	if minTermFreq <= 0 {
+		minTermFreq = 1
+	}
+	minDocFreq := mlt.MinDocFreq
+	if minDocFreq <= 0 {
+		minDocFreq = 1
+	}
+
+	type weightedTerm struct {
+		term   string
+		weight float64
+	}
+	var candidates []weightedTerm
+	for term, tf := range termFrequency {
+		if tf < minTermFreq {
+			continue
+		}
+		idf := 1.0
+		if stats != nil {
+			if stats.DocumentFrequency[term] < uint64(minDocFreq) {
+				continue
+			}
+			idf = stats.CalculateIDF(term)
+		}
+		candidates = append(candidates, weightedTerm{term: term, weight: float64(tf) * idf})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].weight != candidates[j].weight {
+			return candidates[i].weight > candidates[j].weight
+		}
+		return candidates[i].term < candidates[j].term
+	})
+
+	maxQueryTerms := mlt.MaxQueryTerms
+	if maxQueryTerms <= 0 {
+		maxQueryTerms = defaultMoreLikeThisMaxQueryTerms
+	}
+	for i := 0; i < len(candidates) && i < maxQueryTerms; i++ {
+		mlt.terms = append(mlt.terms, candidates[i].term)
+	}
+	log.Printf("MoreLikeThis: Selected terms %v", mlt.terms)
+	return nil
+}
+
+// scanPartition loads the partition once to find the liked document and count document frequencies.
+func (mlt *MoreLikeThis) scanPartition(ctx context.Context, loader DocumentLoader, indexInput *GetIndexConfigurationInput) (map[string]interface{}, *IndexStats, error) {
+	input := *indexInput
+	if mlt.Index != "" {
+		input.Id = mlt.Index
+	}
+	if input.Id == "" {
+		return nil, nil, fmt.Errorf("moreLikeThis requires 'index' outside of a query")
+	}
+
+	iterator, err := loader.Load(ctx, &input, mlt.Composite)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load partition for index '%s': %w", input.Id, err)
+	}
+	defer iterator.Close()
+
+	var liked map[string]interface{}
+	stats := &IndexStats{DocumentFrequency: make(map[string]uint64)}
+	for doc, ok := iterator.Next(); ok; doc, ok = iterator.Next() {
+		stats.TotalDocuments++
+		seen := make(map[string]struct{})
+		for _, field := range mlt.Fields {
+			if value, ok := resolveDotNotation(doc, field); ok {
+				for _, token := range AnalyzeForPhrase(value) {
+					seen[token] = struct{}{}
+				}
+			}
+		}
+		for token := range seen {
+			stats.DocumentFrequency[token]++
+		}
+		if mlt.Id != "" && liked == nil {
+			if id, ok := resolveDotNotation(doc, "id"); ok && id == mlt.Id {
+				liked = doc
+			}
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		log.Printf("MoreLikeThis: Iterator finished with non-fatal error: %v", err)
+	}
+	return liked, stats, nil
+}
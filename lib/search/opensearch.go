@@ -0,0 +1,874 @@
+package search
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ====================================================================
+// === OPENSEARCH BACKEND (Dialect -> OpenSearch DSL) =================
+// ====================================================================
+//
+// Index configs declaring "backend": "opensearch" live in an OpenSearch index
+// ("opensearchIndex", defaulting to the index id) instead of a GitHub index repo.
+// The dialect is translated to a single search request and the response is
+// mapped back to the SearchResultPayload produced by the GitHub engine.
+//
+// Everything (hits, aggregations, facets) is computed on the post-filtered set
+// by the engine, so the post filter becomes a regular filter clause.
+
+// OpenSearchBackend is the index config "backend" routing an index to OpenSearch.
+const OpenSearchBackend = "opensearch"
+
+// OpenSearchMaxResultWindow is the size requested when a query has no limit.
+const OpenSearchMaxResultWindow = 10000
+
+const (
+	openSearchFacetPrefix  = "facet__"
+	openSearchTopHitsAgg   = "__top_hits"
+	openSearchTotalGroups  = "__total_groups"
+	openSearchTermsAggSize = 1000
+)
+
+// IndexBackend returns the backend of an index config ("github" unless declared).
+func IndexBackend(indexObject map[string]interface{}) string {
+	if backend, ok := indexObject["backend"].(string); ok && backend != "" {
+		return backend
+	}
+	return "github"
+}
+
+// OpenSearchIndexName returns the OpenSearch index of an index config.
+func OpenSearchIndexName(indexObject map[string]interface{}, id string) string {
+	if name, ok := indexObject["opensearchIndex"].(string); ok && name != "" {
+		return name
+	}
+	return id
+}
+
+// openSearchTranslator carries the state needed while walking the dialect.
+type openSearchTranslator struct {
+	indexNames map[string]string // dialect index id -> OpenSearch index
+	index      string            // OpenSearch index of the query being translated
+	prefix     string            // Field prefix inside nested documents
+}
+
+func (t openSearchTranslator) field(f string) string {
+	return t.prefix + f
+}
+
+func (t openSearchTranslator) nested(path string) openSearchTranslator {
+	t.prefix = t.field(path) + "."
+	return t
+}
+
+// TranslateToOpenSearch builds the OpenSearch request body of a union query along with
+// the indices to search. indexNames maps the dialect index ids to OpenSearch indices.
+func TranslateToOpenSearch(input *UnionQueryInput, indexNames map[string]string) (map[string]interface{}, []string, error) {
+	if len(input.QueriesToExecute) == 0 {
+		return nil, nil, fmt.Errorf("no queries to translate")
+	}
+	if input.ScoreModifiersRequest != nil {
+		return nil, nil, fmt.Errorf("scoreModifiers are not supported by the opensearch backend")
+	}
+
+	var indices []string
+	seen := make(map[string]bool)
+	var perQuery []interface{}
+	for _, q := range input.QueriesToExecute {
+		name, ok := indexNames[q.Index]
+		if !ok {
+			return nil, nil, fmt.Errorf("index '%s' is not an opensearch index", q.Index)
+		}
+		if !seen[name] {
+			seen[name] = true
+			indices = append(indices, name)
+		}
+		t := openSearchTranslator{indexNames: indexNames, index: name}
+		translated, err := t.bool(&q.Bool)
+		if err != nil {
+			return nil, nil, fmt.Errorf("index '%s': %v", q.Index, err)
+		}
+		perQuery = append(perQuery, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":   []interface{}{translated},
+				"filter": []interface{}{map[string]interface{}{"term": map[string]interface{}{"_index": name}}},
+			},
+		})
+	}
+
+	var query interface{}
+	if len(perQuery) == 1 {
+		query = perQuery[0]
+	} else {
+		// Union: a document matches when the query of its own index matches.
+		query = map[string]interface{}{"bool": map[string]interface{}{"should": perQuery, "minimum_should_match": 1}}
+	}
+
+	if input.PostFilter != nil {
+		t := openSearchTranslator{indexNames: indexNames, index: indices[0]}
+		postFilter, err := t.bool(input.PostFilter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("postFilter: %v", err)
+		}
+		query = map[string]interface{}{"bool": map[string]interface{}{
+			"must":   []interface{}{query},
+			"filter": []interface{}{postFilter},
+		}}
+	}
+
+	body := map[string]interface{}{
+		"query":            query,
+		"track_total_hits": true,
+	}
+
+	aggs := make(map[string]interface{})
+	t := openSearchTranslator{indexNames: indexNames, index: indices[0]}
+	for name, agg := range input.AggregationMap {
+		agg := agg
+		aggType := strings.ToLower(agg.Type)
+		if aggType == "stats_bucket" || aggType == "bucket_script" {
+			return nil, nil, fmt.Errorf("pipeline aggregation '%s' is not supported by the opensearch backend", name)
+		}
+		translated, err := t.aggregation(&agg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("aggregation '%s': %v", name, err)
+		}
+		aggs[name] = translated
+	}
+	for name, agg := range input.FacetingAggs {
+		if agg == nil {
+			continue
+		}
+		translated, err := t.aggregation(agg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("facet '%s': %v", name, err)
+		}
+		aggs[openSearchFacetPrefix+name] = translated
+	}
+
+	isAggregation := len(input.AggregationMap) > 0
+	if isAggregation || input.FacetsOnly {
+		body["size"] = 0
+	} else {
+		size := input.Limit
+		if size <= 0 {
+			size = OpenSearchMaxResultWindow
+		}
+		body["size"] = size
+		if input.Offset > 0 {
+			body["from"] = input.Offset
+		}
+
+		sortRequest := input.SortRequest
+		if len(sortRequest) == 0 {
+			sortRequest = []SortField{{Field: "_score", Order: SortDesc}}
+		}
+		body["sort"] = t.sort(sortRequest)
+
+		if len(input.SourceFields) > 0 {
+			body["_source"] = input.SourceFields
+		}
+
+		if input.Collapse != nil && input.Collapse.Field != "" {
+			collapse := map[string]interface{}{"field": input.Collapse.Field}
+			if input.Collapse.InnerHits != nil {
+				collapse["inner_hits"] = t.topHits(input.Collapse.InnerHits, "collapsed")
+			}
+			body["collapse"] = collapse
+			aggs[openSearchTotalGroups] = map[string]interface{}{"cardinality": map[string]interface{}{"field": input.Collapse.Field}}
+		}
+	}
+
+	if len(aggs) > 0 {
+		body["aggs"] = aggs
+	}
+	return body, indices, nil
+}
+
+// --------------------------------------------------------------------
+// Queries
+// --------------------------------------------------------------------
+
+// bool translates a Bool the way Bool.Evaluate reads it: only the first non-empty group
+// of all, one, none and not decides, the groups after it are ignored.
+func (t openSearchTranslator) bool(b *Bool) (map[string]interface{}, error) {
+	must := []interface{}{}
+	filter := []interface{}{}
+	should := []interface{}{}
+	mustNot := []interface{}{}
+
+	groups := 0
+	for _, group := range [][]Case{b.All, b.One, b.None, b.Not} {
+		if len(group) > 0 {
+			groups++
+		}
+	}
+	if groups > 1 {
+		log.Print("OpenSearch: Warning, bool has more than one group; only the first non-empty one is translated.")
+	}
+
+	switch {
+	case len(b.All) > 0:
+		for i := range b.All {
+			translated, scoring, err := t.condition(&b.All[i])
+			if err != nil {
+				return nil, err
+			}
+			// Filters (Term, Range, geo, ...) do not contribute to the score in the engine either.
+			if scoring {
+				must = append(must, translated)
+			} else {
+				filter = append(filter, translated)
+			}
+		}
+	case len(b.One) > 0:
+		for i := range b.One {
+			translated, _, err := t.condition(&b.One[i])
+			if err != nil {
+				return nil, err
+			}
+			should = append(should, translated)
+		}
+	case len(b.None) > 0:
+		for i := range b.None {
+			translated, _, err := t.condition(&b.None[i])
+			if err != nil {
+				return nil, err
+			}
+			mustNot = append(mustNot, translated)
+		}
+	case len(b.Not) > 0:
+		translated, _, err := t.condition(&b.Not[0])
+		if err != nil {
+			return nil, err
+		}
+		mustNot = append(mustNot, translated)
+	}
+
+	boolQuery := make(map[string]interface{})
+	if len(must) > 0 {
+		boolQuery["must"] = must
+	}
+	if len(filter) > 0 {
+		boolQuery["filter"] = filter
+	}
+	if len(should) > 0 {
+		boolQuery["should"] = should
+		boolQuery["minimum_should_match"] = 1
+	}
+	if len(mustNot) > 0 {
+		boolQuery["must_not"] = mustNot
+	}
+	if len(boolQuery) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+	return map[string]interface{}{"bool": boolQuery}, nil
+}
+
+// condition translates a Case. The second result reports whether it contributes to the score.
+func (t openSearchTranslator) condition(c *Case) (map[string]interface{}, bool, error) {
+	switch {
+	case c.Bool != nil:
+		translated, err := t.bool(c.Bool)
+		return translated, true, err
+
+	case c.Range != nil:
+		bounds := make(map[string]interface{})
+		if c.Range.From != nil {
+			bounds["gte"] = *c.Range.From
+		}
+		if c.Range.To != nil {
+			bounds["lt"] = *c.Range.To
+		}
+		return map[string]interface{}{"range": map[string]interface{}{t.field(c.Range.Field): bounds}}, false, nil
+
+	case c.GeoDistance != nil:
+		unit := c.GeoDistance.Unit
+		if unit == "" {
+			unit = "km"
+		}
+		return map[string]interface{}{"geo_distance": map[string]interface{}{
+			"distance":                  strconv.FormatFloat(c.GeoDistance.Distance, 'f', -1, 64) + unit,
+			t.field(c.GeoDistance.Field): map[string]interface{}{"lat": c.GeoDistance.Latitude, "lon": c.GeoDistance.Longitude},
+		}}, false, nil
+
+	case c.GeoPolygon != nil:
+		return t.geoPolygon(c.GeoPolygon.Field, c.GeoPolygon.Points), false, nil
+
+	case c.GeoMultiPolygon != nil:
+		var polygons []interface{}
+		for _, points := range c.GeoMultiPolygon.Polygons {
+			polygons = append(polygons, t.geoPolygon(c.GeoMultiPolygon.Field, points))
+		}
+		return map[string]interface{}{"bool": map[string]interface{}{"should": polygons, "minimum_should_match": 1}}, false, nil
+
+	case c.GeoLine != nil:
+		return nil, false, fmt.Errorf("geoLine is not supported by the opensearch backend")
+
+	case c.NestedDoc != nil:
+		inner, err := t.nested(c.NestedDoc.Path).bool(&c.NestedDoc.Bool)
+		if err != nil {
+			return nil, false, err
+		}
+		return map[string]interface{}{"nested": map[string]interface{}{
+			"path":       t.field(c.NestedDoc.Path),
+			"query":      inner,
+			"score_mode": "max",
+		}}, true, nil
+
+	case c.Exists != nil:
+		return map[string]interface{}{"exists": map[string]interface{}{"field": t.field(c.Exists.Field)}}, false, nil
+
+	case c.Missing != nil:
+		return map[string]interface{}{"bool": map[string]interface{}{
+			"must_not": []interface{}{map[string]interface{}{"exists": map[string]interface{}{"field": t.field(c.Missing.Field)}}},
+		}}, false, nil
+
+	case c.Template != nil:
+		return nil, false, fmt.Errorf("template conditions are not supported by the opensearch backend")
+
+	case c.Match != nil:
+		if c.Match.SubQuery != nil {
+			return nil, false, fmt.Errorf("subqueries are not supported by the opensearch backend")
+		}
+		match := map[string]interface{}{"query": c.Match.Value}
+		if c.Match.Fuzziness != nil {
+			match["fuzziness"] = *c.Match.Fuzziness
+		}
+		if c.Match.Boost != nil {
+			match["boost"] = *c.Match.Boost
+		}
+		return map[string]interface{}{"match": map[string]interface{}{t.field(c.Match.Field): match}}, true, nil
+
+	case c.MatchPhrase != nil:
+		phrase := map[string]interface{}{"query": c.MatchPhrase.Value}
+		if c.MatchPhrase.Slop != nil {
+			phrase["slop"] = *c.MatchPhrase.Slop
+		}
+		if c.MatchPhrase.Boost != nil {
+			phrase["boost"] = *c.MatchPhrase.Boost
+		}
+		return map[string]interface{}{"match_phrase": map[string]interface{}{t.field(c.MatchPhrase.Field): phrase}}, true, nil
+
+	case c.MoreLikeThis != nil:
+		return t.moreLikeThis(c.MoreLikeThis), true, nil
+
+	case c.Term != nil:
+		return t.term(*c.Term)
+
+	case c.Filter != nil:
+		return t.term(*c.Filter)
+	}
+
+	// Empty case matches everything, as in Case.Evaluate
+	return map[string]interface{}{"match_all": map[string]interface{}{}}, false, nil
+}
+
+func (t openSearchTranslator) geoPolygon(field string, points []Point) map[string]interface{} {
+	var translated []interface{}
+	for _, p := range points {
+		translated = append(translated, map[string]interface{}{"lat": p.Lat, "lon": p.Lon})
+	}
+	return map[string]interface{}{"geo_polygon": map[string]interface{}{
+		t.field(field): map[string]interface{}{"points": translated},
+	}}
+}
+
+func (t openSearchTranslator) term(condition Condition) (map[string]interface{}, bool, error) {
+	if condition.GetSubQuery() != nil {
+		return nil, false, fmt.Errorf("subqueries are not supported by the opensearch backend")
+	}
+	field := t.field(condition.GetField())
+	value := condition.GetValue()
+	op := Equal
+	if condition.GetModifiers() != nil {
+		op = condition.GetModifiers().Operation
+	}
+
+	not := func(q map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"bool": map[string]interface{}{"must_not": []interface{}{q}}}
+	}
+	rangeQuery := func(bound string) map[string]interface{} {
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{bound: value}}}
+	}
+	terms := func() map[string]interface{} {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		return map[string]interface{}{"terms": map[string]interface{}{field: values}}
+	}
+
+	switch op {
+	case Equal:
+		return map[string]interface{}{"term": map[string]interface{}{field: value}}, false, nil
+	case NotEqual:
+		return not(map[string]interface{}{"term": map[string]interface{}{field: value}}), false, nil
+	case GreaterThan:
+		return rangeQuery("gt"), false, nil
+	case LessThan:
+		return rangeQuery("lt"), false, nil
+	case GreaterThanOrEqual:
+		return rangeQuery("gte"), false, nil
+	case LessThanOrEqual:
+		return rangeQuery("lte"), false, nil
+	case Contains:
+		return map[string]interface{}{"wildcard": map[string]interface{}{field: "*" + value + "*"}}, false, nil
+	case StartsWith:
+		return map[string]interface{}{"prefix": map[string]interface{}{field: value}}, false, nil
+	case EndsWith:
+		return map[string]interface{}{"wildcard": map[string]interface{}{field: "*" + value}}, false, nil
+	case In:
+		return terms(), false, nil
+	case NotIn:
+		return not(terms()), false, nil
+	}
+	return nil, false, fmt.Errorf("unsupported operation %d on field '%s'", op, field)
+}
+
+func (t openSearchTranslator) moreLikeThis(mlt *MoreLikeThis) map[string]interface{} {
+	var fields []string
+	for _, f := range mlt.Fields {
+		fields = append(fields, t.field(f))
+	}
+	query := map[string]interface{}{"fields": fields}
+
+	if mlt.Id != "" {
+		index := t.index
+		if name, ok := t.indexNames[mlt.Index]; ok {
+			index = name
+		}
+		query["like"] = []interface{}{map[string]interface{}{"_index": index, "_id": mlt.Id}}
+	} else {
+		query["like"] = mlt.Text
+	}
+
+	maxQueryTerms := mlt.MaxQueryTerms
+	if maxQueryTerms <= 0 {
+		maxQueryTerms = defaultMoreLikeThisMaxQueryTerms
+	}
+	minimumShouldMatch := mlt.MinimumShouldMatch
+	if minimumShouldMatch <= 0 {
+		minimumShouldMatch = defaultMoreLikeThisMinimumShouldMatch
+	}
+	query["max_query_terms"] = maxQueryTerms
+	query["minimum_should_match"] = strconv.FormatFloat(minimumShouldMatch, 'f', -1, 64) + "%"
+	// Same defaults as EvaluateMoreLikeThis (OpenSearch defaults to 2 and 5).
+	query["min_term_freq"] = 1
+	query["min_doc_freq"] = 1
+	if mlt.MinTermFreq > 0 {
+		query["min_term_freq"] = mlt.MinTermFreq
+	}
+	if mlt.MinDocFreq > 0 {
+		query["min_doc_freq"] = mlt.MinDocFreq
+	}
+	if mlt.Boost != nil {
+		query["boost"] = *mlt.Boost
+	}
+	return map[string]interface{}{"more_like_this": query}
+}
+
+func (t openSearchTranslator) sort(fields []SortField) []interface{} {
+	var sorts []interface{}
+	for _, s := range fields {
+		order := s.Order
+		if order == "" {
+			order = SortAsc
+		}
+		field := s.Field
+		if field != "_score" {
+			field = t.field(field)
+		}
+		sorts = append(sorts, map[string]interface{}{field: map[string]interface{}{"order": string(order)}})
+	}
+	return sorts
+}
+
+func (t openSearchTranslator) topHits(topHits *TopHits, name string) map[string]interface{} {
+	translated := map[string]interface{}{"size": topHits.Size}
+	if name != "" {
+		translated["name"] = name
+	}
+	if len(topHits.Sort) > 0 {
+		translated["sort"] = t.sort(topHits.Sort)
+	}
+	if len(topHits.Source) > 0 {
+		translated["_source"] = topHits.Source
+	}
+	return translated
+}
+
+// --------------------------------------------------------------------
+// Aggregations
+// --------------------------------------------------------------------
+
+func (t openSearchTranslator) aggregation(agg *Aggregation) (map[string]interface{}, error) {
+	if len(agg.PipelineAggs) > 0 {
+		return nil, fmt.Errorf("pipelineAggs are not supported by the opensearch backend")
+	}
+	if agg.Having != nil {
+		return nil, fmt.Errorf("having is not supported by the opensearch backend")
+	}
+
+	inner := t
+	if agg.Path != "" {
+		inner = t.nested(agg.Path)
+	}
+
+	sub := make(map[string]interface{})
+	for _, req := range agg.Metrics {
+		metrics, err := inner.metric(req)
+		if err != nil {
+			return nil, err
+		}
+		for name, m := range metrics {
+			sub[name] = m
+		}
+	}
+	if agg.TopHits != nil && agg.TopHits.Size > 0 {
+		sub[openSearchTopHitsAgg] = map[string]interface{}{"top_hits": inner.topHits(agg.TopHits, "")}
+	}
+	for name, subAgg := range agg.Aggs {
+		translated, err := inner.aggregation(subAgg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		sub[name] = translated
+	}
+
+	var translated map[string]interface{}
+	switch {
+	case agg.Path != "":
+		translated = map[string]interface{}{"nested": map[string]interface{}{"path": t.field(agg.Path)}}
+	case len(agg.GroupBy) > 0:
+		translated = map[string]interface{}{"terms": map[string]interface{}{"field": t.field(agg.GroupBy[0]), "size": openSearchTermsAggSize}}
+	case len(agg.RangeBuckets) > 0:
+		for field, buckets := range agg.RangeBuckets {
+			var ranges []interface{}
+			for _, b := range buckets {
+				ranges = append(ranges, map[string]interface{}{"key": b.Key, "from": b.From, "to": b.To})
+			}
+			translated = map[string]interface{}{"range": map[string]interface{}{"field": t.field(field), "ranges": ranges}}
+			break
+		}
+	case agg.DateHistogram != nil:
+		translated = map[string]interface{}{"date_histogram": map[string]interface{}{
+			"field":             t.field(agg.DateHistogram.Field),
+			"calendar_interval": agg.DateHistogram.Interval,
+		}}
+	case agg.Filter != nil:
+		filter, err := t.bool(agg.Filter)
+		if err != nil {
+			return nil, err
+		}
+		translated = map[string]interface{}{"filter": filter}
+	case len(agg.Filters) > 0:
+		filters := make(map[string]interface{})
+		for name, f := range agg.Filters {
+			f := f
+			filter, err := t.bool(&f)
+			if err != nil {
+				return nil, err
+			}
+			filters[name] = filter
+		}
+		spec := map[string]interface{}{"filters": filters}
+		if agg.OtherBucket {
+			spec["other_bucket"] = true
+			spec["other_bucket_key"] = otherBucketKey(agg)
+		}
+		translated = map[string]interface{}{"filters": spec}
+	case agg.Missing != nil:
+		translated = map[string]interface{}{"missing": map[string]interface{}{"field": t.field(agg.Missing.Field)}}
+	default:
+		// Metrics only: a single bucket over every document, as ExecuteAggregation does.
+		translated = map[string]interface{}{"filter": map[string]interface{}{"match_all": map[string]interface{}{}}}
+	}
+
+	if len(sub) > 0 {
+		translated["aggs"] = sub
+	}
+	return translated, nil
+}
+
+func otherBucketKey(agg *Aggregation) string {
+	if agg.OtherBucketKey != "" {
+		return agg.OtherBucketKey
+	}
+	return "_other_"
+}
+
+// metric translates a MetricRequest into one OpenSearch metric agg per result name.
+func (t openSearchTranslator) metric(req MetricRequest) (map[string]interface{}, error) {
+	if req.Scripted != nil {
+		return nil, fmt.Errorf("scripted metrics are not supported by the opensearch backend")
+	}
+	metricType := strings.ToLower(req.Type)
+
+	metrics := make(map[string]interface{})
+	for sourceField, resultName := range req.Fields {
+		if resultName == "" {
+			continue
+		}
+		mt := t
+		if req.Path != "" {
+			mt = t.nested(req.Path)
+		}
+		field := mt.field(sourceField)
+
+		var metric map[string]interface{}
+		switch metricType {
+		case "sum", "min", "max", "avg":
+			metric = map[string]interface{}{metricType: map[string]interface{}{"field": field}}
+		case "mean":
+			metric = map[string]interface{}{"avg": map[string]interface{}{"field": field}}
+		case "median":
+			metric = map[string]interface{}{"percentiles": map[string]interface{}{"field": field, "percents": []float64{50}}}
+		case "percentile":
+			p := req.Percentile
+			if p <= 0 || p > 100 {
+				p = 50.0
+			}
+			metric = map[string]interface{}{"percentiles": map[string]interface{}{"field": field, "percents": []float64{p}}}
+		case "std_dev":
+			metric = map[string]interface{}{"extended_stats": map[string]interface{}{"field": field}}
+		case "cardinality", "unique_count":
+			metric = map[string]interface{}{"cardinality": map[string]interface{}{"field": field}}
+		case "count":
+			metric = map[string]interface{}{"value_count": map[string]interface{}{"field": field}}
+		default:
+			return nil, fmt.Errorf("metric '%s' is not supported by the opensearch backend", req.Type)
+		}
+
+		if req.Path != "" {
+			metric = map[string]interface{}{
+				"nested": map[string]interface{}{"path": t.field(req.Path)},
+				"aggs":   map[string]interface{}{"value": metric},
+			}
+		}
+		metrics[resultName] = metric
+	}
+	return metrics, nil
+}
+
+// --------------------------------------------------------------------
+// Response mapping
+// --------------------------------------------------------------------
+
+// MapOpenSearchResponse turns an OpenSearch search response into the payload the GitHub
+// engine would have produced for the same input.
+func MapOpenSearchResponse(input *UnionQueryInput, response map[string]interface{}) *SearchResultPayload {
+	hitsObject, _ := response["hits"].(map[string]interface{})
+	aggregations, _ := response["aggregations"].(map[string]interface{})
+
+	payload := &SearchResultPayload{StatusCode: http.StatusOK}
+	if total, ok := hitsObject["total"].(map[string]interface{}); ok {
+		payload.TotalHits = int(toFloat64(total["value"]))
+	}
+
+	if len(input.FacetingAggs) > 0 {
+		payload.FacetingResults = make(map[string][]Bucket)
+		for name, agg := range input.FacetingAggs {
+			if agg == nil {
+				continue
+			}
+			raw, _ := aggregations[openSearchFacetPrefix+name].(map[string]interface{})
+			payload.FacetingResults[name] = mapOpenSearchBuckets(agg, raw)
+		}
+	}
+
+	if len(input.AggregationMap) > 0 {
+		payload.IsAggregation = true
+		payload.AggregationResults = make(map[string]AggregationResult)
+		for name, agg := range input.AggregationMap {
+			agg := agg
+			raw, _ := aggregations[name].(map[string]interface{})
+			payload.AggregationResults[name] = mapOpenSearchAggregation(&agg, raw)
+		}
+		payload.TotalHits = 0
+		return payload
+	}
+
+	if groups, ok := aggregations[openSearchTotalGroups].(map[string]interface{}); ok {
+		payload.TotalGroups = int(toFloat64(groups["value"]))
+	}
+
+	if !input.FacetsOnly {
+		rawHits, _ := hitsObject["hits"].([]interface{})
+		payload.Hits = mapOpenSearchHits(rawHits)
+	}
+	return payload
+}
+
+// mapOpenSearchHits returns the sources with the engine's "_score" (and "_innerHits" for collapse).
+func mapOpenSearchHits(rawHits []interface{}) []map[string]interface{} {
+	docs := make([]map[string]interface{}, 0, len(rawHits))
+	for _, h := range rawHits {
+		hit, ok := h.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		doc, _ := hit["_source"].(map[string]interface{})
+		if doc == nil {
+			doc = make(map[string]interface{})
+		}
+		if _, ok := doc["id"]; !ok {
+			if id, ok := hit["_id"].(string); ok {
+				doc["id"] = id
+			}
+		}
+		doc["_score"] = toFloat64(hit["_score"])
+		if innerHits, ok := hit["inner_hits"].(map[string]interface{}); ok {
+			if collapsed, ok := innerHits["collapsed"].(map[string]interface{}); ok {
+				inner, _ := collapsed["hits"].(map[string]interface{})
+				rawInner, _ := inner["hits"].([]interface{})
+				doc["_innerHits"] = mapOpenSearchHits(rawInner)
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func mapOpenSearchAggregation(agg *Aggregation, raw map[string]interface{}) AggregationResult {
+	return AggregationResult{
+		Name:            agg.Name,
+		Buckets:         mapOpenSearchBuckets(agg, raw),
+		PipelineMetrics: make(map[string]interface{}),
+	}
+}
+
+// mapOpenSearchBuckets mirrors the bucket shapes of ExecuteAggregation and executeFilterAggregation.
+func mapOpenSearchBuckets(agg *Aggregation, raw map[string]interface{}) []Bucket {
+	buckets := []Bucket{}
+	if raw == nil {
+		return buckets
+	}
+
+	switch {
+	case agg.Path != "":
+		// One bucket per inner aggregation holding its buckets (see executeNestedAggregation).
+		names := make([]string, 0, len(agg.Aggs))
+		for name := range agg.Aggs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			inner, _ := raw[name].(map[string]interface{})
+			buckets = append(buckets, Bucket{
+				Key:     name,
+				Count:   int(toFloat64(raw["doc_count"])),
+				Buckets: mapOpenSearchBuckets(agg.Aggs[name], inner),
+			})
+		}
+		return buckets
+
+	case agg.Filter != nil || agg.Missing != nil:
+		key := "filter"
+		if agg.Filter == nil {
+			key = "missing"
+		}
+		if agg.Name != "" {
+			key = agg.Name
+		}
+		return append(buckets, mapOpenSearchBucket(agg, key, raw))
+
+	case len(agg.Filters) > 0:
+		keyed, _ := raw["buckets"].(map[string]interface{})
+		keys := make([]string, 0, len(agg.Filters))
+		for k := range agg.Filters {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if agg.OtherBucket {
+			keys = append(keys, otherBucketKey(agg))
+		}
+		for _, k := range keys {
+			b, _ := keyed[k].(map[string]interface{})
+			buckets = append(buckets, mapOpenSearchBucket(agg, k, b))
+		}
+		return buckets
+
+	case len(agg.GroupBy) > 0 || len(agg.RangeBuckets) > 0 || agg.DateHistogram != nil:
+		list, _ := raw["buckets"].([]interface{})
+		for _, item := range list {
+			b, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf("%v", b["key"])
+			if keyAsString, ok := b["key_as_string"].(string); ok {
+				key = keyAsString
+			}
+			if agg.DateHistogram == nil {
+				if f, ok := b["key"].(float64); ok {
+					key = strconv.FormatFloat(f, 'f', -1, 64)
+				}
+			}
+			buckets = append(buckets, mapOpenSearchBucket(agg, normalizeBucketKey(key), b))
+		}
+		return buckets
+	}
+
+	// Metrics only
+	return append(buckets, mapOpenSearchBucket(agg, "", raw))
+}
+
+func mapOpenSearchBucket(agg *Aggregation, key string, raw map[string]interface{}) Bucket {
+	bucket := Bucket{
+		Key:     key,
+		Count:   int(toFloat64(raw["doc_count"])),
+		Metrics: make(map[string]interface{}),
+		Aggs:    make(map[string]AggregationResult),
+	}
+
+	for _, req := range agg.Metrics {
+		metricType := strings.ToLower(req.Type)
+		for _, resultName := range req.Fields {
+			value, ok := raw[resultName].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if req.Path != "" {
+				value, _ = value["value"].(map[string]interface{})
+			}
+			bucket.Metrics[resultName] = openSearchMetricValue(metricType, value)
+		}
+	}
+
+	if agg.TopHits != nil {
+		if topHits, ok := raw[openSearchTopHitsAgg].(map[string]interface{}); ok {
+			hits, _ := topHits["hits"].(map[string]interface{})
+			rawHits, _ := hits["hits"].([]interface{})
+			bucket.TopHits = mapOpenSearchHits(rawHits)
+		}
+	}
+
+	for name, subAgg := range agg.Aggs {
+		inner, _ := raw[name].(map[string]interface{})
+		bucket.Aggs[name] = mapOpenSearchAggregation(subAgg, inner)
+	}
+	return bucket
+}
+
+func openSearchMetricValue(metricType string, value map[string]interface{}) interface{} {
+	switch metricType {
+	case "median", "percentile":
+		if values, ok := value["values"].(map[string]interface{}); ok {
+			for _, v := range values {
+				return toFloat64(v)
+			}
+		}
+		return 0.0
+	case "std_dev":
+		return toFloat64(value["std_deviation"])
+	case "count":
+		return int(toFloat64(value["value"]))
+	}
+	return toFloat64(value["value"])
+}
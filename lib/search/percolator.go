@@ -0,0 +1,292 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v46/github"
+)
+
+// PercolatorIndexType is the value of the "type" field in an index configuration
+// that marks the index as a store of queries rather than documents.
+const PercolatorIndexType = "percolator"
+
+// PercolatorQueriesPath is the directory inside the percolator repo holding one
+// search.Query JSON file per stored query. The file name (minus .json) is the query id.
+const PercolatorQueriesPath = "queries"
+
+// PercolatorMatchesPath is the directory inside the percolator repo where match
+// events are written for downstream delivery.
+const PercolatorMatchesPath = "matches"
+
+// PercolatorIndex holds stored queries and evaluates single documents against them.
+// Queries are bucketed by the index they query and the set of composite fields they
+// declare so a document only gets evaluated against queries whose composite values it
+// actually matches. Both sides go through the transforms of the queried index, the same
+// way the index hook writes partitions and the loader addresses them.
+type PercolatorIndex struct {
+	mu      sync.RWMutex
+	queries map[string]Query
+	keys    map[string]percolatorKey // query id -> where it is bucketed
+
+	// bucket key (index and sorted composite field names) -> composite value key -> query ids
+	buckets map[string]map[string][]string
+	// bucket key -> sorted composite field names
+	bucketFields map[string][]string
+	// bucket key -> queried index
+	bucketIndexes map[string]string
+
+	// Composite field transforms per queried index (see GetFieldTransforms). Set them
+	// before adding the queries of an index.
+	Transforms map[string]map[string]FieldTransform
+
+	Loader     DocumentLoader              // Used by subqueries inside stored queries
+	IndexInput *GetIndexConfigurationInput // Base input passed to Bool.Evaluate
+	RepoName   string                      // Repo holding the stored queries and match events
+}
+
+// PercolateMatch is the match event written for each stored query that matches a saved entity.
+type PercolateMatch struct {
+	QueryId  string                 `json:"queryId"`
+	Index    string                 `json:"index"`
+	Score    float64                `json:"score"`
+	Contract string                 `json:"contract,omitempty"`
+	Entity   map[string]interface{} `json:"entity"`
+}
+
+// NewPercolatorIndex creates an empty percolator index.
+func NewPercolatorIndex(loader DocumentLoader, indexInput *GetIndexConfigurationInput) *PercolatorIndex {
+	return &PercolatorIndex{
+		queries:       make(map[string]Query),
+		keys:          make(map[string]percolatorKey),
+		buckets:       make(map[string]map[string][]string),
+		bucketFields:  make(map[string][]string),
+		bucketIndexes: make(map[string]string),
+		Transforms:    make(map[string]map[string]FieldTransform),
+		Loader:        loader,
+		IndexInput:    indexInput,
+	}
+}
+
+type percolatorKey struct {
+	bucket string
+	value  string
+}
+
+// compositeFieldsOf returns the sorted composite field names of a query.
+func compositeFieldsOf(q Query) []string {
+	fields := make([]string, 0, len(q.Composite))
+	for f := range q.Composite {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Add stores (or replaces) a query under the given id.
+func (p *PercolatorIndex) Add(id string, q Query) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.queries[id]; exists {
+		p.removeLocked(id)
+	}
+
+	fields := compositeFieldsOf(q)
+	bucketKey := q.Index + "|" + strings.Join(fields, ":")
+
+	transforms := p.Transforms[q.Index]
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = TransformCompositeValue(transforms, f, q.Composite[f])
+	}
+	valueKey := strings.Join(values, ":")
+
+	if _, ok := p.buckets[bucketKey]; !ok {
+		p.buckets[bucketKey] = make(map[string][]string)
+		p.bucketFields[bucketKey] = fields
+		p.bucketIndexes[bucketKey] = q.Index
+	}
+	p.buckets[bucketKey][valueKey] = append(p.buckets[bucketKey][valueKey], id)
+	p.queries[id] = q
+	p.keys[id] = percolatorKey{bucket: bucketKey, value: valueKey}
+}
+
+// Remove deletes a stored query.
+func (p *PercolatorIndex) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeLocked(id)
+}
+
+func (p *PercolatorIndex) removeLocked(id string) {
+	key, exists := p.keys[id]
+	if !exists {
+		return
+	}
+	delete(p.queries, id)
+	delete(p.keys, id)
+
+	ids := p.buckets[key.bucket][key.value]
+	for i, existing := range ids {
+		if existing == id {
+			p.buckets[key.bucket][key.value] = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(p.buckets[key.bucket][key.value]) == 0 {
+		delete(p.buckets[key.bucket], key.value)
+	}
+	if len(p.buckets[key.bucket]) == 0 {
+		delete(p.buckets, key.bucket)
+		delete(p.bucketFields, key.bucket)
+		delete(p.bucketIndexes, key.bucket)
+	}
+}
+
+// Len returns the number of stored queries.
+func (p *PercolatorIndex) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.queries)
+}
+
+// candidates returns the ids of stored queries whose composite values match the document.
+// Queries without a composite are always candidates. Fan-out fields make a document
+// match every combination of its values, like the partitions it is written to.
+func (p *PercolatorIndex) candidates(doc map[string]interface{}) []string {
+	var ids []string
+	for bucketKey, fields := range p.bucketFields {
+		transforms := p.Transforms[p.bucketIndexes[bucketKey]]
+		valueKeys := []string{""}
+		for i, f := range fields {
+			segments, err := GetNestedValue(doc, f, transforms[f])
+			if err != nil {
+				valueKeys = nil
+				break
+			}
+			next := make([]string, 0, len(valueKeys)*len(segments))
+			for _, valueKey := range valueKeys {
+				for _, segment := range segments {
+					if i > 0 {
+						next = append(next, valueKey+":"+segment)
+					} else {
+						next = append(next, segment)
+					}
+				}
+			}
+			valueKeys = next
+		}
+		for _, valueKey := range valueKeys {
+			ids = append(ids, p.buckets[bucketKey][valueKey]...)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Percolate evaluates a single document against every stored query and returns
+// the ids of the matching queries.
+func (p *PercolatorIndex) Percolate(ctx context.Context, doc map[string]interface{}) []string {
+	matches := p.PercolateWithScores(ctx, doc)
+	ids := make([]string, 0, len(matches))
+	for _, m := range matches {
+		ids = append(ids, m.QueryId)
+	}
+	return ids
+}
+
+// PercolateWithScores is Percolate but keeps the score of each match.
+func (p *PercolatorIndex) PercolateWithScores(ctx context.Context, doc map[string]interface{}) []PercolateMatch {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	candidateIds := p.candidates(doc)
+	log.Printf("Percolate: %d candidate queries out of %d stored", len(candidateIds), len(p.queries))
+
+	var matches []PercolateMatch
+	for _, id := range candidateIds {
+		q := p.queries[id]
+		matched, score := q.Bool.Evaluate(doc, ctx, p.Loader, p.IndexInput)
+		if matched {
+			matches = append(matches, PercolateMatch{QueryId: id, Index: q.Index, Score: score})
+		}
+	}
+	return matches
+}
+
+// LoadPercolatorIndex reads the percolator index configuration by id and loads
+// every stored query from the queries directory of its repoName.
+func (l *GitHubLoader) LoadPercolatorIndex(ctx context.Context, config *GetIndexConfigurationInput) (*PercolatorIndex, error) {
+	indexObject, err := l.GetIndexById(config)
+	if err != nil || indexObject == nil {
+		return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", config.Id)
+	}
+
+	if indexType, _ := indexObject["type"].(string); indexType != PercolatorIndexType {
+		return nil, fmt.Errorf("index '%s' is not a percolator index", config.Id)
+	}
+
+	repoToFetch, ok := indexObject["repoName"].(string)
+	if !ok || repoToFetch == "" {
+		return nil, fmt.Errorf("index configuration missing 'repoName'")
+	}
+
+	percolator := NewPercolatorIndex(l, config)
+	percolator.RepoName = repoToFetch
+
+	opts := &github.RepositoryContentGetOptions{Ref: config.RefFor(repoToFetch)}
+	_, dirContents, res, err := l.GitHubClient.Repositories.GetContents(ctx, config.Owner, repoToFetch, PercolatorQueriesPath, opts)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			log.Printf("LoadPercolatorIndex: No stored queries for index %s", config.Id)
+			return percolator, nil
+		}
+		return nil, fmt.Errorf("failed to list stored queries for index %s: %w", config.Id, err)
+	}
+
+	for _, content := range dirContents {
+		if content.GetType() != "file" || !strings.HasSuffix(content.GetName(), ".json") {
+			continue
+		}
+
+		file, _, _, err := l.GitHubClient.Repositories.GetContents(ctx, config.Owner, repoToFetch, content.GetPath(), opts)
+		if err != nil || file == nil || file.Content == nil {
+			log.Printf("LoadPercolatorIndex: Failed to retrieve stored query '%s': %v", content.GetPath(), err)
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(*file.Content)
+		if err != nil {
+			decoded = []byte(*file.Content)
+		}
+
+		var q Query
+		if err := json.Unmarshal(decoded, &q); err != nil {
+			log.Printf("LoadPercolatorIndex: Invalid stored query '%s': %v", content.GetPath(), err)
+			continue
+		}
+
+		if _, ok := percolator.Transforms[q.Index]; !ok && len(q.Composite) != 0 {
+			queriedInput := *config
+			queriedInput.Id = q.Index
+			queriedObject, err := l.GetIndexById(&queriedInput)
+			if err != nil || queriedObject == nil {
+				log.Printf("LoadPercolatorIndex: Failed to retrieve index config for ID '%s' queried by '%s'", q.Index, content.GetPath())
+				continue
+			}
+			percolator.Transforms[q.Index] = GetFieldTransforms(queriedObject)
+		}
+
+		percolator.Add(strings.TrimSuffix(content.GetName(), ".json"), q)
+	}
+
+	log.Printf("LoadPercolatorIndex: Loaded %d stored queries for index %s", percolator.Len(), config.Id)
+	return percolator, nil
+}
@@ -0,0 +1,151 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/go-github/v46/github"
+)
+
+// ====================================================================
+// === BRANCH AND POINT-IN-TIME SEARCH ================================
+// ====================================================================
+//
+// A search reads the objects repo (index configs) and one repo per index. A ref
+// (commit SHA or tag) only exists in the repo it was made in, so it anchors a point
+// in time: the repo holding the ref is pinned to it and every other repo to its last
+// commit on the branch at or before the anchor commit.
+
+// ErrInvalidRef is returned when the requested branch or ref does not exist.
+var ErrInvalidRef = errors.New("invalid branch or ref")
+
+// RefFor returns the ref content of a repo is read at: its pinned commit or the branch.
+func (c *GetIndexConfigurationInput) RefFor(repoName string) string {
+	if ref, ok := c.Refs[repoName]; ok && ref != "" {
+		return ref
+	}
+	return c.Branch
+}
+
+// queryRepos returns the objects repo followed by the repos of the given indexes and of
+// the indexes their security predicates read through subqueries.
+func (l *GitHubLoader) queryRepos(config *GetIndexConfigurationInput, indexIds []string) ([]string, error) {
+	pieces := strings.Split(config.Repo, "/")
+	repos := []string{pieces[1]}
+	seen := map[string]bool{pieces[1]: true}
+	collector := &indexCollector{seen: make(map[string]bool)}
+	for _, id := range indexIds {
+		collector.add(id)
+	}
+	// Predicates may add indexes to the collector while it is walked.
+	for i := 0; i < len(collector.indexes); i++ {
+		id := collector.indexes[i]
+		indexInput := *config
+		indexInput.Id = id
+		indexObject, err := l.GetIndexById(&indexInput)
+		if err != nil || indexObject == nil {
+			return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", id)
+		}
+		repoName, ok := indexObject["repoName"].(string)
+		if !ok || repoName == "" {
+			return nil, fmt.Errorf("index configuration missing 'repoName'")
+		}
+		if !seen[repoName] {
+			seen[repoName] = true
+			repos = append(repos, repoName)
+		}
+		if err := collectPredicateIndexes(collector, indexObject); err != nil {
+			return nil, err
+		}
+	}
+	return repos, nil
+}
+
+// collectPredicateIndexes adds the indexes read by the security predicates of an index.
+// Claim placeholders only appear in values, so the templates are walked as they are.
+func collectPredicateIndexes(collector *indexCollector, indexObject map[string]interface{}) error {
+	security, err := IndexSecurity(indexObject)
+	if err != nil || security == nil {
+		return err
+	}
+	for _, predicate := range security.Predicates {
+		b, err := json.Marshal(predicate)
+		if err != nil {
+			return err
+		}
+		var predicateBool Bool
+		if err := json.Unmarshal(b, &predicateBool); err != nil {
+			return fmt.Errorf("invalid security predicate: %v", err)
+		}
+		collector.bool(&predicateBool)
+	}
+	return nil
+}
+
+// ResolveRefs validates the branch and, when a ref is requested, pins every repo read by
+// the given indexes to a commit. The result is meant for GetIndexConfigurationInput.Refs.
+func (l *GitHubLoader) ResolveRefs(ctx context.Context, config *GetIndexConfigurationInput, indexIds []string, ref string) (map[string]string, error) {
+	owner := strings.Split(config.Repo, "/")[0]
+	objectsRepo := strings.Split(config.Repo, "/")[1]
+
+	if _, res, err := l.GitHubClient.Repositories.GetBranch(ctx, owner, objectsRepo, config.Branch, true); err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return nil, fmt.Errorf("%w: branch '%s' does not exist", ErrInvalidRef, config.Branch)
+		}
+		return nil, fmt.Errorf("failed to verify branch '%s': %v", config.Branch, err)
+	}
+
+	if ref == "" {
+		return nil, nil
+	}
+
+	// Index configs are read at the branch head to find the repos, then pinned below.
+	repos, err := l.queryRepos(config, indexIds)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]string)
+	var anchor *github.RepositoryCommit
+	for _, repoName := range repos {
+		commit, res, err := l.GitHubClient.Repositories.GetCommit(ctx, owner, repoName, ref, nil)
+		if err != nil {
+			if res != nil && (res.StatusCode == 404 || res.StatusCode == 422) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to resolve ref '%s' in %s: %v", ref, repoName, err)
+		}
+		anchor = commit
+		refs[repoName] = commit.GetSHA()
+		log.Printf("ResolveRefs: Ref %s is %s@%s", ref, repoName, commit.GetSHA())
+		break
+	}
+	if anchor == nil {
+		return nil, fmt.Errorf("%w: ref '%s' not found in %s", ErrInvalidRef, ref, strings.Join(repos, ", "))
+	}
+
+	asOf := anchor.GetCommit().GetCommitter().GetDate()
+	for _, repoName := range repos {
+		if _, pinned := refs[repoName]; pinned {
+			continue
+		}
+		commits, _, err := l.GitHubClient.Repositories.ListCommits(ctx, owner, repoName, &github.CommitsListOptions{
+			SHA:         config.Branch,
+			Until:       asOf,
+			ListOptions: github.ListOptions{PerPage: 1},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list commits of %s: %v", repoName, err)
+		}
+		if len(commits) == 0 {
+			return nil, fmt.Errorf("%w: %s has no commits on '%s' as of %s", ErrInvalidRef, repoName, config.Branch, asOf)
+		}
+		refs[repoName] = commits[0].GetSHA()
+		log.Printf("ResolveRefs: Pinned %s@%s as of %s", repoName, commits[0].GetSHA(), asOf)
+	}
+	return refs, nil
+}
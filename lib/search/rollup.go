@@ -0,0 +1,204 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/google/go-github/v46/github"
+)
+
+// ====================================================================
+// === PARTITION FACET ROLLUPS ========================================
+// ====================================================================
+//
+// Index configs declare the fields to roll up:
+//
+//	"rollups": ["category", "condition"]
+//
+// The index hook keeps {prefix}/_rollups.json up to date with the number of
+// documents per value of each field so unfiltered facets don't need every
+// document of the partition loaded.
+
+// IndexRollupsFileName is the rollup file inside a partition.
+const IndexRollupsFileName = "_rollups.json"
+
+// IndexRollups is the content of a partition rollup file.
+type IndexRollups struct {
+	Version int                       `json:"v"`
+	Total   int                       `json:"total"`
+	Fields  map[string]map[string]int `json:"fields"` // field -> value -> document count
+
+	// Rollup fields declared by the index config (set by LoadRollups)
+	Declared []string `json:"-"`
+}
+
+// RollupLoader is implemented by loaders able to serve partition rollups.
+type RollupLoader interface {
+	LoadRollups(ctx context.Context, config *GetIndexConfigurationInput, queryComposite map[string]interface{}) (*IndexRollups, error)
+}
+
+// GetRollupFields reads the "rollups" section of an index configuration.
+func GetRollupFields(indexEntity map[string]interface{}) []string {
+	var fields []string
+	if rollups, ok := indexEntity["rollups"].([]interface{}); ok {
+		for _, r := range rollups {
+			if rStr, ok := r.(string); ok {
+				fields = append(fields, rStr)
+			}
+		}
+	}
+	return fields
+}
+
+// ParseIndexRollups decodes a rollup file. Empty content is an empty rollup.
+func ParseIndexRollups(content []byte) (*IndexRollups, error) {
+	rollups := &IndexRollups{Version: 1, Fields: make(map[string]map[string]int)}
+	if len(content) == 0 {
+		return rollups, nil
+	}
+	if err := json.Unmarshal(content, rollups); err != nil {
+		return nil, err
+	}
+	if rollups.Fields == nil {
+		rollups.Fields = make(map[string]map[string]int)
+	}
+	return rollups, nil
+}
+
+// Apply adds (delta 1) or removes (delta -1) a document's contribution. Values are
+// resolved like GroupDocumentsByField so rollups match facets computed from documents.
+func (r *IndexRollups) Apply(doc map[string]interface{}, fields []string, delta int) {
+	r.Total += delta
+	for _, field := range fields {
+		value, exists := resolveDotNotation(doc, field)
+		if !exists {
+			continue
+		}
+		if r.Fields[field] == nil {
+			r.Fields[field] = make(map[string]int)
+		}
+		r.Fields[field][value] += delta
+		if r.Fields[field][value] <= 0 {
+			delete(r.Fields[field], value)
+		}
+	}
+	if r.Total < 0 {
+		r.Total = 0
+	}
+}
+
+// Merge adds another partition's rollups into this one.
+func (r *IndexRollups) Merge(other *IndexRollups) {
+	r.Total += other.Total
+	r.Declared = other.Declared
+	for field, values := range other.Fields {
+		if r.Fields[field] == nil {
+			r.Fields[field] = make(map[string]int)
+		}
+		for value, count := range values {
+			r.Fields[field][value] += count
+		}
+	}
+}
+
+// Buckets returns the facet buckets of a field ordered by count then key.
+func (r *IndexRollups) Buckets(field string) []Bucket {
+	buckets := make([]Bucket, 0, len(r.Fields[field]))
+	for value, count := range r.Fields[field] {
+		buckets = append(buckets, Bucket{Key: value, Count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Count != buckets[j].Count {
+			return buckets[i].Count > buckets[j].Count
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+	return buckets
+}
+
+// IndexRollupPaths returns the rollup files of every partition an entity belongs to.
+func IndexRollupPaths(entityJSON map[string]interface{}, indexEntity map[string]interface{}) ([]string, error) {
+	prefixes, err := ExtractCompositePrefixes(entityJSON, indexEntity)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		paths = append(paths, prefix+"/"+IndexRollupsFileName)
+	}
+	return paths, nil
+}
+
+// RollupFacets answers terms facets from rollups. It returns false when any facet
+// can't be answered this way (non terms, nested aggs, metrics or a field without a rollup).
+func RollupFacets(rollups *IndexRollups, facetingAggs map[string]*Aggregation) (map[string][]Bucket, bool) {
+	available := make(map[string]bool)
+	for _, f := range rollups.Declared {
+		available[f] = true
+	}
+
+	results := make(map[string][]Bucket)
+	for aggName, agg := range facetingAggs {
+		if agg == nil || agg.Type != "terms" || len(agg.GroupBy) != 1 || len(agg.Aggs) > 0 || len(agg.Metrics) > 0 || agg.TopHits != nil {
+			return nil, false
+		}
+		if !available[agg.GroupBy[0]] {
+			return nil, false
+		}
+		results[aggName] = rollups.Buckets(agg.GroupBy[0])
+	}
+	return results, true
+}
+
+// LoadRollups reads the rollup file of the partition addressed by the query composite.
+func (l *GitHubLoader) LoadRollups(ctx context.Context, config *GetIndexConfigurationInput, queryComposite map[string]interface{}) (*IndexRollups, error) {
+	indexObject, err := l.GetIndexById(config)
+	if err != nil || indexObject == nil {
+		return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", config.Id)
+	}
+
+	declared := GetRollupFields(indexObject)
+	if len(declared) == 0 {
+		return nil, fmt.Errorf("index '%s' does not declare rollups", config.Id)
+	}
+
+	contentPath, err := compositePath(indexObject, queryComposite)
+	if err != nil {
+		return nil, err
+	}
+
+	repoToFetch, ok := indexObject["repoName"].(string)
+	if !ok || repoToFetch == "" {
+		return nil, fmt.Errorf("index configuration missing 'repoName'")
+	}
+
+	file, _, res, err := l.GitHubClient.Repositories.GetContents(
+		ctx, config.Owner, repoToFetch, contentPath+"/"+IndexRollupsFileName,
+		&github.RepositoryContentGetOptions{Ref: config.RefFor(repoToFetch)},
+	)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			// Partition without documents
+			rollups, _ := ParseIndexRollups(nil)
+			rollups.Declared = declared
+			return rollups, nil
+		}
+		return nil, fmt.Errorf("failed to load rollups at %s: %v", contentPath, err)
+	}
+
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, err
+	}
+
+	rollups, err := ParseIndexRollups([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	rollups.Declared = declared
+	log.Printf("LoadRollups: Loaded rollups for %s with %d documents", contentPath, rollups.Total)
+	return rollups, nil
+}
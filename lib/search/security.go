@@ -0,0 +1,348 @@
+package search
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ====================================================================
+// === DOCUMENT LEVEL SECURITY ========================================
+// ====================================================================
+//
+// Index configs may restrict which documents a caller can see:
+//
+//	"security": {
+//	  "predicates": [{"all": [{"term": {"field": "userId", "value": "${sub}"}}]}],
+//	  "bypass": {"cognito:groups": ["admin"]}
+//	}
+//
+// Predicates are Bool templates where ${claim} is replaced by the caller's claim
+// (list claims such as cognito:groups are joined with "," for In/NotIn). A document
+// is visible when it satisfies every predicate. Callers holding one of the bypass
+// claim values see everything. Conditions on a claim the caller does not have are
+// false: they drop out of "one" groups, anywhere else they hide every document of
+// the index.
+//
+// SecureLoader enforces the predicates on every load, so queries, subqueries,
+// moreLikeThis, post filters and aggregations only ever see visible documents.
+
+// Principal is the caller a search runs for, identified by its token claims.
+type Principal struct {
+	Claims map[string]interface{}
+}
+
+// SecurityConfig is the "security" section of an index configuration.
+type SecurityConfig struct {
+	Predicates []interface{}       `json:"predicates"`       // Bool templates, ANDed
+	Bypass     map[string][]string `json:"bypass,omitempty"` // claim -> values granting unrestricted access
+}
+
+// IndexConfigLoader is implemented by loaders that can read index configurations.
+type IndexConfigLoader interface {
+	GetIndexById(c *GetIndexConfigurationInput) (map[string]interface{}, error)
+}
+
+var claimPlaceholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// denyAll is a Bool no document satisfies.
+var denyAll = Bool{Not: []Case{{Bool: &Bool{}}}}
+
+// volatileClaims change with every token without changing what the caller may see.
+var volatileClaims = map[string]bool{
+	"iat": true, "exp": true, "nbf": true, "auth_time": true, "jti": true, "origin_jti": true, "event_id": true,
+}
+
+// IndexSecurity reads the "security" section of an index configuration. It returns nil
+// when the index declares no predicates.
+func IndexSecurity(indexObject map[string]interface{}) (*SecurityConfig, error) {
+	raw, ok := indexObject["security"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var config SecurityConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid security configuration: %v", err)
+	}
+	if len(config.Predicates) == 0 {
+		return nil, nil
+	}
+	return &config, nil
+}
+
+// ClaimValues returns the values of a claim. Groups arrive as a list or, through the
+// API Gateway authorizer, flattened to "[a b]" or "a,b".
+func (p *Principal) ClaimValues(name string) ([]string, bool) {
+	if p == nil || p.Claims == nil {
+		return nil, false
+	}
+	raw, ok := p.Claims[name]
+	if !ok || raw == nil {
+		return nil, false
+	}
+	switch v := raw.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, true
+	case []string:
+		return v, true
+	case string:
+		if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+			return strings.FieldsFunc(strings.Trim(v, "[]"), func(r rune) bool { return r == ' ' || r == ',' }), true
+		}
+		if v == "" {
+			return nil, false
+		}
+		return []string{v}, true
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, true
+	default:
+		return []string{fmt.Sprint(v)}, true
+	}
+}
+
+// CacheKey identifies the principal for result caching, ignoring per token claims.
+func (p *Principal) CacheKey() string {
+	if p == nil || len(p.Claims) == 0 {
+		return "anonymous"
+	}
+	names := make([]string, 0, len(p.Claims))
+	for name := range p.Claims {
+		if !volatileClaims[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		values, _ := p.ClaimValues(name)
+		fmt.Fprintf(h, "%s=%s\n", name, strings.Join(values, ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Filter returns the Bool a document must satisfy to be visible to the principal, or nil
+// when the principal is not restricted.
+func (s *SecurityConfig) Filter(principal *Principal) (*Bool, error) {
+	if s == nil || len(s.Predicates) == 0 {
+		return nil, nil
+	}
+	for claim, granted := range s.Bypass {
+		values, _ := principal.ClaimValues(claim)
+		for _, value := range values {
+			for _, grant := range granted {
+				if value == grant {
+					log.Printf("Security: Bypassed by grant %s=%s", claim, grant)
+					return nil, nil
+				}
+			}
+		}
+	}
+
+	filter := Bool{All: make([]Case, 0, len(s.Predicates))}
+	for _, predicate := range s.Predicates {
+		resolved, missing := substituteClaims(predicate, principal, false)
+		if missing != "" {
+			log.Printf("Security: Claim '%s' is missing, no documents are visible", missing)
+			deny := denyAll
+			return &deny, nil
+		}
+		b, err := json.Marshal(resolved)
+		if err != nil {
+			return nil, err
+		}
+		var predicateBool Bool
+		if err := json.Unmarshal(b, &predicateBool); err != nil {
+			return nil, fmt.Errorf("invalid security predicate: %v", err)
+		}
+		filter.All = append(filter.All, Case{Bool: &predicateBool})
+	}
+	return &filter, nil
+}
+
+// substituteClaims replaces ${claim} in every string of a decoded JSON value. It returns
+// the name of the first claim the principal does not have. A case of a "one" group using
+// a missing claim is dropped (it can only be false) unless it sits under none or not,
+// where dropping it would widen what is visible.
+func substituteClaims(value interface{}, principal *Principal, negated bool) (interface{}, string) {
+	switch v := value.(type) {
+	case string:
+		missing := ""
+		replaced := claimPlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+			name := claimPlaceholder.FindStringSubmatch(placeholder)[1]
+			values, ok := principal.ClaimValues(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return strings.Join(values, ",")
+		})
+		return replaced, missing
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			childNegated := negated
+			if key == "none" || key == "not" {
+				childNegated = !negated
+			}
+			if cases, ok := item.([]interface{}); ok && key == "one" && !negated {
+				kept := make([]interface{}, 0, len(cases))
+				missing := ""
+				for _, c := range cases {
+					resolved, caseMissing := substituteClaims(c, principal, negated)
+					if caseMissing != "" {
+						missing = caseMissing
+						continue
+					}
+					kept = append(kept, resolved)
+				}
+				if len(kept) == 0 && missing != "" {
+					return nil, missing
+				}
+				out[key] = kept
+				continue
+			}
+			resolved, missing := substituteClaims(item, principal, childNegated)
+			if missing != "" {
+				return nil, missing
+			}
+			out[key] = resolved
+		}
+		return out, ""
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, missing := substituteClaims(item, principal, negated)
+			if missing != "" {
+				return nil, missing
+			}
+			out[i] = resolved
+		}
+		return out, ""
+	default:
+		return v, ""
+	}
+}
+
+// SecureQuery ANDs a security filter into a query (used where documents are not
+// loaded through a SecureLoader, such as the opensearch backend).
+func SecureQuery(query Query, filter *Bool) Query {
+	if filter == nil {
+		return query
+	}
+	original := query.Bool
+	query.Bool = Bool{All: []Case{{Bool: &original}, {Bool: filter}}}
+	return query
+}
+
+// --------------------------------------------------------------------
+// Secured loading
+// --------------------------------------------------------------------
+
+// SecureLoader wraps a DocumentLoader and drops the documents the principal may not see.
+type SecureLoader struct {
+	Loader    DocumentLoader
+	Principal *Principal
+
+	mu      sync.Mutex
+	filters map[string]*Bool // per index, nil when unrestricted
+}
+
+// NewSecureLoader enforces the index security predicates of the principal on a loader.
+func NewSecureLoader(loader DocumentLoader, principal *Principal) *SecureLoader {
+	return &SecureLoader{Loader: loader, Principal: principal, filters: make(map[string]*Bool)}
+}
+
+// FilterFor returns the security filter of an index, resolved once per loader. Loaders
+// without index configurations have nothing to enforce.
+func (l *SecureLoader) FilterFor(config *GetIndexConfigurationInput) (*Bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if filter, ok := l.filters[config.Id]; ok {
+		return filter, nil
+	}
+	configLoader, ok := l.Loader.(IndexConfigLoader)
+	if !ok {
+		l.filters[config.Id] = nil
+		return nil, nil
+	}
+	indexObject, err := configLoader.GetIndexById(config)
+	if err != nil || indexObject == nil {
+		return nil, fmt.Errorf("failed to retrieve index config for ID '%s'", config.Id)
+	}
+	security, err := IndexSecurity(indexObject)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := security.Filter(l.Principal)
+	if err != nil {
+		return nil, err
+	}
+	l.filters[config.Id] = filter
+	return filter, nil
+}
+
+func (l *SecureLoader) Load(ctx context.Context, config *GetIndexConfigurationInput, queryComposite map[string]interface{}) (DocumentIterator, error) {
+	filter, err := l.FilterFor(config)
+	if err != nil {
+		return nil, err
+	}
+	iterator, err := l.Loader.Load(ctx, config, queryComposite)
+	if err != nil || filter == nil {
+		return iterator, err
+	}
+	indexInput := *config
+	return &secureIterator{DocumentIterator: iterator, filter: filter, ctx: ctx, loader: l, config: &indexInput}, nil
+}
+
+// LoadRollups only serves rollups of unrestricted indexes since they count every document.
+func (l *SecureLoader) LoadRollups(ctx context.Context, config *GetIndexConfigurationInput, queryComposite map[string]interface{}) (*IndexRollups, error) {
+	rollupLoader, ok := l.Loader.(RollupLoader)
+	if !ok {
+		return nil, fmt.Errorf("loader does not provide rollups")
+	}
+	filter, err := l.FilterFor(config)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		return nil, fmt.Errorf("index '%s' is restricted by security predicates", config.Id)
+	}
+	return rollupLoader.LoadRollups(ctx, config, queryComposite)
+}
+
+// secureIterator skips the documents failing the security filter. Predicates may use
+// subqueries, which load through the same SecureLoader.
+type secureIterator struct {
+	DocumentIterator
+	filter *Bool
+	ctx    context.Context
+	loader *SecureLoader
+	config *GetIndexConfigurationInput
+}
+
+func (i *secureIterator) Next() (map[string]interface{}, bool) {
+	for {
+		doc, ok := i.DocumentIterator.Next()
+		if !ok {
+			return nil, false
+		}
+		if visible, _ := i.filter.Evaluate(doc, i.ctx, i.loader, i.config); visible {
+			return doc, true
+		}
+	}
+}
@@ -0,0 +1,1098 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ====================================================================
+// === SQL FRONT END ==================================================
+// ====================================================================
+//
+// ParseSQL compiles a subset of SQL into the JSON dialect:
+//
+//	SELECT * | fields | aggregates FROM index
+//	[WHERE condition] [GROUP BY fields] [HAVING condition]
+//	[ORDER BY field [ASC|DESC], ...] [LIMIT n] [OFFSET n]
+//
+// Conditions support = != <> < > <= >=, [NOT] IN (values), [NOT] IN (SELECT field FROM ...)
+// (compiled to a subquery), [NOT] LIKE, [NOT] BETWEEN, IS [NOT] NULL, MATCH(field, 'text'[, fuzziness]),
+// MATCH_PHRASE(field, 'text'[, slop]) and GEO_DISTANCE(field, lat, lon, distance[, 'unit']).
+// Partition keys are written like any other column: the equality conditions ANDed at the
+// top of a WHERE on the index "fields" (see SQLPartitions) become the query composite, and
+// every partition field of a partitioned index needs one.
+//
+// Aggregates are COUNT(*), COUNT(field), COUNT(DISTINCT field), SUM, AVG, MIN, MAX, MEDIAN,
+// MODE, STDDEV, CARDINALITY and PERCENTILE(field, p). They compile to MetricRequests named by
+// their alias (default "sum_price" style). COUNT(*) is the bucket count.
+
+// sqlAggregationName is the key of the compiled aggregation in Query.Aggs.
+const sqlAggregationName = "sql"
+
+type sqlTokenKind int
+
+const (
+	sqlEOF sqlTokenKind = iota
+	sqlIdent
+	sqlKeyword
+	sqlString
+	sqlNumber
+	sqlSymbol
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "BY": true, "HAVING": true,
+	"ORDER": true, "ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true, "AND": true,
+	"OR": true, "NOT": true, "IN": true, "IS": true, "NULL": true, "LIKE": true,
+	"BETWEEN": true, "AS": true, "DISTINCT": true, "TRUE": true, "FALSE": true,
+	// Recognized only to reject them with a clear error.
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "OUTER": true,
+	"CROSS": true, "ON": true, "UNION": true, "INTERSECT": true, "EXCEPT": true, "WITH": true,
+	"INSERT": true, "UPDATE": true, "DELETE": true, "CASE": true, "EXISTS": true,
+}
+
+var sqlUnsupported = map[string]string{
+	"JOIN":      "joins are not supported, use IN (SELECT ...)",
+	"INNER":     "joins are not supported, use IN (SELECT ...)",
+	"LEFT":      "joins are not supported, use IN (SELECT ...)",
+	"RIGHT":     "joins are not supported, use IN (SELECT ...)",
+	"FULL":      "joins are not supported, use IN (SELECT ...)",
+	"CROSS":     "joins are not supported, use IN (SELECT ...)",
+	"OUTER":     "joins are not supported, use IN (SELECT ...)",
+	"ON":        "joins are not supported, use IN (SELECT ...)",
+	"UNION":     "UNION is not supported in SQL, send a 'union' query instead",
+	"INTERSECT": "INTERSECT is not supported",
+	"EXCEPT":    "EXCEPT is not supported",
+	"WITH":      "WITH (common table expressions) is not supported",
+	"INSERT":    "only SELECT statements are supported",
+	"UPDATE":    "only SELECT statements are supported",
+	"DELETE":    "only SELECT statements are supported",
+	"CASE":      "CASE expressions are not supported",
+	"EXISTS":    "EXISTS is not supported, use IN (SELECT ...)",
+}
+
+// sqlMetricTypes maps SQL aggregate functions to MetricRequest types.
+var sqlMetricTypes = map[string]string{
+	"COUNT":       "count",
+	"SUM":         "sum",
+	"AVG":         "avg",
+	"MIN":         "min",
+	"MAX":         "max",
+	"MEDIAN":      "median",
+	"MODE":        "mode",
+	"STDDEV":      "std_dev",
+	"STD_DEV":     "std_dev",
+	"CARDINALITY": "cardinality",
+	"PERCENTILE":  "percentile",
+}
+
+// tokenizeSQL splits a statement into tokens. Keywords are upper cased, identifiers
+// keep their case and may be dotted (seller.name) or quoted with " or `.
+func tokenizeSQL(sql string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	runes := []rune(sql)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			word := string(runes[start:i])
+			if upper := strings.ToUpper(word); sqlKeywords[upper] {
+				tokens = append(tokens, sqlToken{kind: sqlKeyword, text: upper, pos: start})
+			} else {
+				tokens = append(tokens, sqlToken{kind: sqlIdent, text: word, pos: start})
+			}
+
+		case r == '"' || r == '`':
+			start := i
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated quoted identifier at position %d", start)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlIdent, text: string(runes[start+1 : end]), pos: start})
+			i = end + 1
+
+		case r == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if runes[i] == '\'' {
+					// '' is an escaped quote.
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						b.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlString, text: b.String(), pos: start})
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.')) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E') {
+				i++
+			}
+			text := string(runes[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("invalid number '%s' at position %d", text, start)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, text: text, pos: start})
+
+		default:
+			start := i
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "<=" || two == ">=" || two == "<>" || two == "!=" {
+					tokens = append(tokens, sqlToken{kind: sqlSymbol, text: two, pos: start})
+					i += 2
+					continue
+				}
+			}
+			if strings.ContainsRune("=<>(),*;", r) {
+				tokens = append(tokens, sqlToken{kind: sqlSymbol, text: string(r), pos: start})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", r, start)
+		}
+	}
+	return append(tokens, sqlToken{kind: sqlEOF, pos: len(runes)}), nil
+}
+
+// sqlCondition is a parsed WHERE or HAVING expression before it is compiled to a Bool.
+type sqlCondition struct {
+	and  []*sqlCondition
+	or   []*sqlCondition
+	not  *sqlCondition
+	leaf *Case
+
+	// Set for field = literal so the partition composite can be derived.
+	eqField string
+	eqValue interface{}
+}
+
+// toCase compiles the condition. A Bool only evaluates its first non-empty group, so
+// every nested AND, OR and NOT gets a Bool of its own.
+func (c *sqlCondition) toCase() Case {
+	if c.leaf != nil {
+		return *c.leaf
+	}
+	b := c.toBool()
+	return Case{Bool: &b}
+}
+
+func (c *sqlCondition) toBool() Bool {
+	cases := func(conditions []*sqlCondition) []Case {
+		compiled := make([]Case, len(conditions))
+		for i, condition := range conditions {
+			compiled[i] = condition.toCase()
+		}
+		return compiled
+	}
+	switch {
+	case len(c.and) > 0:
+		return Bool{All: cases(c.and)}
+	case len(c.or) > 0:
+		return Bool{One: cases(c.or)}
+	case c.not != nil:
+		return Bool{Not: []Case{c.not.toCase()}}
+	default:
+		return Bool{All: []Case{*c.leaf}}
+	}
+}
+
+// composite builds the query composite of an index partitioned by partitions from the
+// equality conditions that always apply (top level AND). c is nil without a WHERE.
+func (c *sqlCondition) composite(index string, partitions []string) (map[string]interface{}, error) {
+	equalities := make(map[string]interface{})
+	if c != nil {
+		conditions := c.and
+		if len(conditions) == 0 {
+			conditions = []*sqlCondition{c}
+		}
+		for _, condition := range conditions {
+			if condition.eqField == "" {
+				continue
+			}
+			if _, seen := equalities[condition.eqField]; !seen {
+				equalities[condition.eqField] = condition.eqValue
+			}
+		}
+	}
+
+	composite := make(map[string]interface{})
+	var missing []string
+	for _, field := range partitions {
+		value, found := equalities[field]
+		if !found {
+			missing = append(missing, field)
+			continue
+		}
+		composite[field] = value
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("index '%s' is partitioned by %s: WHERE needs an equality condition on %s", index, strings.Join(partitions, ", "), strings.Join(missing, ", "))
+	}
+	if len(composite) == 0 {
+		return nil, nil
+	}
+	return composite, nil
+}
+
+// sqlAggregate is an aggregate of the select list or HAVING clause.
+type sqlAggregate struct {
+	metric MetricRequest
+	name   string
+	count  bool // COUNT(*), answered by the bucket count
+}
+
+type sqlStatement struct {
+	fields     []string
+	star       bool
+	aggregates []*sqlAggregate
+	index      string
+	where      *sqlCondition
+	groupBy    []string
+	having     *sqlCondition
+	orderBy    []SortField
+	limit      *int
+	offset     *int
+}
+
+// SQLPartitions returns the partition fields ("fields" of the index config) of an index,
+// nil when the index is not partitioned.
+type SQLPartitions func(index string) ([]string, error)
+
+type sqlParser struct {
+	tokens     []sqlToken
+	pos        int
+	partitions SQLPartitions
+
+	// Set while parsing HAVING: fields resolve to bucket keys and aggregates to metrics.
+	stmt   *sqlStatement
+	having bool
+}
+
+// ParseSQL compiles a SQL statement into a Query. Grouped or aggregated statements
+// produce a single aggregation named "sql". partitions resolves the partition fields of
+// the queried indexes so their equality conditions become the composite; without it no
+// composite is compiled.
+func ParseSQL(sql string, partitions SQLPartitions) (*Query, error) {
+	tokens, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	p := &sqlParser{tokens: tokens, partitions: partitions}
+	stmt, err := p.parseSelect()
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	p.acceptSymbol(";")
+	if tok := p.peek(); tok.kind != sqlEOF {
+		return nil, fmt.Errorf("sql: %v", p.unexpected(tok))
+	}
+	query, err := stmt.compile(partitions)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %v", err)
+	}
+	return query, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) peekAt(offset int) sqlToken {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *sqlParser) next() sqlToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != sqlEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *sqlParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == sqlKeyword && tok.text == keyword
+}
+
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return fmt.Errorf("expected %s, %v", keyword, p.unexpected(p.peek()))
+	}
+	return nil
+}
+
+func (p *sqlParser) isSymbol(symbol string) bool {
+	tok := p.peek()
+	return tok.kind == sqlSymbol && tok.text == symbol
+}
+
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return fmt.Errorf("expected '%s', %v", symbol, p.unexpected(p.peek()))
+	}
+	return nil
+}
+
+// unexpected describes a token that cannot appear where it was found.
+func (p *sqlParser) unexpected(tok sqlToken) error {
+	if tok.kind == sqlEOF {
+		return fmt.Errorf("unexpected end of statement")
+	}
+	if reason, ok := sqlUnsupported[tok.text]; ok && tok.kind == sqlKeyword {
+		return fmt.Errorf("%s (at position %d)", reason, tok.pos)
+	}
+	return fmt.Errorf("unexpected '%s' at position %d", tok.text, tok.pos)
+}
+
+func (p *sqlParser) expectIdent(what string) (string, error) {
+	tok := p.peek()
+	if tok.kind != sqlIdent {
+		return "", fmt.Errorf("expected %s, %v", what, p.unexpected(tok))
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+func (p *sqlParser) expectInt(what string) (int, error) {
+	tok := p.next()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != sqlNumber || err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got '%s'", what, tok.text)
+	}
+	return n, nil
+}
+
+func (p *sqlParser) expectNumber(what string) (float64, error) {
+	tok := p.next()
+	if tok.kind != sqlNumber {
+		return 0, fmt.Errorf("%s must be a number, got '%s'", what, tok.text)
+	}
+	return strconv.ParseFloat(tok.text, 64)
+}
+
+func (p *sqlParser) parseSelect() (*sqlStatement, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("DISTINCT") {
+		return nil, fmt.Errorf("SELECT DISTINCT is not supported, use GROUP BY")
+	}
+	stmt := &sqlStatement{}
+	for {
+		if err := p.parseSelectItem(stmt); err != nil {
+			return nil, err
+		}
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if p.isSymbol("(") {
+		return nil, fmt.Errorf("subqueries in FROM are not supported")
+	}
+	index, err := p.expectIdent("index name")
+	if err != nil {
+		return nil, err
+	}
+	stmt.index = index
+	if p.isSymbol(",") {
+		return nil, fmt.Errorf("joins are not supported, use IN (SELECT ...)")
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if stmt.where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			field, err := p.expectIdent("GROUP BY field")
+			if err != nil {
+				return nil, err
+			}
+			stmt.groupBy = append(stmt.groupBy, field)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("HAVING") {
+		p.stmt, p.having = stmt, true
+		stmt.having, err = p.parseOr()
+		p.stmt, p.having = nil, false
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			field, err := p.expectIdent("ORDER BY field")
+			if err != nil {
+				return nil, err
+			}
+			order := SortAsc
+			if p.acceptKeyword("DESC") {
+				order = SortDesc
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			stmt.orderBy = append(stmt.orderBy, SortField{Field: field, Order: order})
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		limit, err := p.expectInt("LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		stmt.limit = &limit
+	}
+	if p.acceptKeyword("OFFSET") {
+		offset, err := p.expectInt("OFFSET")
+		if err != nil {
+			return nil, err
+		}
+		stmt.offset = &offset
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) parseSelectItem(stmt *sqlStatement) error {
+	if p.acceptSymbol("*") {
+		stmt.star = true
+		return nil
+	}
+	tok := p.peek()
+	if tok.kind != sqlIdent {
+		return fmt.Errorf("expected field or aggregate, %v", p.unexpected(tok))
+	}
+
+	if p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "(" {
+		agg, err := p.parseAggregate()
+		if err != nil {
+			return err
+		}
+		if p.acceptKeyword("AS") || p.peek().kind == sqlIdent {
+			alias, err := p.expectIdent("alias")
+			if err != nil {
+				return err
+			}
+			if strings.Contains(alias, ".") {
+				return fmt.Errorf("alias '%s' cannot contain '.'", alias)
+			}
+			agg.name = alias
+		}
+		for _, existing := range stmt.aggregates {
+			if existing.name == agg.name {
+				return fmt.Errorf("duplicate aggregate name '%s', add an alias with AS", agg.name)
+			}
+		}
+		stmt.aggregates = append(stmt.aggregates, agg)
+		return nil
+	}
+
+	p.pos++
+	if p.isKeyword("AS") {
+		return fmt.Errorf("aliases are only supported on aggregates (field '%s')", tok.text)
+	}
+	stmt.fields = append(stmt.fields, tok.text)
+	return nil
+}
+
+// parseAggregate parses FUNC(field), COUNT(*), COUNT(DISTINCT field) and PERCENTILE(field, p).
+func (p *sqlParser) parseAggregate() (*sqlAggregate, error) {
+	nameTok := p.next()
+	fn := strings.ToUpper(nameTok.text)
+	metricType, ok := sqlMetricTypes[fn]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %s() at position %d", nameTok.text, nameTok.pos)
+	}
+	p.next() // (
+
+	if fn == "COUNT" && p.acceptSymbol("*") {
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return &sqlAggregate{name: "_count", count: true}, nil
+	}
+	if p.acceptKeyword("DISTINCT") {
+		if fn != "COUNT" {
+			return nil, fmt.Errorf("DISTINCT is only supported in COUNT(DISTINCT field)")
+		}
+		metricType = "cardinality"
+	}
+	field, err := p.expectIdent(fn + " field")
+	if err != nil {
+		return nil, err
+	}
+
+	agg := &sqlAggregate{metric: MetricRequest{Type: metricType}}
+	defaultName := metricType + "_" + strings.ReplaceAll(field, ".", "_")
+	if fn == "PERCENTILE" {
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+		percentile, err := p.expectNumber("PERCENTILE rank")
+		if err != nil {
+			return nil, err
+		}
+		if percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("PERCENTILE rank must be in (0, 100], got %v", percentile)
+		}
+		agg.metric.Percentile = percentile
+		defaultName = "p" + strings.ReplaceAll(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_") + "_" + strings.ReplaceAll(field, ".", "_")
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	agg.name = defaultName
+	agg.metric.Fields = map[string]string{field: defaultName}
+	return agg, nil
+}
+
+func (p *sqlParser) parseOr() (*sqlCondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("OR") {
+		return left, nil
+	}
+	or := &sqlCondition{or: []*sqlCondition{left}}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or.or = append(or.or, right)
+	}
+	return or, nil
+}
+
+func (p *sqlParser) parseAnd() (*sqlCondition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("AND") {
+		return left, nil
+	}
+	and := &sqlCondition{and: []*sqlCondition{left}}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and.and = append(and.and, right)
+	}
+	return and, nil
+}
+
+func (p *sqlParser) parseNot() (*sqlCondition, error) {
+	if p.acceptKeyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlCondition{not: inner}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *sqlParser) parsePredicate() (*sqlCondition, error) {
+	if p.acceptSymbol("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	tok := p.peek()
+	if tok.kind == sqlIdent && p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "(" {
+		switch strings.ToUpper(tok.text) {
+		case "MATCH", "MATCH_PHRASE", "GEO_DISTANCE":
+			if p.having {
+				return nil, fmt.Errorf("%s() is not allowed in HAVING", strings.ToUpper(tok.text))
+			}
+			return p.parseSearchFunction()
+		}
+	}
+
+	field, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	negate := p.acceptKeyword("NOT")
+	var condition *sqlCondition
+	switch {
+	case p.acceptKeyword("IN"):
+		condition, err = p.parseIn(field, negate)
+		negate = false
+	case p.acceptKeyword("LIKE"):
+		condition, err = p.parseLike(field)
+	case p.acceptKeyword("BETWEEN"):
+		condition, err = p.parseBetween(field)
+	case !negate && p.acceptKeyword("IS"):
+		isNot := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		if isNot {
+			condition = &sqlCondition{leaf: &Case{Exists: &Exists{Field: field}}}
+		} else {
+			condition = &sqlCondition{leaf: &Case{Missing: &Missing{Field: field}}}
+		}
+	case !negate && p.peek().kind == sqlSymbol:
+		condition, err = p.parseComparison(field)
+	default:
+		return nil, fmt.Errorf("expected a comparison after '%s', %v", field, p.unexpected(p.peek()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return &sqlCondition{not: condition}, nil
+	}
+	return condition, nil
+}
+
+// parseOperand reads the left side of a condition. In HAVING it resolves to the
+// bucket document: the last grouped field is "key", aggregates are their metric names.
+func (p *sqlParser) parseOperand() (string, error) {
+	tok := p.peek()
+	if tok.kind != sqlIdent {
+		if tok.kind == sqlString || tok.kind == sqlNumber {
+			return "", fmt.Errorf("conditions must have the field on the left, got '%s' at position %d", tok.text, tok.pos)
+		}
+		return "", fmt.Errorf("expected field, %v", p.unexpected(tok))
+	}
+	isCall := p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "("
+
+	if !p.having {
+		if isCall {
+			if _, aggregate := sqlMetricTypes[strings.ToUpper(tok.text)]; aggregate {
+				return "", fmt.Errorf("aggregate %s() is not allowed in WHERE, use HAVING", strings.ToUpper(tok.text))
+			}
+			return "", fmt.Errorf("unsupported function %s() at position %d", tok.text, tok.pos)
+		}
+		p.pos++
+		return tok.text, nil
+	}
+
+	if isCall {
+		agg, err := p.parseAggregate()
+		if err != nil {
+			return "", err
+		}
+		if agg.count {
+			return "_count", nil
+		}
+		for _, existing := range p.stmt.aggregates {
+			if !existing.count && existing.metric.Type == agg.metric.Type && existing.metric.Percentile == agg.metric.Percentile && fmt.Sprint(existing.metric.Fields) == fmt.Sprint(agg.metric.Fields) {
+				return existing.name, nil
+			}
+		}
+		// Aggregates only used in HAVING are computed as well.
+		p.stmt.aggregates = append(p.stmt.aggregates, agg)
+		return agg.name, nil
+	}
+
+	p.pos++
+	for _, existing := range p.stmt.aggregates {
+		if existing.name == tok.text {
+			if existing.count {
+				return "_count", nil
+			}
+			return existing.name, nil
+		}
+	}
+	if n := len(p.stmt.groupBy); n > 0 && p.stmt.groupBy[n-1] == tok.text {
+		return "key", nil
+	}
+	return "", fmt.Errorf("HAVING can only reference the last GROUP BY field and aggregates, got '%s'", tok.text)
+}
+
+// parseLiteral returns the condition value of a literal. Numbers are normalized the
+// way document values are (resolveDotNotation) so equality compares like for like.
+func (p *sqlParser) parseLiteral() (string, interface{}, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == sqlString:
+		return tok.text, tok.text, nil
+	case tok.kind == sqlNumber:
+		n, _ := strconv.ParseFloat(tok.text, 64)
+		return strconv.FormatFloat(n, 'f', -1, 64), n, nil
+	case tok.kind == sqlKeyword && (tok.text == "TRUE" || tok.text == "FALSE"):
+		return strings.ToLower(tok.text), tok.text == "TRUE", nil
+	case tok.kind == sqlKeyword && tok.text == "NULL":
+		return "", nil, fmt.Errorf("comparisons with NULL are never true, use IS [NOT] NULL")
+	case tok.kind == sqlIdent:
+		return "", nil, fmt.Errorf("comparing two fields is not supported ('%s' at position %d)", tok.text, tok.pos)
+	default:
+		return "", nil, fmt.Errorf("expected a value, %v", p.unexpected(tok))
+	}
+}
+
+func termCondition(field string, value string, op Operation) *sqlCondition {
+	return &sqlCondition{leaf: &Case{Term: &Term{Field: field, Value: value, Modifiers: &Modifiers{Operation: op}}}}
+}
+
+var sqlComparisons = map[string]Operation{
+	"=":  Equal,
+	"!=": NotEqual,
+	"<>": NotEqual,
+	"<":  LessThan,
+	">":  GreaterThan,
+	"<=": LessThanOrEqual,
+	">=": GreaterThanOrEqual,
+}
+
+func (p *sqlParser) parseComparison(field string) (*sqlCondition, error) {
+	tok := p.next()
+	op, ok := sqlComparisons[tok.text]
+	if !ok {
+		return nil, fmt.Errorf("expected a comparison operator after '%s', %v", field, p.unexpected(tok))
+	}
+	value, raw, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	condition := termCondition(field, value, op)
+	if op == Equal && !p.having {
+		condition.eqField, condition.eqValue = field, raw
+	}
+	return condition, nil
+}
+
+// parseIn handles value lists and IN (SELECT field FROM ...) subqueries.
+func (p *sqlParser) parseIn(field string, negate bool) (*sqlCondition, error) {
+	op := In
+	if negate {
+		op = NotIn
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("SELECT") {
+		if p.having {
+			return nil, fmt.Errorf("subqueries are not allowed in HAVING")
+		}
+		sub, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		subQuery, err := sub.compileSubQuery(p.partitions)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlCondition{leaf: &Case{Term: &Term{Field: field, SubQuery: subQuery, Modifiers: &Modifiers{Operation: op}}}}, nil
+	}
+
+	var values []string
+	for {
+		value, _, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(value, ",") {
+			return nil, fmt.Errorf("IN values cannot contain ',' ('%s')", value)
+		}
+		values = append(values, value)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return termCondition(field, strings.Join(values, ","), op), nil
+}
+
+// parseLike maps 'abc%', '%abc' and '%abc%' onto StartsWith, EndsWith and Contains.
+func (p *sqlParser) parseLike(field string) (*sqlCondition, error) {
+	tok := p.next()
+	if tok.kind != sqlString {
+		return nil, fmt.Errorf("LIKE expects a string pattern, got '%s'", tok.text)
+	}
+	pattern := tok.text
+	leading := strings.HasPrefix(pattern, "%")
+	trailing := len(pattern) > 1 && strings.HasSuffix(pattern, "%")
+	value := strings.TrimSuffix(strings.TrimPrefix(pattern, "%"), "%")
+	if strings.ContainsAny(value, "%_") {
+		return nil, fmt.Errorf("LIKE pattern '%s' is not supported, only 'abc%%', '%%abc' and '%%abc%%'", pattern)
+	}
+	switch {
+	case leading && trailing:
+		return termCondition(field, value, Contains), nil
+	case leading:
+		return termCondition(field, value, EndsWith), nil
+	case trailing:
+		return termCondition(field, value, StartsWith), nil
+	default:
+		return termCondition(field, value, Equal), nil
+	}
+}
+
+func (p *sqlParser) parseBetween(field string) (*sqlCondition, error) {
+	from, _, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("AND"); err != nil {
+		return nil, err
+	}
+	to, _, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlCondition{and: []*sqlCondition{
+		termCondition(field, from, GreaterThanOrEqual),
+		termCondition(field, to, LessThanOrEqual),
+	}}, nil
+}
+
+// parseSearchFunction handles MATCH, MATCH_PHRASE and GEO_DISTANCE.
+func (p *sqlParser) parseSearchFunction() (*sqlCondition, error) {
+	fn := strings.ToUpper(p.next().text)
+	p.next() // (
+	field, err := p.expectIdent(fn + " field")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(","); err != nil {
+		return nil, err
+	}
+
+	var leaf Case
+	switch fn {
+	case "MATCH", "MATCH_PHRASE":
+		tok := p.next()
+		if tok.kind != sqlString {
+			return nil, fmt.Errorf("%s expects a string, got '%s'", fn, tok.text)
+		}
+		var option *int
+		if p.acceptSymbol(",") {
+			n, err := p.expectInt(fn + " option")
+			if err != nil {
+				return nil, err
+			}
+			option = &n
+		}
+		if fn == "MATCH" {
+			leaf.Match = &Match{Field: field, Value: tok.text, Fuzziness: option}
+		} else {
+			leaf.MatchPhrase = &MatchPhrase{Field: field, Value: tok.text, Slop: option}
+		}
+
+	case "GEO_DISTANCE":
+		geo := &GeoDistance{Field: field, Unit: "km"}
+		if geo.Latitude, err = p.expectNumber("GEO_DISTANCE latitude"); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+		if geo.Longitude, err = p.expectNumber("GEO_DISTANCE longitude"); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+		if geo.Distance, err = p.expectNumber("GEO_DISTANCE distance"); err != nil {
+			return nil, err
+		}
+		if p.acceptSymbol(",") {
+			tok := p.next()
+			if tok.kind != sqlString {
+				return nil, fmt.Errorf("GEO_DISTANCE unit must be a string such as 'km' or 'mi', got '%s'", tok.text)
+			}
+			geo.Unit = tok.text
+		}
+		leaf.GeoDistance = geo
+	}
+
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return &sqlCondition{leaf: &leaf}, nil
+}
+
+// compileComposite resolves the partition fields of the statement index into its composite.
+func (s *sqlStatement) compileComposite(partitions SQLPartitions) (map[string]interface{}, error) {
+	if partitions == nil {
+		return nil, nil
+	}
+	fields, err := partitions(s.index)
+	if err != nil {
+		return nil, err
+	}
+	return s.where.composite(s.index, fields)
+}
+
+// compileSubQuery builds the Query of an IN (SELECT field FROM ...) subquery.
+func (s *sqlStatement) compileSubQuery(partitions SQLPartitions) (*Query, error) {
+	if s.star || len(s.fields) != 1 || len(s.aggregates) > 0 {
+		return nil, fmt.Errorf("IN subqueries must select exactly one field")
+	}
+	if len(s.groupBy) > 0 || s.having != nil || len(s.orderBy) > 0 || s.limit != nil || s.offset != nil {
+		return nil, fmt.Errorf("IN subqueries support only SELECT field FROM index WHERE ...")
+	}
+	query := &Query{Index: s.index, ResultField: s.fields[0]}
+	if s.where != nil {
+		query.Bool = s.where.toBool()
+	}
+	composite, err := s.compileComposite(partitions)
+	if err != nil {
+		return nil, err
+	}
+	query.Composite = composite
+	return query, nil
+}
+
+func (s *sqlStatement) compile(partitions SQLPartitions) (*Query, error) {
+	query := &Query{Index: s.index}
+	if s.where != nil {
+		query.Bool = s.where.toBool()
+	}
+	composite, err := s.compileComposite(partitions)
+	if err != nil {
+		return nil, err
+	}
+	query.Composite = composite
+
+	if len(s.aggregates) == 0 && len(s.groupBy) == 0 {
+		if s.having != nil {
+			return nil, fmt.Errorf("HAVING requires GROUP BY or aggregates")
+		}
+		if !s.star {
+			query.Source = s.fields
+		}
+		query.Sort = s.orderBy
+		if s.limit != nil {
+			query.Limit = *s.limit
+		}
+		if s.offset != nil {
+			query.Offset = *s.offset
+		}
+		return query, nil
+	}
+
+	// Grouped results are buckets: there is no document ordering or paging to apply.
+	if s.star {
+		return nil, fmt.Errorf("SELECT * cannot be combined with aggregates or GROUP BY")
+	}
+	if len(s.orderBy) > 0 {
+		return nil, fmt.Errorf("ORDER BY is not supported with aggregates or GROUP BY")
+	}
+	if s.limit != nil || s.offset != nil {
+		return nil, fmt.Errorf("LIMIT and OFFSET are not supported with aggregates or GROUP BY")
+	}
+	grouped := make(map[string]bool)
+	for _, field := range s.groupBy {
+		grouped[field] = true
+	}
+	for _, field := range s.fields {
+		if !grouped[field] {
+			return nil, fmt.Errorf("field '%s' must appear in GROUP BY or be aggregated", field)
+		}
+	}
+
+	// Each grouped field is a nested terms level, metrics and HAVING apply to the innermost.
+	innermost := &Aggregation{Name: sqlAggregationName}
+	for _, agg := range s.aggregates {
+		if !agg.count {
+			innermost.Metrics = append(innermost.Metrics, agg.metric)
+		}
+	}
+	if s.having != nil {
+		having := s.having.toBool()
+		innermost.Having = &having
+	}
+
+	root := innermost
+	for i := len(s.groupBy) - 1; i >= 0; i-- {
+		level := innermost
+		if i < len(s.groupBy)-1 {
+			level = &Aggregation{Aggs: map[string]*Aggregation{s.groupBy[i+1]: root}}
+		}
+		level.Type = "terms"
+		level.Name = s.groupBy[i]
+		level.GroupBy = []string{s.groupBy[i]}
+		root = level
+	}
+	query.Aggs = map[string]Aggregation{sqlAggregationName: *root}
+	return query, nil
+}
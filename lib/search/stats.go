@@ -1,5 +1,7 @@
 package search
 
+import "math"
+
 // IndexStats holds pre-calculated global statistics for IDF scoring.
 type IndexStats struct {
     TotalDocuments uint64 // N: Total number of documents in the index.
@@ -0,0 +1,277 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ====================================================================
+// === SPELLING CORRECTION ("did you mean") ===========================
+// ====================================================================
+//
+// Term dictionaries are built from the text fields targeted by Match conditions
+// while a query iterates its documents and are cached per index partition, so
+// a query without hits can propose the closest known phrasing.
+
+// TermDictionaryTTL is how long a partition dictionary is reused before it is rebuilt.
+const TermDictionaryTTL = 5 * time.Minute
+
+// TermDictionary holds the frequency of every token seen in the indexed text fields.
+type TermDictionary struct {
+	Terms map[string]int
+}
+
+type termDictionaryCacheEntry struct {
+	dictionary *TermDictionary
+	expires    time.Time
+}
+
+var termDictionaryCache = struct {
+	sync.Mutex
+	entries map[string]termDictionaryCacheEntry
+}{entries: make(map[string]termDictionaryCacheEntry)}
+
+// NewTermDictionary creates an empty dictionary.
+func NewTermDictionary() *TermDictionary {
+	return &TermDictionary{Terms: make(map[string]int)}
+}
+
+// dictionaryTokens tokenizes like Analyze but keeps the surface form of words so
+// suggestions read naturally (no stemming or n-grams).
+func dictionaryTokens(text string) []string {
+	return lowercaseFilter(simpleTokenizer(normalizeText(text)))
+}
+
+// isDictionaryTerm reports whether a token is worth indexing or correcting.
+func isDictionaryTerm(token string) bool {
+	if len(token) <= 1 {
+		return false
+	}
+	if _, stop := englishStopwords[token]; stop {
+		return false
+	}
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return false
+	}
+	return true
+}
+
+// AddText adds the tokens of a text to the dictionary.
+func (d *TermDictionary) AddText(text string) {
+	for _, token := range dictionaryTokens(text) {
+		if isDictionaryTerm(token) {
+			d.Terms[token]++
+		}
+	}
+}
+
+// AddDocument adds the given text fields of a document to the dictionary.
+func (d *TermDictionary) AddDocument(doc map[string]interface{}, fields []string) {
+	for _, field := range fields {
+		if value, ok := resolveDotNotation(doc, field); ok {
+			d.AddText(value)
+		}
+	}
+}
+
+// Merge adds the terms of another dictionary.
+func (d *TermDictionary) Merge(other *TermDictionary) {
+	if other == nil {
+		return
+	}
+	for term, count := range other.Terms {
+		d.Terms[term] += count
+	}
+}
+
+// maxSuggestionEdits mirrors the usual "auto" fuzziness: short words tolerate fewer edits.
+func maxSuggestionEdits(token string) int {
+	switch n := len([]rune(token)); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// correctToken returns the closest dictionary term using LevenshteinDistance,
+// preferring the most frequent term on equal distance.
+func (d *TermDictionary) correctToken(token string) (string, bool) {
+	maxEdits := maxSuggestionEdits(token)
+	if maxEdits == 0 {
+		return token, false
+	}
+	best := ""
+	bestDistance := maxEdits + 1
+	bestCount := 0
+	for term, count := range d.Terms {
+		distance := LevenshteinDistance(token, term)
+		if distance > maxEdits {
+			continue
+		}
+		if distance < bestDistance || (distance == bestDistance && (count > bestCount || (count == bestCount && term < best))) {
+			best, bestDistance, bestCount = term, distance, count
+		}
+	}
+	if best == "" {
+		return token, false
+	}
+	return best, true
+}
+
+// Suggest proposes a corrected phrasing of a text. Tokens already in the dictionary,
+// stopwords and numbers are kept. It returns false when nothing was corrected.
+func (d *TermDictionary) Suggest(text string) (string, bool) {
+	if d == nil || len(d.Terms) == 0 {
+		return text, false
+	}
+	tokens := dictionaryTokens(text)
+	corrected := false
+	for i, token := range tokens {
+		if !isDictionaryTerm(token) {
+			continue
+		}
+		if _, known := d.Terms[token]; known {
+			continue
+		}
+		if replacement, ok := d.correctToken(token); ok {
+			tokens[i] = replacement
+			corrected = true
+		}
+	}
+	if !corrected {
+		return text, false
+	}
+	return strings.Join(tokens, " "), true
+}
+
+// MatchFields returns the fields targeted by the positive Match conditions of a query.
+func MatchFields(b Bool) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, m := range collectMatches(b) {
+		if !seen[m.Field] {
+			seen[m.Field] = true
+			fields = append(fields, m.Field)
+		}
+	}
+	return fields
+}
+
+// collectMatches walks All and One (None and Not exclude documents so they are not corrected).
+func collectMatches(b Bool) []*Match {
+	var matches []*Match
+	for _, cases := range [][]Case{b.All, b.One} {
+		for _, c := range cases {
+			if c.Match != nil && c.Match.Value != "" {
+				matches = append(matches, c.Match)
+			}
+			if c.Bool != nil {
+				matches = append(matches, collectMatches(*c.Bool)...)
+			}
+		}
+	}
+	return matches
+}
+
+// SuggestCorrections corrects every positive Match value of the queries. It returns
+// value -> corrected value for the values that changed.
+func SuggestCorrections(queries []Query, dictionary *TermDictionary) map[string]string {
+	corrections := make(map[string]string)
+	for _, query := range queries {
+		for _, m := range collectMatches(query.Bool) {
+			if _, done := corrections[m.Value]; done {
+				continue
+			}
+			if suggestion, ok := dictionary.Suggest(m.Value); ok {
+				corrections[m.Value] = suggestion
+			}
+		}
+	}
+	return corrections
+}
+
+// DidYouMean renders the corrections in query order as a single phrase.
+func DidYouMean(queries []Query, corrections map[string]string) string {
+	seen := make(map[string]bool)
+	var phrases []string
+	for _, query := range queries {
+		for _, m := range collectMatches(query.Bool) {
+			suggestion, ok := corrections[m.Value]
+			if !ok || seen[suggestion] {
+				continue
+			}
+			seen[suggestion] = true
+			phrases = append(phrases, suggestion)
+		}
+	}
+	return strings.Join(phrases, " ")
+}
+
+// RewriteMatches returns a copy of a Bool with the corrected Match values. The
+// original query is left untouched.
+func RewriteMatches(b Bool, corrections map[string]string) Bool {
+	rewriteCases := func(cases []Case) []Case {
+		if cases == nil {
+			return nil
+		}
+		rewritten := make([]Case, len(cases))
+		for i, c := range cases {
+			if c.Match != nil {
+				if suggestion, ok := corrections[c.Match.Value]; ok {
+					m := *c.Match
+					m.Value = suggestion
+					c.Match = &m
+				}
+			}
+			if c.Bool != nil {
+				nested := RewriteMatches(*c.Bool, corrections)
+				c.Bool = &nested
+			}
+			rewritten[i] = c
+		}
+		return rewritten
+	}
+	return Bool{
+		All:  rewriteCases(b.All),
+		None: b.None,
+		One:  rewriteCases(b.One),
+		Not:  b.Not,
+	}
+}
+
+// termDictionaryKey identifies the partition and fields a dictionary was built from.
+// Secure loaders only see the documents of their principal so it is part of the key.
+func termDictionaryKey(loader DocumentLoader, config *GetIndexConfigurationInput, queryComposite map[string]interface{}, fields []string) string {
+	composite, _ := json.Marshal(queryComposite)
+	principal := ""
+	if secure, ok := loader.(*SecureLoader); ok {
+		principal = secure.Principal.CacheKey()
+	}
+	return fmt.Sprintf("%s@%s%v/%s/%s/%s#%s", config.Repo, config.Branch, config.Refs, config.Id, composite, strings.Join(fields, ","), principal)
+}
+
+// getCachedTermDictionary returns a dictionary still within its TTL.
+func getCachedTermDictionary(key string) (*TermDictionary, bool) {
+	termDictionaryCache.Lock()
+	defer termDictionaryCache.Unlock()
+	entry, ok := termDictionaryCache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(termDictionaryCache.entries, key)
+		return nil, false
+	}
+	return entry.dictionary, true
+}
+
+// cacheTermDictionary stores a dictionary for TermDictionaryTTL.
+func cacheTermDictionary(key string, dictionary *TermDictionary) {
+	termDictionaryCache.Lock()
+	defer termDictionaryCache.Unlock()
+	termDictionaryCache.entries[key] = termDictionaryCacheEntry{dictionary: dictionary, expires: time.Now().Add(TermDictionaryTTL)}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -22,6 +23,7 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	session "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go/service/kms"
 	lambda2 "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/sfn"
 	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
@@ -66,6 +68,7 @@ type ActionContext struct {
 	AdditionalResources *[]gov.Resource
 	CloudName           string
 	Bindings            *entity.VariableBindings
+	Keys                entity.KeyManagement
 }
 
 type RepoInitParams struct {
@@ -115,6 +118,9 @@ func GetEntities(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.
 		Attributes: allAttributes,
 	}
 	entities := ac.EntityManager.Find(ac.Implementation, query, &data)
+	if err := expandEntities(req, ac, entities); err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
 	body, err := json.Marshal(entities)
 	if err != nil {
 		return res, err
@@ -137,7 +143,12 @@ func GetEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.AP
 		id = pathPieces[3]
 	}
 	log.Printf("entity by id: %s", id)
-	ent := ac.EntityManager.Load(id, ac.Implementation)
+	ent, version := ac.EntityManager.LoadVersion(id, ac.Implementation)
+	if ent != nil {
+		if err := expandEntities(req, ac, []map[string]interface{}{ent}); err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		}
+	}
 	body, err := json.Marshal(ent)
 	if err != nil {
 		return res, err
@@ -146,6 +157,7 @@ func GetEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.AP
 	res.Headers = map[string]string{
 		"Content-Type": "application/json",
 	}
+	setETag(&res, version)
 	res.Body = string(body[:])
 	return res, nil
 }
@@ -161,6 +173,9 @@ func CreateEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events
 		if strings.Contains(err.Error(), "unauthorized") {
 			res.StatusCode = 403
 			res.Body = err.Error()
+		} else if errors.Is(err, entity.ErrPreconditionFailed) {
+			res.StatusCode = 412
+			res.Body = err.Error()
 		}
 		return res, nil
 	} else if createRes.Success == false {
@@ -180,6 +195,9 @@ func CreateEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events
 	res.Headers = map[string]string{
 		"Content-Type": "application/json",
 	}
+	if versions := ac.EntityManager.Versions(); versions != nil {
+		setETag(&res, versions.Version)
+	}
 	res.Body = string(resBody)
 	return res, nil
 }
@@ -192,6 +210,11 @@ func UpdateEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events
 	json.Unmarshal(body, &e)
 	updateRes, err := ac.EntityManager.Update(e)
 	if err != nil {
+		if errors.Is(err, entity.ErrPreconditionFailed) {
+			res.StatusCode = 412
+			res.Body = err.Error()
+			return res, nil
+		}
 		return res, err
 	} else if updateRes.Success == false {
 		validationErrors, _ := json.Marshal(updateRes.Errors)
@@ -211,10 +234,296 @@ func UpdateEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events
 	res.Headers = map[string]string{
 		"Content-Type": "application/json",
 	}
+	if versions := ac.EntityManager.Versions(); versions != nil {
+		setETag(&res, versions.Version)
+	}
 	res.Body = string(resBody)
 	return res, nil
 }
 
+func PatchEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	pathPieces := strings.Split(req.Path, "/")
+	res := events.APIGatewayProxyResponse{StatusCode: 500}
+	var id string
+	if len(pathPieces) > 3 && pathPieces[3] == "shapeshifter" {
+		id = pathPieces[len(pathPieces)-1]
+	} else {
+		id = pathPieces[3]
+	}
+	log.Printf("patch entity by id: %s", id)
+	patchRes, err := ac.EntityManager.Patch(id, req.Headers["content-type"], []byte(req.Body))
+	if err != nil {
+		res.Body = err.Error()
+		if strings.Contains(err.Error(), "unauthorized") {
+			res.StatusCode = 403
+		} else if errors.Is(err, entity.ErrEntityNotFound) {
+			res.StatusCode = 404
+		} else if errors.Is(err, entity.ErrUnsupportedPatch) {
+			res.StatusCode = 415
+			res.Headers = map[string]string{
+				"Accept-Patch": entity.MergePatchContentType + ", " + entity.JSONPatchContentType,
+			}
+		} else if errors.Is(err, entity.ErrPreconditionFailed) {
+			res.StatusCode = 412
+		} else if errors.Is(err, entity.ErrPatchTestFailed) {
+			res.StatusCode = 409
+		} else if errors.Is(err, entity.ErrInvalidPatch) {
+			res.StatusCode = 400
+		} else {
+			res.Body = ""
+		}
+		return res, nil
+	} else if patchRes.Success == false {
+		validationErrors, _ := json.Marshal(patchRes.Errors)
+		res.Body = string(validationErrors)
+		return res, err
+	}
+	resBody, err := json.Marshal(patchRes.Entity)
+	if err != nil {
+		return res, err
+	}
+	if len(pathPieces) > 3 && pathPieces[3] == "shapeshifter" {
+		log.Print("Index Entity")
+		ac.EntityManager.Save(patchRes.Entity, "opensearch")
+	}
+	res.StatusCode = 200
+	res.Headers = map[string]string{
+		"Content-Type": "application/json",
+	}
+	if versions := ac.EntityManager.Versions(); versions != nil {
+		setETag(&res, versions.Version)
+	}
+	res.Body = string(resBody)
+	return res, nil
+}
+
+func DeleteEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	pathPieces := strings.Split(req.Path, "/")
+	res := events.APIGatewayProxyResponse{StatusCode: 500}
+	var id string
+	if len(pathPieces) > 3 && pathPieces[3] == "shapeshifter" {
+		id = pathPieces[len(pathPieces)-1]
+	} else {
+		id = pathPieces[3]
+	}
+	log.Printf("delete entity by id: %s", id)
+	deleteRes, err := ac.EntityManager.Delete(id)
+	if err != nil {
+		var referenceErr *entity.ReferenceError
+		if errors.As(err, &referenceErr) {
+			res, _ := jsonResponse(referenceErr)
+			res.StatusCode = 409
+			return res, nil
+		}
+		if strings.Contains(err.Error(), "unauthorized") {
+			res.StatusCode = 403
+			res.Body = err.Error()
+		} else if err == entity.ErrEntityNotFound {
+			res.StatusCode = 404
+			res.Body = err.Error()
+		}
+		return res, nil
+	}
+	resBody, err := json.Marshal(deleteRes.Entity)
+	if err != nil {
+		return res, err
+	}
+	res.StatusCode = 200
+	res.Headers = map[string]string{
+		"Content-Type": "application/json",
+	}
+	res.Body = string(resBody)
+	return res, nil
+}
+
+// GetEntityRevisions lists the revisions of an entity, newest first: GET .../{id}?revisions[={limit}]
+func GetEntityRevisions(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	id := entityIdFromPath(req)
+	limit := 30
+	if l, err := strconv.Atoi(req.QueryStringParameters["revisions"]); err == nil && l > 0 {
+		limit = l
+	}
+	log.Printf("entity revisions by id: %s", id)
+	revisions, err := ac.EntityManager.Revisions(id, limit)
+	if err != nil {
+		return revisionErrorResponse(err), nil
+	}
+	return jsonResponse(revisions)
+}
+
+// GetEntityRevision returns an entity as it was at a revision: GET .../{id}?revision={sha}
+func GetEntityRevision(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	id := entityIdFromPath(req)
+	revision := req.QueryStringParameters["revision"]
+	log.Printf("entity %s at revision %s", id, revision)
+	ent, err := ac.EntityManager.LoadRevision(id, revision)
+	if err != nil {
+		return revisionErrorResponse(err), nil
+	}
+	return jsonResponse(ent)
+}
+
+// DiffEntityRevisions compares two revisions field by field: GET .../{id}?from={sha}[&to={sha}]
+// The current entity is used when to is omitted.
+func DiffEntityRevisions(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	id := entityIdFromPath(req)
+	from := req.QueryStringParameters["from"]
+	to := req.QueryStringParameters["to"]
+	log.Printf("entity %s diff %s..%s", id, from, to)
+	changes, err := ac.EntityManager.DiffRevisions(id, from, to)
+	if err != nil {
+		return revisionErrorResponse(err), nil
+	}
+	return jsonResponse(changes)
+}
+
+// RestoreEntity writes an old revision as a new update: PUT .../{id}?restore={sha}
+func RestoreEntity(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	pathPieces := strings.Split(req.Path, "/")
+	id := entityIdFromPath(req)
+	revision := req.QueryStringParameters["restore"]
+	log.Printf("restore entity %s to revision %s", id, revision)
+	restoreRes, err := ac.EntityManager.Restore(id, revision)
+	if err != nil {
+		if strings.Contains(err.Error(), "unauthorized") {
+			return events.APIGatewayProxyResponse{StatusCode: 403, Body: err.Error()}, nil
+		} else if errors.Is(err, entity.ErrPreconditionFailed) {
+			return events.APIGatewayProxyResponse{StatusCode: 412, Body: err.Error()}, nil
+		}
+		return revisionErrorResponse(err), nil
+	} else if restoreRes.Success == false {
+		validationErrors, _ := json.Marshal(restoreRes.Errors)
+		return events.APIGatewayProxyResponse{StatusCode: 500, Body: string(validationErrors)}, nil
+	}
+	if len(pathPieces) > 3 && pathPieces[3] == "shapeshifter" {
+		log.Print("Index Entity")
+		ac.EntityManager.Save(restoreRes.Entity, "opensearch")
+	}
+	res, err := jsonResponse(restoreRes.Entity)
+	if versions := ac.EntityManager.Versions(); versions != nil {
+		setETag(&res, versions.Version)
+	}
+	return res, err
+}
+
+type batchEntitiesRequest struct {
+	Mode     entity.BatchMode         `json:"mode"`
+	Entities []map[string]interface{} `json:"entities"`
+}
+
+// BatchEntities writes many entities in one commit: POST .../{type}/_batch
+// with {"mode": "atomic"|"best-effort", "entities": [...]}. Atomic is the default.
+func BatchEntities(req *events.APIGatewayProxyRequest, ac *ActionContext) (events.APIGatewayProxyResponse, error) {
+	var batchReq batchEntitiesRequest
+	if err := json.Unmarshal([]byte(req.Body), &batchReq); err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+	}
+	if batchReq.Mode == "" {
+		batchReq.Mode = entity.BatchAtomic
+	}
+	// Entities without an id get one like single creates do.
+	for _, ent := range batchReq.Entities {
+		if id, _ := ent["id"].(string); ent != nil && id == "" {
+			ent["id"] = utils.GenerateId()
+		}
+	}
+	batchRes, err := ac.EntityManager.Batch(batchReq.Entities, batchReq.Mode)
+	if err != nil {
+		if strings.Contains(err.Error(), "unauthorized") {
+			return events.APIGatewayProxyResponse{StatusCode: 403, Body: err.Error()}, nil
+		} else if errors.Is(err, entity.ErrInvalidBatch) {
+			return events.APIGatewayProxyResponse{StatusCode: 400, Body: err.Error()}, nil
+		} else if errors.Is(err, entity.ErrBatchUnsupported) {
+			return events.APIGatewayProxyResponse{StatusCode: 501, Body: err.Error()}, nil
+		}
+		log.Printf("Batch failed: %s", err.Error())
+	}
+	res, resErr := jsonResponse(batchRes)
+	if resErr != nil {
+		return res, resErr
+	}
+	if err != nil {
+		res.StatusCode = 500
+	} else if batchRes.Written == 0 {
+		res.StatusCode = 422
+	} else if !batchRes.Success {
+		res.StatusCode = 207
+	}
+	return res, nil
+}
+
+// expandEntities inlines the references named by ?expand=seller,category.parent.
+func expandEntities(req *events.APIGatewayProxyRequest, ac *ActionContext, entities []map[string]interface{}) error {
+	expand := req.QueryStringParameters["expand"]
+	if expand == "" {
+		return nil
+	}
+	return ac.EntityManager.Expand(entities, strings.Split(expand, ","))
+}
+
+func entityIdFromPath(req *events.APIGatewayProxyRequest) string {
+	pathPieces := strings.Split(req.Path, "/")
+	if len(pathPieces) > 3 && pathPieces[3] == "shapeshifter" {
+		return pathPieces[len(pathPieces)-1]
+	}
+	return pathPieces[3]
+}
+
+func jsonResponse(v interface{}) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: 500}, err
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}, nil
+}
+
+func revisionErrorResponse(err error) events.APIGatewayProxyResponse {
+	log.Printf("Revision request failed: %s", err.Error())
+	if errors.Is(err, entity.ErrEntityNotFound) || errors.Is(err, entity.ErrRevisionNotFound) {
+		return events.APIGatewayProxyResponse{StatusCode: 404, Body: err.Error()}
+	} else if errors.Is(err, entity.ErrRevisionsUnsupported) {
+		return events.APIGatewayProxyResponse{StatusCode: 501, Body: err.Error()}
+	}
+	return events.APIGatewayProxyResponse{StatusCode: 500}
+}
+
+// setETag exposes an entity version as a strong entity tag.
+func setETag(res *events.APIGatewayProxyResponse, version string) {
+	if version == "" {
+		return
+	}
+	res.Headers["ETag"] = "\"" + version + "\""
+}
+
+// parseETags reads the entity tags of an If-Match or If-None-Match header.
+func parseETags(header string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		tags = append(tags, strings.Trim(strings.TrimPrefix(tag, "W/"), "\""))
+	}
+	return tags
+}
+
+// applyPreconditions copies the conditional request headers onto the write preconditions.
+func applyPreconditions(req *events.APIGatewayProxyRequest, versions *entity.EntityVersioning) {
+	versions.IfMatch = parseETags(req.Headers["if-match"])
+	for _, tag := range parseETags(req.Headers["if-none-match"]) {
+		if tag == "*" {
+			versions.IfNoneMatch = true
+		}
+	}
+}
+
 func InitializeHandler(c *ActionContext) Handler {
 	return func(req *events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
@@ -262,6 +571,7 @@ func InitializeHandler(c *ActionContext) Handler {
 		var clusteringOwner string
 		var clusteringRepo string
 		var catalogFile string
+		var catalogChapter string
 		var clusteringEnabled bool
 
 		if os.Getenv("CLUSTERING_ENABLED") == "true" {
@@ -345,6 +655,9 @@ func InitializeHandler(c *ActionContext) Handler {
 
 		userId := GetUserId(req)
 
+		// Batches post to {type}/_batch so the proxy does not end with an entity id.
+		batchRequest := singularName == "shapeshifter" && req.HTTPMethod == "POST" && strings.HasSuffix(req.PathParameters["proxy"], "/_batch")
+
 		log.Printf("entity plural name: %s", pluralName)
 		log.Printf("entity singular name: %s", singularName)
 
@@ -372,7 +685,8 @@ func InitializeHandler(c *ActionContext) Handler {
 			log.Print("search Index: " + searchIndex)
 		}
 
-		if singularName == "shapeshifter" {
+		// Deletes only remove from the catalog so there is no page to ensure.
+		if singularName == "shapeshifter" && req.HTTPMethod != "DELETE" {
 			proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
 			directoryPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
 			c, err := repo.EnsureCatalog(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, os.Getenv("GITHUB_BRANCH"), clusteringEnabled, catalogPageMax)
@@ -383,6 +697,7 @@ func InitializeHandler(c *ActionContext) Handler {
 				catalogFile = c
 				catalogPieces := strings.Split(catalogFile, "/")
 				chapter := catalogPieces[len(catalogPieces)-2]
+				catalogChapter = chapter
 				log.Printf("The chapter is %s", chapter)
 				repoPieces := strings.Split(req.PathParameters["repo"], "-")
 				clusteringRepoPrefix := strings.Join(repoPieces[0:len(repoPieces)-1],"-")
@@ -393,10 +708,12 @@ func InitializeHandler(c *ActionContext) Handler {
 			}
 		}
 
+		// Storage and loaders of contract entities encrypt and decrypt x-encrypted fields.
+		var fieldEncryption *entity.FieldEncryption
 		if singularName == "type" {
 			ac.EntityManager = ac.TypeManager
 		} else {
-			ac.EntityManager = entity.NewDefaultManager(entity.DefaultManagerConfig{
+			managerConfig := entity.DefaultManagerConfig{
 				SingularName:        singularName,
 				PluralName:          pluralName,
 				Index:               searchIndex,
@@ -417,7 +734,14 @@ func InitializeHandler(c *ActionContext) Handler {
 				Repo:     			 req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
 				Branch:   			 os.Getenv("GITHUB_BRANCH"),
 				Contract: 			 "/contracts/" + strings.Split(req.PathParameters["proxy"], "/")[0] + ".json",
-			})
+				Keys:                ac.Keys,
+			}
+			if singularName == "shapeshifter" {
+				managerConfig.References = shapeshiftReferences(ac, req, managerConfig, strings.Split(req.PathParameters["proxy"], "/")[0])
+			}
+			manager := entity.NewDefaultManager(managerConfig)
+			fieldEncryption = manager.Encryption
+			ac.EntityManager = manager
 			/*manager, err := entity.GetManager(
 				singularName,
 				map[string]interface{}{
@@ -495,31 +819,7 @@ func InitializeHandler(c *ActionContext) Handler {
 		} else if singularName == "shapeshifter" {
 			// Github Installation will indirectly enforce access to repository.
 			// ac.EntityManager.AddAuthorizer("default", entity.NoopAuthorizationAdaptor{})
-			if ac.CloudName == "azure" {
-				ac.EntityManager.AddAuthorizer("default", entity.ResourceAuthorizationEmbeddedAdaptor{
-					Config: entity.ResourceAuthorizationEmbeddedConfig{
-						UserId:              userId,
-						Site:                ac.Site,
-						Resource:            gov.GithubRepo,
-						Asset:               req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
-						Lambda:              ac.Lambda,
-						CassSession:         ac.CassSession,
-						GrantAccessManager:  ac.GrantAccessManager,
-						AdditionalResources: ac.AdditionalResources,
-					},
-				})
-			} else {
-				ac.EntityManager.AddAuthorizer("default", entity.ResourceAuthorizationAdaptor{
-					Config: entity.ResourceAuthorizationConfig{
-						UserId:              userId,
-						Site:                ac.Site,
-						Resource:            gov.GithubRepo,
-						Asset:               req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
-						Lambda:              ac.Lambda,
-						AdditionalResources: ac.AdditionalResources,
-					},
-				})
-			}
+			ac.EntityManager.AddAuthorizer("default", shapeshiftAuthorizer(ac, req, userId))
 		} else {
 			ac.EntityManager.AddAuthorizer("default", entity.OwnerAuthorizationAdaptor{
 				Config: entity.OwnerAuthorizationConfig{
@@ -566,14 +866,9 @@ func InitializeHandler(c *ActionContext) Handler {
 			})
 		} else if singularName == "shapeshifter" {
 			proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
-			var loaderPath string
-			if req.HTTPMethod == "GET" {
-				loaderPath = strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
-			} else if req.HTTPMethod == "PUT" {
-				loaderPath = strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
-			} else {
-				loaderPath = req.PathParameters["proxy"]
-			}
+			// The proxy always ends with the id (POST appends it above) so every method
+			// loads from the directory the entity is stored in.
+			loaderPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
 			// @todo: The loader will need to use the right one yeeh!
 			log.Print("REPORT RequestId: " + req.RequestContext.RequestID + " Organization: " + req.PathParameters["owner"] + " Repository: " + req.PathParameters["repo"])
 			
@@ -583,9 +878,13 @@ func InitializeHandler(c *ActionContext) Handler {
 			//proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
 			directoryPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
 			fileNameGuid := strings.Split(proxyPieces[len(proxyPieces)-1],".")[0]
-			loadChapter, err := repo.FindChapterByGUID(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, fileNameGuid, os.Getenv("GITHUB_BRANCH"))
-			if err != nil {
-				log.Print("Error looking up chapter for entity %s", proxyPieces[len(proxyPieces)-1])
+			loadChapter := catalogChapter
+			// A batch writes to a single chapter so existing entities are loaded from it as well.
+			if !batchRequest {
+				loadChapter, err = repo.FindChapterByGUID(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, fileNameGuid, os.Getenv("GITHUB_BRANCH"))
+				if err != nil {
+					log.Print("Error looking up chapter for entity %s", proxyPieces[len(proxyPieces)-1])
+				}
 			}
 			log.Printf("Loading entity from chapter %s", loadChapter)
 			repoPieces := strings.Split(req.PathParameters["repo"], "-")
@@ -603,10 +902,11 @@ func InitializeHandler(c *ActionContext) Handler {
 					Branch:   os.Getenv("GITHUB_BRANCH"),
 					Path:     loaderPath,
 					UserName: GetUsername(req),
+					Encryption: fieldEncryption,
 				},
 			})
 			updateClusteringRepo := clusteringOwner + "/" + clusteringRepo
-			if (req.HTTPMethod == "PUT") {
+			if (req.HTTPMethod == "PUT" || req.HTTPMethod == "PATCH" || req.HTTPMethod == "DELETE") {
 				updateClusteringRepo = loaderClusteringRep
 			}
 			ac.EntityManager.AddStorage("default", entity.GithubRestFileUploadAdaptor{
@@ -617,6 +917,7 @@ func InitializeHandler(c *ActionContext) Handler {
 					Branch:   os.Getenv("GITHUB_BRANCH"),
 					Path:     strings.Join(proxyPieces[0:len(proxyPieces)-1], "/"),
 					UserName: GetUsername(req),
+					Encryption: fieldEncryption,
 				},
 			})
 			ac.EntityManager.AddValidator("default", entity.ContractValidatorAdaptor{
@@ -628,11 +929,52 @@ func InitializeHandler(c *ActionContext) Handler {
 					Repo:     req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
 					Branch:   os.Getenv("GITHUB_BRANCH"),
 					Contract: "/contracts/" + proxyPieces[0] + ".json",
+					Enforcer: os.Getenv("CONTRACT_ENFORCER"),
 				},
 			})
 		}
 
-		if (singularName == "shapeshifter" && req.HTTPMethod == "POST") {
+		// Ids a batch adds to the catalog of its chapter, appended page by page once the batch is written.
+		var batchCatalogIds []string
+		if batchRequest {
+			proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
+			directoryPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
+			catalogChapters, err := repo.CatalogChapters(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, os.Getenv("GITHUB_BRANCH"))
+			if err != nil {
+				log.Printf("Unable to read catalog: %s", err.Error())
+				return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+			}
+			if clusteringEnabled {
+				err := repo.EnsureRepoCreate(ac.GithubRestClient, clusteringOwner, clusteringRepo, "clustering repo for " + req.PathParameters["owner"] + "/" + req.PathParameters["repo"], false)
+				if err != nil {
+					log.Printf("Could not ensure repo %s/%s", clusteringOwner, clusteringRepo)
+					return events.APIGatewayProxyResponse{StatusCode: 500}, nil
+				}
+			}
+			batchNew := make(map[string]bool)
+			ac.EntityManager.SetHook(entity.BeforeSave, func(ent map[string]interface{}, m *entity.EntityManager) (map[string]interface{}, error) {
+				id := fmt.Sprint(ent["id"])
+				guid, err := repo.CatalogGUID(id)
+				if err != nil {
+					return nil, err
+				}
+				chapter, cataloged := catalogChapters[guid]
+				if cataloged && chapter != catalogChapter {
+					return nil, fmt.Errorf("entity %s is stored in chapter %s, update it on its own", id, chapter)
+				}
+				batchNew[id] = !cataloged
+				return ent, nil
+			})
+			ac.EntityManager.SetHook(entity.AfterSave, func(ent map[string]interface{}, m *entity.EntityManager) (map[string]interface{}, error) {
+				id := fmt.Sprint(ent["id"])
+				if batchNew[id] {
+					batchCatalogIds = append(batchCatalogIds, id)
+				}
+				return ent, nil
+			})
+		}
+
+		if (singularName == "shapeshifter" && req.HTTPMethod == "POST" && !batchRequest) {
 			// var catalogFile string
 			ac.EntityManager.SetHook(entity.BeforeSave, func(ent map[string]interface{}, m *entity.EntityManager) (map[string]interface{}, error) {
 				log.Print("Before shapeshift save")
@@ -675,14 +1017,60 @@ func InitializeHandler(c *ActionContext) Handler {
 			})
 		}
 
+		if (singularName == "shapeshifter" && req.HTTPMethod == "DELETE") {
+			ac.EntityManager.SetHook(entity.AfterDelete, func(ent map[string]interface{}, m *entity.EntityManager) (map[string]interface{}, error) {
+				log.Print("After shapeshift delete")
+				id, ok := ent["id"].(string)
+				if !ok {
+					log.Print("Error: 'id' is not a string or is missing")
+					return nil, fmt.Errorf("'id' is not a string or is missing")
+				}
+				proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
+				directoryPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
+				log.Print("Remove id from catalog " + directoryPath)
+				if _, err := repo.RemoveFromCatalog(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, id, os.Getenv("GITHUB_BRANCH")); err != nil {
+					log.Printf("Unable to remove %s from catalog: %s", id, err.Error())
+					return nil, err
+				}
+				return ent, nil
+			})
+		}
+
+		if versions := ac.EntityManager.Versions(); versions != nil {
+			applyPreconditions(req, versions)
+		}
+
 		if entityName == pluralName && req.HTTPMethod == "GET" {
 			return GetEntities(req, ac)
+		} else if _, ok := req.QueryStringParameters["revisions"]; ok && entityName == singularName && req.HTTPMethod == "GET" {
+			return GetEntityRevisions(req, ac)
+		} else if req.QueryStringParameters["revision"] != "" && entityName == singularName && req.HTTPMethod == "GET" {
+			return GetEntityRevision(req, ac)
+		} else if req.QueryStringParameters["from"] != "" && entityName == singularName && req.HTTPMethod == "GET" {
+			return DiffEntityRevisions(req, ac)
 		} else if entityName == singularName && req.HTTPMethod == "GET" {
 			return GetEntity(req, ac)
+		} else if batchRequest {
+			res, err := BatchEntities(req, ac)
+			if len(batchCatalogIds) != 0 {
+				proxyPieces := strings.Split(req.PathParameters["proxy"], "/")
+				directoryPath := strings.Join(proxyPieces[0:len(proxyPieces)-1], "/")
+				log.Printf("Append %d ids to catalog chapter %s", len(batchCatalogIds), catalogChapter)
+				if err := repo.AppendManyToCatalog(context.Background(), ac.GithubRestClient, req.PathParameters["owner"], req.PathParameters["repo"], directoryPath, catalogChapter, batchCatalogIds, os.Getenv("GITHUB_BRANCH"), catalogPageMax); err != nil {
+					log.Printf("Unable to append batch to catalog: %s", err.Error())
+				}
+			}
+			return res, err
 		} else if entityName == singularName && req.HTTPMethod == "POST" {
 			return CreateEntity(req, ac)
+		} else if req.QueryStringParameters["restore"] != "" && entityName == singularName && req.HTTPMethod == "PUT" {
+			return RestoreEntity(req, ac)
 		} else if entityName == singularName && req.HTTPMethod == "PUT" {
 			return UpdateEntity(req, ac)
+		} else if entityName == singularName && req.HTTPMethod == "PATCH" {
+			return PatchEntity(req, ac)
+		} else if entityName == singularName && req.HTTPMethod == "DELETE" {
+			return DeleteEntity(req, ac)
 		}
 
 		return events.APIGatewayProxyResponse{StatusCode: 500}, nil
@@ -974,6 +1362,94 @@ func GrantAccessManager(params *gov.ResourceManagerParams, bindings *entity.Vari
 	return manager, nil
 }
 
+// Shapeshifter entities are authorized against the repository they are stored in.
+func shapeshiftAuthorizer(ac *ActionContext, req *events.APIGatewayProxyRequest, userId string) entity.Authorization {
+	if ac.CloudName == "azure" {
+		return entity.ResourceAuthorizationEmbeddedAdaptor{
+			Config: entity.ResourceAuthorizationEmbeddedConfig{
+				UserId:              userId,
+				Site:                ac.Site,
+				Resource:            gov.GithubRepo,
+				Asset:               req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
+				Lambda:              ac.Lambda,
+				CassSession:         ac.CassSession,
+				GrantAccessManager:  ac.GrantAccessManager,
+				AdditionalResources: ac.AdditionalResources,
+			},
+		}
+	}
+	return entity.ResourceAuthorizationAdaptor{
+		Config: entity.ResourceAuthorizationConfig{
+			UserId:              userId,
+			Site:                ac.Site,
+			Resource:            gov.GithubRepo,
+			Asset:               req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
+			Lambda:              ac.Lambda,
+			AdditionalResources: ac.AdditionalResources,
+		},
+	}
+}
+
+// shapeshiftReferences resolves contract references (x-ref) of a type to the top level
+// directories of the same repo, {type}/{id}.json.
+func shapeshiftReferences(ac *ActionContext, req *events.APIGatewayProxyRequest, config entity.DefaultManagerConfig, entityType string) *entity.GithubEntityReferences {
+	return &entity.GithubEntityReferences{
+		Config: entity.GithubEntityReferencesConfig{
+			Client: ac.GithubRestClient,
+			Repo:   req.PathParameters["owner"] + "/" + req.PathParameters["repo"],
+			Branch: os.Getenv("GITHUB_BRANCH"),
+			Type:   entityType,
+			Manager: func(refType string, id string) (entity.Manager, error) {
+				return shapeshiftReferenceManager(ac, req, config, refType, id)
+			},
+		},
+	}
+}
+
+// shapeshiftReferenceManager builds the manager of a referenced entity the way a
+// request to {type}/{id} would.
+func shapeshiftReferenceManager(ac *ActionContext, req *events.APIGatewayProxyRequest, config entity.DefaultManagerConfig, entityType string, id string) (entity.Manager, error) {
+	owner := req.PathParameters["owner"]
+	objectsRepo := req.PathParameters["repo"]
+	branch := os.Getenv("GITHUB_BRANCH")
+
+	entityRepo := owner + "/" + objectsRepo
+	chapter, err := repo.FindChapterByGUID(context.Background(), ac.GithubRestClient, owner, objectsRepo, entityType, id, branch)
+	if err != nil {
+		// No catalog yet means no entities of the type, the load comes back empty.
+		log.Printf("Unable to find chapter of %s %s: %s", entityType, id, err.Error())
+	} else if chapter != "0" {
+		repoPieces := strings.Split(objectsRepo, "-")
+		entityRepo = owner + "/" + strings.Join(repoPieces[0:len(repoPieces)-1], "-") + "-" + chapter + "-objects"
+	}
+
+	config.Index = owner + "__" + objectsRepo + "__" + entityType
+	config.Contract = "/contracts/" + entityType + ".json"
+	config.References = shapeshiftReferences(ac, req, config, entityType)
+	manager := entity.NewDefaultManager(config)
+
+	fileConfig := entity.GithubRestFileUploadConfig{
+		Client:   ac.GithubRestClient,
+		Repo:     entityRepo,
+		Branch:   branch,
+		Path:     entityType,
+		UserName: GetUsername(req),
+		Encryption: manager.Encryption,
+	}
+	manager.AddLoader("default", entity.GithubRestFileLoaderAdaptor{Config: fileConfig})
+	manager.AddStorage("default", entity.GithubRestFileUploadAdaptor{Config: fileConfig})
+	manager.AddAuthorizer("default", shapeshiftAuthorizer(ac, req, config.UserId))
+	// Cascaded deletes leave the catalog like a DELETE request does.
+	manager.SetHook(entity.AfterDelete, func(ent map[string]interface{}, m *entity.EntityManager) (map[string]interface{}, error) {
+		if _, err := repo.RemoveFromCatalog(context.Background(), ac.GithubRestClient, owner, objectsRepo, entityType, fmt.Sprint(ent["id"]), branch); err != nil {
+			log.Printf("Unable to remove %v from catalog: %s", ent["id"], err.Error())
+			return nil, err
+		}
+		return ent, nil
+	})
+	return manager, nil
+}
+
 func AutomateRepoInit(ctx context.Context, ac *ActionContext, templateOwner, templateRepo, newRepoOwner, newRepoName, description string, private bool) error {
 	log.Printf("Creating repository '%s/%s' from template '%s/%s'...", newRepoOwner, newRepoName, templateOwner, templateRepo)
 
@@ -1195,6 +1671,18 @@ func ShapeshiftActionContext() *ActionContext {
 		Bindings:     &entity.VariableBindings{Values: make([]interface{}, 0)},
 	}
 
+	// Data keys of x-encrypted contract fields come from KMS, a key file stands in locally.
+	if keyId := os.Getenv("FIELD_ENCRYPTION_KMS_KEY_ID"); keyId != "" {
+		actionContext.Keys = entity.AwsKeyManagement{Client: kms.New(sess), KeyId: keyId}
+	} else if keyFile := os.Getenv("FIELD_ENCRYPTION_KEY_FILE"); keyFile != "" {
+		keys, err := entity.NewFileKeyManagement(keyFile)
+		if err != nil {
+			log.Printf("Unable to read field encryption key file: %s", err.Error())
+		} else {
+			actionContext.Keys = keys
+		}
+	}
+
 	log.Printf("entity bucket storage: %s", actionContext.BucketName)
 
 	funcMap := template.FuncMap{